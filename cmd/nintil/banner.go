@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sukus21/nintil/nds"
+)
+
+type iconOutput struct {
+	Output   string `json:"output"`
+	Animated bool   `json:"animated"`
+}
+
+func runIcon(cmd *command, args []string) error {
+	fset, jsonOut := cmd.flags()
+	output := fset.String("o", "", "output file, \"-\" for standard output (default icon.png or icon.gif when exporting, the input ROM when replacing)")
+	animated := fset.Bool("gif", false, "use the animated DSi icon, as a GIF")
+	set := fset.String("set", "", "replace the icon with this PNG or GIF image")
+	if err := parseFlags(fset, args, 1, 1); err != nil {
+		return err
+	}
+
+	rom, f, err := openRom(fset.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Replace icon
+	if *set != "" {
+		if *output == "" {
+			*output = fset.Arg(0)
+		}
+		if err := setIcon(rom, *set, *animated); err != nil {
+			return err
+		}
+		if _, err := saveRom(rom, *output); err != nil {
+			return err
+		}
+		if *jsonOut {
+			return printJSON(iconOutput{Output: *output, Animated: *animated})
+		}
+		fmt.Printf("replaced icon, wrote %s\n", *output)
+		return nil
+	}
+
+	// Export icon
+	buf := &bytes.Buffer{}
+	if *animated {
+		g, err := rom.GetAnimatedIconGIF()
+		if err != nil {
+			return err
+		}
+		if err := gif.EncodeAll(buf, g); err != nil {
+			return err
+		}
+		if *output == "" {
+			*output = "icon.gif"
+		}
+	} else {
+		if err := png.Encode(buf, rom.GetIcon()); err != nil {
+			return err
+		}
+		if *output == "" {
+			*output = "icon.png"
+		}
+	}
+	if err := writeOutput(*output, buf.Bytes()); err != nil {
+		return err
+	}
+	if *jsonOut && *output != "-" {
+		return printJSON(iconOutput{Output: *output, Animated: *animated})
+	}
+	return nil
+}
+
+// Set the icon from an image file.
+func setIcon(rom *nds.Rom, name string, animated bool) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if animated {
+		g, err := gif.DecodeAll(f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		return rom.SetAnimatedIconGIF(g)
+	}
+
+	var img image.Image
+	if strings.EqualFold(filepath.Ext(name), ".gif") {
+		img, err = gif.Decode(f)
+	} else {
+		img, err = png.Decode(f)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return rom.SetIcon(img)
+}
+
+func runTitle(cmd *command, args []string) error {
+	fset, jsonOut := cmd.flags()
+	output := fset.String("o", "", "write the new ROM here instead of replacing the input ROM")
+	language := fset.String("lang", "", "only show or change the title in this language (Japanese, English, French, German, Italian, Spanish, Chinese or Korean)")
+	set := fset.String("set", "", "change the title, use \\n for line breaks")
+	if err := parseFlags(fset, args, 1, 1); err != nil {
+		return err
+	}
+
+	rom, f, err := openRom(fset.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Pick languages
+	langs := romLanguages(rom)
+	if *language != "" {
+		lang, ok := parseLanguage(*language)
+		if !ok {
+			return usageErrorf(fset, "unknown language %q", *language)
+		}
+		langs = []nds.TitleLanguage{lang}
+	}
+
+	// Change titles
+	if *set != "" {
+		if *output == "" {
+			*output = fset.Arg(0)
+		}
+		title := strings.ReplaceAll(*set, `\n`, "\n")
+		for _, lang := range langs {
+			if err := rom.SetTitle(title, lang); err != nil {
+				return err
+			}
+		}
+		if _, err := saveRom(rom, *output); err != nil {
+			return err
+		}
+	}
+
+	titles := map[string]string{}
+	for _, lang := range langs {
+		title, err := rom.GetTitle(lang)
+		if err != nil {
+			return err
+		}
+		titles[lang.String()] = title
+	}
+	if *jsonOut {
+		return printJSON(titles)
+	}
+	for _, lang := range langs {
+		fmt.Printf("%s: %q\n", lang, titles[lang.String()])
+	}
+	return nil
+}
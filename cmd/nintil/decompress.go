@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/sukus21/nintil/compression/blz"
+	"github.com/sukus21/nintil/compression/lz10"
+	"github.com/sukus21/nintil/compression/pmoc"
+	"github.com/sukus21/nintil/compression/rlx"
+	"github.com/sukus21/nintil/compression/rlz"
+)
+
+var decompressors = map[string]func([]byte) ([]byte, error){
+	"blz":  blz.Decompress,
+	"lz10": lz10.Decompress,
+	"pmoc": pmoc.Decompress,
+	"rlx":  rlx.Decompress,
+	"rlz":  rlz.Decompress,
+}
+
+type decompressOutput struct {
+	Format         string `json:"format"`
+	Input          string `json:"input"`
+	Output         string `json:"output"`
+	CompressedSize int    `json:"compressedSize"`
+	Size           int    `json:"size"`
+}
+
+func runDecompress(cmd *command, args []string) error {
+	formats := make([]string, 0, len(decompressors))
+	for name := range decompressors {
+		formats = append(formats, name)
+	}
+	slices.Sort(formats)
+
+	fset, jsonOut := cmd.flags()
+	format := fset.String("f", "", "compression format ("+strings.Join(formats, ", ")+")")
+	output := fset.String("o", "-", "output file, \"-\" for standard output")
+	if err := parseFlags(fset, args, 1, 1); err != nil {
+		return err
+	}
+	decompress, ok := decompressors[*format]
+	if !ok {
+		return usageErrorf(fset, "unknown compression format %q", *format)
+	}
+	if *jsonOut && *output == "-" {
+		return usageErrorf(fset, "an output file is needed for JSON output")
+	}
+
+	in, err := openInput(fset.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	compressed, err := io.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	data, err := decompress(compressed)
+	if err != nil {
+		return fmt.Errorf("%s: %w", fset.Arg(0), err)
+	}
+	if err := writeOutput(*output, data); err != nil {
+		return err
+	}
+
+	if *jsonOut {
+		return printJSON(decompressOutput{
+			Format:         *format,
+			Input:          fset.Arg(0),
+			Output:         *output,
+			CompressedSize: len(compressed),
+			Size:           len(data),
+		})
+	}
+	return nil
+}
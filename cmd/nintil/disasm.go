@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/sukus21/nintil/nds/disasm"
+)
+
+type disasmEntry struct {
+	Address  uint32  `json:"address"`
+	Raw      uint32  `json:"raw"`
+	Size     int     `json:"size"`
+	Mnemonic string  `json:"mnemonic"`
+	Args     string  `json:"args"`
+	Target   *uint32 `json:"target,omitempty"`
+	Literal  *uint32 `json:"literal,omitempty"`
+}
+
+func runDisasm(cmd *command, args []string) error {
+	fset, jsonOut := cmd.flags()
+	count := fset.Int("n", 16, "number of instructions to disassemble")
+	thumb := fset.Bool("thumb", false, "disassemble Thumb instead of ARM code")
+	overlay := fset.Int("overlay", -1, "prefer this ARM9 overlay when overlays share the address")
+	if err := parseFlags(fset, args, 2, 2); err != nil {
+		return err
+	}
+	address, err := parseAddress(fset.Arg(1))
+	if err != nil {
+		return usageErrorf(fset, "invalid address %q", fset.Arg(1))
+	}
+	if *count <= 0 {
+		return usageErrorf(fset, "-n must be positive")
+	}
+
+	rom, f, err := openRom(fset.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	space, err := rom.AddressSpace()
+	if err != nil {
+		return err
+	}
+	var overlays []uint32
+	if *overlay >= 0 {
+		overlays = append(overlays, uint32(*overlay))
+	}
+	loc, err := space.Resolve(address, overlays...)
+	if err != nil {
+		return err
+	}
+
+	mode := disasm.ModeARM
+	if *thumb {
+		mode = disasm.ModeThumb
+	}
+	instructions, err := disasm.Range(space, loc, *count*4, mode)
+	if err != nil {
+		return err
+	}
+	instructions = instructions[:min(*count, len(instructions))]
+
+	if *jsonOut {
+		entries := make([]disasmEntry, len(instructions))
+		for i, ins := range instructions {
+			entries[i] = disasmEntry{
+				Address:  ins.Address,
+				Raw:      ins.Raw,
+				Size:     ins.Size,
+				Mnemonic: ins.Mnemonic,
+				Args:     ins.Args,
+			}
+			if ins.Branch != nil {
+				entries[i].Target = &ins.Branch.Target
+			}
+			if ins.Literal != nil && ins.Literal.Known {
+				entries[i].Literal = &ins.Literal.Value
+			}
+		}
+		return printJSON(entries)
+	}
+	fmt.Printf("; %s\n", loc)
+	fmt.Print(disasm.Listing(instructions))
+	return nil
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"text/tabwriter"
+
+	"github.com/sukus21/nintil/nds"
+	"github.com/sukus21/nintil/nds/nitrofs"
+)
+
+type fileInfo struct {
+	Path string  `json:"path"`
+	Dir  bool    `json:"dir"`
+	Size int64   `json:"size"`
+	ID   *uint16 `json:"id,omitempty"`
+}
+
+func runLs(cmd *command, args []string) error {
+	fset, jsonOut := cmd.flags()
+	recursive := fset.Bool("r", false, "list subdirectories recursively")
+	if err := parseFlags(fset, args, 1, 2); err != nil {
+		return err
+	}
+	dir := "."
+	if fset.NArg() == 2 {
+		dir = fset.Arg(1)
+	}
+
+	rom, f, err := openRom(fset.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Collect files
+	fsys := rom.Filesystem
+	mapper, _ := fsys.(nitrofs.IDMapper)
+	files := []fileInfo{}
+	err = fs.WalkDir(fsys, dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == dir && d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		file := fileInfo{Path: p, Dir: d.IsDir()}
+		if !file.Dir {
+			file.Size = info.Size()
+			if mapper != nil {
+				if id, ok := mapper.FileID(p); ok {
+					file.ID = &id
+				}
+			}
+		}
+		files = append(files, file)
+		if d.IsDir() && !*recursive {
+			return fs.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if *jsonOut {
+		return printJSON(files)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	for _, file := range files {
+		switch {
+		case file.Dir:
+			fmt.Fprintf(tw, "\t\t %s/\n", file.Path)
+		case file.ID != nil:
+			fmt.Fprintf(tw, "#%d\t%d\t %s\n", *file.ID, file.Size, file.Path)
+		default:
+			fmt.Fprintf(tw, "\t%d\t %s\n", file.Size, file.Path)
+		}
+	}
+	return tw.Flush()
+}
+
+type catOutput struct {
+	Path string `json:"path,omitempty"`
+	ID   uint16 `json:"id"`
+	Data []byte `json:"data"`
+}
+
+func runCat(cmd *command, args []string) error {
+	fset, jsonOut := cmd.flags()
+	byId := fset.Bool("id", false, "the file is given by file ID instead of path, this includes overlay files")
+	if err := parseFlags(fset, args, 2, 2); err != nil {
+		return err
+	}
+
+	rom, f, err := openRom(fset.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Open file by path or by ID
+	idfs, ok := rom.Filesystem.(nitrofs.IDFS)
+	if !ok {
+		return fmt.Errorf("filesystem has no file IDs")
+	}
+	out := catOutput{Path: fset.Arg(1)}
+	var file fs.File
+	if *byId {
+		id, err := parseNumber(fset.Arg(1))
+		if err != nil || id > 0xFFFF {
+			return usageErrorf(fset, "invalid file ID %q", fset.Arg(1))
+		}
+		out.ID = uint16(id)
+		out.Path, _ = idfs.PathOf(out.ID)
+		file, err = idfs.OpenID(out.ID)
+		if err != nil {
+			return err
+		}
+	} else {
+		file, err = rom.Filesystem.Open(out.Path)
+		if err != nil {
+			return err
+		}
+		out.ID, _ = idfs.FileID(out.Path)
+	}
+	defer file.Close()
+
+	if !*jsonOut {
+		_, err = io.Copy(os.Stdout, file)
+		return err
+	}
+	if out.Data, err = io.ReadAll(file); err != nil {
+		return err
+	}
+	return printJSON(out)
+}
+
+type extractOutput struct {
+	Rom          string `json:"rom"`
+	Dir          string `json:"dir"`
+	Files        int    `json:"files"`
+	Arm9Overlays int    `json:"arm9Overlays"`
+	Arm7Overlays int    `json:"arm7Overlays"`
+}
+
+func runExtract(cmd *command, args []string) error {
+	fset, jsonOut := cmd.flags()
+	if err := parseFlags(fset, args, 2, 2); err != nil {
+		return err
+	}
+
+	rom, f, err := openRom(fset.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := nds.SaveNdstool(rom, fset.Arg(1)); err != nil {
+		return err
+	}
+
+	out := extractOutput{
+		Rom:          fset.Arg(0),
+		Dir:          fset.Arg(1),
+		Arm9Overlays: rom.Arm9Overlays.Len(),
+		Arm7Overlays: rom.Arm7Overlays.Len(),
+	}
+	fs.WalkDir(rom.Filesystem, ".", func(p string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			out.Files++
+		}
+		return err
+	})
+	if *jsonOut {
+		return printJSON(out)
+	}
+	fmt.Printf("extracted %d files and %d overlays to %s\n", out.Files, out.Arm9Overlays+out.Arm7Overlays, out.Dir)
+	return nil
+}
+
+type saveOutput struct {
+	Rom  string `json:"rom"`
+	Size int    `json:"size"`
+}
+
+func runBuild(cmd *command, args []string) error {
+	fset, jsonOut := cmd.flags()
+	stable := fset.Bool("stable", false, "keep the file IDs of overlays, and give other files IDs after them")
+	fixChecksums := fset.Bool("fix-checksums", false, "recompute the secure area and logo checksums")
+	headerPatch := fset.String("header", "", "apply this JSON header patch, fields not in the patch are kept")
+	if err := parseFlags(fset, args, 2, 2); err != nil {
+		return err
+	}
+
+	rom, err := nds.OpenNdstool(os.DirFS(fset.Arg(0)))
+	if err != nil {
+		return err
+	}
+	if *headerPatch != "" {
+		patch, err := os.ReadFile(*headerPatch)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(patch, rom.GetHeader()); err != nil {
+			return fmt.Errorf("%s: %w", *headerPatch, err)
+		}
+	}
+	var opts []nds.SaveOption
+	if *stable {
+		opts = append(opts, nds.WithStableFileIDs())
+	}
+	if *fixChecksums {
+		opts = append(opts, nds.WithFixedChecksums())
+	}
+	size, err := saveRom(rom, fset.Arg(1), opts...)
+	if err != nil {
+		return err
+	}
+
+	if *jsonOut {
+		return printJSON(saveOutput{Rom: fset.Arg(1), Size: size})
+	}
+	fmt.Printf("built %s (0x%X bytes)\n", fset.Arg(1), size)
+	return nil
+}
+
+func runReplace(cmd *command, args []string) error {
+	fset, jsonOut := cmd.flags()
+	output := fset.String("o", "", "write the new ROM here instead of replacing the input ROM")
+	stable := fset.Bool("stable", false, "keep the original file IDs")
+	fixChecksums := fset.Bool("fix-checksums", false, "recompute the secure area and logo checksums")
+	create := fset.Bool("create", false, "create the file if it does not exist")
+	if err := parseFlags(fset, args, 3, 3); err != nil {
+		return err
+	}
+	romPath, name, localPath := fset.Arg(0), path.Clean(fset.Arg(1)), fset.Arg(2)
+	if *output == "" {
+		*output = romPath
+	}
+
+	data, err := os.ReadFile(localPath)
+	if err != nil {
+		return err
+	}
+	rom, f, err := openRom(romPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Replace file in a writable layer
+	mfs, err := nitrofs.NewMutableFS(rom.Filesystem)
+	if err != nil {
+		return err
+	}
+	if info, err := fs.Stat(mfs, name); err != nil && !*create {
+		return err
+	} else if err == nil && info.IsDir() {
+		return fmt.Errorf("%s is a directory", name)
+	}
+	if err := mfs.WriteFile(name, data); err != nil {
+		return err
+	}
+	rom.Filesystem = mfs
+
+	var opts []nds.SaveOption
+	if *stable {
+		opts = append(opts, nds.WithStableFileIDs())
+	}
+	if *fixChecksums {
+		opts = append(opts, nds.WithFixedChecksums())
+	}
+	size, err := saveRom(rom, *output, opts...)
+	if err != nil {
+		return err
+	}
+
+	if *jsonOut {
+		return printJSON(saveOutput{Rom: *output, Size: size})
+	}
+	fmt.Printf("replaced %s, wrote %s (0x%X bytes)\n", name, *output, size)
+	return nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+)
+
+// Exit codes
+const (
+	exitOK    = 0
+	exitError = 1
+	exitUsage = 2
+)
+
+// Returned when the usage has already been printed
+var errUsage = errors.New("usage")
+
+type command struct {
+	name string
+	args string
+	desc string
+	run  func(cmd *command, args []string) error
+}
+
+var commands = []*command{
+	{"info", "[flags] <rom>", "Show information about a ROM.", runInfo},
+	{"ls", "[flags] <rom> [path]", "List files in the NitroFS filesystem.", runLs},
+	{"cat", "[flags] <rom> <path>", "Write the contents of a NitroFS file to standard output.", runCat},
+	{"extract", "[flags] <rom> <dir>", "Extract a ROM to the ndstool directory layout.", runExtract},
+	{"build", "[flags] <dir> <rom>", "Build a ROM from the ndstool directory layout.", runBuild},
+	{"replace", "[flags] <rom> <path> <file>", "Replace a NitroFS file with the contents of a local file.", runReplace},
+	{"icon", "[flags] <rom>", "Export or replace the ROM icon.", runIcon},
+	{"title", "[flags] <rom>", "Show or change the ROM titles.", runTitle},
+	{"map", "[flags] <rom> [address...]", "Show what lies where in a ROM.", runMap},
+	{"disasm", "[flags] <rom> <address>", "Disassemble ARM or Thumb code at a RAM address.", runDisasm},
+	{"diff", "[flags] <source> <target> <patch>", "Create an IPS or BPS patch turning one ROM into another.", runDiff},
+	{"patch", "[flags] <rom> <patch>", "Apply an IPS or BPS patch to a ROM.", runPatch},
+	{"decompress", "[flags] <file>", "Decompress a file.", runDecompress},
+}
+
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+func run(args []string) int {
+	if len(args) == 0 {
+		printUsage(os.Stderr)
+		return exitUsage
+	}
+	if args[0] == "help" || args[0] == "-h" || args[0] == "-help" || args[0] == "--help" {
+		printUsage(os.Stdout)
+		return exitOK
+	}
+
+	var cmd *command
+	for _, c := range commands {
+		if c.name == args[0] {
+			cmd = c
+		}
+	}
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "nintil: unknown command %q\n", args[0])
+		printUsage(os.Stderr)
+		return exitUsage
+	}
+
+	err := cmd.run(cmd, args[1:])
+	switch {
+	case err == nil, errors.Is(err, flag.ErrHelp):
+		return exitOK
+	case errors.Is(err, errUsage):
+		return exitUsage
+	default:
+		fmt.Fprintf(os.Stderr, "nintil %s: %v\n", cmd.name, err)
+		return exitError
+	}
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintf(w, "usage: nintil <command> [flags] [arguments]\n\ncommands:\n")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, c := range commands {
+		fmt.Fprintf(tw, "  %s\t%s\n", c.name, c.desc)
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "\nRun 'nintil <command> -h' for help on a command.\n")
+}
+
+// Create the flag set for a command.
+// All commands have a -json flag.
+func (c *command) flags() (*flag.FlagSet, *bool) {
+	fset := flag.NewFlagSet(c.name, flag.ContinueOnError)
+	fset.Usage = func() {
+		fmt.Fprintf(fset.Output(), "usage: nintil %s %s\n\n%s\n\nflags:\n", c.name, c.args, c.desc)
+		fset.PrintDefaults()
+	}
+	jsonOut := fset.Bool("json", false, "write output as JSON")
+	return fset, jsonOut
+}
+
+// Parse flags, and check that there are between min and max positional arguments.
+// A max of -1 means no limit.
+func parseFlags(fset *flag.FlagSet, args []string, min int, max int) error {
+	if err := fset.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return errUsage
+	}
+	if fset.NArg() < min || (max >= 0 && fset.NArg() > max) {
+		return usageErrorf(fset, "wrong number of arguments")
+	}
+	return nil
+}
+
+// Print a problem with the arguments, followed by the usage.
+func usageErrorf(fset *flag.FlagSet, format string, args ...any) error {
+	fmt.Fprintf(fset.Output(), format+"\n", args...)
+	fset.Usage()
+	return errUsage
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sukus21/nintil/nds"
+	"github.com/sukus21/nintil/patch"
+)
+
+var patchFormats = map[string]patch.Format{
+	"ips": patch.FormatIPS,
+	"bps": patch.FormatBPS,
+}
+
+type diffOutput struct {
+	Format string `json:"format"`
+	Patch  string `json:"patch"`
+	Size   int    `json:"size"`
+}
+
+func runDiff(cmd *command, args []string) error {
+	fset, jsonOut := cmd.flags()
+	formatName := fset.String("f", "", "patch format (ips, bps), from the patch file extension by default")
+	if err := parseFlags(fset, args, 3, 3); err != nil {
+		return err
+	}
+	sourcePath, targetPath, patchPath := fset.Arg(0), fset.Arg(1), fset.Arg(2)
+	if *formatName == "" {
+		*formatName = strings.TrimPrefix(strings.ToLower(filepath.Ext(patchPath)), ".")
+	}
+	format, ok := patchFormats[*formatName]
+	if !ok {
+		return usageErrorf(fset, "unknown patch format %q", *formatName)
+	}
+
+	source, err := os.ReadFile(sourcePath)
+	if err != nil {
+		return err
+	}
+	target, err := os.ReadFile(targetPath)
+	if err != nil {
+		return err
+	}
+	data, err := patch.Create(format, bytes.NewReader(source), int64(len(source)), bytes.NewReader(target), int64(len(target)))
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(patchPath, data, 0666); err != nil {
+		return err
+	}
+
+	if *jsonOut {
+		return printJSON(diffOutput{Format: format.String(), Patch: patchPath, Size: len(data)})
+	}
+	fmt.Printf("wrote %s patch %s (0x%X bytes)\n", format, patchPath, len(data))
+	return nil
+}
+
+func runPatch(cmd *command, args []string) error {
+	fset, jsonOut := cmd.flags()
+	output := fset.String("o", "", "write the patched ROM here instead of replacing the input ROM")
+	if err := parseFlags(fset, args, 2, 2); err != nil {
+		return err
+	}
+	romPath, patchPath := fset.Arg(0), fset.Arg(1)
+	if *output == "" {
+		*output = romPath
+	}
+
+	p, err := os.ReadFile(patchPath)
+	if err != nil {
+		return err
+	}
+	source, err := os.ReadFile(romPath)
+	if err != nil {
+		return err
+	}
+	data, err := patch.Apply(bytes.NewReader(source), int64(len(source)), p)
+	if err != nil {
+		return fmt.Errorf("%s: %w", patchPath, err)
+	}
+
+	// Only write patched data that is still a ROM
+	if _, err := nds.OpenROM(bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("patched ROM: %w", err)
+	}
+	write := func(f *os.File) error {
+		_, err := f.Write(data)
+		return err
+	}
+	if _, err := replaceFile(*output, write); err != nil {
+		return err
+	}
+
+	if *jsonOut {
+		return printJSON(saveOutput{Rom: *output, Size: len(data)})
+	}
+	fmt.Printf("patched %s, wrote %s (0x%X bytes)\n", romPath, *output, len(data))
+	return nil
+}
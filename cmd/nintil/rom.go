@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/sukus21/nintil/nds"
+)
+
+type binaryInfo struct {
+	RomOffset   uint32 `json:"romOffset"`
+	Size        uint32 `json:"size"`
+	Destination uint32 `json:"destination"`
+	Entry       uint32 `json:"entry"`
+}
+
+type romInfo struct {
+	Title         string            `json:"title"`
+	GameCode      string            `json:"gameCode"`
+	MakerCode     string            `json:"makerCode"`
+	UnitCode      byte              `json:"unitCode"`
+	RomVersion    byte              `json:"romVersion"`
+	Capacity      uint32            `json:"capacity"`
+	RomSize       uint32            `json:"romSize"`
+	Arm9          binaryInfo        `json:"arm9"`
+	Arm7          binaryInfo        `json:"arm7"`
+	Arm9Overlays  int               `json:"arm9Overlays"`
+	Arm7Overlays  int               `json:"arm7Overlays"`
+	Files         int               `json:"files"`
+	BannerVersion uint16            `json:"bannerVersion"`
+	Titles        map[string]string `json:"titles"`
+
+	// Checksums that do not match
+	ChecksumMismatches []string `json:"checksumMismatches"`
+
+	SecureArea string `json:"secureArea"`
+}
+
+func runInfo(cmd *command, args []string) error {
+	fset, jsonOut := cmd.flags()
+	keyFile := fset.String("key1", "", "KEY1 key table or ARM7 BIOS, needed to detect an encrypted secure area")
+	if err := parseFlags(fset, args, 1, 1); err != nil {
+		return err
+	}
+	table, err := openKeyTable(*keyFile)
+	if err != nil {
+		return err
+	}
+
+	rom, f, err := openRom(fset.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := rom.GetHeader()
+	capacity, _ := nds.DeviceCapacity(h.DeviceSize)
+	info := romInfo{
+		Title:      strings.TrimRight(h.GameTitle, "\x00"),
+		GameCode:   h.GameCode,
+		MakerCode:  h.MakerCode,
+		UnitCode:   h.UnitCode,
+		RomVersion: h.RomVersion,
+		Capacity:   capacity,
+		RomSize:    h.RomSize,
+		Arm9: binaryInfo{
+			RomOffset:   h.Arm9RomOffset,
+			Size:        h.Arm9Size,
+			Destination: h.Arm9Destination,
+			Entry:       h.Arm9ExecuteAddress,
+		},
+		Arm7: binaryInfo{
+			RomOffset:   h.Arm7RomOffset,
+			Size:        h.Arm7Size,
+			Destination: h.Arm7Destination,
+			Entry:       h.Arm7ExecuteAddress,
+		},
+		Arm9Overlays:  rom.Arm9Overlays.Len(),
+		Arm7Overlays:  rom.Arm7Overlays.Len(),
+		BannerVersion: rom.GetBannerVersion(),
+		Titles:        map[string]string{},
+
+		ChecksumMismatches: []string{},
+		SecureArea:         rom.SecureAreaState(table).String(),
+	}
+	for _, d := range rom.ChecksumMismatches() {
+		info.ChecksumMismatches = append(info.ChecksumMismatches, d.String())
+	}
+	err = fs.WalkDir(rom.Filesystem, ".", func(p string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			info.Files++
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for _, lang := range romLanguages(rom) {
+		info.Titles[lang.String()], _ = rom.GetTitle(lang)
+	}
+
+	if *jsonOut {
+		return printJSON(info)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Title:\t%s\n", info.Title)
+	fmt.Fprintf(tw, "Game code:\t%s\n", info.GameCode)
+	fmt.Fprintf(tw, "Maker code:\t%s\n", info.MakerCode)
+	fmt.Fprintf(tw, "Unit code:\t0x%02X\n", info.UnitCode)
+	fmt.Fprintf(tw, "ROM version:\t%d\n", info.RomVersion)
+	fmt.Fprintf(tw, "Capacity:\t0x%08X\n", info.Capacity)
+	fmt.Fprintf(tw, "ROM size:\t0x%08X\n", info.RomSize)
+	for _, bin := range []struct {
+		name string
+		info binaryInfo
+	}{{"ARM9", info.Arm9}, {"ARM7", info.Arm7}} {
+		fmt.Fprintf(tw, "%s binary:\toffset 0x%08X, size 0x%08X, loaded at 0x%08X, entry 0x%08X\n",
+			bin.name,
+			bin.info.RomOffset,
+			bin.info.Size,
+			bin.info.Destination,
+			bin.info.Entry,
+		)
+	}
+	fmt.Fprintf(tw, "Overlays:\t%d ARM9, %d ARM7\n", info.Arm9Overlays, info.Arm7Overlays)
+	fmt.Fprintf(tw, "Files:\t%d\n", info.Files)
+	fmt.Fprintf(tw, "Banner version:\t0x%04X\n", info.BannerVersion)
+	for _, lang := range romLanguages(rom) {
+		fmt.Fprintf(tw, "Title (%s):\t%q\n", lang, info.Titles[lang.String()])
+	}
+	if len(info.ChecksumMismatches) == 0 {
+		fmt.Fprintf(tw, "Checksums:\tok\n")
+	}
+	for _, mismatch := range info.ChecksumMismatches {
+		fmt.Fprintf(tw, "Checksums:\t%s\n", mismatch)
+	}
+	fmt.Fprintf(tw, "Secure area:\t%s\n", info.SecureArea)
+	return tw.Flush()
+}
+
+type mapEntry struct {
+	Address *uint32 `json:"address,omitempty"`
+	Name    string  `json:"name"`
+	From    uint32  `json:"from"`
+	To      uint32  `json:"to"`
+}
+
+func runMap(cmd *command, args []string) error {
+	fset, jsonOut := cmd.flags()
+	if err := parseFlags(fset, args, 1, -1); err != nil {
+		return err
+	}
+	addresses := make([]uint32, fset.NArg()-1)
+	for i, arg := range fset.Args()[1:] {
+		address, err := parseAddress(arg)
+		if err != nil {
+			return usageErrorf(fset, "invalid address %q", arg)
+		}
+		addresses[i] = address
+	}
+
+	rom, f, err := openRom(fset.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Whole mapping, or only what lies at the given addresses
+	var entries []mapEntry
+	if len(addresses) == 0 {
+		for _, e := range rom.GetMapping().Entries() {
+			entries = append(entries, mapEntry{Name: e.Name(), From: e.From(), To: e.To()})
+		}
+	}
+	for _, address := range addresses {
+		entry := mapEntry{Address: &address}
+		if e := rom.WhatsHere(address); e != nil {
+			entry.Name, entry.From, entry.To = e.Name(), e.From(), e.To()
+		}
+		entries = append(entries, entry)
+	}
+
+	if *jsonOut {
+		if entries == nil {
+			entries = []mapEntry{}
+		}
+		return printJSON(entries)
+	}
+	for _, e := range entries {
+		if e.Address != nil {
+			fmt.Printf("0x%08X: ", *e.Address)
+			if e.Name == "" {
+				fmt.Println("nothing")
+				continue
+			}
+		}
+		fmt.Printf("offset 0x%08X -> 0x%08X: %s\n", e.From, e.To, e.Name)
+	}
+	return nil
+}
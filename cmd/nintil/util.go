@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/sukus21/nintil/nds"
+	"github.com/sukus21/nintil/nds/key1"
+)
+
+// Open a ROM file.
+// The returned file must be closed once the ROM is no longer in use.
+func openRom(name string) (*nds.Rom, *os.File, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	rom, err := nds.OpenROM(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return rom, f, nil
+}
+
+// Read a KEY1 key table, or return nil if no file is given.
+func openKeyTable(name string) (*key1.KeyTable, error) {
+	if name == "" {
+		return nil, nil
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	table, err := key1.OpenKeyTable(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return table, nil
+}
+
+// Stream a ROM to a temporary file next to name, then move it over name.
+// The file may be the one the ROM was opened from, and is only replaced once the ROM is complete.
+// Returns the size of the ROM.
+func saveRom(rom *nds.Rom, name string, opts ...nds.SaveOption) (int, error) {
+	return replaceFile(name, func(f *os.File) error {
+		return nds.SaveROMTo(rom, f, opts...)
+	})
+}
+
+// Write a temporary file next to name, then move it over name.
+// The file may be one that is still being read from, and is only replaced once write succeeds.
+// Returns the size of the file.
+func replaceFile(name string, write func(f *os.File) error) (int, error) {
+	mode := fs.FileMode(0644)
+	if stat, err := os.Stat(name); err == nil {
+		mode = stat.Mode().Perm()
+	}
+	f, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".*.tmp")
+	if err != nil {
+		return 0, err
+	}
+	fail := func(err error) (int, error) {
+		f.Close()
+		os.Remove(f.Name())
+		return 0, err
+	}
+
+	if err := write(f); err != nil {
+		return fail(err)
+	}
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fail(err)
+	}
+	if err := f.Chmod(mode); err != nil {
+		return fail(err)
+	}
+	if err := f.Close(); err != nil {
+		return fail(err)
+	}
+	if err := os.Rename(f.Name(), name); err != nil {
+		os.Remove(f.Name())
+		return 0, err
+	}
+	return int(size), nil
+}
+
+// Open a file for reading, "-" is standard input.
+func openInput(name string) (io.ReadCloser, error) {
+	if name == "-" {
+		return io.NopCloser(os.Stdin), nil
+	}
+	return os.Open(name)
+}
+
+// Write data to a file, "-" is standard output.
+func writeOutput(name string, data []byte) error {
+	if name == "-" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(name, data, 0666)
+}
+
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "\t")
+	return enc.Encode(v)
+}
+
+// Parse a number, hexadecimal with a 0x prefix.
+func parseNumber(s string) (uint32, error) {
+	n, err := strconv.ParseUint(s, 0, 32)
+	return uint32(n), err
+}
+
+// Parse an address, always hexadecimal.
+func parseAddress(s string) (uint32, error) {
+	n, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(s), "0x"), 16, 32)
+	return uint32(n), err
+}
+
+func parseLanguage(name string) (nds.TitleLanguage, bool) {
+	for lang := nds.TitleLanguage(0); lang < nds.TitleLanguage_Count; lang++ {
+		if strings.EqualFold(lang.String(), name) {
+			return lang, true
+		}
+	}
+	return 0, false
+}
+
+// Get the languages the ROM banner has titles for.
+func romLanguages(rom *nds.Rom) []nds.TitleLanguage {
+	var langs []nds.TitleLanguage
+	for lang := nds.TitleLanguage(0); lang < nds.TitleLanguage_Count; lang++ {
+		if _, err := rom.GetTitle(lang); err != nil {
+			break
+		}
+		langs = append(langs, lang)
+	}
+	return langs
+}
@@ -0,0 +1,206 @@
+package blz
+
+import (
+	"encoding/binary"
+	"errors"
+	"slices"
+
+	"github.com/sukus21/nintil/util/ezbin"
+)
+
+var ErrNotBLZ = errors.New("data is not BLZ compressed")
+var ErrIncompressible = errors.New("data does not get smaller with BLZ compression")
+
+// Decompresses a blob of BLZ ("backwards LZ") compressed data.
+// The footer describing the compressed region is expected at the end of the blob.
+// Data before the compressed region is copied as-is.
+// If data is not BLZ compressed, ErrNotBLZ is returned.
+func Decompress(dat []byte) ([]byte, error) {
+	if len(dat) < 8 {
+		return nil, ErrNotBLZ
+	}
+
+	// Read footer
+	footer := binary.LittleEndian.Uint32(dat[len(dat)-8:])
+	increase := binary.LittleEndian.Uint32(dat[len(dat)-4:])
+	encLen := int(footer & 0x00FFFFFF)
+	hdrLen := int(footer >> 24)
+	if hdrLen < 8 || hdrLen > encLen || encLen > len(dat) {
+		return nil, ErrNotBLZ
+	}
+
+	out := make([]byte, len(dat)+int(increase))
+	copy(out, dat)
+	src := len(dat) - hdrLen
+	dst := len(out)
+	stop := len(dat) - encLen
+
+	for src > stop {
+		flags := dat[src-1]
+		src--
+		for range 8 {
+			if src <= stop {
+				break
+			}
+
+			// Single byte
+			if flags&0x80 == 0 {
+				if dst <= src {
+					return nil, ErrNotBLZ
+				}
+				dst--
+				src--
+				out[dst] = dat[src]
+				flags <<= 1
+				continue
+			}
+
+			// Copy previous data
+			if src-2 < stop {
+				return nil, ErrNotBLZ
+			}
+			b1 := dat[src-1]
+			b2 := dat[src-2]
+			src -= 2
+			count := int(b1>>4) + 3
+			disp := (int(b1&0x0F)<<8 | int(b2)) + 3
+			if dst-count < src || dst+disp-1 >= len(out) {
+				return nil, ErrNotBLZ
+			}
+			for range count {
+				dst--
+				out[dst] = out[dst+disp]
+			}
+			flags <<= 1
+		}
+	}
+
+	if dst != stop {
+		return nil, ErrNotBLZ
+	}
+	return out, nil
+}
+
+// Compresses a blob of data with BLZ compression.
+// Equivalent to CompressKeep(dat, 0).
+func Compress(dat []byte) ([]byte, error) {
+	return CompressKeep(dat, 0)
+}
+
+// Compresses a blob of data with BLZ compression.
+// The first keep bytes are never compressed (the ARM9 binary needs 0x4000).
+// If compression does not make the data smaller, ErrIncompressible is returned.
+//
+// This is a port of the BLZ encoder from CUE's DS/GBA compressors.
+func CompressKeep(dat []byte, keep int) ([]byte, error) {
+	const (
+		threshold = 2
+		window    = 0x1002
+		maxLength = 0x12
+	)
+
+	// Work backwards, by compressing reversed data
+	raw := slices.Clone(dat)
+	slices.Reverse(raw)
+	rawEnd := max(0, len(raw)-keep)
+	pak := make([]byte, 0, len(raw)+(len(raw)+7)/8+11)
+
+	// Best split between uncompressed and compressed data
+	pakTmp := 0
+	rawTmp := len(raw)
+
+	// Hash chains of previous positions, for faster searching
+	const hashSize = 1 << 16
+	head := ezbin.FillerArray(hashSize, -1)
+	prev := make([]int, len(raw))
+	hash := func(pos int) int {
+		return (int(raw[pos])<<8 ^ int(raw[pos+1])<<4 ^ int(raw[pos+2])) & (hashSize - 1)
+	}
+	insert := func(pos int) {
+		if pos+2 < rawEnd {
+			h := hash(pos)
+			prev[pos] = head[h]
+			head[h] = pos
+		}
+	}
+
+	flagPos := 0
+	mask := byte(0)
+	for pos := 0; pos < rawEnd; {
+		mask >>= 1
+		if mask == 0 {
+			flagPos = len(pak)
+			pak = append(pak, 0)
+			mask = 0x80
+		}
+
+		// Search for longest match, without overlap.
+		// Chains are ordered by distance, so the closest match wins ties.
+		bestLen := threshold
+		bestDisp := 0
+		if pos+2 < rawEnd {
+			for candidate := head[hash(pos)]; candidate != -1 && pos-candidate <= window; candidate = prev[candidate] {
+				disp := pos - candidate
+				if disp < 3 {
+					continue
+				}
+				length := 0
+				for length < maxLength && pos+length < rawEnd && length < disp {
+					if raw[pos+length] != raw[candidate+length] {
+						break
+					}
+					length++
+				}
+				if length > bestLen {
+					bestLen = length
+					bestDisp = disp
+					if length == maxLength {
+						break
+					}
+				}
+			}
+		}
+
+		// Encode match or single byte
+		if bestLen > threshold {
+			pak[flagPos] |= mask
+			pak = append(pak,
+				byte((bestLen-(threshold+1))<<4|(bestDisp-3)>>8),
+				byte(bestDisp-3),
+			)
+			for range bestLen {
+				insert(pos)
+				pos++
+			}
+		} else {
+			pak = append(pak, raw[pos])
+			insert(pos)
+			pos++
+		}
+
+		// Keep track of the smallest total size
+		if len(pak)+len(raw)-pos < pakTmp+rawTmp {
+			pakTmp = len(pak)
+			rawTmp = len(raw) - pos
+		}
+	}
+
+	// Not worth it
+	hdrLen := 8 + ezbin.Pad(pakTmp+rawTmp, 4)
+	increase := len(dat) - pakTmp - rawTmp - hdrLen
+	if pakTmp == 0 || increase < 0 {
+		return nil, ErrIncompressible
+	}
+
+	// Uncompressed beginning, followed by compressed end
+	slices.Reverse(pak)
+	out := make([]byte, 0, rawTmp+pakTmp+hdrLen)
+	out = append(out, dat[:rawTmp]...)
+	out = append(out, pak[len(pak)-pakTmp:]...)
+
+	// Write footer
+	out = append(out, ezbin.FillerArray(hdrLen-8, byte(0xFF))...)
+	out = binary.LittleEndian.AppendUint32(out, uint32(pakTmp+hdrLen)|uint32(hdrLen)<<24)
+	out = binary.LittleEndian.AppendUint32(out, uint32(increase))
+	return out, nil
+}
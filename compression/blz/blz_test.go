@@ -0,0 +1,114 @@
+package blz
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+// Data with many repeats, as code tends to have.
+func repetitive(size int, seed int64) []byte {
+	r := rand.New(rand.NewSource(seed))
+	data := make([]byte, 0, size)
+	for len(data) < size {
+		if len(data) < 0x100 || r.Intn(8) == 0 {
+			data = append(data, byte(r.Intn(256)))
+			continue
+		}
+		from := len(data) - 1 - r.Intn(0x100)
+		for n := 3 + r.Intn(16); n > 0 && len(data) < size; n-- {
+			data = append(data, data[from])
+			from++
+		}
+	}
+	return data
+}
+
+// Data that does not get smaller.
+func random(size int, seed int64) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		keep int
+	}{
+		{"zeroes", make([]byte, 0x1000), 0},
+		{"text", bytes.Repeat([]byte("nintil BLZ round trip "), 200), 0},
+		{"repetitive", repetitive(0x8000, 1), 0},
+		{"keep", repetitive(0x8000, 2), 0x4000},
+		{"keep random prefix", append(random(0x4000, 3), make([]byte, 0x2000)...), 0x4000},
+		{"odd size", repetitive(12345, 4), 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			compressed, err := CompressKeep(tt.data, tt.keep)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(compressed) >= len(tt.data) {
+				t.Errorf("compressed to 0x%X bytes, from 0x%X", len(compressed), len(tt.data))
+			}
+			if !bytes.Equal(compressed[:tt.keep], tt.data[:tt.keep]) {
+				t.Errorf("first 0x%X bytes were not kept", tt.keep)
+			}
+			data, err := Decompress(compressed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, tt.data) {
+				t.Errorf("decompressed data differs")
+			}
+		})
+	}
+}
+
+func TestIncompressible(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		keep int
+	}{
+		{"empty", nil, 0},
+		{"tiny", []byte{1, 2, 3}, 0},
+		{"random", random(0x1000, 5), 0},
+		{"all kept", repetitive(0x1000, 6), 0x1000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := CompressKeep(tt.data, tt.keep); !errors.Is(err, ErrIncompressible) {
+				t.Errorf("got %v, expected %v", err, ErrIncompressible)
+			}
+		})
+	}
+}
+
+func TestDecompressInvalid(t *testing.T) {
+	compressed, err := Compress(repetitive(0x1000, 7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	footer := len(compressed) - 8
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"too short", []byte{1, 2, 3}},
+		{"no footer", make([]byte, 0x20)},
+		{"header too long", append(bytes.Clone(compressed[:footer]), 0xFF, 0xFF, 0x00, 0xFF, 0, 0, 0, 0)},
+		{"cut short", compressed[0x100:]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Decompress(tt.data); !errors.Is(err, ErrNotBLZ) {
+				t.Errorf("got %v, expected %v", err, ErrNotBLZ)
+			}
+		})
+	}
+}
@@ -6,10 +6,12 @@ import (
 	"fmt"
 	"image"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 
 	"github.com/sukus21/nintil/nds"
+	"github.com/sukus21/nintil/nds/nitrofs"
 	"github.com/sukus21/nintil/nds/pit"
 	"github.com/sukus21/nintil/util"
 )
@@ -31,19 +33,44 @@ func addNdsFuncs(r *Runner) {
 	})
 
 	// Opens a file from the loaded ROM's filesystem
-	// - string				fname
+	// - string|int			fname or file ID
 	// + []byte
 	r.AddFunc("nds_fread", func(r *Runner) any {
-		fname := ReadArg[string](r)
+		fname := ReadArg[any](r)
 
 		rom := ReadVar[*nds.Rom](r, "nds")
-		datFile := util.Must1(rom.Filesystem.Open(fname))
+		var datFile fs.File
+		if name, ok := fname.(string); ok {
+			datFile = util.Must1(rom.Filesystem.Open(name))
+		} else {
+			idfs := rom.Filesystem.(nitrofs.IDFS)
+			datFile = util.Must1(idfs.OpenID(uint16(getNumber(fname))))
+		}
 		content := util.Must1(io.ReadAll(datFile))
 		datFile.Close()
 
 		return content
 	})
 
+	// Get path of a file in the loaded ROM's filesystem
+	// - int				file ID
+	// + string
+	r.AddFunc("nds_fpath", func(r *Runner) any {
+		id := ReadArg[int](r)
+
+		rom := ReadVar[*nds.Rom](r, "nds")
+		idfs := rom.Filesystem.(nitrofs.IDFS)
+		return util.Must1(idfs.PathOf(uint16(id)))
+	})
+
+	// List IDs of files without a name in the loaded ROM's filesystem
+	r.AddFunc("nds_unnamed", func(r *Runner) any {
+		rom := ReadVar[*nds.Rom](r, "nds")
+		idfs := rom.Filesystem.(nitrofs.IDFS)
+		fmt.Println(util.Must1(idfs.UnnamedIDs()))
+		return nil
+	})
+
 	// Explain whats here at given ROM address
 	// - uint32				address
 	r.AddFunc("here", func(r *Runner) any {
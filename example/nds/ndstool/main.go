@@ -0,0 +1,32 @@
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/sukus21/nintil/nds"
+	"github.com/sukus21/nintil/util"
+)
+
+func main() {
+	if len(os.Args) < 4 {
+		log.Fatal("usage: ndstool extract <path-to-rom> <output-dir> | ndstool build <input-dir> <output-rom>")
+	}
+
+	switch os.Args[1] {
+	case "extract":
+		in := util.Must1(os.Open(os.Args[2]))
+		defer in.Close()
+		rom := util.Must1(nds.OpenROM(in))
+		util.Must(nds.SaveNdstool(rom, os.Args[3]))
+
+	case "build":
+		rom := util.Must1(nds.OpenNdstool(os.DirFS(os.Args[2])))
+		out := util.Must1(os.Create(os.Args[3]))
+		defer out.Close()
+		util.Must(nds.SaveROMTo(rom, out))
+
+	default:
+		log.Fatalf("unknown command %q, must be extract or build", os.Args[1])
+	}
+}
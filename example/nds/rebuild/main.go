@@ -21,5 +21,5 @@ func main() {
 	// Rebuild ROM file
 	out := util.Must1(os.Create("out.nds"))
 	defer out.Close()
-	util.Must(nds.SaveROM(rom, out))
+	util.Must(nds.SaveROMTo(rom, out))
 }
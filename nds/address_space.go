@@ -0,0 +1,424 @@
+package nds
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/sukus21/nintil/nds/nitrofs"
+	"github.com/sukus21/nintil/util/ezbin"
+)
+
+var ErrAmbiguousAddress = errors.New("address is in more than one overlay")
+var ErrBssAddress = errors.New("address is in BSS")
+var ErrOutsideBinary = errors.New("offset is outside binary")
+
+// Binary that code and data are loaded from.
+type Binary int
+
+const (
+	BinaryArm9 Binary = iota
+	BinaryArm7
+	BinaryArm9Overlay
+	BinaryArm7Overlay
+)
+
+func (b Binary) String() string {
+	switch b {
+	case BinaryArm9:
+		return "ARM9"
+	case BinaryArm7:
+		return "ARM7"
+	case BinaryArm9Overlay:
+		return "ARM9 overlay"
+	case BinaryArm7Overlay:
+		return "ARM7 overlay"
+	default:
+		return "unknown"
+	}
+}
+
+// Is the binary an overlay?
+func (b Binary) IsOverlay() bool {
+	return b == BinaryArm9Overlay || b == BinaryArm7Overlay
+}
+
+// Is the binary run by the ARM7?
+func (b Binary) IsArm7() bool {
+	return b == BinaryArm7 || b == BinaryArm7Overlay
+}
+
+// RAM the ARM7 runs code from: main RAM from an ARM7 destination in main RAM on, and ARM7 WRAM.
+// Overlays loaded here are ARM7 overlays.
+const (
+	mainRamStart  = 0x02000000
+	mainRamEnd    = 0x02400000
+	arm7WramStart = 0x037F8000
+	arm7WramEnd   = 0x03810000
+)
+
+// Location in a binary of the ROM.
+type Location struct {
+	Binary Binary
+
+	// Overlay ID, only used for overlays
+	Overlay uint32
+
+	// Offset in the uncompressed code of the binary
+	Offset uint32
+}
+
+func (l Location) String() string {
+	if l.Binary.IsOverlay() {
+		return fmt.Sprintf("%s %d+0x%X", l.Binary, l.Overlay, l.Offset)
+	}
+	return fmt.Sprintf("%s+0x%X", l.Binary, l.Offset)
+}
+
+// Translates between RAM addresses and locations in the binaries of a ROM.
+// The ARM9 binary is decompressed up front, overlays are decompressed when first needed.
+// Changes made with Put and Write are applied to the ROM by Flush.
+type AddressSpace struct {
+	rom      *Rom
+	arm9     *Arm9Memory
+	arm9Code []byte
+	arm7     []byte
+	overlays map[Location][]byte
+	dirty    map[Location]bool
+}
+
+// Create an address space for the ARM9 binary, the ARM7 binary and the overlays of both.
+// ARM9 binaries without module params are treated as one static section.
+func (o *Rom) AddressSpace() (*AddressSpace, error) {
+	code, err := o.Arm9Code()
+	if err != nil {
+		return nil, err
+	}
+	a := &AddressSpace{
+		rom:      o,
+		arm9Code: code,
+		arm7:     slices.Clone(o.Arm7Binary),
+		overlays: map[Location][]byte{},
+		dirty:    map[Location]bool{},
+	}
+
+	params, err := o.Arm9ModuleParams()
+	if errors.Is(err, ErrNoModuleParams) {
+		a.arm9 = &Arm9Memory{Sections: []*MemorySection{{
+			Kind:    SectionStatic,
+			Address: o.header.Arm9Destination,
+			Data:    code,
+		}}}
+	} else if err != nil {
+		return nil, err
+	} else if a.arm9, err = o.arm9Memory(code, params); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Get the ARM9 memory sections.
+func (a *AddressSpace) Arm9Memory() *Arm9Memory {
+	return a.arm9
+}
+
+// Get the overlay set of an overlay binary.
+func (a *AddressSpace) overlaySet(bin Binary) *nitrofs.OverlaySet {
+	if bin == BinaryArm7Overlay {
+		return a.rom.Arm7Overlays
+	}
+	return a.rom.Arm9Overlays
+}
+
+// Get an overlay of the ROM.
+func (a *AddressSpace) overlay(bin Binary, id uint32) (nitrofs.Overlay, error) {
+	set := a.overlaySet(bin)
+	if set == nil {
+		return nil, nitrofs.ErrNoSuchOverlay
+	}
+	return set.Get(id)
+}
+
+// Get the uncompressed code of an overlay.
+func (a *AddressSpace) overlayCode(bin Binary, id uint32) ([]byte, error) {
+	key := Location{Binary: bin, Overlay: id}
+	if code, ok := a.overlays[key]; ok {
+		return code, nil
+	}
+	ov, err := a.overlay(bin, id)
+	if err != nil {
+		return nil, err
+	}
+
+	var code []byte
+	if simple, ok := ov.(*nitrofs.OverlaySimple); ok {
+		if code, err = simple.Code(); err != nil {
+			return nil, err
+		}
+	} else if ov.Flags().IsCompressed() {
+		return nil, fmt.Errorf("%s %d: cannot decompress overlay of type %T", bin, id, ov)
+	} else {
+		code = slices.Clone(ov.Data())
+	}
+	a.overlays[key] = code
+	return code, nil
+}
+
+// Does an overlay contain address?
+// Returns the offset of address in the overlay code, or ErrBssAddress if it is in the BSS.
+// The overlay is only decompressed if its table entry covers address.
+func (a *AddressSpace) overlayOffset(bin Binary, id uint32, address uint32) (uint32, bool, error) {
+	ov, err := a.overlay(bin, id)
+	if err != nil {
+		return 0, false, err
+	}
+	start := ov.Address()
+	if address < start || address-start >= ov.Size()+ov.DynamicSize() {
+		return 0, false, nil
+	}
+
+	code, err := a.overlayCode(bin, id)
+	if err != nil {
+		return 0, true, err
+	}
+	if address-start >= uint32(len(code))+ov.DynamicSize() {
+		return 0, false, nil
+	}
+	if address-start >= uint32(len(code)) {
+		return 0, true, ErrBssAddress
+	}
+	return address - start, true, nil
+}
+
+// Is address in RAM the ARM7 runs code from?
+func (a *AddressSpace) isArm7Address(address uint32) bool {
+	dest := a.rom.header.Arm7Destination
+	if dest >= mainRamStart && dest < mainRamEnd && address >= dest && address < mainRamEnd {
+		return true
+	}
+	return address >= arm7WramStart && address < arm7WramEnd
+}
+
+// Find the location a RAM address is loaded from.
+// The given overlays are checked first, then the ARM9 binary, then the ARM7 binary.
+// Other overlays are only checked last, and only if exactly one contains address.
+// Overlays are ARM7 overlays for addresses in ARM7 RAM, and ARM9 overlays otherwise.
+func (a *AddressSpace) Resolve(address uint32, overlays ...uint32) (Location, error) {
+	fail := func(err error) (Location, error) {
+		return Location{}, fmt.Errorf("resolve 0x%08X: %w", address, err)
+	}
+	bin := BinaryArm9Overlay
+	if a.isArm7Address(address) {
+		bin = BinaryArm7Overlay
+	}
+	for _, id := range overlays {
+		offset, ok, err := a.overlayOffset(bin, id, address)
+		if err != nil {
+			return fail(err)
+		}
+		if ok {
+			return Location{Binary: bin, Overlay: id, Offset: offset}, nil
+		}
+	}
+
+	// Static ARM9 and autoloads
+	if section := a.arm9.Section(address); section != nil {
+		rel := address - section.Address
+		if rel >= uint32(len(section.Data)) {
+			return fail(ErrBssAddress)
+		}
+		return Location{Binary: BinaryArm9, Offset: section.Offset + rel}, nil
+	}
+
+	// ARM7
+	start := a.rom.header.Arm7Destination
+	if address >= start && address-start < uint32(len(a.arm7)) {
+		return Location{Binary: BinaryArm7, Offset: address - start}, nil
+	}
+
+	// Any overlay, as long as there is only one
+	var found []Location
+	if set := a.overlaySet(bin); set != nil {
+		for id := range uint32(set.Len()) {
+			offset, ok, err := a.overlayOffset(bin, id, address)
+			if err != nil {
+				return fail(err)
+			}
+			if ok {
+				found = append(found, Location{Binary: bin, Overlay: id, Offset: offset})
+			}
+		}
+	}
+	switch len(found) {
+	case 0:
+		return fail(ErrUnmappedAddress)
+	case 1:
+		return found[0], nil
+	default:
+		return fail(ErrAmbiguousAddress)
+	}
+}
+
+// Get the RAM address a location is loaded at.
+// Returns ErrUnmappedAddress if that part of the binary is not loaded.
+func (a *AddressSpace) Address(loc Location) (uint32, error) {
+	code, err := a.Code(loc)
+	if err != nil {
+		return 0, fmt.Errorf("address of %s: %w", loc, err)
+	}
+	if loc.Offset >= uint32(len(code)) {
+		return 0, fmt.Errorf("address of %s: %w", loc, ErrOutsideBinary)
+	}
+	switch loc.Binary {
+	case BinaryArm9:
+		for _, section := range a.arm9.Sections {
+			if len(section.Data) != 0 && loc.Offset >= section.Offset && loc.Offset-section.Offset < uint32(len(section.Data)) {
+				return section.Address + loc.Offset - section.Offset, nil
+			}
+		}
+	case BinaryArm7:
+		return a.rom.header.Arm7Destination + loc.Offset, nil
+	case BinaryArm9Overlay, BinaryArm7Overlay:
+		ov, _ := a.overlay(loc.Binary, loc.Overlay)
+		return ov.Address() + loc.Offset, nil
+	}
+	return 0, fmt.Errorf("address of %s: %w", loc, ErrUnmappedAddress)
+}
+
+// Get every binary of the address space, as locations at their start.
+func (a *AddressSpace) Binaries() []Location {
+	binaries := []Location{{Binary: BinaryArm9}, {Binary: BinaryArm7}}
+	for _, bin := range []Binary{BinaryArm9Overlay, BinaryArm7Overlay} {
+		if set := a.overlaySet(bin); set != nil {
+			for id := range uint32(set.Len()) {
+				binaries = append(binaries, Location{Binary: bin, Overlay: id})
+			}
+		}
+	}
+	return binaries
+}
+
+// Get the whole uncompressed code of the binary holding loc.
+// The returned slice belongs to the address space, use Put to change it.
+func (a *AddressSpace) Code(loc Location) ([]byte, error) {
+	switch loc.Binary {
+	case BinaryArm9:
+		return a.arm9Code, nil
+	case BinaryArm7:
+		return a.arm7, nil
+	case BinaryArm9Overlay, BinaryArm7Overlay:
+		return a.overlayCode(loc.Binary, loc.Overlay)
+	default:
+		return nil, fmt.Errorf("unknown binary %d", loc.Binary)
+	}
+}
+
+// Get the uncompressed code of the binary at loc.
+// ARM9 code ends with the section containing loc, so reads and writes stay within it.
+func (a *AddressSpace) code(loc Location) ([]byte, error) {
+	if loc.Binary == BinaryArm9 {
+		for _, section := range a.arm9.Sections {
+			end := section.Offset + uint32(len(section.Data))
+			if loc.Offset >= section.Offset && loc.Offset < end {
+				return a.arm9Code[:end], nil
+			}
+		}
+	}
+	return a.Code(loc)
+}
+
+// Read values at a location, using ezbin.
+func (a *AddressSpace) Get(loc Location, data ...any) error {
+	code, err := a.code(loc)
+	if err != nil {
+		return fmt.Errorf("read %s: %w", loc, err)
+	}
+	if loc.Offset > uint32(len(code)) {
+		return fmt.Errorf("read %s: %w", loc, ErrOutsideBinary)
+	}
+	if err := ezbin.Get(code, int(loc.Offset), data...); err != nil {
+		return fmt.Errorf("read %s: %w", loc, err)
+	}
+	return nil
+}
+
+// Write values at a location, using ezbin.
+// The values must fit in the binary.
+func (a *AddressSpace) Put(loc Location, data ...any) error {
+	code, err := a.code(loc)
+	if err != nil {
+		return fmt.Errorf("write %s: %w", loc, err)
+	}
+	buf := &bytes.Buffer{}
+	if err := ezbin.Write(buf, data...); err != nil {
+		return fmt.Errorf("write %s: %w", loc, err)
+	}
+	if loc.Offset > uint32(len(code)) || uint32(buf.Len()) > uint32(len(code))-loc.Offset {
+		return fmt.Errorf("write %s: %w", loc, ErrOutsideBinary)
+	}
+	copy(code[loc.Offset:], buf.Bytes())
+	a.dirty[Location{Binary: loc.Binary, Overlay: loc.Overlay}] = true
+	return nil
+}
+
+// Read values at a RAM address, using ezbin.
+// The address is resolved with Resolve.
+func (a *AddressSpace) Read(address uint32, data ...any) error {
+	return a.ReadIn(address, nil, data...)
+}
+
+// Read values at a RAM address, using ezbin.
+// The address is resolved with Resolve, checking the given overlays first.
+func (a *AddressSpace) ReadIn(address uint32, overlays []uint32, data ...any) error {
+	loc, err := a.Resolve(address, overlays...)
+	if err != nil {
+		return err
+	}
+	return a.Get(loc, data...)
+}
+
+// Write values at a RAM address, using ezbin.
+// The address is resolved with Resolve.
+func (a *AddressSpace) Write(address uint32, data ...any) error {
+	return a.WriteIn(address, nil, data...)
+}
+
+// Write values at a RAM address, using ezbin.
+// The address is resolved with Resolve, checking the given overlays first.
+func (a *AddressSpace) WriteIn(address uint32, overlays []uint32, data ...any) error {
+	loc, err := a.Resolve(address, overlays...)
+	if err != nil {
+		return err
+	}
+	return a.Put(loc, data...)
+}
+
+// Apply changes to the binaries of the ROM.
+// Compressed binaries are compressed again.
+func (a *AddressSpace) Flush() error {
+	for loc := range a.dirty {
+		switch loc.Binary {
+		case BinaryArm9:
+			if err := a.rom.SetArm9Code(a.arm9Code); err != nil {
+				return err
+			}
+		case BinaryArm7:
+			a.rom.Arm7Binary = slices.Clone(a.arm7)
+		case BinaryArm9Overlay, BinaryArm7Overlay:
+			ov, err := a.overlay(loc.Binary, loc.Overlay)
+			if err != nil {
+				return err
+			}
+			simple, ok := ov.(*nitrofs.OverlaySimple)
+			if !ok {
+				return fmt.Errorf("%s %d: cannot change overlay of type %T", loc.Binary, loc.Overlay, ov)
+			}
+			if err := simple.SetCode(a.overlays[loc]); err != nil {
+				return err
+			}
+		}
+		delete(a.dirty, loc)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package nds
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/sukus21/nintil/nds/nitrofs"
+	"github.com/sukus21/nintil/util/ezbin"
+)
+
+var ErrNotAutoload = errors.New("address is not in an autoload section")
+
+// Add a new ARM9 overlay made of uncompressed code, loaded at address.
+// Returns the ID of the new overlay.
+// The game does not know about the overlay, so it has to be loaded by code patched into the game.
+func (a *AddressSpace) AppendOverlay(address uint32, code []byte, bssSize uint32) uint32 {
+	if a.rom.Arm9Overlays == nil {
+		a.rom.Arm9Overlays = nitrofs.NewOverlaySet()
+	}
+	id := a.rom.Arm9Overlays.Append(nitrofs.NewOverlay(address, code, bssSize))
+	a.overlays[Location{Binary: BinaryArm9Overlay, Overlay: id}] = slices.Clone(code)
+	return id
+}
+
+// Remove an ARM9 overlay.
+// Overlays after it move down one ID, and unflushed changes to them move along.
+func (a *AddressSpace) RemoveOverlay(id uint32) error {
+	if err := a.rom.Arm9Overlays.Remove(id); err != nil {
+		return err
+	}
+
+	// Renumber cached overlay code
+	overlays := map[Location][]byte{}
+	for loc, code := range a.overlays {
+		if loc.Binary == BinaryArm9Overlay && loc.Overlay == id {
+			continue
+		}
+		if loc.Binary == BinaryArm9Overlay && loc.Overlay > id {
+			loc.Overlay--
+		}
+		overlays[loc] = code
+	}
+	dirty := map[Location]bool{}
+	for loc := range a.dirty {
+		if loc.Binary == BinaryArm9Overlay && loc.Overlay == id {
+			continue
+		}
+		if loc.Binary == BinaryArm9Overlay && loc.Overlay > id {
+			loc.Overlay--
+		}
+		dirty[loc] = true
+	}
+	a.overlays, a.dirty = overlays, dirty
+	return nil
+}
+
+// Change the size of the data of the ARM9 autoload section containing address.
+// Data is added or removed at the end of the section, added data is zeroed.
+// Autoload data following the section and the autoload list move to make room.
+// Returns the RAM address of the old end of the section data.
+//
+// The BSS of the section moves along with the end of its data,
+// so the RAM following the BSS must be unused.
+func (a *AddressSpace) ResizeArm9Section(address uint32, size uint32) (uint32, error) {
+	fail := func(err error) (uint32, error) {
+		return 0, fmt.Errorf("resize ARM9 section at 0x%08X: %w", address, err)
+	}
+	if findModuleParams(a.arm9Code) == -1 {
+		return fail(ErrNoModuleParams)
+	}
+	index := slices.IndexFunc(a.arm9.Sections, func(s *MemorySection) bool {
+		return s.Kind != SectionStatic && s.Kind != SectionBss && s.Contains(address)
+	})
+	if index == -1 {
+		return fail(ErrNotAutoload)
+	}
+	section := a.arm9.Sections[index]
+	params := a.arm9.Params
+	dest := a.rom.header.Arm9Destination
+	oldSize := uint32(len(section.Data))
+	end := section.Offset + oldSize
+
+	// Sections come in autoload list order, after the static part and its BSS
+	entry := params.AutoloadListStart - dest + uint32(index-2)*autoloadEntrySize
+	if entry >= end {
+		entry += size - oldSize
+	}
+	var code []byte
+	if size >= oldSize {
+		code = slices.Concat(a.arm9Code[:end], make([]byte, size-oldSize), a.arm9Code[end:])
+	} else {
+		code = slices.Delete(slices.Clone(a.arm9Code), int(section.Offset+size), int(end))
+	}
+
+	// Move pointers to anything after the section
+	move := func(p *uint32) {
+		if *p-dest >= end {
+			*p += size - oldSize
+		}
+	}
+	move(&params.AutoloadListStart)
+	move(&params.AutoloadListEnd)
+	if _, err := ezbin.Put(code, int(entry+4), size); err != nil {
+		return fail(err)
+	}
+
+	// Module params may have moved as well
+	paramsPos := findModuleParams(code)
+	if paramsPos == -1 {
+		return fail(ErrNoModuleParams)
+	}
+	if _, err := ezbin.Put(code, paramsPos, &params); err != nil {
+		return fail(err)
+	}
+
+	mem, err := a.rom.arm9Memory(code, &params)
+	if err != nil {
+		return fail(err)
+	}
+	a.arm9, a.arm9Code = mem, code
+	a.dirty[Location{Binary: BinaryArm9}] = true
+	return section.Address + oldSize, nil
+}
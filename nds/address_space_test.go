@@ -0,0 +1,138 @@
+package nds
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/sukus21/nintil/nds/nitrofs"
+)
+
+// Get the address space of the test ROM, with a second overlay at the same address as the first,
+// and a compressed overlay that cannot be decompressed.
+func testAddressSpace(t *testing.T) *AddressSpace {
+	t.Helper()
+	rom, _ := testROM(t, false)
+	rom.Arm9Overlays.Append(nitrofs.NewOverlay(0x02100000, testData(9, 0x200), 0))
+	broken := nitrofs.NewOverlay(0x02200000, bytes.Repeat([]byte{0xFF}, 0x100), 0)
+	broken.SetFlags(nitrofs.OverlayFlagCompressed)
+	rom.Arm9Overlays.Append(broken)
+
+	space, err := rom.AddressSpace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return space
+}
+
+func TestAddressSpaceOverlays(t *testing.T) {
+	space := testAddressSpace(t)
+	overlay1 := testData(9, 0x200)
+
+	// Both overlays hold the address
+	var value uint32
+	if err := space.Read(0x02100010, &value); !errors.Is(err, ErrAmbiguousAddress) {
+		t.Errorf("got %v, expected %v", err, ErrAmbiguousAddress)
+	}
+	if err := space.ReadIn(0x02100010, []uint32{1}, &value); err != nil {
+		t.Fatal(err)
+	}
+	if expected := binary.LittleEndian.Uint32(overlay1[0x10:]); value != expected {
+		t.Errorf("got %08X, expected %08X", value, expected)
+	}
+
+	// Only the given overlay is written to
+	if err := space.WriteIn(0x02100010, []uint32{1}, uint32(0xDEADBEEF)); err != nil {
+		t.Fatal(err)
+	}
+	for id, expected := range []uint32{binary.LittleEndian.Uint32(testData(3, 0x400)[0x10:]), 0xDEADBEEF} {
+		if err := space.Get(Location{Binary: BinaryArm9Overlay, Overlay: uint32(id), Offset: 0x10}, &value); err != nil {
+			t.Fatal(err)
+		}
+		if value != expected {
+			t.Errorf("overlay %d: got %08X, expected %08X", id, value, expected)
+		}
+	}
+
+	// Only the first overlay is this large
+	loc, err := space.Resolve(0x02100300)
+	if err != nil || loc != (Location{Binary: BinaryArm9Overlay, Overlay: 0, Offset: 0x300}) {
+		t.Errorf("got %s, %v", loc, err)
+	}
+	if err := space.Write(0x02100300, uint32(1)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAddressSpaceOverlayErrors(t *testing.T) {
+	space := testAddressSpace(t)
+
+	// Decompression errors are returned, instead of the address being unmapped
+	var value uint32
+	for _, overlays := range [][]uint32{nil, {2}} {
+		err := space.ReadIn(0x02200010, overlays, &value)
+		if err == nil || errors.Is(err, ErrUnmappedAddress) {
+			t.Errorf("overlays %v: got %v, expected a decompression error", overlays, err)
+		}
+	}
+
+	// But only for addresses in the broken overlay
+	if err := space.Read(0x02000010, &value); err != nil {
+		t.Error(err)
+	}
+	if err := space.Read(0x02300000, &value); !errors.Is(err, ErrUnmappedAddress) {
+		t.Errorf("got %v, expected %v", err, ErrUnmappedAddress)
+	}
+	if err := space.Read(0x02100400, &value); !errors.Is(err, ErrBssAddress) {
+		t.Errorf("got %v, expected %v", err, ErrBssAddress)
+	}
+}
+
+func TestAddressSpaceArm7Overlays(t *testing.T) {
+	rom, _ := testROM(t, false)
+	rom.Arm7Overlays.Append(nitrofs.NewOverlay(0x037F8000, testData(10, 0x100), 0x20))
+	space, err := rom.AddressSpace()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// ARM7 RAM is resolved to ARM7 overlays, even when given the ID of an ARM9 overlay
+	expected := Location{Binary: BinaryArm7Overlay, Overlay: 0, Offset: 0x10}
+	loc, err := space.Resolve(0x037F8010, 0)
+	if err != nil || loc != expected {
+		t.Errorf("got %s, %v, expected %s", loc, err, expected)
+	}
+	if address, err := space.Address(expected); err != nil || address != 0x037F8010 {
+		t.Errorf("got %08X, %v, expected %08X", address, err, 0x037F8010)
+	}
+	if !slices.Contains(space.Binaries(), Location{Binary: BinaryArm7Overlay}) {
+		t.Errorf("ARM7 overlay is not listed in %v", space.Binaries())
+	}
+	if err := space.Read(0x037F8100, new(uint32)); !errors.Is(err, ErrBssAddress) {
+		t.Errorf("got %v, expected %v", err, ErrBssAddress)
+	}
+
+	// Changes are flushed to the ARM7 overlay only
+	if err := space.Write(0x037F8010, uint32(0xDEADBEEF)); err != nil {
+		t.Fatal(err)
+	}
+	if err := space.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	ov, err := rom.Arm7Overlays.Get(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value := binary.LittleEndian.Uint32(ov.Data()[0x10:]); value != 0xDEADBEEF {
+		t.Errorf("got %08X, expected %08X", value, 0xDEADBEEF)
+	}
+	ov, err = rom.Arm9Overlays.Get(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(ov.Data(), testData(3, 0x400)) {
+		t.Errorf("ARM9 overlay was changed")
+	}
+}
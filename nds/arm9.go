@@ -0,0 +1,104 @@
+package nds
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/sukus21/nintil/compression/blz"
+)
+
+// Magic numbers found at the end of the ARM9 module params
+const (
+	moduleParamsMagic1 = 0xDEC00621
+	moduleParamsMagic2 = 0x2106C0DE
+)
+
+// Offsets within the ARM9 module params
+const (
+	moduleParamsCompressedEnd = 0x14
+	moduleParamsMagic         = 0x1C
+	moduleParamsSize          = 0x24
+)
+
+// Size of the footer following the ARM9 binary in ROM.
+// It starts with moduleParamsMagic1, followed by the offset of the module params.
+const arm9FooterSize = 0x0C
+
+// The start of the ARM9 binary is never compressed
+const arm9UncompressedSize = 0x4000
+
+// Find the module params in an ARM9 binary.
+// Returns -1 if they could not be found.
+func findModuleParams(bin []byte) int {
+	for pos := 0; pos+moduleParamsSize <= len(bin); pos += 4 {
+		if binary.LittleEndian.Uint32(bin[pos+moduleParamsMagic:]) == moduleParamsMagic1 &&
+			binary.LittleEndian.Uint32(bin[pos+moduleParamsMagic+4:]) == moduleParamsMagic2 {
+			return pos
+		}
+	}
+	return -1
+}
+
+// Is the ARM9 binary BLZ compressed?
+func (o *Rom) IsArm9Compressed() bool {
+	params := findModuleParams(o.Arm9Binary)
+	return params != -1 && binary.LittleEndian.Uint32(o.Arm9Binary[params+moduleParamsCompressedEnd:]) != 0
+}
+
+// Get the ARM9 binary as it looks once loaded into RAM.
+// If the binary is BLZ compressed, it is decompressed first.
+// The returned slice is a copy, changes to it are not reflected in the ROM.
+func (o *Rom) Arm9Code() ([]byte, error) {
+	params := findModuleParams(o.Arm9Binary)
+	if params == -1 {
+		return slices.Clone(o.Arm9Binary), nil
+	}
+	compressedEnd := binary.LittleEndian.Uint32(o.Arm9Binary[params+moduleParamsCompressedEnd:])
+	if compressedEnd == 0 {
+		return slices.Clone(o.Arm9Binary), nil
+	}
+
+	// Decompress, anything after the compressed region is kept as-is
+	end := compressedEnd - o.header.Arm9Destination
+	if end > uint32(len(o.Arm9Binary)) || end < uint32(params+moduleParamsSize) {
+		return nil, fmt.Errorf("ARM9 code: compressed end 0x%08X outside binary", compressedEnd)
+	}
+	code, err := blz.Decompress(o.Arm9Binary[:end])
+	if err != nil {
+		return nil, fmt.Errorf("ARM9 code: %w", err)
+	}
+	code = append(code, o.Arm9Binary[end:]...)
+
+	// The code is no longer compressed
+	binary.LittleEndian.PutUint32(code[params+moduleParamsCompressedEnd:], 0)
+	return code, nil
+}
+
+// Replace the ARM9 binary with (uncompressed) code.
+// If the current binary is BLZ compressed, the new code is compressed as well,
+// and the compressed end pointer in the module params is updated to match.
+func (o *Rom) SetArm9Code(code []byte) error {
+	params := findModuleParams(code)
+	if !o.IsArm9Compressed() || params == -1 {
+		o.Arm9Binary = slices.Clone(code)
+		return nil
+	}
+
+	// Module params must stay uncompressed
+	bin, err := blz.CompressKeep(code, max(arm9UncompressedSize, params+moduleParamsSize))
+	if errors.Is(err, blz.ErrIncompressible) {
+		bin = slices.Clone(code)
+		binary.LittleEndian.PutUint32(bin[params+moduleParamsCompressedEnd:], 0)
+		o.Arm9Binary = bin
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("ARM9 code: %w", err)
+	}
+
+	compressedEnd := o.header.Arm9Destination + uint32(len(bin))
+	binary.LittleEndian.PutUint32(bin[params+moduleParamsCompressedEnd:], compressedEnd)
+	o.Arm9Binary = bin
+	return nil
+}
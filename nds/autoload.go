@@ -0,0 +1,256 @@
+package nds
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/sukus21/nintil/util/ezbin"
+)
+
+var ErrNoModuleParams = errors.New("ARM9 binary has no module params")
+var ErrInvalidModuleParams = errors.New("ARM9 module params point outside binary")
+var ErrUnmappedAddress = errors.New("address is not loaded")
+
+// Size of an entry in the autoload list
+const autoloadEntrySize = 0x0C
+
+// DTCM addresses used by the SDK.
+// DTCM can be placed anywhere, so other addresses are not recognized.
+var dtcmAddresses = []uint32{0x023C0000, 0x027C0000, 0x027E0000, 0x02FE0000}
+
+// ARM9 module params, found in the ARM9 binary by their magic numbers.
+// Addresses are RAM addresses.
+type ModuleParams struct {
+	AutoloadListStart uint32
+	AutoloadListEnd   uint32
+	AutoloadStart     uint32
+	BssStart          uint32
+	BssEnd            uint32
+
+	// End of the BLZ compressed region, 0 if the binary is not compressed
+	CompressedEnd uint32
+	SdkVersion    uint32
+}
+
+// Get the module params of the ARM9 binary.
+// Returns ErrNoModuleParams if there are none.
+func (o *Rom) Arm9ModuleParams() (*ModuleParams, error) {
+	return readModuleParams(o.Arm9Binary)
+}
+
+// Read the module params of an ARM9 binary.
+func readModuleParams(bin []byte) (*ModuleParams, error) {
+	pos := findModuleParams(bin)
+	if pos == -1 {
+		return nil, ErrNoModuleParams
+	}
+	params := &ModuleParams{}
+	if err := ezbin.Read(bytes.NewReader(bin[pos:]), params); err != nil {
+		return nil, fmt.Errorf("ARM9 module params: %w", err)
+	}
+	return params, nil
+}
+
+// Kind of memory section.
+type SectionKind int
+
+const (
+	// Static part of the ARM9 binary, loaded at the ARM9 destination
+	SectionStatic SectionKind = iota
+
+	// BSS of the static part, cleared on boot
+	SectionBss
+
+	// Autoload to instruction TCM
+	SectionITCM
+
+	// Autoload to data TCM
+	SectionDTCM
+
+	// Autoload to anywhere else, usually main RAM
+	SectionExtra
+)
+
+func (k SectionKind) String() string {
+	switch k {
+	case SectionStatic:
+		return "static"
+	case SectionBss:
+		return "BSS"
+	case SectionITCM:
+		return "ITCM"
+	case SectionDTCM:
+		return "DTCM"
+	case SectionExtra:
+		return "extra"
+	default:
+		return "unknown"
+	}
+}
+
+// Get the kind of an autoload section from its address.
+func autoloadKind(address uint32) SectionKind {
+	if address < 0x02000000 {
+		return SectionITCM
+	}
+	if slices.Contains(dtcmAddresses, address) {
+		return SectionDTCM
+	}
+	return SectionExtra
+}
+
+// Section of loaded ARM9 memory.
+// Data is followed by BssSize zero bytes.
+type MemorySection struct {
+	Kind    SectionKind
+	Address uint32
+	Data    []byte
+	BssSize uint32
+
+	// Offset of Data in the uncompressed ARM9 code, 0 if there is no data
+	Offset uint32
+}
+
+// Get the RAM address following the section, including its BSS.
+func (s *MemorySection) End() uint32 {
+	return s.Address + uint32(len(s.Data)) + s.BssSize
+}
+
+// Does the section contain address?
+func (s *MemorySection) Contains(address uint32) bool {
+	return address >= s.Address && address < s.End()
+}
+
+// ARM9 memory as it looks once the binary is loaded and the autoloads are done.
+type Arm9Memory struct {
+	Params   ModuleParams
+	Sections []*MemorySection
+
+	// RAM address of the function called once the autoloads are done
+	AutoloadHook uint32
+}
+
+// Get the ARM9 memory as it looks once loaded.
+// The ARM9 code is decompressed, then split into its static part and autoload sections.
+// Changes to the returned memory are not reflected in the ROM.
+func (o *Rom) Arm9Memory() (*Arm9Memory, error) {
+	params, err := o.Arm9ModuleParams()
+	if err != nil {
+		return nil, err
+	}
+	code, err := o.Arm9Code()
+	if err != nil {
+		return nil, err
+	}
+	return o.arm9Memory(code, params)
+}
+
+// Split uncompressed ARM9 code into its memory sections.
+// The sections share memory with code.
+func (o *Rom) arm9Memory(code []byte, params *ModuleParams) (*Arm9Memory, error) {
+	dest := o.header.Arm9Destination
+	codeOffset := func(address uint32) (uint32, error) {
+		if address < dest || address-dest > uint32(len(code)) {
+			return 0, fmt.Errorf("ARM9 memory: %w: 0x%08X", ErrInvalidModuleParams, address)
+		}
+		return address - dest, nil
+	}
+	staticEnd, err := codeOffset(params.AutoloadStart)
+	if err != nil {
+		return nil, err
+	}
+	listStart, err := codeOffset(params.AutoloadListStart)
+	if err != nil {
+		return nil, err
+	}
+	listEnd, err := codeOffset(params.AutoloadListEnd)
+	if err != nil {
+		return nil, err
+	}
+	if listEnd < listStart || params.BssEnd < params.BssStart {
+		return nil, fmt.Errorf("ARM9 memory: %w", ErrInvalidModuleParams)
+	}
+
+	mem := &Arm9Memory{
+		Params:       *params,
+		AutoloadHook: o.header.Arm9AutoloadList,
+	}
+	mem.Sections = append(mem.Sections, &MemorySection{
+		Kind:    SectionStatic,
+		Address: dest,
+		Data:    code[:staticEnd],
+	}, &MemorySection{
+		Kind:    SectionBss,
+		Address: params.BssStart,
+		BssSize: params.BssEnd - params.BssStart,
+	})
+
+	// Autoload data follows the static part, in list order
+	pos := staticEnd
+	for entry := listStart; entry+autoloadEntrySize <= listEnd; entry += autoloadEntrySize {
+		var address, size, bssSize uint32
+		if err := ezbin.Read(bytes.NewReader(code[entry:]), &address, &size, &bssSize); err != nil {
+			return nil, fmt.Errorf("ARM9 memory: %w", err)
+		}
+		if size > uint32(len(code))-pos {
+			return nil, fmt.Errorf("ARM9 memory: %w: autoload 0x%08X", ErrInvalidModuleParams, address)
+		}
+		mem.Sections = append(mem.Sections, &MemorySection{
+			Kind:    autoloadKind(address),
+			Address: address,
+			Data:    code[pos : pos+size],
+			BssSize: bssSize,
+			Offset:  pos,
+		})
+		pos += size
+	}
+	return mem, nil
+}
+
+// Get the section containing address, or nil if it is not loaded.
+// If sections overlap, the one loaded last wins.
+func (m *Arm9Memory) Section(address uint32) *MemorySection {
+	for i := len(m.Sections) - 1; i >= 0; i-- {
+		if m.Sections[i].Contains(address) {
+			return m.Sections[i]
+		}
+	}
+	return nil
+}
+
+// Read loaded memory, with off as the RAM address.
+// BSS reads as zeroes, and reads may span several sections.
+// Returns ErrUnmappedAddress when reaching an address that is not loaded.
+func (m *Arm9Memory) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		address := uint32(off) + uint32(n)
+		section := m.Section(address)
+		if off < 0 || off+int64(n) > 0xFFFFFFFF || section == nil {
+			return n, fmt.Errorf("ARM9 memory: %w: 0x%08X", ErrUnmappedAddress, address)
+		}
+
+		// Copy data, then zeroes for the BSS
+		rel := address - section.Address
+		size := min(uint32(len(p)-n), section.End()-address)
+		if rel < uint32(len(section.Data)) {
+			copied := copy(p[n:n+int(size)], section.Data[rel:])
+			clear(p[n+copied : n+int(size)])
+		} else {
+			clear(p[n : n+int(size)])
+		}
+		n += int(size)
+	}
+	return n, nil
+}
+
+// Read size bytes of loaded memory at a RAM address.
+func (m *Arm9Memory) Read(address uint32, size int) ([]byte, error) {
+	buf := make([]byte, size)
+	if _, err := m.ReadAt(buf, int64(address)); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
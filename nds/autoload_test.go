@@ -0,0 +1,219 @@
+package nds
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/sukus21/nintil/compression/blz"
+	"github.com/sukus21/nintil/util/ezbin"
+)
+
+// An autoload of the test ARM9 code.
+type testAutoload struct {
+	kind    SectionKind
+	address uint32
+	size    uint32
+	bssSize uint32
+}
+
+// ITCM, DTCM and main RAM autoloads, each with a BSS.
+var testAutoloads = []testAutoload{
+	{SectionITCM, 0x01FF8000, 0x100, 0x20},
+	{SectionDTCM, 0x02FE0000, 0x80, 0x40},
+	{SectionExtra, 0x02300000, 0x200, 0x100},
+}
+
+// Layout of the test ARM9 code, as offsets from the ARM9 destination
+const (
+	testModuleParams = 0x800
+	testAutoloadList = 0x1000
+	testStaticEnd    = 0x4800
+	testBssSize      = 0x800
+)
+
+// Build uncompressed ARM9 code with module params and the test autoloads.
+// The code is compressible, but it does not have to be compressed.
+func testArm9Code(t *testing.T, dest uint32) ([]byte, ModuleParams) {
+	t.Helper()
+	code := bytes.Repeat([]byte("nintil ARM9 code"), testStaticEnd/16)
+	params := ModuleParams{
+		AutoloadListStart: dest + testAutoloadList,
+		AutoloadListEnd:   dest + testAutoloadList + uint32(len(testAutoloads))*autoloadEntrySize,
+		AutoloadStart:     dest + testStaticEnd,
+		BssStart:          dest + testStaticEnd,
+		BssEnd:            dest + testStaticEnd + testBssSize,
+		SdkVersion:        0x05035303,
+	}
+	var err error
+	for i, autoload := range testAutoloads {
+		if code, err = ezbin.Put(code, testAutoloadList+i*autoloadEntrySize, autoload.address, autoload.size, autoload.bssSize); err != nil {
+			t.Fatal(err)
+		}
+		code = append(code, bytes.Repeat([]byte{byte(i + 1)}, int(autoload.size))...)
+	}
+	if code, err = ezbin.Put(code, testModuleParams, &params, uint32(moduleParamsMagic1), uint32(moduleParamsMagic2)); err != nil {
+		t.Fatal(err)
+	}
+	return code, params
+}
+
+func TestModuleParams(t *testing.T) {
+	rom := newTestROM(false)
+	code, params := testArm9Code(t, rom.header.Arm9Destination)
+	rom.Arm9Binary = code
+
+	got, err := rom.Arm9ModuleParams()
+	if err != nil || *got != params {
+		t.Errorf("got %+v, %v, expected %+v", got, err, params)
+	}
+	if rom.IsArm9Compressed() {
+		t.Errorf("uncompressed ARM9 binary is compressed")
+	}
+}
+
+func TestModuleParamsCompressed(t *testing.T) {
+	rom := newTestROM(false)
+	code, params := testArm9Code(t, rom.header.Arm9Destination)
+
+	// Compressed like SaveROM expects, with the module params left uncompressed
+	bin, err := blz.CompressKeep(code, arm9UncompressedSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params.CompressedEnd = rom.header.Arm9Destination + uint32(len(bin))
+	binary.LittleEndian.PutUint32(bin[testModuleParams+moduleParamsCompressedEnd:], params.CompressedEnd)
+	rom.Arm9Binary = bin
+
+	got, err := rom.Arm9ModuleParams()
+	if err != nil || *got != params {
+		t.Errorf("got %+v, %v, expected %+v", got, err, params)
+	}
+	if !rom.IsArm9Compressed() {
+		t.Errorf("compressed ARM9 binary is not compressed")
+	}
+
+	// Decompressed code no longer has a compressed end
+	decompressed, err := rom.Arm9Code()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decompressed, code) {
+		t.Errorf("decompressed ARM9 code differs")
+	}
+
+	// Memory is split from the decompressed code
+	mem, err := rom.Arm9Memory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mem.Params != params || len(mem.Sections) != 2+len(testAutoloads) {
+		t.Fatalf("got params %+v and %d sections", mem.Params, len(mem.Sections))
+	}
+	if !bytes.Equal(mem.Sections[0].Data, code[:testStaticEnd]) {
+		t.Errorf("static section differs")
+	}
+}
+
+func TestModuleParamsMissing(t *testing.T) {
+	rom := newTestROM(false)
+	if _, err := rom.Arm9ModuleParams(); !errors.Is(err, ErrNoModuleParams) {
+		t.Errorf("got %v, expected %v", err, ErrNoModuleParams)
+	}
+	if _, err := rom.Arm9Memory(); !errors.Is(err, ErrNoModuleParams) {
+		t.Errorf("got %v, expected %v", err, ErrNoModuleParams)
+	}
+	if rom.IsArm9Compressed() {
+		t.Errorf("ARM9 binary without module params is compressed")
+	}
+
+	// The address space treats the binary as one static section
+	code, err := rom.Arm9Code()
+	if err != nil || !bytes.Equal(code, rom.Arm9Binary) {
+		t.Errorf("got %v, ARM9 code differs from binary", err)
+	}
+	space, err := rom.AddressSpace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loc, err := space.Resolve(rom.header.Arm9Destination + 0x10)
+	if expected := (Location{Binary: BinaryArm9, Offset: 0x10}); err != nil || loc != expected {
+		t.Errorf("got %s, %v, expected %s", loc, err, expected)
+	}
+}
+
+func TestArm9MemoryAutoloads(t *testing.T) {
+	rom := newTestROM(false)
+	dest := rom.header.Arm9Destination
+	code, _ := testArm9Code(t, dest)
+	rom.Arm9Binary = code
+	mem, err := rom.Arm9Memory()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Static part and its BSS, then the autoloads in list order
+	expected := []MemorySection{
+		{Kind: SectionStatic, Address: dest},
+		{Kind: SectionBss, Address: dest + testStaticEnd, BssSize: testBssSize},
+	}
+	offset := uint32(testStaticEnd)
+	for _, autoload := range testAutoloads {
+		expected = append(expected, MemorySection{Kind: autoload.kind, Address: autoload.address, BssSize: autoload.bssSize, Offset: offset})
+		offset += autoload.size
+	}
+	if len(mem.Sections) != len(expected) {
+		t.Fatalf("got %d sections, expected %d", len(mem.Sections), len(expected))
+	}
+	for i, section := range mem.Sections {
+		e := expected[i]
+		if section.Kind != e.Kind || section.Address != e.Address || section.BssSize != e.BssSize || section.Offset != e.Offset {
+			t.Errorf("section %d: got %s at 0x%08X, BSS 0x%X, offset 0x%X, expected %s at 0x%08X, BSS 0x%X, offset 0x%X",
+				i, section.Kind, section.Address, section.BssSize, section.Offset, e.Kind, e.Address, e.BssSize, e.Offset)
+		}
+	}
+
+	// Autoload data, followed by its BSS
+	for i, autoload := range testAutoloads {
+		data, err := mem.Read(autoload.address, int(autoload.size+autoload.bssSize))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, append(bytes.Repeat([]byte{byte(i + 1)}, int(autoload.size)), make([]byte, autoload.bssSize)...)) {
+			t.Errorf("%s autoload: data or BSS differs", autoload.kind)
+		}
+		end := autoload.address + autoload.size + autoload.bssSize
+		if section := mem.Section(end - 1); section == nil || section.Kind != autoload.kind {
+			t.Errorf("%s autoload: BSS is not in its section", autoload.kind)
+		}
+		if _, err := mem.Read(end-4, 8); !errors.Is(err, ErrUnmappedAddress) {
+			t.Errorf("%s autoload: got %v, expected %v", autoload.kind, err, ErrUnmappedAddress)
+		}
+	}
+
+	// Static BSS
+	data, err := mem.Read(dest+testStaticEnd, testBssSize)
+	if err != nil || !bytes.Equal(data, make([]byte, testBssSize)) {
+		t.Errorf("got %v, static BSS is not zeroed", err)
+	}
+}
+
+func TestAutoloadKind(t *testing.T) {
+	tests := []struct {
+		address  uint32
+		expected SectionKind
+	}{
+		{0x01FF8000, SectionITCM},
+		{0x023C0000, SectionDTCM},
+		{0x027C0000, SectionDTCM},
+		{0x027E0000, SectionDTCM},
+		{0x02FE0000, SectionDTCM},
+		{0x02300000, SectionExtra},
+	}
+	for _, tt := range tests {
+		if kind := autoloadKind(tt.address); kind != tt.expected {
+			t.Errorf("0x%08X: got %s, expected %s", tt.address, kind, tt.expected)
+		}
+	}
+}
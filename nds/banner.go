@@ -56,10 +56,11 @@ func (t TitleLanguage) String() string {
 }
 
 type banner struct {
-	version uint16
-	icon    image.PalettedImage
-	titles  [8]string
-	crcs    [4]uint16
+	version   uint16
+	icon      image.PalettedImage
+	titles    [8]string
+	crcs      [4]uint16
+	animation *bannerAnimation
 }
 
 // Check if a given title language is valid for banner version.
@@ -76,6 +77,22 @@ func (b *banner) checkValidLanguage(language TitleLanguage) error {
 	return nil
 }
 
+// Get size of banner data based on version, without padding
+func (b *banner) getDataSize() int {
+	switch b.version {
+	case BannerVersionOriginal:
+		return 0x0840
+	case BannerVersionChinese:
+		return 0x0940
+	case BannerVersionKorean:
+		return 0x0A40
+	case BannerVersionDSi:
+		return 0x23C0
+	default:
+		return -1
+	}
+}
+
 // Get binary size of banner based on version
 func (b *banner) getSize() int {
 	switch b.version {
@@ -218,7 +235,7 @@ func OpenBanner(r io.Reader) (*banner, error) {
 	case BannerVersionKorean:
 		langCount = 8
 	case BannerVersionDSi:
-		return nil, fmt.Errorf("decode banner: DSi banner mode not yet supported")
+		langCount = 8
 	default:
 		return nil, fmt.Errorf("decode banner: %04X is not a valid banner version", b.version)
 	}
@@ -245,6 +262,20 @@ func OpenBanner(r io.Reader) (*banner, error) {
 		b.titles[i] = strings.Trim(string(str), "\x00")
 	}
 
+	// Read animated icon
+	if b.version == BannerVersionDSi {
+		b.animation = &bannerAnimation{}
+		err := ezbin.Read(r,
+			ezbin.FillerArray(0x800, byte(0)),
+			b.animation.bitmaps[:],
+			b.animation.palettes[:],
+			b.animation.sequence[:],
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// Everything worked out :)
 	return b, nil
 }
@@ -305,18 +336,40 @@ func SaveBanner(out io.Writer, b *banner) error {
 		return err
 	}
 
+	// Animated icon
+	if b.version == BannerVersionDSi {
+		animation := b.animation
+		if animation == nil {
+			animation = &bannerAnimation{}
+		}
+		err = ezbin.Write(w,
+			ezbin.FillerArray(0x800, byte(0)),
+			animation.bitmaps[:],
+			animation.palettes[:],
+			animation.sequence[:],
+		)
+		if err != nil {
+			return err
+		}
+	}
+
 	// Write padding
 	length := w.Pos
 	padLength := (0x200 - (length & 0x1FF)) & 0x1FF
 	ezbin.Write(w, ezbin.FillerArray(int(padLength), byte(0xFF)))
 	dlen := w.Pos
 
-	// Write CRC's
-	crcs := []uint16{
-		CRC16(buf[0x0020:0x0840]),
-		CRC16(buf[0x0020:0x0940]),
-		CRC16(buf[0x0020:0x0A40]),
-		CRC16(buf[0x0020:0x23C0]),
+	// Write CRC's, only for the areas this version has
+	crcs := make([]uint16, 4)
+	crcs[0] = CRC16(buf[0x0020:0x0840])
+	if b.version >= BannerVersionChinese {
+		crcs[1] = CRC16(buf[0x0020:0x0940])
+	}
+	if b.version >= BannerVersionKorean {
+		crcs[2] = CRC16(buf[0x0020:0x0A40])
+	}
+	if b.version == BannerVersionDSi {
+		crcs[3] = CRC16(buf[0x1240:0x23C0])
 	}
 	w.Seek(0x02, io.SeekStart)
 	err = ezbin.Write(w, crcs)
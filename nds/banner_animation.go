@@ -0,0 +1,279 @@
+package nds
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"math"
+	"slices"
+
+	"github.com/sukus21/nintil/util/ezbin"
+)
+
+// Animated icon, only present in DSi banners.
+type bannerAnimation struct {
+	bitmaps  [8][0x200]byte
+	palettes [8][0x20]byte
+	sequence [64]IconSequenceEntry
+}
+
+// A single step in an animated DSi icon sequence.
+// A bitfield, but can be used like a regular uint16.
+// A duration of 0 marks the end of the sequence.
+type IconSequenceEntry uint16
+
+// How long to show this frame, in 60 Hz frames
+func (e IconSequenceEntry) GetDuration() int {
+	return ezbin.Bitget[int](e, 8, 0)
+}
+func (e *IconSequenceEntry) SetDuration(duration int) {
+	*e = ezbin.Bitset(*e, duration, 8, 0)
+}
+
+// Which of the 8 bitmaps to show
+func (e IconSequenceEntry) GetBitmap() int {
+	return ezbin.Bitget[int](e, 3, 8)
+}
+func (e *IconSequenceEntry) SetBitmap(bitmap int) {
+	*e = ezbin.Bitset(*e, bitmap, 3, 8)
+}
+
+// Which of the 8 palettes to use
+func (e IconSequenceEntry) GetPalette() int {
+	return ezbin.Bitget[int](e, 3, 11)
+}
+func (e *IconSequenceEntry) SetPalette(palette int) {
+	*e = ezbin.Bitset(*e, palette, 3, 11)
+}
+
+// If the bitmap should be mirrored or not
+func (e IconSequenceEntry) GetFlipX() bool {
+	return ezbin.BitgetFlag(e, 14)
+}
+func (e *IconSequenceEntry) SetFlipX(flipX bool) {
+	*e = ezbin.BitsetFlag(*e, flipX, 14)
+}
+
+// If the bitmap should be flipped or not
+func (e IconSequenceEntry) GetFlipY() bool {
+	return ezbin.BitgetFlag(e, 15)
+}
+func (e *IconSequenceEntry) SetFlipY(flipY bool) {
+	*e = ezbin.BitsetFlag(*e, flipY, 15)
+}
+
+// A single frame of an animated DSi icon.
+type AnimatedIconFrame struct {
+	// The frame, with flipping already applied
+	Image *image.Paletted
+
+	// How long to show this frame, in 60 Hz frames
+	Duration int
+
+	// Bitmap and palette used, and how the bitmap is flipped
+	Bitmap  int
+	Palette int
+	FlipX   bool
+	FlipY   bool
+}
+
+// Get all frames of the animation, in order.
+func (a *bannerAnimation) frames() []AnimatedIconFrame {
+	frames := make([]AnimatedIconFrame, 0, len(a.sequence))
+	for _, entry := range a.sequence {
+		if entry.GetDuration() == 0 {
+			break
+		}
+
+		// Render frame
+		tiles := DeserializeTiles4BPP(a.bitmaps[entry.GetBitmap()][:])
+		palette := DeserializePalette(a.palettes[entry.GetPalette()][:], true)
+		img := image.NewPaletted(image.Rect(0, 0, 32, 32), palette)
+		for i := range tiles {
+			x := 8 * (i & 3)
+			y := 8 * (i >> 2)
+			if entry.GetFlipX() {
+				x = 24 - x
+			}
+			if entry.GetFlipY() {
+				y = 24 - y
+			}
+			DrawTileSamePalette(img, &tiles[i], x, y, entry.GetFlipX(), entry.GetFlipY())
+		}
+
+		frames = append(frames, AnimatedIconFrame{
+			Image:    img,
+			Duration: entry.GetDuration(),
+			Bitmap:   entry.GetBitmap(),
+			Palette:  entry.GetPalette(),
+			FlipX:    entry.GetFlipX(),
+			FlipY:    entry.GetFlipY(),
+		})
+	}
+	return frames
+}
+
+// Convert animation to a looping GIF.
+func (a *bannerAnimation) toGIF() *gif.GIF {
+	frames := a.frames()
+	g := &gif.GIF{
+		Image:    make([]*image.Paletted, len(frames)),
+		Delay:    make([]int, len(frames)),
+		Disposal: make([]byte, len(frames)),
+		Config: image.Config{
+			Width:  32,
+			Height: 32,
+		},
+	}
+	for i, frame := range frames {
+		g.Image[i] = frame.Image
+		g.Delay[i] = int(math.Round(float64(frame.Duration) * 100 / 60))
+		g.Disposal[i] = gif.DisposalBackground
+	}
+	if len(frames) != 0 {
+		g.Config.ColorModel = frames[0].Image.Palette
+	}
+	return g
+}
+
+// Build an animation from a GIF.
+// Frames are deduplicated, and bitmaps share palettes where possible.
+func animationFromGIF(g *gif.GIF) (*bannerAnimation, error) {
+	if len(g.Image) == 0 {
+		return nil, fmt.Errorf("animated icon: GIF has no frames")
+	}
+	if g.Config.Width != 0 && (g.Config.Width != 32 || g.Config.Height != 32) {
+		return nil, fmt.Errorf("animated icon: GIF should be exactly 32x32 pixels")
+	}
+
+	a := &bannerAnimation{}
+	palettes := make([][]uint16, 0, 8)
+	bitmaps := make(map[[0x200]byte]int)
+	numSteps := 0
+
+	canvas := image.NewRGBA(image.Rect(0, 0, 32, 32))
+	previous := image.NewRGBA(canvas.Rect)
+	for i, frame := range g.Image {
+		copy(previous.Pix, canvas.Pix)
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+
+		// Find colors used in frame
+		colors := make([]uint16, 0, 16)
+		pixels := make([]int, 32*32)
+		for y := range 32 {
+			for x := range 32 {
+				c := canvas.RGBAAt(x, y)
+				if c.A == 0 {
+					pixels[x+y*32] = -1
+					continue
+				}
+				if c.A != 255 {
+					return nil, fmt.Errorf("animated icon: frame %d: pixels cannot have partial transparency", i)
+				}
+				rgb := uint16(c.R>>3) | uint16(c.G>>3)<<5 | uint16(c.B>>3)<<10
+				pixels[x+y*32] = int(rgb)
+				if !slices.Contains(colors, rgb) {
+					colors = append(colors, rgb)
+				}
+			}
+		}
+		if len(colors) > 15 {
+			return nil, fmt.Errorf("animated icon: frame %d: can only contain 15 colors + transparency", i)
+		}
+
+		// Find or create a palette with room for all colors
+		paletteId := -1
+		for j, palette := range palettes {
+			missing := 0
+			for _, c := range colors {
+				if !slices.Contains(palette[1:], c) {
+					missing++
+				}
+			}
+			if len(palette)+missing <= 16 {
+				paletteId = j
+				break
+			}
+		}
+		if paletteId == -1 {
+			if len(palettes) == len(a.palettes) {
+				return nil, fmt.Errorf("animated icon: frame %d: more than %d palettes needed", i, len(a.palettes))
+			}
+			paletteId = len(palettes)
+			palettes = append(palettes, []uint16{0})
+		}
+		for _, c := range colors {
+			if !slices.Contains(palettes[paletteId][1:], c) {
+				palettes[paletteId] = append(palettes[paletteId], c)
+			}
+		}
+
+		// Create bitmap
+		palette := palettes[paletteId]
+		tiles := make([]Tile, 16)
+		for j := range tiles {
+			for k := range 64 {
+				x := 8*(j&3) + (k & 7)
+				y := 8*(j>>2) + (k >> 3)
+				if pix := pixels[x+y*32]; pix != -1 {
+					tiles[j].Pix[k] = byte(slices.Index(palette[1:], uint16(pix)) + 1)
+				}
+			}
+		}
+		tileData, err := SerializeTiles4BPP(tiles)
+		if err != nil {
+			return nil, err
+		}
+
+		// Reuse identical bitmaps
+		var bitmap [0x200]byte
+		copy(bitmap[:], tileData)
+		bitmapId, ok := bitmaps[bitmap]
+		if !ok {
+			if len(bitmaps) == len(a.bitmaps) {
+				return nil, fmt.Errorf("animated icon: frame %d: more than %d bitmaps needed", i, len(a.bitmaps))
+			}
+			bitmapId = len(bitmaps)
+			bitmaps[bitmap] = bitmapId
+			a.bitmaps[bitmapId] = bitmap
+		}
+
+		// Add to sequence, long frames are split up
+		duration := 1
+		if i < len(g.Delay) {
+			duration = max(1, int(math.Round(float64(g.Delay[i])*60/100)))
+		}
+		for duration > 0 {
+			if numSteps == len(a.sequence) {
+				return nil, fmt.Errorf("animated icon: sequence longer than %d steps", len(a.sequence))
+			}
+			step := &a.sequence[numSteps]
+			step.SetDuration(min(duration, 0xFF))
+			step.SetBitmap(bitmapId)
+			step.SetPalette(paletteId)
+			duration -= 0xFF
+			numSteps++
+		}
+
+		// Dispose of frame
+		if i < len(g.Disposal) {
+			switch g.Disposal[i] {
+			case gif.DisposalBackground:
+				draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+			case gif.DisposalPrevious:
+				copy(canvas.Pix, previous.Pix)
+			}
+		}
+	}
+
+	// Serialize palettes
+	for i, palette := range palettes {
+		for j, c := range palette {
+			binary.LittleEndian.PutUint16(a.palettes[i][j*2:], c)
+		}
+	}
+
+	return a, nil
+}
@@ -0,0 +1,143 @@
+package nds
+
+import (
+	"image"
+	"image/color"
+	"image/gif"
+	"testing"
+)
+
+// Compare colors the way they are stored in banners, with 5 bits per channel.
+func sameBannerColor(a color.Color, b color.Color) bool {
+	ar, ag, ab, aa := a.RGBA()
+	br, bg, bb, ba := b.RGBA()
+	if aa == 0 || ba == 0 {
+		return aa == ba
+	}
+	return ar>>11 == br>>11 && ag>>11 == bg>>11 && ab>>11 == bb>>11
+}
+
+// Check that two 32x32 images look the same.
+func sameIcon(a image.Image, b image.Image) bool {
+	for y := range 32 {
+		for x := range 32 {
+			if !sameBannerColor(a.At(x, y), b.At(x, y)) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func TestBannerRoundTrip(t *testing.T) {
+	for _, twl := range []bool{false, true} {
+		rom, _ := testROM(t, twl)
+		version := uint16(BannerVersionKorean)
+		if twl {
+			version = BannerVersionDSi
+		}
+		if rom.GetBannerVersion() != version {
+			t.Errorf("DSi %t: got banner version %04X, expected %04X", twl, rom.GetBannerVersion(), version)
+		}
+		for language := range TitleLanguage_Count {
+			title, err := rom.GetTitle(language)
+			if expected := "Nintil\nTest ROM\n" + language.String(); err != nil || title != expected {
+				t.Errorf("DSi %t: got %q, %v, expected %q", twl, title, err, expected)
+			}
+		}
+		if !sameIcon(rom.GetIcon(), testIcon()) {
+			t.Errorf("DSi %t: icon differs", twl)
+		}
+	}
+
+	// Regular banners have no animated icon
+	rom, _ := testROM(t, false)
+	if _, err := rom.GetAnimatedIcon(); err == nil {
+		t.Errorf("expected an error")
+	}
+	if err := rom.SetAnimatedIconGIF(&gif.GIF{}); err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+// Animation with a repeated frame, a flipped frame and two palettes.
+func testAnimation() *gif.GIF {
+	palettes := []color.Palette{
+		{color.RGBA{}, color.RGBA{0xFF, 0x00, 0x00, 0xFF}, color.RGBA{0x00, 0xFF, 0x00, 0xFF}},
+		{color.RGBA{}, color.RGBA{0x00, 0x00, 0xFF, 0xFF}, color.RGBA{0x84, 0x84, 0x84, 0xFF}},
+	}
+	frame := func(palette color.Palette, flip bool) *image.Paletted {
+		img := image.NewPaletted(image.Rect(0, 0, 32, 32), palette)
+		for y := range 32 {
+			for x := range 16 {
+				if flip {
+					img.SetColorIndex(31-x, y, byte(1+y%2))
+				} else {
+					img.SetColorIndex(x, y, byte(1+y%2))
+				}
+			}
+		}
+		return img
+	}
+	return &gif.GIF{
+		Image: []*image.Paletted{
+			frame(palettes[0], false),
+			frame(palettes[1], true),
+			frame(palettes[0], false),
+		},
+		Delay:    []int{10, 20, 500},
+		Disposal: []byte{gif.DisposalBackground, gif.DisposalBackground, gif.DisposalBackground},
+	}
+}
+
+func TestAnimatedIconRoundTrip(t *testing.T) {
+	rom, _ := testROM(t, true)
+	g := testAnimation()
+	if err := rom.SetAnimatedIconGIF(g); err != nil {
+		t.Fatal(err)
+	}
+	saved, _ := saveAndOpenROM(t, rom)
+
+	// Long frames are split into steps of at most 255 frames
+	frames, err := saved.GetAnimatedIcon()
+	if err != nil {
+		t.Fatal(err)
+	}
+	durations := []int{6, 12, 255, 45}
+	images := []int{0, 1, 2, 2}
+	if len(frames) != len(durations) {
+		t.Fatalf("got %d frames, expected %d", len(frames), len(durations))
+	}
+	for i, frame := range frames {
+		if frame.Duration != durations[i] {
+			t.Errorf("frame %d: got duration %d, expected %d", i, frame.Duration, durations[i])
+		}
+		if !sameIcon(frame.Image, g.Image[images[i]]) {
+			t.Errorf("frame %d: image differs", i)
+		}
+	}
+	if frames[0].Bitmap != frames[2].Bitmap || frames[0].Palette != frames[2].Palette {
+		t.Errorf("repeated frame was not reused")
+	}
+
+	// Converting to a GIF and back gives the same animation
+	converted, err := saved.GetAnimatedIconGIF()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := saved.SetAnimatedIconGIF(converted); err != nil {
+		t.Fatal(err)
+	}
+	again, err := saved.GetAnimatedIcon()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(again) != len(frames) {
+		t.Fatalf("got %d frames, expected %d", len(again), len(frames))
+	}
+	for i := range frames {
+		if again[i].Duration != frames[i].Duration || !sameIcon(again[i].Image, frames[i].Image) {
+			t.Errorf("frame %d differs after GIF round trip", i)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package nds
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/sukus21/nintil/nds/key1"
+	"github.com/sukus21/nintil/util"
+)
+
+// The secure area checksum covers this region of the ROM
+const (
+	secureAreaStart = 0x4000
+	secureAreaSize  = 0x4000
+)
+
+var ErrNoSecureAreaChecksum = errors.New("secure area checksum cannot be checked")
+var ErrSecureAreaKeyTable = errors.New("decrypted secure area needs a KEY1 key table")
+
+// Compute the secure area checksum of a ROM image.
+// This is the CRC16 of ROM region 0x4000..0x7FFF, with the secure area encrypted.
+// A secure area that is not decrypted is taken to be encrypted already.
+// A decrypted secure area is encrypted first, which needs a KEY1 key table, table may be nil otherwise.
+// Returns ErrNoSecureAreaChecksum if the ARM9 binary does not start at 0x4000 or the header has no checksum.
+// A decrypted secure area without a key table also returns ErrSecureAreaKeyTable.
+func SecureAreaCRC(h *Header, r io.ReaderAt, table *key1.KeyTable) (uint16, error) {
+	buf := make([]byte, secureAreaSize)
+	if n, err := r.ReadAt(buf, secureAreaStart); n != len(buf) {
+		return 0, fmt.Errorf("secure area checksum: %w", util.TranslateEOF(err))
+	}
+	return secureAreaCRC(h, buf, table)
+}
+
+// Compute the secure area checksum from the contents of ROM region 0x4000..0x7FFF.
+func secureAreaCRC(h *Header, data []byte, table *key1.KeyTable) (uint16, error) {
+	fail := func(reason string) (uint16, error) {
+		return 0, fmt.Errorf("secure area checksum: %w: %s", ErrNoSecureAreaChecksum, reason)
+	}
+	if h.Arm9RomOffset != secureAreaStart {
+		return fail("ARM9 binary does not start at the secure area")
+	}
+	if h.secureAreaChecksum == 0 {
+		return fail("header has no checksum")
+	}
+
+	if state, _ := key1.SecureAreaState(nil, h.GameCode, data); state != key1.StateDecrypted {
+		return CRC16(data), nil
+	}
+	if table == nil {
+		return 0, fmt.Errorf("secure area checksum: %w: %w", ErrNoSecureAreaChecksum, ErrSecureAreaKeyTable)
+	}
+	encrypted := slices.Clone(data)
+	if err := key1.EncryptSecureArea(table, h.GameCode, encrypted); err != nil {
+		return 0, fmt.Errorf("secure area checksum: %w", err)
+	}
+	return CRC16(encrypted), nil
+}
+
+// Compute the checksum of a compressed Nintendo logo.
+func LogoCRC(logo [LogoSize]byte) uint16 {
+	return CRC16(logo[:])
+}
+
+// Recompute the Nintendo logo checksum.
+func (h *Header) UpdateLogoChecksum() {
+	h.nintendoLogoCrc = LogoCRC(h.nintendoLogo)
+}
+
+// Get the checksums that did not match when the ROM was opened.
+// Returns an empty list if all checksums match, or if the ROM was not opened with OpenROM.
+func (o *Rom) ChecksumMismatches() []Diagnostic {
+	return o.checksumMismatches
+}
+
+// Keeps a copy of everything written to a region of the underlying writer.
+// Regions that are never written to are left as zeroes.
+type regionCapture struct {
+	util.WriteAtSeeker
+	start int64
+	buf   []byte
+}
+
+func newRegionCapture(w util.WriteAtSeeker, start int64, size int) *regionCapture {
+	return &regionCapture{
+		WriteAtSeeker: w,
+		start:         start,
+		buf:           make([]byte, size),
+	}
+}
+
+func (c *regionCapture) Write(p []byte) (int, error) {
+	if pos, err := c.Seek(0, io.SeekCurrent); err == nil {
+		c.capture(p, pos)
+	}
+	return c.WriteAtSeeker.Write(p)
+}
+
+func (c *regionCapture) WriteAt(p []byte, off int64) (int, error) {
+	c.capture(p, off)
+	return c.WriteAtSeeker.WriteAt(p, off)
+}
+
+func (c *regionCapture) capture(p []byte, off int64) {
+	from := max(off, c.start)
+	to := min(off+int64(len(p)), c.start+int64(len(c.buf)))
+	if from < to {
+		copy(c.buf[from-c.start:to-c.start], p[from-off:to-off])
+	}
+}
@@ -0,0 +1,138 @@
+package nds
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/sukus21/nintil/nds/key1"
+)
+
+// Generate a KEY1 key table.
+// The real one is not needed, KEY1 works with any table.
+func testKeyTable(t *testing.T) *key1.KeyTable {
+	t.Helper()
+	table, err := key1.OpenKeyTable(bytes.NewReader(testData(8, key1.KeyTableSize)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return table
+}
+
+// Get the test ROM with a decrypted secure area and a secure area checksum.
+func testSecureROM(t *testing.T) *Rom {
+	t.Helper()
+	rom, _ := testROM(t, false)
+	copy(rom.Arm9Binary, "\xFF\xDE\xFF\xE7\xFF\xDE\xFF\xE7")
+	rom.GetHeader().SetSecureAreaChecksum(0x1234)
+	return rom
+}
+
+// Check the kinds of checksum mismatches of a ROM.
+func checkMismatches(t *testing.T, name string, rom *Rom, expected ...DiagnosticKind) {
+	t.Helper()
+	mismatches := rom.ChecksumMismatches()
+	kinds := make([]DiagnosticKind, len(mismatches))
+	for i, d := range mismatches {
+		kinds[i] = d.Kind
+	}
+	if !slices.Equal(kinds, expected) {
+		t.Errorf("%s: got %v, expected %v", name, mismatches, expected)
+	}
+}
+
+func TestFixedChecksums(t *testing.T) {
+	rom, _ := testROM(t, false)
+	h := rom.GetHeader()
+	logoCrc := h.LogoChecksum()
+	h.SetLogoChecksum(logoCrc ^ 1)
+	h.HeaderChecksum = 0
+
+	// Header checksum is always recomputed
+	saved, data := saveAndOpenROM(t, rom)
+	checkMismatches(t, "kept", saved, DiagnosticLogoChecksum)
+	if crc := CRC16(data[:0x15E]); saved.GetHeader().HeaderChecksum != crc {
+		t.Errorf("got header checksum %04X, expected %04X", saved.GetHeader().HeaderChecksum, crc)
+	}
+	if saved.GetHeader().LogoChecksum() != logoCrc^1 {
+		t.Errorf("logo checksum was changed")
+	}
+
+	saved, _ = saveAndOpenROM(t, rom, WithFixedChecksums())
+	checkMismatches(t, "fixed", saved)
+	if saved.GetHeader().LogoChecksum() != logoCrc {
+		t.Errorf("got logo checksum %04X, expected %04X", saved.GetHeader().LogoChecksum(), logoCrc)
+	}
+
+	// Without a key table, a secure area that is not decrypted is taken to be encrypted
+	h.SetSecureAreaChecksum(0x1234)
+	saved, _ = saveAndOpenROM(t, rom)
+	checkMismatches(t, "secure area", saved, DiagnosticLogoChecksum, DiagnosticSecureAreaChecksum)
+	saved, data = saveAndOpenROM(t, rom, WithFixedChecksums())
+	checkMismatches(t, "fixed secure area", saved)
+	if crc := CRC16(data[secureAreaStart : secureAreaStart+secureAreaSize]); saved.GetHeader().SecureAreaChecksum() != crc {
+		t.Errorf("got secure area checksum %04X, expected %04X", saved.GetHeader().SecureAreaChecksum(), crc)
+	}
+
+	// Without a checksum in the header, there is nothing to check
+	h.SetSecureAreaChecksum(0)
+	saved, _ = saveAndOpenROM(t, rom, WithFixedChecksums())
+	if saved.GetHeader().SecureAreaChecksum() != 0 {
+		t.Errorf("got secure area checksum %04X, expected none", saved.GetHeader().SecureAreaChecksum())
+	}
+}
+
+func TestFixedSecureAreaChecksum(t *testing.T) {
+	table := testKeyTable(t)
+	rom := testSecureROM(t)
+	arm9 := bytes.Clone(rom.Arm9Binary)
+
+	// Encrypted while saving
+	buf := &bytes.Buffer{}
+	if err := SaveROM(rom, buf, WithSecureAreaEncryption(table), WithFixedChecksums()); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := OpenROM(bytes.NewReader(buf.Bytes()), WithSecureAreaDecryption(table))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkMismatches(t, "encrypted", saved)
+	if crc := CRC16(buf.Bytes()[secureAreaStart : secureAreaStart+secureAreaSize]); saved.GetHeader().SecureAreaChecksum() != crc {
+		t.Errorf("got secure area checksum %04X, expected %04X", saved.GetHeader().SecureAreaChecksum(), crc)
+	}
+	if !bytes.Equal(saved.Arm9Binary, arm9) {
+		t.Errorf("ARM9 binary differs after decryption")
+	}
+
+	// Recomputed from the already encrypted secure area
+	buf.Reset()
+	saved.GetHeader().SetSecureAreaChecksum(1)
+	if err := SaveROM(saved, buf, WithSecureAreaEncryption(table), WithFixedChecksums()); err != nil {
+		t.Fatal(err)
+	}
+	resaved, err := OpenROM(bytes.NewReader(buf.Bytes()), WithSecureAreaDecryption(table))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkMismatches(t, "resaved", resaved)
+
+	// Saved decrypted, the checksum cannot be recomputed
+	buf.Reset()
+	if err := SaveROM(rom, buf, WithFixedChecksums()); !errors.Is(err, ErrSecureAreaKeyTable) {
+		t.Errorf("got %v, expected %v", err, ErrSecureAreaKeyTable)
+	}
+
+	// And is reported when opening, if a key table is given
+	if err := SaveROM(rom, buf); err != nil {
+		t.Fatal(err)
+	}
+	decrypted, err := OpenROM(bytes.NewReader(buf.Bytes()), WithSecureAreaDecryption(table))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkMismatches(t, "decrypted", decrypted, DiagnosticSecureAreaChecksum)
+	if _, err := SecureAreaCRC(decrypted.GetHeader(), bytes.NewReader(buf.Bytes()), nil); !errors.Is(err, ErrSecureAreaKeyTable) {
+		t.Errorf("got %v, expected %v", err, ErrSecureAreaKeyTable)
+	}
+}
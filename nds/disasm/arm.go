@@ -0,0 +1,373 @@
+package disasm
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+var dataProcessingNames = [16]string{
+	"and", "eor", "sub", "rsb", "add", "adc", "sbc", "rsc",
+	"tst", "teq", "cmp", "cmn", "orr", "mov", "bic", "mvn",
+}
+
+func (d *decoder) decodeARM(w uint32, address uint32) Instruction {
+	ins := Instruction{
+		Address: address,
+		Mode:    ModeARM,
+		Size:    4,
+		Raw:     w,
+	}
+	cond := w >> 28
+	if cond == 0xF {
+		d.armUnconditional(&ins)
+		return ins
+	}
+
+	c := condNames[cond]
+	switch (w >> 25) & 7 {
+	case 0:
+		switch {
+		case w&0x90 == 0x90:
+			d.armMultiplyOrExtraLoadStore(&ins, c)
+		case w&0x01900000 == 0x01000000:
+			d.armMisc(&ins, c)
+		default:
+			d.armDataProcessing(&ins, c)
+		}
+	case 1:
+		switch {
+		case w&0x01B00000 == 0x01200000:
+			ins.set("msr"+c, "%s, %s", psrFields(w), imm(armImmediate(w)))
+		case w&0x01900000 == 0x01000000:
+			ins.undefined()
+		default:
+			d.armDataProcessing(&ins, c)
+		}
+	case 2:
+		d.armLoadStore(&ins, c)
+	case 3:
+		if bit(w, 4) {
+			ins.undefined()
+		} else {
+			d.armLoadStore(&ins, c)
+		}
+	case 4:
+		d.armBlockTransfer(&ins, c)
+	case 5:
+		offset := uint32(int32(w<<8) >> 6)
+		ins.Branch = &Branch{
+			Target: address + 8 + offset,
+			Mode:   ModeARM,
+			Link:   bit(w, 24),
+		}
+		ins.set(flag(bit(w, 24), "bl")+flag(!bit(w, 24), "b")+c, "%s", target(ins.Branch.Target))
+	case 6:
+		d.armCoprocessorLoadStore(&ins, "", c)
+	case 7:
+		if bit(w, 24) {
+			ins.set("swi"+c, "%s", imm(w&0xFFFFFF))
+		} else {
+			d.armCoprocessor(&ins, "", c)
+		}
+	}
+	return ins
+}
+
+// Instructions with the condition field set to 0b1111, only in ARMv5.
+func (d *decoder) armUnconditional(ins *Instruction) {
+	w := ins.Raw
+	if !d.v5() {
+		ins.undefined()
+		return
+	}
+
+	switch {
+	case w&0x0E000000 == 0x0A000000:
+		offset := uint32(int32(w<<8)>>6) | (w>>23)&2
+		ins.Branch = &Branch{
+			Target: ins.Address + 8 + offset,
+			Mode:   ModeThumb,
+			Link:   true,
+		}
+		ins.set("blx", "%s", target(ins.Branch.Target))
+	case w&0x0D70F000 == 0x0550F000:
+		ins.set("pld", "%s", armAddressMode2(w))
+	case w&0x0F000000 == 0x0E000000:
+		d.armCoprocessor(ins, "2", "")
+	case w&0x0E000000 == 0x0C000000:
+		d.armCoprocessorLoadStore(ins, "2", "")
+	default:
+		ins.undefined()
+	}
+}
+
+// Get the rotated immediate of a data processing instruction.
+func armImmediate(w uint32) uint32 {
+	return bits.RotateLeft32(w&0xFF, -int((w>>8)&0xF)*2)
+}
+
+// Format the shifted register operand of a data processing or load/store instruction.
+func armShiftedRegister(w uint32) string {
+	rm := reg(w)
+	shift := (w >> 5) & 3
+	if bit(w, 4) {
+		return fmt.Sprintf("%s, %s %s", rm, shiftNames[shift], reg(w>>8))
+	}
+
+	amount := (w >> 7) & 0x1F
+	switch {
+	case shift == 0 && amount == 0:
+		return rm
+	case shift == 3 && amount == 0:
+		return rm + ", rrx"
+	case amount == 0:
+		amount = 32
+	}
+	return fmt.Sprintf("%s, %s #%d", rm, shiftNames[shift], amount)
+}
+
+// Format the fields of an MSR instruction.
+func psrFields(w uint32) string {
+	psr := "cpsr_"
+	if bit(w, 22) {
+		psr = "spsr_"
+	}
+	for i, field := range []string{"f", "s", "x", "c"} {
+		if bit(w, 19-i) {
+			psr += field
+		}
+	}
+	return psr
+}
+
+func (d *decoder) armDataProcessing(ins *Instruction, c string) {
+	w := ins.Raw
+	op := (w >> 21) & 0xF
+	s := flag(bit(w, 20), "s")
+	rn, rd := (w>>16)&0xF, (w>>12)&0xF
+
+	operand := armShiftedRegister(w)
+	if bit(w, 25) {
+		operand = imm(armImmediate(w))
+	}
+
+	name := dataProcessingNames[op]
+	switch op {
+	case 0x8, 0x9, 0xA, 0xB:
+		ins.set(name+c, "%s, %s", reg(rn), operand)
+	case 0xD, 0xF:
+		ins.set(name+s+c, "%s, %s", reg(rd), operand)
+	default:
+		ins.set(name+s+c, "%s, %s, %s", reg(rd), reg(rn), operand)
+	}
+}
+
+// Multiplies, swaps, and halfword, signed byte and doubleword loads and stores.
+func (d *decoder) armMultiplyOrExtraLoadStore(ins *Instruction, c string) {
+	w := ins.Raw
+	rn, rd, rs, rm := (w>>16)&0xF, (w>>12)&0xF, (w>>8)&0xF, w&0xF
+	s := flag(bit(w, 20), "s")
+
+	if w&0x60 == 0 {
+		switch {
+		case w&0x0FC00000 == 0:
+			if bit(w, 21) {
+				ins.set("mla"+s+c, "%s, %s, %s, %s", reg(rn), reg(rm), reg(rs), reg(rd))
+			} else {
+				ins.set("mul"+s+c, "%s, %s, %s", reg(rn), reg(rm), reg(rs))
+			}
+		case w&0x0F800000 == 0x00800000:
+			name := []string{"umull", "umlal", "smull", "smlal"}[(w>>21)&3]
+			ins.set(name+s+c, "%s, %s, %s, %s", reg(rd), reg(rn), reg(rm), reg(rs))
+		case w&0x0FB00FF0 == 0x01000090:
+			ins.set("swp"+flag(bit(w, 22), "b")+c, "%s, %s, [%s]", reg(rd), reg(rm), reg(rn))
+		default:
+			ins.undefined()
+		}
+		return
+	}
+
+	pre, up, immediate, writeback, load := bit(w, 24), bit(w, 23), bit(w, 22), bit(w, 21), bit(w, 20)
+	var name string
+	size := 0
+	switch sh := (w >> 5) & 3; {
+	case load:
+		name = []string{"", "ldrh", "ldrsb", "ldrsh"}[sh]
+		size = []int{0, 2, 1, 2}[sh]
+	case sh == 1:
+		name = "strh"
+	case d.v5():
+		name = []string{"", "", "ldrd", "strd"}[sh]
+	default:
+		ins.undefined()
+		return
+	}
+
+	offset, value := "", uint32(0)
+	if immediate {
+		value = (w>>4)&0xF0 | w&0xF
+		offset = offsetImm(value, up)
+	} else {
+		offset = flag(!up, "-") + reg(rm)
+	}
+	operand := memOperand(rn, pre, writeback, offset, immediate && value == 0 && up)
+
+	if name == "ldrd" || name == "strd" {
+		ins.set(name+c, "%s, %s, %s", reg(rd), reg(rd+1), operand)
+	} else {
+		ins.set(name+c, "%s, %s", reg(rd), operand)
+	}
+	if size != 0 && rn == 15 && pre && immediate && !writeback {
+		address := ins.Address + 8 + value
+		if !up {
+			address = ins.Address + 8 - value
+		}
+		ins.Literal = d.literal(address, size)
+	}
+}
+
+// Status register transfers, BX, BLX, CLZ, BKPT, saturating arithmetic and signed halfword multiplies.
+func (d *decoder) armMisc(ins *Instruction, c string) {
+	w := ins.Raw
+	rn, rd, rs, rm := (w>>16)&0xF, (w>>12)&0xF, (w>>8)&0xF, w&0xF
+	xy := func(n int) string {
+		return flag(bit(w, n), "t") + flag(!bit(w, n), "b")
+	}
+
+	switch {
+	case w&0x0FBF0FFF == 0x010F0000:
+		ins.set("mrs"+c, "%s, %s", reg(rd), flag(bit(w, 22), "spsr")+flag(!bit(w, 22), "cpsr"))
+	case w&0x0FB0FFF0 == 0x0120F000:
+		ins.set("msr"+c, "%s, %s", psrFields(w), reg(rm))
+	case w&0x0FFFFFF0 == 0x012FFF10:
+		ins.set("bx"+c, "%s", reg(rm))
+	case !d.v5():
+		ins.undefined()
+	case w&0x0FFFFFF0 == 0x012FFF30:
+		ins.set("blx"+c, "%s", reg(rm))
+	case w&0x0FFF0FF0 == 0x016F0F10:
+		ins.set("clz"+c, "%s, %s", reg(rd), reg(rm))
+	case w&0xFFF000F0 == 0xE1200070:
+		ins.set("bkpt", "%s", imm((w>>4)&0xFFF0|w&0xF))
+	case w&0x0F900FF0 == 0x01000050:
+		name := []string{"qadd", "qsub", "qdadd", "qdsub"}[(w>>21)&3]
+		ins.set(name+c, "%s, %s, %s", reg(rd), reg(rm), reg(rn))
+	case w&0x0F900090 == 0x01000080:
+		switch (w >> 21) & 3 {
+		case 0:
+			ins.set("smla"+xy(5)+xy(6)+c, "%s, %s, %s, %s", reg(rn), reg(rm), reg(rs), reg(rd))
+		case 1:
+			if bit(w, 5) {
+				ins.set("smulw"+xy(6)+c, "%s, %s, %s", reg(rn), reg(rm), reg(rs))
+			} else {
+				ins.set("smlaw"+xy(6)+c, "%s, %s, %s, %s", reg(rn), reg(rm), reg(rs), reg(rd))
+			}
+		case 2:
+			ins.set("smlal"+xy(5)+xy(6)+c, "%s, %s, %s, %s", reg(rd), reg(rn), reg(rm), reg(rs))
+		case 3:
+			ins.set("smul"+xy(5)+xy(6)+c, "%s, %s, %s", reg(rn), reg(rm), reg(rs))
+		}
+	default:
+		ins.undefined()
+	}
+}
+
+// Format the address of a word or unsigned byte load/store.
+func armAddressMode2(w uint32) string {
+	pre, up, writeback := bit(w, 24), bit(w, 23), bit(w, 21)
+	rn := (w >> 16) & 0xF
+	if bit(w, 25) {
+		return memOperand(rn, pre, writeback, flag(!up, "-")+armShiftedRegister(w), false)
+	}
+	value := w & 0xFFF
+	return memOperand(rn, pre, writeback, offsetImm(value, up), value == 0 && up)
+}
+
+// Word and unsigned byte loads and stores.
+func (d *decoder) armLoadStore(ins *Instruction, c string) {
+	w := ins.Raw
+	pre, byteSize, writeback, load := bit(w, 24), bit(w, 22), bit(w, 21), bit(w, 20)
+	rn, rd := (w>>16)&0xF, (w>>12)&0xF
+
+	name := flag(load, "ldr") + flag(!load, "str") + flag(byteSize, "b") + flag(!pre && writeback, "t")
+	ins.set(name+c, "%s, %s", reg(rd), armAddressMode2(w))
+
+	if load && rn == 15 && pre && !writeback && !bit(w, 25) {
+		address := ins.Address + 8 + w&0xFFF
+		if !bit(w, 23) {
+			address = ins.Address + 8 - w&0xFFF
+		}
+		size := 4
+		if byteSize {
+			size = 1
+		}
+		ins.Literal = d.literal(address, size)
+	}
+}
+
+// Load and store multiple.
+func (d *decoder) armBlockTransfer(ins *Instruction, c string) {
+	w := ins.Raw
+	userMode, writeback, load := bit(w, 22), bit(w, 21), bit(w, 20)
+	rn := (w >> 16) & 0xF
+	list := w & 0xFFFF
+	mode := []string{"da", "", "db", "ib"}[(w>>23)&3]
+
+	// Stack operations
+	if rn == 13 && writeback && !userMode && bits.OnesCount32(list) > 1 {
+		if load && mode == "" {
+			ins.set("pop"+c, "%s", regList(list))
+			return
+		}
+		if !load && mode == "db" {
+			ins.set("push"+c, "%s", regList(list))
+			return
+		}
+	}
+
+	name := flag(load, "ldm") + flag(!load, "stm") + mode
+	ins.set(name+c, "%s%s, %s%s", reg(rn), flag(writeback, "!"), regList(list), flag(userMode, "^"))
+}
+
+// Coprocessor data operations and register transfers.
+// suffix is "2" for the unconditional ARMv5 variants.
+func (d *decoder) armCoprocessor(ins *Instruction, suffix string, c string) {
+	w := ins.Raw
+	cp := (w >> 8) & 0xF
+	crn, crd, crm := (w>>16)&0xF, (w>>12)&0xF, w&0xF
+	op2 := (w >> 5) & 7
+
+	if !bit(w, 4) {
+		ins.set("cdp"+suffix+c, "p%d, %d, c%d, c%d, c%d, %d", cp, (w>>20)&0xF, crd, crn, crm, op2)
+		return
+	}
+	name := flag(bit(w, 20), "mrc") + flag(!bit(w, 20), "mcr")
+	ins.set(name+suffix+c, "p%d, %d, %s, c%d, c%d, %d", cp, (w>>21)&7, reg(crd), crn, crm, op2)
+}
+
+// Coprocessor loads and stores.
+// suffix is "2" for the unconditional ARMv5 variants.
+func (d *decoder) armCoprocessorLoadStore(ins *Instruction, suffix string, c string) {
+	w := ins.Raw
+	pre, up, long, writeback, load := bit(w, 24), bit(w, 23), bit(w, 22), bit(w, 21), bit(w, 20)
+	rn, crd, cp := (w>>16)&0xF, (w>>12)&0xF, (w>>8)&0xF
+	value := (w & 0xFF) * 4
+
+	// Unindexed with a negative offset is MCRR and MRRC instead
+	if !pre && !up && !writeback {
+		if suffix != "" || !long || !d.v5() {
+			ins.undefined()
+			return
+		}
+		name := flag(load, "mrrc") + flag(!load, "mcrr")
+		ins.set(name+c, "p%d, %d, %s, %s, c%d", cp, (w>>4)&0xF, reg(crd), reg(rn), w&0xF)
+		return
+	}
+
+	name := flag(load, "ldc") + flag(!load, "stc") + suffix + flag(long, "l") + c
+	if !pre && !writeback {
+		ins.set(name, "p%d, c%d, [%s], {%d}", cp, crd, reg(rn), w&0xFF)
+		return
+	}
+	ins.set(name, "p%d, c%d, %s", cp, crd, memOperand(rn, pre, writeback, offsetImm(value, up), value == 0 && up))
+}
@@ -0,0 +1,209 @@
+// ARM and Thumb disassembler for the ARM946E-S (ARMv5TE) and ARM7TDMI (ARMv4T) CPUs of the Nintendo DS.
+// Mnemonics use unified ARM assembly syntax, in lowercase.
+package disasm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Instruction set.
+type Mode int
+
+const (
+	ModeARM Mode = iota
+	ModeThumb
+)
+
+func (m Mode) String() string {
+	if m == ModeThumb {
+		return "Thumb"
+	}
+	return "ARM"
+}
+
+// Architecture version, decides which instructions exist.
+type Arch int
+
+const (
+	// ARM9 of the Nintendo DS
+	ARMv5TE Arch = iota
+
+	// ARM7 of the Nintendo DS
+	ARMv4T
+)
+
+// Target of a branch with an immediate offset.
+type Branch struct {
+	Target uint32
+
+	// Instruction set at the target, BLX switches it
+	Mode Mode
+
+	// Does the branch set the link register?
+	Link bool
+}
+
+// Value loaded by a PC-relative load, usually from a literal pool.
+type Literal struct {
+	Address uint32
+	Size    int
+	Value   uint32
+
+	// Could the value be read? If not, Value is 0
+	Known bool
+}
+
+// Disassembled instruction.
+type Instruction struct {
+	Address uint32
+	Mode    Mode
+
+	// Size in bytes, 4 for ARM instructions, 2 or 4 for Thumb instructions.
+	// A 4 byte Thumb instruction is a BL or BLX pair.
+	Size int
+
+	// Instruction bits.
+	// For Thumb BL and BLX pairs, the first halfword is in the upper 16 bits.
+	Raw uint32
+
+	Mnemonic string
+	Args     string
+
+	// Set for undefined instructions, Mnemonic is then "undefined"
+	Undefined bool
+
+	// Set for branches with an immediate target
+	Branch *Branch
+
+	// Set for PC-relative loads
+	Literal *Literal
+}
+
+func (i Instruction) String() string {
+	s := i.Mnemonic
+	if i.Args != "" {
+		s += " " + i.Args
+	}
+	if i.Literal != nil && i.Literal.Known {
+		s += fmt.Sprintf(" ; =0x%08X", i.Literal.Value)
+	}
+	return s
+}
+
+// Options for Disassemble and Decode.
+type Option func(*decoder)
+
+// Only decode instructions that exist in arch.
+// The default is ARMv5TE, the ARM9.
+func WithArch(arch Arch) Option {
+	return func(d *decoder) {
+		d.arch = arch
+	}
+}
+
+// Read literal pool values from memory, with RAM addresses as offsets.
+// Values within the code being disassembled are always read from the code itself.
+func WithMemory(r io.ReaderAt) Option {
+	return func(d *decoder) {
+		d.memory = r
+	}
+}
+
+type decoder struct {
+	arch   Arch
+	memory io.ReaderAt
+
+	// Code being disassembled, and its address
+	code    []byte
+	address uint32
+}
+
+func newDecoder(code []byte, address uint32, opts []Option) *decoder {
+	d := &decoder{
+		code:    code,
+		address: address,
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+func (d *decoder) v5() bool {
+	return d.arch == ARMv5TE
+}
+
+// Read a literal value.
+func (d *decoder) literal(address uint32, size int) *Literal {
+	lit := &Literal{Address: address, Size: size}
+	buf := make([]byte, 4)
+	if rel := address - d.address; address >= d.address && uint64(rel)+uint64(size) <= uint64(len(d.code)) {
+		copy(buf, d.code[rel:rel+uint32(size)])
+	} else if d.memory == nil {
+		return lit
+	} else if n, _ := d.memory.ReadAt(buf[:size], int64(address)); n != size {
+		return lit
+	}
+	lit.Value = binary.LittleEndian.Uint32(buf)
+	lit.Known = true
+	return lit
+}
+
+// Decode a single instruction at the start of code, which is located at address.
+// Returns io.ErrUnexpectedEOF if code is too short.
+func Decode(code []byte, address uint32, mode Mode, opts ...Option) (Instruction, error) {
+	d := newDecoder(code, address, opts)
+	return d.decode(0, mode)
+}
+
+func (d *decoder) decode(offset int, mode Mode) (Instruction, error) {
+	address := d.address + uint32(offset)
+	code := d.code[offset:]
+	if mode == ModeThumb {
+		if len(code) < 2 {
+			return Instruction{}, io.ErrUnexpectedEOF
+		}
+		first := binary.LittleEndian.Uint16(code)
+		second, hasSecond := uint16(0), len(code) >= 4
+		if hasSecond {
+			second = binary.LittleEndian.Uint16(code[2:])
+		}
+		return d.decodeThumb(first, second, hasSecond, address), nil
+	}
+
+	if len(code) < 4 {
+		return Instruction{}, io.ErrUnexpectedEOF
+	}
+	return d.decodeARM(binary.LittleEndian.Uint32(code), address), nil
+}
+
+// Disassemble code located at address, one instruction after the other.
+// A trailing partial instruction is left out.
+func Disassemble(code []byte, address uint32, mode Mode, opts ...Option) []Instruction {
+	d := newDecoder(code, address, opts)
+	var out []Instruction
+	for offset := 0; ; {
+		ins, err := d.decode(offset, mode)
+		if err != nil {
+			return out
+		}
+		out = append(out, ins)
+		offset += ins.Size
+	}
+}
+
+// Format instructions as a listing, one instruction per line, prefixed with its address and raw bits.
+func Listing(instructions []Instruction) string {
+	sb := &strings.Builder{}
+	for _, ins := range instructions {
+		raw := fmt.Sprintf("%08X", ins.Raw)
+		if ins.Size == 2 {
+			raw = fmt.Sprintf("%04X    ", ins.Raw)
+		}
+		fmt.Fprintf(sb, "%08X: %s  %s\n", ins.Address, raw, ins)
+	}
+	return sb.String()
+}
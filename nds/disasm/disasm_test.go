@@ -0,0 +1,196 @@
+package disasm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+// Code placed after every tested instruction, read by PC-relative loads.
+var testPool = []byte{0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88, 1, 2, 3, 4, 5, 6, 7, 8}
+
+// Encode an instruction followed by testPool.
+// Thumb BL and BLX pairs have the first halfword in the upper 16 bits, like Instruction.Raw.
+func testCode(raw uint32, mode Mode) []byte {
+	var code []byte
+	switch {
+	case mode == ModeARM:
+		code = binary.LittleEndian.AppendUint32(nil, raw)
+	case raw > 0xFFFF:
+		code = binary.LittleEndian.AppendUint16(nil, uint16(raw>>16))
+		code = binary.LittleEndian.AppendUint16(code, uint16(raw))
+	default:
+		code = binary.LittleEndian.AppendUint16(nil, uint16(raw))
+	}
+	return append(code, testPool...)
+}
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		raw     uint32
+		address uint32
+		mode    Mode
+		arch    Arch
+		text    string
+		size    int
+		branch  *Branch
+		literal *Literal
+	}{
+		// ARM
+		{0xE3A00001, 0x02000000, ModeARM, ARMv5TE, "mov r0, #1", 4, nil, nil},
+		{0xE0810002, 0x02000000, ModeARM, ARMv5TE, "add r0, r1, r2", 4, nil, nil},
+		{0xE3500000, 0x02000000, ModeARM, ARMv5TE, "cmp r0, #0", 4, nil, nil},
+		{0xE0000291, 0x02000000, ModeARM, ARMv5TE, "mul r0, r1, r2", 4, nil, nil},
+		{0xE12FFF1E, 0x02000000, ModeARM, ARMv5TE, "bx lr", 4, nil, nil},
+		{0xE92D4010, 0x02000000, ModeARM, ARMv5TE, "push {r4, lr}", 4, nil, nil},
+		{0xE8BD8010, 0x02000000, ModeARM, ARMv5TE, "pop {r4, pc}", 4, nil, nil},
+		{0xE5910004, 0x02000000, ModeARM, ARMv5TE, "ldr r0, [r1, #4]", 4, nil, nil},
+		{0xE1D000B2, 0x02000000, ModeARM, ARMv5TE, "ldrh r0, [r0, #2]", 4, nil, nil},
+		{0xEF000005, 0x02000000, ModeARM, ARMv5TE, "swi #5", 4, nil, nil},
+		{0xE7F000F0, 0x02000000, ModeARM, ARMv5TE, "undefined 0xE7F000F0", 4, nil, nil},
+
+		// ARM branches
+		{0xEB000000, 0x02000000, ModeARM, ARMv5TE, "bl 0x02000008", 4, &Branch{0x02000008, ModeARM, true}, nil},
+		{0xEAFFFFFE, 0x02000000, ModeARM, ARMv5TE, "b 0x02000000", 4, &Branch{0x02000000, ModeARM, false}, nil},
+		{0x0A000001, 0x02000000, ModeARM, ARMv5TE, "beq 0x0200000C", 4, &Branch{0x0200000C, ModeARM, false}, nil},
+		{0xEBFFFFFE, 0x02000100, ModeARM, ARMv5TE, "bl 0x02000100", 4, &Branch{0x02000100, ModeARM, true}, nil},
+		{0xFA000000, 0x02000000, ModeARM, ARMv5TE, "blx 0x02000008", 4, &Branch{0x02000008, ModeThumb, true}, nil},
+		{0xFB000000, 0x02000000, ModeARM, ARMv5TE, "blx 0x0200000A", 4, &Branch{0x0200000A, ModeThumb, true}, nil},
+		{0xE12FFF31, 0x02000000, ModeARM, ARMv5TE, "blx r1", 4, nil, nil},
+
+		// ARMv5 only
+		{0xE16F0F11, 0x02000000, ModeARM, ARMv5TE, "clz r0, r1", 4, nil, nil},
+		{0xE16F0F11, 0x02000000, ModeARM, ARMv4T, "undefined 0xE16F0F11", 4, nil, nil},
+		{0xFA000000, 0x02000000, ModeARM, ARMv4T, "undefined 0xFA000000", 4, nil, nil},
+		{0xE12FFF31, 0x02000000, ModeARM, ARMv4T, "undefined 0xE12FFF31", 4, nil, nil},
+
+		// ARM literals, PC is 8 bytes ahead
+		{0xE59F0004, 0x02000000, ModeARM, ARMv5TE, "ldr r0, [pc, #4] ; =0x04030201", 4, nil, &Literal{0x0200000C, 4, 0x04030201, true}},
+		{0xE51F0008, 0x02000000, ModeARM, ARMv5TE, "ldr r0, [pc, #-8] ; =0xE51F0008", 4, nil, &Literal{0x02000000, 4, 0xE51F0008, true}},
+		{0xE15F00B4, 0x02000000, ModeARM, ARMv5TE, "ldrh r0, [pc, #-4] ; =0x00002211", 4, nil, &Literal{0x02000004, 2, 0x2211, true}},
+		{0xE59F0100, 0x02000000, ModeARM, ARMv5TE, "ldr r0, [pc, #0x100]", 4, nil, &Literal{0x02000108, 4, 0, false}},
+
+		// Thumb
+		{0x2001, 0x02000000, ModeThumb, ARMv5TE, "movs r0, #1", 2, nil, nil},
+		{0x1C48, 0x02000000, ModeThumb, ARMv5TE, "adds r0, r1, #1", 2, nil, nil},
+		{0x8808, 0x02000000, ModeThumb, ARMv5TE, "ldrh r0, [r1]", 2, nil, nil},
+		{0x4770, 0x02000000, ModeThumb, ARMv5TE, "bx lr", 2, nil, nil},
+		{0xB510, 0x02000000, ModeThumb, ARMv5TE, "push {r4, lr}", 2, nil, nil},
+		{0xBD10, 0x02000000, ModeThumb, ARMv5TE, "pop {r4, pc}", 2, nil, nil},
+		{0xDF05, 0x02000000, ModeThumb, ARMv5TE, "swi #5", 2, nil, nil},
+		{0x4788, 0x02000000, ModeThumb, ARMv5TE, "blx r1", 2, nil, nil},
+		{0x4788, 0x02000000, ModeThumb, ARMv4T, "undefined 0x4788", 2, nil, nil},
+
+		// Thumb branches
+		{0xD0FE, 0x02000002, ModeThumb, ARMv5TE, "beq 0x02000002", 2, &Branch{0x02000002, ModeThumb, false}, nil},
+		{0xE7FE, 0x02000000, ModeThumb, ARMv5TE, "b 0x02000000", 2, &Branch{0x02000000, ModeThumb, false}, nil},
+		{0xF000F802, 0x02000000, ModeThumb, ARMv5TE, "bl 0x02000008", 4, &Branch{0x02000008, ModeThumb, true}, nil},
+		{0xF000F802, 0x02000002, ModeThumb, ARMv5TE, "bl 0x0200000A", 4, &Branch{0x0200000A, ModeThumb, true}, nil},
+		{0xF7FFFFFE, 0x02000002, ModeThumb, ARMv5TE, "bl 0x02000002", 4, &Branch{0x02000002, ModeThumb, true}, nil},
+		{0xF000E802, 0x02000000, ModeThumb, ARMv5TE, "blx 0x02000008", 4, &Branch{0x02000008, ModeARM, true}, nil},
+		{0xF000E802, 0x02000002, ModeThumb, ARMv5TE, "blx 0x02000008", 4, &Branch{0x02000008, ModeARM, true}, nil},
+		{0xF000E802, 0x02000000, ModeThumb, ARMv4T, "undefined 0xF000", 2, nil, nil},
+		{0xF000, 0x02000000, ModeThumb, ARMv5TE, "undefined 0xF000", 2, nil, nil},
+
+		// Thumb literals, PC is 4 bytes ahead and word aligned
+		{0x4801, 0x02000000, ModeThumb, ARMv5TE, "ldr r0, [pc, #4] ; =0x02018877", 2, nil, &Literal{0x02000008, 4, 0x02018877, true}},
+		{0x4801, 0x02000002, ModeThumb, ARMv5TE, "ldr r0, [pc, #4] ; =0x88776655", 2, nil, &Literal{0x02000008, 4, 0x88776655, true}},
+		{0x4802, 0x02000002, ModeThumb, ARMv5TE, "ldr r0, [pc, #8] ; =0x04030201", 2, nil, &Literal{0x0200000C, 4, 0x04030201, true}},
+	}
+	for _, tt := range tests {
+		ins, err := Decode(testCode(tt.raw, tt.mode), tt.address, tt.mode, WithArch(tt.arch))
+		if err != nil {
+			t.Errorf("%08X: %v", tt.raw, err)
+			continue
+		}
+		if ins.String() != tt.text || ins.Size != tt.size {
+			t.Errorf("%08X at 0x%08X: got %q (%d bytes), expected %q (%d bytes)", tt.raw, tt.address, ins, ins.Size, tt.text, tt.size)
+		}
+		if (ins.Branch == nil) != (tt.branch == nil) || ins.Branch != nil && *ins.Branch != *tt.branch {
+			t.Errorf("%08X at 0x%08X: got branch %+v, expected %+v", tt.raw, tt.address, ins.Branch, tt.branch)
+		}
+		if (ins.Literal == nil) != (tt.literal == nil) || ins.Literal != nil && *ins.Literal != *tt.literal {
+			t.Errorf("%08X at 0x%08X: got literal %+v, expected %+v", tt.raw, tt.address, ins.Literal, tt.literal)
+		}
+	}
+}
+
+// Memory starting at 0x02000000.
+type testMemory []byte
+
+func (m testMemory) ReadAt(p []byte, off int64) (int, error) {
+	off -= 0x02000000
+	if off < 0 || off >= int64(len(m)) {
+		return 0, io.EOF
+	}
+	n := copy(p, m[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func TestLiteralFromMemory(t *testing.T) {
+	memory := testMemory(make([]byte, 0x200))
+	binary.LittleEndian.PutUint32(memory[0x108:], 0xCAFEBABE)
+
+	// Only the instruction is disassembled, the literal lies outside it
+	code := binary.LittleEndian.AppendUint32(nil, 0xE59F0100)
+	ins, err := Decode(code, 0x02000000, ModeARM, WithMemory(memory))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Literal{0x02000108, 4, 0xCAFEBABE, true}
+	if ins.Literal == nil || *ins.Literal != expected {
+		t.Errorf("got literal %+v, expected %+v", ins.Literal, expected)
+	}
+
+	// Literals in the code itself are read from the code
+	binary.LittleEndian.PutUint32(memory[0x0C:], 0xDEADBEEF)
+	ins, err = Decode(testCode(0xE59F0004, ModeARM), 0x02000000, ModeARM, WithMemory(memory))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ins.Literal == nil || ins.Literal.Value != 0x04030201 {
+		t.Errorf("got literal %+v, expected value 0x04030201", ins.Literal)
+	}
+
+	// Literals outside memory are unknown
+	ins, _ = Decode(binary.LittleEndian.AppendUint32(nil, 0xE59F0FFF), 0x02000000, ModeARM, WithMemory(memory))
+	if ins.Literal == nil || ins.Literal.Known {
+		t.Errorf("got literal %+v, expected unknown value", ins.Literal)
+	}
+}
+
+func TestDisassemble(t *testing.T) {
+	// Thumb BL pair, then a halfword instruction and a trailing partial instruction
+	code := []byte{0x00, 0xF0, 0x02, 0xF8, 0x70, 0x47, 0x00}
+	instructions := Disassemble(code, 0x02000000, ModeThumb)
+	expected := []struct {
+		address uint32
+		text    string
+	}{
+		{0x02000000, "bl 0x02000008"},
+		{0x02000004, "bx lr"},
+	}
+	if len(instructions) != len(expected) {
+		t.Fatalf("got %d instructions, expected %d", len(instructions), len(expected))
+	}
+	for i, ins := range instructions {
+		if ins.Address != expected[i].address || ins.String() != expected[i].text {
+			t.Errorf("got %q at 0x%08X, expected %q at 0x%08X", ins, ins.Address, expected[i].text, expected[i].address)
+		}
+	}
+
+	if _, err := Decode(code[:3], 0x02000000, ModeARM); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("got %v, expected %v", err, io.ErrUnexpectedEOF)
+	}
+	if _, err := Decode(code[:1], 0x02000000, ModeThumb); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("got %v, expected %v", err, io.ErrUnexpectedEOF)
+	}
+	if listing := Listing(instructions); !bytes.Contains([]byte(listing), []byte("bl 0x02000008")) {
+		t.Errorf("listing is missing instructions:\n%s", listing)
+	}
+}
@@ -0,0 +1,105 @@
+package disasm
+
+import (
+	"fmt"
+	"strings"
+)
+
+var regNames = [16]string{
+	"r0", "r1", "r2", "r3", "r4", "r5", "r6", "r7",
+	"r8", "r9", "r10", "r11", "r12", "sp", "lr", "pc",
+}
+
+var condNames = [16]string{
+	"eq", "ne", "cs", "cc", "mi", "pl", "vs", "vc",
+	"hi", "ls", "ge", "lt", "gt", "le", "", "",
+}
+
+var shiftNames = [4]string{"lsl", "lsr", "asr", "ror"}
+
+func reg[K ~uint16 | ~uint32](r K) string {
+	return regNames[r&0xF]
+}
+
+// Format an immediate, small values in decimal and the rest in hex.
+func imm(v uint32) string {
+	if v < 10 {
+		return fmt.Sprintf("#%d", v)
+	}
+	return fmt.Sprintf("#0x%X", v)
+}
+
+// Format an immediate offset, negative if up is false.
+func offsetImm(v uint32, up bool) string {
+	if up {
+		return imm(v)
+	}
+	return "#-" + imm(v)[1:]
+}
+
+// Format a memory operand.
+// Pre-indexed operands with a zero offset are written as just the base register.
+func memOperand(rn uint32, pre bool, writeback bool, offset string, zero bool) string {
+	switch {
+	case !pre:
+		return fmt.Sprintf("[%s], %s", reg(rn), offset)
+	case zero && !writeback:
+		return fmt.Sprintf("[%s]", reg(rn))
+	case writeback:
+		return fmt.Sprintf("[%s, %s]!", reg(rn), offset)
+	default:
+		return fmt.Sprintf("[%s, %s]", reg(rn), offset)
+	}
+}
+
+// Format a register list, runs of three or more low registers are written as ranges.
+func regList(list uint32) string {
+	var parts []string
+	for r := 0; r < 16; r++ {
+		if list&(1<<r) == 0 {
+			continue
+		}
+		end := r
+		for end+1 < 13 && list&(1<<(end+1)) != 0 {
+			end++
+		}
+		if end-r >= 2 {
+			parts = append(parts, regNames[r]+"-"+regNames[end])
+			r = end
+		} else {
+			parts = append(parts, regNames[r])
+		}
+	}
+	return "{" + strings.Join(parts, ", ") + "}"
+}
+
+// Format a branch target.
+func target(address uint32) string {
+	return fmt.Sprintf("0x%08X", address)
+}
+
+func flag(set bool, s string) string {
+	if set {
+		return s
+	}
+	return ""
+}
+
+func bit(w uint32, n int) bool {
+	return w&(1<<n) != 0
+}
+
+func (i *Instruction) set(mnemonic string, format string, args ...any) {
+	i.Mnemonic = mnemonic
+	i.Args = fmt.Sprintf(format, args...)
+}
+
+func (i *Instruction) undefined() {
+	i.Undefined = true
+	i.Mnemonic = "undefined"
+	if i.Size == 2 {
+		i.Args = fmt.Sprintf("0x%04X", i.Raw)
+	} else {
+		i.Args = fmt.Sprintf("0x%08X", i.Raw)
+	}
+}
@@ -0,0 +1,67 @@
+package disasm
+
+import (
+	"github.com/sukus21/nintil/nds"
+)
+
+// Reads RAM through an address space.
+type spaceReader struct {
+	space *nds.AddressSpace
+}
+
+func (r spaceReader) ReadAt(p []byte, off int64) (int, error) {
+	if err := r.space.Read(uint32(off), p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Options for disassembling the binary at loc.
+// Literal values are read through the address space, and ARM7 binaries are decoded as ARMv4T.
+func spaceOptions(a *nds.AddressSpace, loc nds.Location, opts []Option) []Option {
+	defaults := []Option{WithMemory(spaceReader{a})}
+	if loc.Binary.IsArm7() {
+		defaults = append(defaults, WithArch(ARMv4T))
+	}
+	return append(defaults, opts...)
+}
+
+// Disassemble a whole binary of the address space, at the RAM addresses it is loaded to.
+// loc is the binary as returned by AddressSpace.Binaries, its offset is ignored.
+// The ARM9 binary is disassembled one memory section at a time, in section order.
+func Binary(a *nds.AddressSpace, loc nds.Location, mode Mode, opts ...Option) ([]Instruction, error) {
+	loc.Offset = 0
+	opts = spaceOptions(a, loc, opts)
+	if loc.Binary == nds.BinaryArm9 {
+		var out []Instruction
+		for _, section := range a.Arm9Memory().Sections {
+			out = append(out, Disassemble(section.Data, section.Address, mode, opts...)...)
+		}
+		return out, nil
+	}
+
+	code, err := a.Code(loc)
+	if err != nil {
+		return nil, err
+	}
+	address, err := a.Address(loc)
+	if err != nil {
+		return nil, err
+	}
+	return Disassemble(code, address, mode, opts...), nil
+}
+
+// Disassemble size bytes starting at a location in the address space.
+// Use AddressSpace.Resolve to get the location of a RAM address.
+func Range(a *nds.AddressSpace, loc nds.Location, size int, mode Mode, opts ...Option) ([]Instruction, error) {
+	code, err := a.Code(loc)
+	if err != nil {
+		return nil, err
+	}
+	address, err := a.Address(loc)
+	if err != nil {
+		return nil, err
+	}
+	end := min(int(loc.Offset)+size, len(code))
+	return Disassemble(code[loc.Offset:end], address, mode, spaceOptions(a, loc, opts)...), nil
+}
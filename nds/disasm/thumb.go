@@ -0,0 +1,188 @@
+package disasm
+
+var thumbALUNames = [16]string{
+	"ands", "eors", "lsls", "lsrs", "asrs", "adcs", "sbcs", "rors",
+	"tst", "negs", "cmp", "cmn", "orrs", "muls", "bics", "mvns",
+}
+
+// Decode a Thumb instruction.
+// second is the following halfword, used for BL and BLX pairs.
+func (d *decoder) decodeThumb(h uint16, second uint16, hasSecond bool, address uint32) Instruction {
+	ins := Instruction{
+		Address: address,
+		Mode:    ModeThumb,
+		Size:    2,
+		Raw:     uint32(h),
+	}
+	w := uint32(h)
+	rd, rs, rn := w&7, (w>>3)&7, (w>>6)&7
+	off5 := (w >> 6) & 0x1F
+	imm8 := w & 0xFF
+
+	switch {
+	// Add and subtract
+	case w&0xF800 == 0x1800:
+		name := flag(bit(w, 9), "subs") + flag(!bit(w, 9), "adds")
+		if bit(w, 10) {
+			ins.set(name, "%s, %s, %s", reg(rd), reg(rs), imm(rn))
+		} else {
+			ins.set(name, "%s, %s, %s", reg(rd), reg(rs), reg(rn))
+		}
+
+	// Shift by immediate
+	case w&0xE000 == 0x0000:
+		shift := (w >> 11) & 3
+		switch {
+		case shift == 0 && off5 == 0:
+			ins.set("movs", "%s, %s", reg(rd), reg(rs))
+		case off5 == 0:
+			ins.set(shiftNames[shift]+"s", "%s, %s, #32", reg(rd), reg(rs))
+		default:
+			ins.set(shiftNames[shift]+"s", "%s, %s, #%d", reg(rd), reg(rs), off5)
+		}
+
+	// Move, compare, add and subtract immediate
+	case w&0xE000 == 0x2000:
+		name := []string{"movs", "cmp", "adds", "subs"}[(w>>11)&3]
+		ins.set(name, "%s, %s", reg((w>>8)&7), imm(imm8))
+
+	// ALU operations
+	case w&0xFC00 == 0x4000:
+		ins.set(thumbALUNames[(w>>6)&0xF], "%s, %s", reg(rd), reg(rs))
+
+	// High register operations and branch exchange
+	case w&0xFC00 == 0x4400:
+		hd := rd | (w>>4)&8
+		hs := (w >> 3) & 0xF
+		switch (w >> 8) & 3 {
+		case 0:
+			ins.set("add", "%s, %s", reg(hd), reg(hs))
+		case 1:
+			ins.set("cmp", "%s, %s", reg(hd), reg(hs))
+		case 2:
+			ins.set("mov", "%s, %s", reg(hd), reg(hs))
+		case 3:
+			if !bit(w, 7) {
+				ins.set("bx", "%s", reg(hs))
+			} else if d.v5() {
+				ins.set("blx", "%s", reg(hs))
+			} else {
+				ins.undefined()
+			}
+		}
+
+	// PC-relative load
+	case w&0xF800 == 0x4800:
+		ins.set("ldr", "%s, [pc, %s]", reg((w>>8)&7), imm(imm8*4))
+		ins.Literal = d.literal((address+4)&^3+imm8*4, 4)
+
+	// Load and store with register offset
+	case w&0xF000 == 0x5000:
+		name := []string{"str", "strh", "strb", "ldrsb", "ldr", "ldrh", "ldrb", "ldrsh"}[(w>>9)&7]
+		ins.set(name, "%s, [%s, %s]", reg(rd), reg(rs), reg(rn))
+
+	// Load and store with immediate offset
+	case w&0xE000 == 0x6000:
+		name := flag(bit(w, 11), "ldr") + flag(!bit(w, 11), "str")
+		offset := off5 * 4
+		if bit(w, 12) {
+			name += "b"
+			offset = off5
+		}
+		ins.set(name, "%s, %s", reg(rd), memOperand(rs, true, false, imm(offset), offset == 0))
+	case w&0xF000 == 0x8000:
+		name := flag(bit(w, 11), "ldrh") + flag(!bit(w, 11), "strh")
+		ins.set(name, "%s, %s", reg(rd), memOperand(rs, true, false, imm(off5*2), off5 == 0))
+
+	// SP-relative load and store
+	case w&0xF000 == 0x9000:
+		name := flag(bit(w, 11), "ldr") + flag(!bit(w, 11), "str")
+		ins.set(name, "%s, %s", reg((w>>8)&7), memOperand(13, true, false, imm(imm8*4), imm8 == 0))
+
+	// Load address
+	case w&0xF000 == 0xA000:
+		base := flag(bit(w, 11), "sp") + flag(!bit(w, 11), "pc")
+		ins.set("add", "%s, %s, %s", reg((w>>8)&7), base, imm(imm8*4))
+
+	// Adjust stack pointer
+	case w&0xFF00 == 0xB000:
+		name := flag(bit(w, 7), "sub") + flag(!bit(w, 7), "add")
+		ins.set(name, "sp, %s", imm((w&0x7F)*4))
+
+	// Push and pop
+	case w&0xF600 == 0xB400:
+		list := imm8
+		if bit(w, 11) {
+			list |= uint32(bit32(w, 8)) << 15
+			ins.set("pop", "%s", regList(list))
+		} else {
+			list |= uint32(bit32(w, 8)) << 14
+			ins.set("push", "%s", regList(list))
+		}
+
+	// Breakpoint
+	case w&0xFF00 == 0xBE00 && d.v5():
+		ins.set("bkpt", "%s", imm(imm8))
+
+	// Load and store multiple
+	case w&0xF000 == 0xC000:
+		rb := (w >> 8) & 7
+		load := bit(w, 11)
+		writeback := !load || imm8&(1<<rb) == 0
+		name := flag(load, "ldm") + flag(!load, "stm")
+		ins.set(name, "%s%s, %s", reg(rb), flag(writeback, "!"), regList(imm8))
+
+	// Software interrupt
+	case w&0xFF00 == 0xDF00:
+		ins.set("swi", "%s", imm(imm8))
+
+	// Conditional branch
+	case w&0xF000 == 0xD000:
+		cond := (w >> 8) & 0xF
+		if cond == 0xE {
+			ins.undefined()
+			break
+		}
+		ins.Branch = &Branch{
+			Target: address + 4 + uint32(int32(int8(imm8))<<1),
+			Mode:   ModeThumb,
+		}
+		ins.set("b"+condNames[cond], "%s", target(ins.Branch.Target))
+
+	// Unconditional branch
+	case w&0xF800 == 0xE000:
+		ins.Branch = &Branch{
+			Target: address + 4 + uint32(int32(w<<21)>>20),
+			Mode:   ModeThumb,
+		}
+		ins.set("b", "%s", target(ins.Branch.Target))
+
+	// Long branch with link, made of two halfwords
+	case w&0xF800 == 0xF000:
+		s := uint32(second)
+		isBL := s&0xF800 == 0xF800
+		isBLX := s&0xF800 == 0xE800 && s&1 == 0 && d.v5()
+		if !hasSecond || !(isBL || isBLX) {
+			ins.undefined()
+			break
+		}
+		ins.Size = 4
+		ins.Raw = w<<16 | s
+		dest := address + 4 + uint32(int32(w<<21)>>9) + (s&0x7FF)<<1
+		if isBL {
+			ins.Branch = &Branch{Target: dest, Mode: ModeThumb, Link: true}
+			ins.set("bl", "%s", target(dest))
+		} else {
+			ins.Branch = &Branch{Target: dest &^ 3, Mode: ModeARM, Link: true}
+			ins.set("blx", "%s", target(dest&^3))
+		}
+
+	default:
+		ins.undefined()
+	}
+	return ins
+}
+
+func bit32(w uint32, n int) uint32 {
+	return (w >> n) & 1
+}
@@ -1,15 +1,58 @@
 package nds
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"strings"
 
 	"github.com/sukus21/nintil/nds/nitrofs"
 	"github.com/sukus21/nintil/util"
 	"github.com/sukus21/nintil/util/ezbin"
 )
 
-type header struct {
+// Valid range of Header.DeviceSize values.
+// Cartridge capacity is 128 KB shifted left by the device size.
+const (
+	DeviceSizeMin = 0x00 // 128 KB
+	DeviceSizeMax = 0x0C // 512 MB
+)
+
+var ErrInvalidDeviceSize = errors.New("device size out of range")
+var ErrHeaderStringLength = errors.New("string too long for header")
+var ErrHeaderStringSymbols = errors.New("string contains non-ASCII symbols")
+
+// Maximum lengths of header strings, shorter strings are padded with zeroes
+const (
+	gameTitleSize = 12
+	gameCodeSize  = 4
+	makerCodeSize = 2
+)
+
+// Size of the Nintendo logo in the header
+const LogoSize = 0x9C
+
+// Get cartridge capacity in bytes from a Header.DeviceSize value.
+func DeviceCapacity(deviceSize byte) (uint32, error) {
+	if deviceSize > DeviceSizeMax {
+		return 0, ErrInvalidDeviceSize
+	}
+	return 0x20000 << deviceSize, nil
+}
+
+// Get the smallest Header.DeviceSize value that can hold the given amount of bytes.
+func DeviceSizeFor(size uint32) (byte, error) {
+	for deviceSize := byte(DeviceSizeMin); deviceSize <= DeviceSizeMax; deviceSize++ {
+		if capacity, _ := DeviceCapacity(deviceSize); capacity >= size {
+			return deviceSize, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: %d bytes exceeds largest cartridge capacity", ErrInvalidDeviceSize, size)
+}
+
+// NDS ROM header.
+// Fields that are rarely changed are only available through getters and setters.
+type Header struct {
 	GameTitle          string
 	GameCode           string
 	MakerCode          string
@@ -44,18 +87,25 @@ type header struct {
 	disableSecureArea  uint64
 	RomSize            uint32
 	HeaderSize         uint32
+	arm9ParamsOffset   uint32
+	arm7ParamsOffset   uint32
+	NtrRegionEnd       uint16
+	TwlRegionStart     uint16
 	nandRomEnd         uint16
 	nandRwStart        uint16
-	nintendoLogo       [0x9C]byte
+	nintendoLogo       [LogoSize]byte
 	nintendoLogoCrc    uint16
 	HeaderChecksum     uint16
 	debugRomOffset     uint32
 	debugSize          uint32
 	debugRamAddress    uint32
+
+	// Extended DSi header, nil for regular NDS ROMs
+	Twl *TwlHeader
 }
 
-func OpenHeader(r io.ReadSeeker) (*header, error) {
-	h := &header{}
+func OpenHeader(r io.ReadSeeker) (*Header, error) {
+	h := &Header{}
 	strs := make([]byte, 18)
 	err := ezbin.Read(r,
 		strs,
@@ -99,7 +149,10 @@ func OpenHeader(r io.ReadSeeker) (*header, error) {
 		&h.disableSecureArea,
 		&h.RomSize,
 		&h.HeaderSize,
-		make([]byte, 12),
+		&h.arm9ParamsOffset,
+		&h.arm7ParamsOffset,
+		&h.NtrRegionEnd,
+		&h.TwlRegionStart,
 		&h.nandRomEnd,
 		&h.nandRwStart,
 		make([]byte, 0x28),
@@ -117,26 +170,47 @@ func OpenHeader(r io.ReadSeeker) (*header, error) {
 	h.GameTitle = string(strs[:12])
 	h.GameCode = string(strs[0x0C:0x10])
 	h.MakerCode = string(strs[0x10:0x12])
+	if err != nil {
+		return h, err
+	}
+
+	// Read DSi extended header
+	if h.IsTwl() {
+		h.Twl = &TwlHeader{}
+		err = ezbin.Read(r,
+			make([]byte, 0x14),
+			h.Twl.raw[:],
+		)
+		h.Twl.decode()
+	}
 	return h, err
 }
 
-// TODO: validate string lengths
-func SaveHeader(w io.WriteSeeker, h *header) error {
-	s, _ := w.Seek(0, io.SeekCurrent)
-	err := ezbin.Write(w,
-		[]byte(h.GameTitle),
-		[]byte(h.GameCode),
-		[]byte(h.MakerCode),
-	)
-	if err != nil {
-		return err
-	}
-	if n, _ := w.Seek(0, io.SeekCurrent); n != s+0x12 {
-		w.Seek(s, io.SeekStart)
-		return fmt.Errorf("save header: title, gamecode or makercode length invalid")
+// Serialize header.
+// Game title, game code and maker code are padded with zeroes if they are too short.
+func SaveHeader(w io.WriteSeeker, h *Header) error {
+	strs := make([]byte, 0x12)
+	for _, str := range []struct {
+		name  string
+		value string
+		at    int
+		size  int
+	}{
+		{"game title", h.GameTitle, 0x00, gameTitleSize},
+		{"game code", h.GameCode, 0x0C, gameCodeSize},
+		{"maker code", h.MakerCode, 0x10, makerCodeSize},
+	} {
+		// Strings read from a ROM keep their zero padding.
+		// Other symbols are written as-is, only the setters require ASCII.
+		value := strings.TrimRight(str.value, "\x00")
+		if err := checkHeaderStringLength(str.name, value, str.size); err != nil {
+			return fmt.Errorf("save header: %w", err)
+		}
+		copy(strs[str.at:], value)
 	}
 
-	err = ezbin.Write(w,
+	err := ezbin.Write(w,
+		strs,
 		h.UnitCode,
 		h.EncryptionSeed,
 		h.DeviceSize,
@@ -177,7 +251,10 @@ func SaveHeader(w io.WriteSeeker, h *header) error {
 		h.disableSecureArea,
 		h.RomSize,
 		h.HeaderSize,
-		make([]byte, 12),
+		h.arm9ParamsOffset,
+		h.arm7ParamsOffset,
+		h.NtrRegionEnd,
+		h.TwlRegionStart,
 		h.nandRomEnd,
 		h.nandRwStart,
 		make([]byte, 0x28),
@@ -191,14 +268,29 @@ func SaveHeader(w io.WriteSeeker, h *header) error {
 		h.debugRamAddress,
 
 		// Reserved 0's
-		make([]byte, 0x04+0x90+0x0E00),
+		make([]byte, 0x14),
 	)
+	if err != nil {
+		return err
+	}
+
+	// DSi extended header, or more reserved 0's
+	if h.Twl != nil {
+		err = ezbin.Write(w, h.Twl.encode())
+	} else {
+		err = ezbin.Write(w, make([]byte, twlHeaderSize))
+	}
 
-	// TODO: checksum re-calculations
+	// Checksums are written as-is, use UpdateChecksum to recompute them
 	return err
 }
 
-func (h *header) GetNitroFSInfo() *nitrofs.Info {
+// Does the unit code say this ROM has an extended DSi header?
+func (h *Header) IsTwl() bool {
+	return h.UnitCode&UnitCodeTwlFlag != 0
+}
+
+func (h *Header) GetNitroFSInfo() *nitrofs.Info {
 	return &nitrofs.Info{
 		FntOffset:  h.FilenameOffset,
 		FntSize:    h.FilenameSize,
@@ -211,7 +303,7 @@ func (h *header) GetNitroFSInfo() *nitrofs.Info {
 	}
 }
 
-func (h *header) ApplyNitroFSInfo(info *nitrofs.Info) {
+func (h *Header) ApplyNitroFSInfo(info *nitrofs.Info) {
 	h.FilenameOffset = info.FntOffset
 	h.FilenameSize = info.FntSize
 	h.FatOffset = info.FatOffset
@@ -222,8 +314,158 @@ func (h *header) ApplyNitroFSInfo(info *nitrofs.Info) {
 	h.Arm7OverlaySize = info.Ovt7Size
 }
 
-func (h *header) UpdateChecksum() {
+// Recompute the header checksum.
+// Fails if the header cannot be serialized, in which case the checksum is left unchanged.
+func (h *Header) UpdateChecksum() error {
 	w := util.NewWriteSeeker(make([]byte, 0x4000))
-	SaveHeader(w, h)
+	if err := SaveHeader(w, h); err != nil {
+		return err
+	}
 	h.HeaderChecksum = CRC16(w.Buf[:0x15E])
+	return nil
+}
+
+// Check that a header string fits.
+func checkHeaderStringLength(name string, value string, size int) error {
+	if len(value) > size {
+		return fmt.Errorf("%s %q: %w (max %d)", name, value, ErrHeaderStringLength, size)
+	}
+	return nil
+}
+
+// Check that a header string fits, and only contains printable ASCII characters.
+func checkHeaderString(name string, value string, size int) error {
+	if err := checkHeaderStringLength(name, value, size); err != nil {
+		return err
+	}
+	for _, c := range value {
+		if c < ' ' || c > '~' {
+			return fmt.Errorf("%s %q: %w", name, value, ErrHeaderStringSymbols)
+		}
+	}
+	return nil
+}
+
+// Set the game title, at most 12 ASCII characters.
+func (h *Header) SetGameTitle(title string) error {
+	if err := checkHeaderString("game title", title, gameTitleSize); err != nil {
+		return err
+	}
+	h.GameTitle = title
+	return nil
+}
+
+// Set the game code, at most 4 ASCII characters.
+func (h *Header) SetGameCode(code string) error {
+	if err := checkHeaderString("game code", code, gameCodeSize); err != nil {
+		return err
+	}
+	h.GameCode = code
+	return nil
+}
+
+// Set the maker code, at most 2 ASCII characters.
+func (h *Header) SetMakerCode(code string) error {
+	if err := checkHeaderString("maker code", code, makerCodeSize); err != nil {
+		return err
+	}
+	h.MakerCode = code
+	return nil
+}
+
+// Get the cartridge port settings used for normal commands and KEY1 commands.
+func (h *Header) PortCommands() (normal uint32, key1 uint32) {
+	return h.portNormalCommands, h.portKeyCommands
+}
+
+// Set the cartridge port settings used for normal commands and KEY1 commands.
+func (h *Header) SetPortCommands(normal uint32, key1 uint32) {
+	h.portNormalCommands = normal
+	h.portKeyCommands = key1
+}
+
+// Get the CRC16 of the secure area.
+func (h *Header) SecureAreaChecksum() uint16 {
+	return h.secureAreaChecksum
+}
+
+// Set the CRC16 of the secure area.
+func (h *Header) SetSecureAreaChecksum(checksum uint16) {
+	h.secureAreaChecksum = checksum
+}
+
+// Get the delay before reading the secure area, in 131 kHz units.
+func (h *Header) SecureAreaDelay() uint16 {
+	return h.secureAreaDelay
+}
+
+// Set the delay before reading the secure area, in 131 kHz units.
+func (h *Header) SetSecureAreaDelay(delay uint16) {
+	h.secureAreaDelay = delay
+}
+
+// Get the secure area disable value, only used by debug ROMs.
+func (h *Header) SecureAreaDisable() uint64 {
+	return h.disableSecureArea
+}
+
+// Set the secure area disable value, only used by debug ROMs.
+func (h *Header) SetSecureAreaDisable(value uint64) {
+	h.disableSecureArea = value
+}
+
+// Get the offsets of the ARM9 and ARM7 module params, which hold the autoload lists.
+func (h *Header) ModuleParamsOffsets() (arm9 uint32, arm7 uint32) {
+	return h.arm9ParamsOffset, h.arm7ParamsOffset
+}
+
+// Set the offsets of the ARM9 and ARM7 module params, which hold the autoload lists.
+func (h *Header) SetModuleParamsOffsets(arm9 uint32, arm7 uint32) {
+	h.arm9ParamsOffset = arm9
+	h.arm7ParamsOffset = arm7
+}
+
+// Get the end of the DSi NAND ROM region and the start of the NAND RW region.
+func (h *Header) NandRegion() (romEnd uint16, rwStart uint16) {
+	return h.nandRomEnd, h.nandRwStart
+}
+
+// Set the end of the DSi NAND ROM region and the start of the NAND RW region.
+func (h *Header) SetNandRegion(romEnd uint16, rwStart uint16) {
+	h.nandRomEnd = romEnd
+	h.nandRwStart = rwStart
+}
+
+// Get the compressed Nintendo logo.
+func (h *Header) Logo() [LogoSize]byte {
+	return h.nintendoLogo
+}
+
+// Set the compressed Nintendo logo.
+// The logo checksum is not updated.
+func (h *Header) SetLogo(logo [LogoSize]byte) {
+	h.nintendoLogo = logo
+}
+
+// Get the CRC16 of the Nintendo logo.
+func (h *Header) LogoChecksum() uint16 {
+	return h.nintendoLogoCrc
+}
+
+// Set the CRC16 of the Nintendo logo.
+func (h *Header) SetLogoChecksum(checksum uint16) {
+	h.nintendoLogoCrc = checksum
+}
+
+// Get where the debug ROM is, and where it is loaded to.
+func (h *Header) Debug() (romOffset uint32, size uint32, ramAddress uint32) {
+	return h.debugRomOffset, h.debugSize, h.debugRamAddress
+}
+
+// Set where the debug ROM is, and where it is loaded to.
+// These should all be 0 for retail ROMs.
+func (h *Header) SetDebug(romOffset uint32, size uint32, ramAddress uint32) {
+	h.debugRomOffset = romOffset
+	h.debugSize = size
+	h.debugRamAddress = ramAddress
 }
@@ -0,0 +1,188 @@
+package nds
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Header without its JSON methods.
+type headerFields Header
+
+// JSON form of the header.
+// Exported fields are taken from the header as-is, the rest are added here.
+type headerJSON struct {
+	*headerFields
+	PortNormalCommands uint32
+	PortKeyCommands    uint32
+	SecureAreaChecksum uint16
+	SecureAreaDelay    uint16
+	SecureAreaDisable  uint64
+	Arm9ParamsOffset   uint32
+	Arm7ParamsOffset   uint32
+	NandRomEnd         uint16
+	NandRwStart        uint16
+	NintendoLogo       []byte
+	NintendoLogoCrc    uint16
+	DebugRomOffset     uint32
+	DebugSize          uint32
+	DebugRamAddress    uint32
+}
+
+// Copy header into its JSON form.
+// Header strings have their zero padding removed, see headerStringToJSON.
+// The DSi header is copied as well, so decoding into the result never touches h.
+func (h *Header) toJSON() headerJSON {
+	fields := headerFields(*h)
+	if h.Twl != nil {
+		twl := *h.Twl
+		fields.Twl = &twl
+	}
+	fields.GameTitle = headerStringToJSON(fields.GameTitle)
+	fields.GameCode = headerStringToJSON(fields.GameCode)
+	fields.MakerCode = headerStringToJSON(fields.MakerCode)
+
+	return headerJSON{
+		headerFields:       &fields,
+		PortNormalCommands: h.portNormalCommands,
+		PortKeyCommands:    h.portKeyCommands,
+		SecureAreaChecksum: h.secureAreaChecksum,
+		SecureAreaDelay:    h.secureAreaDelay,
+		SecureAreaDisable:  h.disableSecureArea,
+		Arm9ParamsOffset:   h.arm9ParamsOffset,
+		Arm7ParamsOffset:   h.arm7ParamsOffset,
+		NandRomEnd:         h.nandRomEnd,
+		NandRwStart:        h.nandRwStart,
+		NintendoLogo:       h.nintendoLogo[:],
+		NintendoLogoCrc:    h.nintendoLogoCrc,
+		DebugRomOffset:     h.debugRomOffset,
+		DebugSize:          h.debugSize,
+		DebugRamAddress:    h.debugRamAddress,
+	}
+}
+
+// Get the JSON form of a header string, without its zero padding.
+// Headers can hold any bytes, which are not always valid UTF-8.
+// Each byte becomes the character of the same value, so the string survives a round trip.
+func headerStringToJSON(value string) string {
+	value = strings.TrimRight(value, "\x00")
+	runes := make([]rune, len(value))
+	for i := range len(value) {
+		runes[i] = rune(value[i])
+	}
+	return string(runes)
+}
+
+// Get a header string from its JSON form.
+// Every character must be a byte, and the string must fit.
+func headerStringFromJSON(name string, value string, size int) (string, error) {
+	data := make([]byte, 0, len(value))
+	for _, c := range value {
+		if c > 0xFF {
+			return "", fmt.Errorf("%s %q: %w", name, value, ErrHeaderStringSymbols)
+		}
+		data = append(data, byte(c))
+	}
+	if err := checkHeaderStringLength(name, string(data), size); err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func (h *Header) MarshalJSON() ([]byte, error) {
+	return json.Marshal(h.toJSON())
+}
+
+// Unmarshal header from JSON.
+// Fields missing from the JSON are left unchanged, so this can be used to patch an existing header.
+// Unknown fields are not allowed, and header strings must fit and only hold characters up to U+00FF.
+// The header is only changed if everything is valid.
+func (h *Header) UnmarshalJSON(data []byte) error {
+	j := h.toJSON()
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&j); err != nil {
+		return fmt.Errorf("unmarshal header: %w", err)
+	}
+
+	// Validate
+	nh := Header(*j.headerFields)
+	var err error
+	if nh.GameTitle, err = headerStringFromJSON("game title", nh.GameTitle, gameTitleSize); err != nil {
+		return fmt.Errorf("unmarshal header: %w", err)
+	}
+	if nh.GameCode, err = headerStringFromJSON("game code", nh.GameCode, gameCodeSize); err != nil {
+		return fmt.Errorf("unmarshal header: %w", err)
+	}
+	if nh.MakerCode, err = headerStringFromJSON("maker code", nh.MakerCode, makerCodeSize); err != nil {
+		return fmt.Errorf("unmarshal header: %w", err)
+	}
+	if len(j.NintendoLogo) != LogoSize {
+		return fmt.Errorf("unmarshal header: Nintendo logo must be %d bytes, got %d", LogoSize, len(j.NintendoLogo))
+	}
+
+	// Apply the rest
+	nh.portNormalCommands = j.PortNormalCommands
+	nh.portKeyCommands = j.PortKeyCommands
+	nh.secureAreaChecksum = j.SecureAreaChecksum
+	nh.secureAreaDelay = j.SecureAreaDelay
+	nh.disableSecureArea = j.SecureAreaDisable
+	nh.arm9ParamsOffset = j.Arm9ParamsOffset
+	nh.arm7ParamsOffset = j.Arm7ParamsOffset
+	nh.nandRomEnd = j.NandRomEnd
+	nh.nandRwStart = j.NandRwStart
+	copy(nh.nintendoLogo[:], j.NintendoLogo)
+	nh.nintendoLogoCrc = j.NintendoLogoCrc
+	nh.debugRomOffset = j.DebugRomOffset
+	nh.debugSize = j.DebugSize
+	nh.debugRamAddress = j.DebugRamAddress
+	*h = nh
+	return nil
+}
+
+// DSi header without its JSON methods.
+type twlFields TwlHeader
+
+// JSON form of the DSi header.
+// Raw holds the whole area, so fields that are not parsed out survive a round trip.
+type twlJSON struct {
+	*twlFields
+	Raw []byte
+}
+
+func (t *TwlHeader) MarshalJSON() ([]byte, error) {
+	fields := twlFields(*t)
+	return json.Marshal(twlJSON{
+		twlFields: &fields,
+		Raw:       t.encode(),
+	})
+}
+
+// Unmarshal DSi header from JSON.
+// Raw is applied first, and the named fields on top of it.
+// Fields missing from the JSON are left unchanged, and unknown fields are not allowed.
+// The header is only changed if everything is valid.
+func (t *TwlHeader) UnmarshalJSON(data []byte) error {
+	nt := *t
+	raw := struct{ Raw []byte }{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("DSi header: %w", err)
+	}
+	if raw.Raw != nil {
+		if len(raw.Raw) != twlHeaderSize {
+			return fmt.Errorf("DSi header: raw data must be %d bytes, got %d", twlHeaderSize, len(raw.Raw))
+		}
+		copy(nt.raw[:], raw.Raw)
+		nt.decode()
+	}
+
+	fields := twlFields(nt)
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&twlJSON{twlFields: &fields}); err != nil {
+		return fmt.Errorf("DSi header: %w", err)
+	}
+	*t = TwlHeader(fields)
+	return nil
+}
@@ -0,0 +1,164 @@
+package nds
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/sukus21/nintil/util"
+)
+
+// Serialize a header and read it back.
+func saveAndOpenHeader(t *testing.T, h *Header) *Header {
+	t.Helper()
+	w := util.NewWriteSeeker(make([]byte, 0x1000))
+	if err := SaveHeader(w, h); err != nil {
+		t.Fatal(err)
+	}
+	h, err := OpenHeader(bytes.NewReader(w.Buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestSaveHeaderStrings(t *testing.T) {
+	// Symbols outside printable ASCII are written as-is
+	h := &Header{GameTitle: "TITLE\xFF\x01", GameCode: "AB\x80", MakerCode: "01"}
+	if err := h.UpdateChecksum(); err != nil {
+		t.Fatal(err)
+	}
+	saved := saveAndOpenHeader(t, h)
+	if saved.GameTitle != "TITLE\xFF\x01\x00\x00\x00\x00\x00" || saved.GameCode != "AB\x80\x00" || saved.MakerCode != "01" {
+		t.Errorf("got %q %q %q", saved.GameTitle, saved.GameCode, saved.MakerCode)
+	}
+	if saved.HeaderChecksum != h.HeaderChecksum {
+		t.Errorf("got checksum %04X, expected %04X", saved.HeaderChecksum, h.HeaderChecksum)
+	}
+
+	// Strings that are too long cannot be saved, and leave the checksum as it was
+	h.GameTitle = "THIS TITLE IS TOO LONG"
+	if err := h.UpdateChecksum(); !errors.Is(err, ErrHeaderStringLength) {
+		t.Errorf("got %v, expected %v", err, ErrHeaderStringLength)
+	}
+	if h.HeaderChecksum != saved.HeaderChecksum {
+		t.Errorf("checksum changed to %04X", h.HeaderChecksum)
+	}
+}
+
+func TestHeaderSetters(t *testing.T) {
+	h := &Header{}
+	if err := h.SetGameTitle("NINTIL"); err != nil || h.GameTitle != "NINTIL" {
+		t.Errorf("got %q, %v", h.GameTitle, err)
+	}
+	if err := h.SetGameTitle("NINTIL\xFF"); !errors.Is(err, ErrHeaderStringSymbols) {
+		t.Errorf("got %v, expected %v", err, ErrHeaderStringSymbols)
+	}
+	if err := h.SetGameCode("ABCDE"); !errors.Is(err, ErrHeaderStringLength) {
+		t.Errorf("got %v, expected %v", err, ErrHeaderStringLength)
+	}
+	if err := h.SetMakerCode("0\n"); !errors.Is(err, ErrHeaderStringSymbols) {
+		t.Errorf("got %v, expected %v", err, ErrHeaderStringSymbols)
+	}
+	if h.GameTitle != "NINTIL" || h.GameCode != "" || h.MakerCode != "" {
+		t.Errorf("invalid strings were applied: %q %q %q", h.GameTitle, h.GameCode, h.MakerCode)
+	}
+}
+
+func TestHeaderJSON(t *testing.T) {
+	h := &Header{GameTitle: "NINTIL\x00\x00", GameCode: "NTIL", MakerCode: "01", UnitCode: UnitCodeDSi}
+	h.Twl = &TwlHeader{Arm9iRomOffset: 0x80000}
+	h.SetSecureAreaChecksum(0x1234)
+	h.SetDebug(1, 2, 3)
+	data, err := json.Marshal(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := &Header{}
+	if err := json.Unmarshal(data, got); err != nil {
+		t.Fatal(err)
+	}
+	if got.GameTitle != "NINTIL" || got.SecureAreaChecksum() != 0x1234 || got.Twl == nil || got.Twl.Arm9iRomOffset != 0x80000 {
+		t.Errorf("got %+v", got)
+	}
+	if romOffset, size, ramAddress := got.Debug(); romOffset != 1 || size != 2 || ramAddress != 3 {
+		t.Errorf("got debug %d %d %d", romOffset, size, ramAddress)
+	}
+
+	// Invalid strings and unknown fields leave the header unchanged
+	for _, patch := range []string{`{"GameCode":"€"}`, `{"MakerCode":"012"}`, `{"Unknown":1}`} {
+		if err := json.Unmarshal([]byte(patch), got); err == nil {
+			t.Errorf("%s: expected an error", patch)
+		}
+	}
+	if got.GameCode != "NTIL" || got.MakerCode != "01" {
+		t.Errorf("header changed to %q %q", got.GameCode, got.MakerCode)
+	}
+
+	// Invalid patches leave the DSi header unchanged too
+	for _, patch := range []string{`{"Twl":{"TitleId":5},"MakerCode":"012"}`, `{"Twl":{"TitleId":5,"Raw":"AAAA"}}`, `{"Twl":{"TitleId":5,"Unknown":1}}`} {
+		if err := json.Unmarshal([]byte(patch), got); err == nil {
+			t.Errorf("%s: expected an error", patch)
+		}
+	}
+	if got.Twl.TitleId != 0 {
+		t.Errorf("DSi title ID changed to %X", got.Twl.TitleId)
+	}
+}
+
+func TestHeaderJSONBytes(t *testing.T) {
+	h := &Header{GameTitle: "NINTIL\xFF\x80", GameCode: "NTIL", MakerCode: "\x01\x00"}
+	data, err := json.Marshal(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Strings that are not ASCII survive a round trip
+	got := &Header{}
+	if err := json.Unmarshal(data, got); err != nil {
+		t.Fatal(err)
+	}
+	if got.GameTitle != h.GameTitle || got.MakerCode != "\x01" {
+		t.Errorf("got %q %q, expected %q %q", got.GameTitle, got.MakerCode, h.GameTitle, "\x01")
+	}
+
+	// And do not stop other fields from being patched
+	if err := json.Unmarshal([]byte(`{"GameCode":"ABCD"}`), got); err != nil {
+		t.Fatal(err)
+	}
+	if got.GameCode != "ABCD" || got.GameTitle != h.GameTitle {
+		t.Errorf("got %q %q", got.GameCode, got.GameTitle)
+	}
+}
+
+func TestTwlHeaderJSON(t *testing.T) {
+	h := &Header{UnitCode: UnitCodeDSi, Twl: &TwlHeader{TitleId: 0x00030004}}
+	h.Twl.raw[0xF80-twlHeaderStart] = 0xAB
+	data, err := json.Marshal(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Unparsed fields survive, even onto a fresh header
+	got := &Header{}
+	if err := json.Unmarshal(data, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Twl.encode(), h.Twl.encode()) || got.Twl.TitleId != h.Twl.TitleId {
+		t.Errorf("got title ID %X, DSi header data differs", got.Twl.TitleId)
+	}
+
+	// Named fields take precedence over the raw data
+	if err := json.Unmarshal([]byte(`{"Twl":{"TitleId":5}}`), got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Twl.TitleId != 5 || got.Twl.raw[0xF80-twlHeaderStart] != 0xAB {
+		t.Errorf("got title ID %X, unparsed byte %02X", got.Twl.TitleId, got.Twl.raw[0xF80-twlHeaderStart])
+	}
+	saved := saveAndOpenHeader(t, got)
+	if saved.Twl.TitleId != 5 || saved.Twl.raw[0xF80-twlHeaderStart] != 0xAB {
+		t.Errorf("saved title ID %X, unparsed byte %02X", saved.Twl.TitleId, saved.Twl.raw[0xF80-twlHeaderStart])
+	}
+}
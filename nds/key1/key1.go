@@ -0,0 +1,146 @@
+// KEY1 encryption, as used for the secure area of Nintendo DS ROMs.
+// KEY1 is Blowfish with a fixed initial key table, scrambled with the game code.
+//
+// The key table is copyrighted, so it is not included here.
+// It can be dumped from the ARM7 BIOS of a Nintendo DS, see OpenKeyTable.
+package key1
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+var ErrKeyTableSize = errors.New("key table must be 0x1048 bytes, or a 0x4000 byte ARM7 BIOS")
+var ErrGameCodeLength = errors.New("game code must be 4 bytes")
+
+// Size of the key table, in bytes
+const KeyTableSize = 0x1048
+
+// Where the key table lives in the ARM7 BIOS
+const (
+	biosSize        = 0x4000
+	biosTableOffset = 0x30
+)
+
+// Blowfish P-array and S-boxes
+const (
+	keyTableWords = KeyTableSize / 4
+	pArraySize    = 18
+	sBoxSize      = 0x100
+)
+
+// Initial KEY1 key table.
+type KeyTable [keyTableWords]uint32
+
+// Read a key table.
+// Either the 0x1048 byte key table itself, or a whole ARM7 BIOS dump is accepted.
+func OpenKeyTable(r io.Reader) (*KeyTable, error) {
+	data, err := io.ReadAll(io.LimitReader(r, biosSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("open key table: %w", err)
+	}
+	switch len(data) {
+	case KeyTableSize:
+	case biosSize:
+		data = data[biosTableOffset : biosTableOffset+KeyTableSize]
+	default:
+		return nil, fmt.Errorf("open key table: %w", ErrKeyTableSize)
+	}
+
+	table := &KeyTable{}
+	for i := range table {
+		table[i] = binary.LittleEndian.Uint32(data[i*4:])
+	}
+	return table, nil
+}
+
+// Key table scrambled with a key code.
+type cipher struct {
+	keys [keyTableWords]uint32
+	code [3]uint32
+}
+
+// Create a level 2 cipher, as used for the first block of the secure area.
+func newCipher(table *KeyTable, gameCode string) (*cipher, error) {
+	if len(gameCode) != 4 {
+		return nil, ErrGameCodeLength
+	}
+	id := binary.LittleEndian.Uint32([]byte(gameCode))
+	c := &cipher{
+		keys: *table,
+		code: [3]uint32{id, id >> 1, id << 1},
+	}
+	c.applyKeyCode()
+	c.applyKeyCode()
+	return c, nil
+}
+
+// Advance cipher to level 3, as used for the rest of the secure area.
+func (c *cipher) level3() {
+	c.code[1] <<= 1
+	c.code[2] >>= 1
+	c.applyKeyCode()
+}
+
+// Scramble key table with the key code.
+func (c *cipher) applyKeyCode() {
+	c.encrypt(&c.code[1], &c.code[2])
+	c.encrypt(&c.code[0], &c.code[1])
+	for i := 0; i < pArraySize; i++ {
+		c.keys[i] ^= bits.ReverseBytes32(c.code[i%2])
+	}
+
+	var lo, hi uint32
+	for i := 0; i < len(c.keys); i += 2 {
+		c.encrypt(&lo, &hi)
+		c.keys[i] = hi
+		c.keys[i+1] = lo
+	}
+}
+
+func (c *cipher) f(x uint32) uint32 {
+	s := c.keys[pArraySize:]
+	a := s[x>>24]
+	b := s[sBoxSize+(x>>16)&0xFF]
+	d := s[sBoxSize*2+(x>>8)&0xFF]
+	e := s[sBoxSize*3+x&0xFF]
+	return e + (d ^ (b + a))
+}
+
+// Encrypt a 64-bit block, split into its low and high word.
+func (c *cipher) encrypt(lo, hi *uint32) {
+	x, y := *hi, *lo
+	for i := 0; i < 16; i++ {
+		z := c.keys[i] ^ x
+		x = y ^ c.f(z)
+		y = z
+	}
+	*lo = x ^ c.keys[16]
+	*hi = y ^ c.keys[17]
+}
+
+// Decrypt a 64-bit block, split into its low and high word.
+func (c *cipher) decrypt(lo, hi *uint32) {
+	x, y := *hi, *lo
+	for i := 17; i > 1; i-- {
+		z := c.keys[i] ^ x
+		x = y ^ c.f(z)
+		y = z
+	}
+	*hi = y ^ c.keys[0]
+	*lo = x ^ c.keys[1]
+}
+
+// Encrypt or decrypt every 8 byte block in data.
+func (c *cipher) apply(data []byte, crypt func(lo, hi *uint32)) {
+	for i := 0; i+8 <= len(data); i += 8 {
+		lo := binary.LittleEndian.Uint32(data[i:])
+		hi := binary.LittleEndian.Uint32(data[i+4:])
+		crypt(&lo, &hi)
+		binary.LittleEndian.PutUint32(data[i:], lo)
+		binary.LittleEndian.PutUint32(data[i+4:], hi)
+	}
+}
@@ -0,0 +1,162 @@
+package key1
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+// Generate a key table.
+// The real one is not needed, KEY1 works with any table.
+func testKeyTable(t *testing.T) *KeyTable {
+	t.Helper()
+	raw := make([]byte, KeyTableSize)
+	rand.New(rand.NewSource(1)).Read(raw)
+	table, err := OpenKeyTable(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return table
+}
+
+// Start of an ARM9 binary with a decrypted secure area.
+func decryptedArm9(seed int64) []byte {
+	data := make([]byte, SecureAreaSize+0x100)
+	rand.New(rand.NewSource(seed)).Read(data)
+	copy(data, secureAreaDecrypted)
+	return data
+}
+
+func TestOpenKeyTable(t *testing.T) {
+	raw := make([]byte, biosSize)
+	rand.New(rand.NewSource(2)).Read(raw)
+	fromTable, err := OpenKeyTable(bytes.NewReader(raw[biosTableOffset : biosTableOffset+KeyTableSize]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromBios, err := OpenKeyTable(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *fromTable != *fromBios {
+		t.Errorf("key table read from BIOS differs")
+	}
+
+	for _, size := range []int{0, KeyTableSize - 1, KeyTableSize + 1, biosSize + 1} {
+		if _, err := OpenKeyTable(bytes.NewReader(make([]byte, size))); !errors.Is(err, ErrKeyTableSize) {
+			t.Errorf("size 0x%X: got %v, expected %v", size, err, ErrKeyTableSize)
+		}
+	}
+}
+
+func TestSecureAreaRoundTrip(t *testing.T) {
+	table := testKeyTable(t)
+	for i, gameCode := range []string{"ABCE", "AMRE", "A6CP", "\x00\x00\x00\x00"} {
+		t.Run(gameCode, func(t *testing.T) {
+			original := decryptedArm9(int64(i))
+			data := bytes.Clone(original)
+			if err := EncryptSecureArea(table, gameCode, data); err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Equal(data[:SecureAreaSize], original[:SecureAreaSize]) {
+				t.Errorf("secure area was not encrypted")
+			}
+			if !bytes.Equal(data[SecureAreaSize:], original[SecureAreaSize:]) {
+				t.Errorf("data after the secure area was changed")
+			}
+
+			// The encrypted ID decrypts to "encryObj"
+			id := [8]byte(data[:8])
+			if err := decryptID(table, gameCode, id[:]); err != nil {
+				t.Fatal(err)
+			}
+			if string(id[:]) != secureAreaID {
+				t.Errorf("ID decrypts to %q, expected %q", id, secureAreaID)
+			}
+
+			if err := DecryptSecureArea(table, gameCode, data); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, original) {
+				t.Errorf("decrypted secure area differs from original")
+			}
+		})
+	}
+}
+
+func TestSecureAreaState(t *testing.T) {
+	table := testKeyTable(t)
+	decrypted := decryptedArm9(10)
+	encrypted := bytes.Clone(decrypted)
+	if err := EncryptSecureArea(table, "ABCE", encrypted); err != nil {
+		t.Fatal(err)
+	}
+	plain := make([]byte, SecureAreaSize)
+	rand.New(rand.NewSource(11)).Read(plain)
+
+	tests := []struct {
+		name     string
+		table    *KeyTable
+		gameCode string
+		data     []byte
+		state    State
+		err      error
+	}{
+		{"decrypted", table, "ABCE", decrypted, StateDecrypted, nil},
+		{"decrypted without table", nil, "ABCE", decrypted, StateDecrypted, nil},
+		{"encrypted", table, "ABCE", encrypted, StateEncrypted, nil},
+		{"encrypted without table", nil, "ABCE", encrypted, StateUnknown, nil},
+		{"encrypted for other game", table, "XYZE", encrypted, StateUnknown, nil},
+		{"no secure area", table, "ABCE", plain, StateUnknown, nil},
+		{"too short", table, "ABCE", decrypted[:SecureAreaSize-1], StateUnknown, ErrSecureAreaSize},
+		{"bad game code", table, "ABC", encrypted, StateUnknown, ErrGameCodeLength},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state, err := SecureAreaState(tt.table, tt.gameCode, tt.data)
+			if !errors.Is(err, tt.err) {
+				t.Errorf("got error %v, expected %v", err, tt.err)
+			}
+			if state != tt.state {
+				t.Errorf("got state %s, expected %s", state, tt.state)
+			}
+		})
+	}
+}
+
+func TestSecureAreaErrors(t *testing.T) {
+	table := testKeyTable(t)
+	decrypted := decryptedArm9(20)
+	encrypted := bytes.Clone(decrypted)
+	if err := EncryptSecureArea(table, "ABCE", encrypted); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		crypt func(*KeyTable, string, []byte) error
+		code  string
+		data  []byte
+		err   error
+	}{
+		{"encrypt encrypted", EncryptSecureArea, "ABCE", encrypted, ErrNotDecrypted},
+		{"decrypt decrypted", DecryptSecureArea, "ABCE", decrypted, ErrNotEncrypted},
+		{"decrypt with other game code", DecryptSecureArea, "XYZE", encrypted, ErrNotEncrypted},
+		{"encrypt short", EncryptSecureArea, "ABCE", decrypted[:8], ErrSecureAreaSize},
+		{"decrypt short", DecryptSecureArea, "ABCE", encrypted[:8], ErrSecureAreaSize},
+		{"encrypt bad game code", EncryptSecureArea, "ABCDE", decrypted, ErrGameCodeLength},
+		{"decrypt bad game code", DecryptSecureArea, "", encrypted, ErrGameCodeLength},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := bytes.Clone(tt.data)
+			if err := tt.crypt(table, tt.code, data); !errors.Is(err, tt.err) {
+				t.Errorf("got %v, expected %v", err, tt.err)
+			}
+			if !bytes.Equal(data, tt.data) {
+				t.Errorf("data was changed")
+			}
+		})
+	}
+}
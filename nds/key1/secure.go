@@ -0,0 +1,131 @@
+package key1
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrSecureAreaSize = errors.New("secure area must be at least 0x800 bytes")
+var ErrNotEncrypted = errors.New("secure area is not encrypted")
+var ErrNotDecrypted = errors.New("secure area is not decrypted")
+
+// Size of the encrypted part of the secure area, in bytes.
+// This is the start of the ARM9 binary.
+const SecureAreaSize = 0x800
+
+// First 8 bytes of the secure area.
+// Once decrypted, "encryObj" is replaced by two undefined instructions.
+const (
+	secureAreaID        = "encryObj"
+	secureAreaDecrypted = "\xFF\xDE\xFF\xE7\xFF\xDE\xFF\xE7"
+)
+
+// Encryption state of a secure area.
+type State int
+
+const (
+	// Not known, either because no key table was given or because there is no secure area
+	StateUnknown State = iota
+
+	// Decrypted, starts with two undefined instructions
+	StateDecrypted
+
+	// Encrypted, starts with "encryObj" once decrypted
+	StateEncrypted
+)
+
+func (s State) String() string {
+	switch s {
+	case StateDecrypted:
+		return "decrypted"
+	case StateEncrypted:
+		return "encrypted"
+	default:
+		return "unknown"
+	}
+}
+
+// Get the encryption state of a secure area.
+// data is the start of the ARM9 binary.
+// Without a key table, encrypted secure areas cannot be detected.
+func SecureAreaState(table *KeyTable, gameCode string, data []byte) (State, error) {
+	if len(data) < SecureAreaSize {
+		return StateUnknown, ErrSecureAreaSize
+	}
+	if string(data[:8]) == secureAreaDecrypted {
+		return StateDecrypted, nil
+	}
+	if table == nil {
+		return StateUnknown, nil
+	}
+
+	id := [8]byte(data[:8])
+	if err := decryptID(table, gameCode, id[:]); err != nil {
+		return StateUnknown, err
+	}
+	if string(id[:]) == secureAreaID {
+		return StateEncrypted, nil
+	}
+	return StateUnknown, nil
+}
+
+// Decrypt the secure area in place.
+// data is the start of the ARM9 binary, only the first 0x800 bytes are changed.
+// Returns ErrNotEncrypted if the secure area does not decrypt to a valid ID.
+func DecryptSecureArea(table *KeyTable, gameCode string, data []byte) error {
+	if len(data) < SecureAreaSize {
+		return fmt.Errorf("decrypt secure area: %w", ErrSecureAreaSize)
+	}
+
+	id := [8]byte(data[:8])
+	if err := decryptID(table, gameCode, id[:]); err != nil {
+		return fmt.Errorf("decrypt secure area: %w", err)
+	}
+	if string(id[:]) != secureAreaID {
+		return fmt.Errorf("decrypt secure area: %w", ErrNotEncrypted)
+	}
+
+	c, _ := newCipher(table, gameCode)
+	c.level3()
+	c.apply(data[8:SecureAreaSize], c.decrypt)
+	copy(data, secureAreaDecrypted)
+	return nil
+}
+
+// Encrypt the secure area in place.
+// data is the start of the ARM9 binary, only the first 0x800 bytes are changed.
+// Returns ErrNotDecrypted if the secure area does not start with the decrypted ID.
+func EncryptSecureArea(table *KeyTable, gameCode string, data []byte) error {
+	if len(data) < SecureAreaSize {
+		return fmt.Errorf("encrypt secure area: %w", ErrSecureAreaSize)
+	}
+	if string(data[:8]) != secureAreaDecrypted {
+		return fmt.Errorf("encrypt secure area: %w", ErrNotDecrypted)
+	}
+
+	c, err := newCipher(table, gameCode)
+	if err != nil {
+		return fmt.Errorf("encrypt secure area: %w", err)
+	}
+	c.level3()
+	c.apply(data[8:SecureAreaSize], c.encrypt)
+
+	// The ID is encrypted twice, first with level 3, then with level 2
+	copy(data, secureAreaID)
+	c.apply(data[:8], c.encrypt)
+	c, _ = newCipher(table, gameCode)
+	c.apply(data[:8], c.encrypt)
+	return nil
+}
+
+// Decrypt the secure area ID in place.
+func decryptID(table *KeyTable, gameCode string, id []byte) error {
+	c, err := newCipher(table, gameCode)
+	if err != nil {
+		return err
+	}
+	c.apply(id, c.decrypt)
+	c.level3()
+	c.apply(id, c.decrypt)
+	return nil
+}
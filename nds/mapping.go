@@ -4,5 +4,9 @@ const (
 	mappingNameHeader     = "ROM header"
 	mappingBanner         = "ROM banner"
 	mappingNameArm9Binary = "ARM9 binary"
+	mappingNameArm9Footer = "ARM9 footer"
 	mappingNameArm7Binary = "ARM7 binary"
+
+	mappingNameArm9iBinary = "ARM9i binary"
+	mappingNameArm7iBinary = "ARM7i binary"
 )
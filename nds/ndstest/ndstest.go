@@ -0,0 +1,56 @@
+// Build small ROMs for tests of packages that work on ROMs.
+package ndstest
+
+import (
+	"bytes"
+	"maps"
+	"testing"
+	"testing/fstest"
+
+	"github.com/sukus21/nintil/nds"
+	"github.com/sukus21/nintil/nds/nitrofs"
+	"github.com/sukus21/nintil/util"
+)
+
+// Get a header for a test ROM, with the ARM9 binary at 0x02000000 and the ARM7 binary at 0x02380000.
+func Header() *nds.Header {
+	return &nds.Header{
+		GameTitle:       "NINTIL",
+		GameCode:        "NTIL",
+		MakerCode:       "01",
+		Arm9Destination: 0x02000000,
+		Arm7Destination: 0x02380000,
+		HeaderSize:      0x4000,
+	}
+}
+
+// Open a ROM from ndstool files, with a version 1 banner with a blank icon and titles.
+// files holds the files other than header.bin and banner.bin, at least arm9.bin and arm7.bin.
+func Rom(t testing.TB, h *nds.Header, files fstest.MapFS) *nds.Rom {
+	t.Helper()
+	header := util.NewWriteSeeker(make([]byte, 0x1000))
+	if err := nds.SaveHeader(header, h); err != nil {
+		t.Fatal(err)
+	}
+	banner := make([]byte, 0x840)
+	banner[0] = nds.BannerVersionOriginal
+
+	fsys := maps.Clone(files)
+	fsys["header.bin"] = &fstest.MapFile{Data: header.Buf[:0x200]}
+	fsys["banner.bin"] = &fstest.MapFile{Data: banner}
+	rom, err := nds.OpenNdstool(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rom
+}
+
+// Get an overlay table, as stored in y9.bin and y7.bin.
+func OverlayTable(t testing.TB, overlays []nitrofs.Overlay, fileIDs []uint16) []byte {
+	t.Helper()
+	table := &bytes.Buffer{}
+	if err := nitrofs.WriteOverlayTable(table, overlays, fileIDs); err != nil {
+		t.Fatal(err)
+	}
+	return table.Bytes()
+}
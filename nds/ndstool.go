@@ -0,0 +1,278 @@
+package nds
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/sukus21/nintil/nds/nitrofs"
+	"github.com/sukus21/nintil/util"
+	"github.com/sukus21/nintil/util/mapping"
+)
+
+// Files and folders of the ndstool directory layout
+const (
+	ndstoolHeader  = "header.bin"
+	ndstoolBanner  = "banner.bin"
+	ndstoolArm9    = "arm9.bin"
+	ndstoolArm7    = "arm7.bin"
+	ndstoolArm9i   = "arm9i.bin"
+	ndstoolArm7i   = "arm7i.bin"
+	ndstoolOvt9    = "y9.bin"
+	ndstoolOvt7    = "y7.bin"
+	ndstoolOverlay = "overlay/overlay_%04d.bin"
+	ndstoolData    = "data"
+)
+
+// Size of header.bin, the DSi header is only included for DSi ROMs
+const (
+	ndstoolHeaderSize    = 0x0200
+	ndstoolHeaderSizeTwl = 0x1000
+)
+
+// Extract a ROM to dir, using the same directory layout as ndstool.
+// NitroFS files go in data/, overlay files go in overlay/ and are named after their file ID.
+// The header is written as-is, so its offsets point into the original ROM.
+//
+// FAT entries without a name are not extracted,
+// and neither is the DSi region data before the ARM9i binary.
+func SaveNdstool(o *Rom, dir string) error {
+	writeFile := func(name string, data []byte) error {
+		return os.WriteFile(filepath.Join(dir, filepath.FromSlash(name)), data, 0666)
+	}
+	for _, d := range []string{dir, filepath.Join(dir, "overlay"), filepath.Join(dir, ndstoolData)} {
+		if err := os.MkdirAll(d, os.ModePerm); err != nil {
+			return err
+		}
+	}
+
+	// Write header
+	headerBuf := util.NewWriteSeeker(make([]byte, ndstoolHeaderSizeTwl))
+	if err := SaveHeader(headerBuf, o.header); err != nil {
+		return err
+	}
+	headerSize := ndstoolHeaderSize
+	if o.header.Twl != nil {
+		headerSize = ndstoolHeaderSizeTwl
+	}
+	if err := writeFile(ndstoolHeader, headerBuf.Buf[:headerSize]); err != nil {
+		return err
+	}
+
+	// Write banner, without padding
+	bannerBuf := &bytes.Buffer{}
+	if err := SaveBanner(bannerBuf, o.banner); err != nil {
+		return err
+	}
+	if err := writeFile(ndstoolBanner, bannerBuf.Bytes()[:o.banner.getDataSize()]); err != nil {
+		return err
+	}
+
+	// Write binaries, ndstool keeps the ARM9 footer
+	if err := writeFile(ndstoolArm9, slices.Concat(o.Arm9Binary, o.arm9Footer)); err != nil {
+		return err
+	}
+	if err := writeFile(ndstoolArm7, o.Arm7Binary); err != nil {
+		return err
+	}
+	if o.header.Twl != nil {
+		if err := writeFile(ndstoolArm9i, o.Arm9iBinary); err != nil {
+			return err
+		}
+		if err := writeFile(ndstoolArm7i, o.Arm7iBinary); err != nil {
+			return err
+		}
+	}
+
+	// Write overlay tables and overlay files
+	arm9Overlays := o.Arm9Overlays.All()
+	arm7Overlays := o.Arm7Overlays.All()
+	ids9, ids7 := ndstoolOverlayIDs(arm9Overlays, arm7Overlays)
+	for _, table := range []struct {
+		name     string
+		overlays []nitrofs.Overlay
+		ids      []uint16
+	}{
+		{ndstoolOvt9, arm9Overlays, ids9},
+		{ndstoolOvt7, arm7Overlays, ids7},
+	} {
+		buf := &bytes.Buffer{}
+		if err := nitrofs.WriteOverlayTable(buf, table.overlays, table.ids); err != nil {
+			return err
+		}
+		if err := writeFile(table.name, buf.Bytes()); err != nil {
+			return err
+		}
+		for i, ov := range table.overlays {
+			data, err := nitrofs.ReadOverlayData(ov)
+			if err != nil {
+				return err
+			}
+			if err := writeFile(fmt.Sprintf(ndstoolOverlay, table.ids[i]), data); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Write NitroFS files
+	return fs.WalkDir(o.Filesystem, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		outPath := filepath.Join(dir, ndstoolData, filepath.FromSlash(p))
+		if d.IsDir() {
+			return os.MkdirAll(outPath, os.ModePerm)
+		}
+
+		in, err := o.Filesystem.Open(p)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		out, err := os.Create(outPath)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+		_, err = io.Copy(out, in)
+		return err
+	})
+}
+
+// Get the file IDs overlays are extracted with.
+// Original file IDs are kept if every overlay has a unique one,
+// otherwise overlays are numbered in order, ARM9 overlays first.
+func ndstoolOverlayIDs(arm9 []nitrofs.Overlay, arm7 []nitrofs.Overlay) ([]uint16, []uint16) {
+	all := slices.Concat(arm9, arm7)
+	ids := make([]uint16, len(all))
+	seen := map[uint16]bool{}
+	for i, ov := range all {
+		simple, ok := ov.(*nitrofs.OverlaySimple)
+		if !ok {
+			break
+		}
+		id, ok := simple.FileID()
+		if !ok || seen[id] {
+			break
+		}
+		seen[id] = true
+		ids[i] = id
+	}
+
+	// Not all overlays had a usable ID
+	if len(seen) != len(all) {
+		for i := range ids {
+			ids[i] = uint16(i)
+		}
+	}
+	return ids[:len(arm9)], ids[len(arm9):]
+}
+
+// Open a ROM extracted to the ndstool directory layout, for example with os.DirFS.
+// The ROM can then be built with SaveROM or SaveROMTo.
+// The header is used as-is, except for the parts SaveROM always updates.
+func OpenNdstool(fsys fs.FS) (*Rom, error) {
+	readFile := func(name string) ([]byte, error) {
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, fmt.Errorf("open ndstool directory: %w", err)
+		}
+		return data, nil
+	}
+
+	// Read header
+	headerData, err := readFile(ndstoolHeader)
+	if err != nil {
+		return nil, err
+	}
+	h, err := OpenHeader(bytes.NewReader(headerData))
+	if err != nil {
+		return nil, fmt.Errorf("open ndstool directory: %s: %w", ndstoolHeader, err)
+	}
+	capacity, err := DeviceCapacity(h.DeviceSize)
+	if err != nil {
+		capacity, _ = DeviceCapacity(DeviceSizeMax)
+	}
+	rom := &Rom{
+		header:  h,
+		mapping: mapping.NewMapping(capacity),
+	}
+
+	// Read banner
+	bannerData, err := readFile(ndstoolBanner)
+	if err != nil {
+		return nil, err
+	}
+	if rom.banner, err = OpenBanner(bytes.NewReader(bannerData)); err != nil {
+		return nil, fmt.Errorf("open ndstool directory: %s: %w", ndstoolBanner, err)
+	}
+
+	// Read binaries, split ARM9 footer from binary
+	if rom.Arm9Binary, err = readFile(ndstoolArm9); err != nil {
+		return nil, err
+	}
+	if n := len(rom.Arm9Binary) - arm9FooterSize; n >= 0 && binary.LittleEndian.Uint32(rom.Arm9Binary[n:]) == moduleParamsMagic1 {
+		rom.arm9Footer = rom.Arm9Binary[n:]
+		rom.Arm9Binary = rom.Arm9Binary[:n:n]
+	}
+	if rom.Arm7Binary, err = readFile(ndstoolArm7); err != nil {
+		return nil, err
+	}
+	if h.Twl != nil {
+		if rom.Arm9iBinary, err = readFile(ndstoolArm9i); err != nil {
+			return nil, err
+		}
+		if rom.Arm7iBinary, err = readFile(ndstoolArm7i); err != nil {
+			return nil, err
+		}
+	}
+
+	// Read overlays
+	if rom.Arm9Overlays, err = openNdstoolOverlays(fsys, ndstoolOvt9); err != nil {
+		return nil, err
+	}
+	if rom.Arm7Overlays, err = openNdstoolOverlays(fsys, ndstoolOvt7); err != nil {
+		return nil, err
+	}
+
+	// NitroFS files are read when building
+	data, err := fs.Sub(fsys, ndstoolData)
+	if err != nil {
+		return nil, fmt.Errorf("open ndstool directory: %w", err)
+	}
+	rom.Filesystem = nitrofs.WithOverlays(data, rom.Arm9Overlays, rom.Arm7Overlays)
+	return rom, nil
+}
+
+// Read an overlay table and its overlay files.
+// A missing overlay table means there are no overlays.
+func openNdstoolOverlays(fsys fs.FS, name string) (*nitrofs.OverlaySet, error) {
+	table, err := fs.ReadFile(fsys, name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nitrofs.NewOverlaySet(), nil
+	} else if err != nil {
+		return nil, fmt.Errorf("open ndstool directory: %w", err)
+	}
+
+	overlays, err := nitrofs.ReadOverlayTable(bytes.NewReader(table), 0, uint32(len(table)))
+	if err != nil {
+		return nil, fmt.Errorf("open ndstool directory: %s: %w", name, err)
+	}
+	set := nitrofs.NewOverlaySet()
+	for _, ov := range overlays {
+		id, _ := ov.FileID()
+		data, err := fs.ReadFile(fsys, fmt.Sprintf(ndstoolOverlay, id))
+		if err != nil {
+			return nil, fmt.Errorf("open ndstool directory: %w", err)
+		}
+		ov.SetData(data)
+		set.Append(ov)
+	}
+	return set, nil
+}
@@ -0,0 +1,92 @@
+package nds
+
+import (
+	"bytes"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Get a region of a ROM image.
+func romRegion(data []byte, offset uint32, size uint32) []byte {
+	return data[offset : offset+size]
+}
+
+// Get the paths and contents of all files in a filesystem.
+func readAllFiles(t *testing.T, fsys fs.FS) map[string][]byte {
+	t.Helper()
+	files := map[string][]byte{}
+	err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		files[p], err = fs.ReadFile(fsys, p)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestNdstoolRoundTrip(t *testing.T) {
+	for _, twl := range []bool{false, true} {
+		rom, data := testROM(t, twl)
+		dir := t.TempDir()
+		if err := SaveNdstool(rom, dir); err != nil {
+			t.Fatal(err)
+		}
+		if info, err := os.Stat(filepath.Join(dir, ndstoolHeader)); err != nil || info.Mode()&0111 != 0 {
+			t.Errorf("DSi %t: got %v, %v, expected a file that is not executable", twl, info, err)
+		}
+		opened, err := OpenNdstool(os.DirFS(dir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		saved, savedData := saveAndOpenROM(t, opened)
+
+		binaries := []struct {
+			name     string
+			got      []byte
+			expected []byte
+		}{
+			{"ARM9", saved.Arm9Binary, rom.Arm9Binary},
+			{"ARM7", saved.Arm7Binary, rom.Arm7Binary},
+			{"ARM9i", saved.Arm9iBinary, rom.Arm9iBinary},
+			{"ARM7i", saved.Arm7iBinary, rom.Arm7iBinary},
+		}
+		for _, b := range binaries {
+			if !bytes.Equal(b.got, b.expected) {
+				t.Errorf("DSi %t: %s binary differs", twl, b.name)
+			}
+		}
+
+		h, sh := rom.GetHeader(), saved.GetHeader()
+		if !bytes.Equal(romRegion(savedData, sh.Arm9OverlayOffset, sh.Arm9OverlaySize), romRegion(data, h.Arm9OverlayOffset, h.Arm9OverlaySize)) {
+			t.Errorf("DSi %t: ARM9 overlay table differs", twl)
+		}
+		if !bytes.Equal(romRegion(savedData, sh.Arm7OverlayOffset, sh.Arm7OverlaySize), romRegion(data, h.Arm7OverlayOffset, h.Arm7OverlaySize)) {
+			t.Errorf("DSi %t: ARM7 overlay table differs", twl)
+		}
+		overlays, savedOverlays := rom.Arm9Overlays.All(), saved.Arm9Overlays.All()
+		if len(savedOverlays) != len(overlays) {
+			t.Fatalf("DSi %t: got %d overlays, expected %d", twl, len(savedOverlays), len(overlays))
+		}
+		for i, ov := range overlays {
+			if !bytes.Equal(savedOverlays[i].Data(), ov.Data()) {
+				t.Errorf("DSi %t: overlay %d differs", twl, i)
+			}
+		}
+
+		bannerSize := uint32(rom.banner.getSize())
+		if !bytes.Equal(romRegion(savedData, sh.BannerOffset, bannerSize), romRegion(data, h.BannerOffset, bannerSize)) {
+			t.Errorf("DSi %t: banner differs", twl)
+		}
+
+		if !maps.EqualFunc(readAllFiles(t, saved.Filesystem), readAllFiles(t, rom.Filesystem), bytes.Equal) {
+			t.Errorf("DSi %t: NitroFS files differ", twl)
+		}
+	}
+}
@@ -22,16 +22,23 @@ func Validate(nfs fs.FS) error {
 	return err
 }
 
+// Implemented by files read from a ROM, to get their original FAT entry.
+type fatEntryFile interface {
+	fatEntry() (start uint32, end uint32)
+}
+
 type fsCacheFile struct {
 	name string
 	path string
+	id   uint16
 }
 
 type fsCacheFolder struct {
-	name    string
-	path    string
-	files   []fsCacheFile
-	folders []fsCacheFolder
+	name      string
+	path      string
+	files     []fsCacheFile
+	folders   []fsCacheFolder
+	firstFile uint16
 }
 
 type fsCache struct {
@@ -54,6 +61,9 @@ func validate(fsys fs.FS) (*fsCache, error) {
 	fsc.folderLookup["."] = &fsc.root
 	fsc.numFolders++
 
+	// Plus 1 for null-termination of root subtable
+	fsc.fntSubLen++
+
 	fs.WalkDir(fsys, ".", func(currentPath string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
@@ -123,15 +133,52 @@ func validate(fsys fs.FS) (*fsCache, error) {
 
 const alignment = uint32(0x0200)
 
+// Options for Build.
+type BuildOption func(*buildOptions)
+
+type buildOptions struct {
+	stableIDs bool
+}
+
+// Keep the original file IDs of all files and overlays, and the first file ID of each directory.
+// Original IDs are taken from filesystems implementing IDMapper.
+// New files are given IDs after the existing ones.
+// If this is not possible, Build returns ErrUnstableIDs.
+func WithStableIDs() BuildOption {
+	return func(o *buildOptions) {
+		o.stableIDs = true
+	}
+}
+
 // Builds a NitroFS filesystem from a fs.FS.
 // If the given filesystem implements nitrofs.NitroFS, overlay files will be written as well.
-func Build(w util.WriteAtSeeker, fsys fs.FS, mmap *mapping.Mapping) (info *Info, err error) {
+func Build(w util.WriteAtSeeker, fsys fs.FS, mmap *mapping.Mapping, opts ...BuildOption) (info *Info, err error) {
 	defer util.Recover(&err)
 	info = &Info{}
+	options := buildOptions{}
+	for _, opt := range opts {
+		opt(&options)
+	}
 
 	// Is this a valid NitroFS?
 	fsc := util.Must1(validate(fsys))
 
+	// Get overlays, if any
+	var arm9Overlays, arm7Overlays []Overlay
+	nfs, hasOverlays := fsys.(NitroFS)
+	if hasOverlays {
+		arm9Overlays = nfs.GetArm9Overlays()
+		arm7Overlays = nfs.GetArm7Overlays()
+	}
+
+	// Decide on file IDs
+	var plan *buildPlan
+	if options.stableIDs {
+		plan = util.Must1(planStable(fsys, fsc, arm9Overlays, arm7Overlays))
+	} else {
+		plan = util.Must1(planSequential(fsys, fsc, arm9Overlays, arm7Overlays))
+	}
+
 	writeHead := util.Must1(ezbin.At[uint32](w))
 	getWriter := func(size uint32, align bool) uint32 {
 		if size == 0 {
@@ -156,100 +203,47 @@ func Build(w util.WriteAtSeeker, fsys fs.FS, mmap *mapping.Mapping) (info *Info,
 	subtableWriter := io.NewOffsetWriter(w, int64(subOffset))
 
 	// Initialize FAT writing
-	info.FatSize = uint32(fsc.numFiles) * 8
+	info.FatSize = uint32(len(plan.entries)) * 8
 	info.FatOffset = getWriter(info.FatSize, true)
 	fatWriter := io.NewOffsetWriter(w, int64(info.FatOffset))
 
 	// Initialize overlay table writing
-	nfs, hasOverlays := fsys.(NitroFS)
 	var ovt9Writer *io.OffsetWriter
 	var ovt7Writer *io.OffsetWriter
 	if hasOverlays {
-		info.Ovt9Size = uint32(len(nfs.GetArm9Overlays())) * 32
+		info.Ovt9Size = uint32(len(arm9Overlays)) * 32
 		info.Ovt9Offset = getWriter(info.Ovt9Size, true)
 		ovt9Writer = io.NewOffsetWriter(w, int64(info.Ovt9Offset))
 
-		info.Ovt7Size = uint32(len(nfs.GetArm7Overlays())) * 32
+		info.Ovt7Size = uint32(len(arm7Overlays)) * 32
 		info.Ovt7Offset = getWriter(info.Ovt7Size, true)
 		ovt7Writer = io.NewOffsetWriter(w, int64(info.Ovt7Offset))
 	}
 
-	// Initialize file writing
-	fileId := uint16(0)
-	util.Must1(ezbin.Seek(w, writeHead, io.SeekStart))
-
-	// Handle overlay files
-	if hasOverlays {
-		for i, ov := range nfs.GetArm9Overlays() {
-			util.Must(overlayWrite(ovt9Writer, ov, uint32(i), fileId))
-			writeFile(bytes.NewReader(ov.Data()), w, fatWriter)
-			fileId++
-		}
-		for i, ov := range nfs.GetArm7Overlays() {
-			util.Must(overlayWrite(ovt7Writer, ov, uint32(i), fileId))
-			writeFile(bytes.NewReader(ov.Data()), w, fatWriter)
-			fileId++
-		}
-	}
-
-	type listElem struct {
-		folder *fsCacheFolder
-		parent uint16
-		mine   uint16
-	}
-
-	todoFolders := make([]listElem, 0, fsc.numFolders)
-	todoFolders = append(todoFolders, listElem{
-		folder: &fsc.root,
-		parent: uint16(fsc.numFolders),
-		mine:   0xF000,
-	})
+	// Write file name table
+	folders, parents := fsc.breadthFirst()
 	folderId := uint16(0xF001)
-
-	for len(todoFolders) != 0 {
-		listEntry := todoFolders[0]
-		folder := listEntry.folder
-		parent := listEntry.parent
-		myId := listEntry.mine
-		todoFolders = todoFolders[1:]
-
+	for i, folder := range folders {
 		subtableOffset := util.Must1(ezbin.At[uint32](subtableWriter))
 		subtableOffset += mainSize
 
-		// Write main table entry
-		util.Must(ezbin.Write(fntWriter, subtableOffset, fileId, parent))
-
-		// Write files
-		for i := range folder.files {
-			entry := folder.files[i]
-
-			// Open file for reading
-			file := util.Must1(fsys.Open(entry.path))
-			defer file.Close()
-			writeFile(file, w, fatWriter)
+		// Write main table entry, root holds number of folders instead of parent
+		parent := uint16(fsc.numFolders)
+		if i != 0 {
+			parent = 0xF000 | uint16(parents[i])
+		}
+		util.Must(ezbin.Write(fntWriter, subtableOffset, folder.firstFile, parent))
 
-			// Write to subtable
-			fname := []byte(entry.name)
+		// Write files to subtable
+		for _, file := range folder.files {
+			fname := []byte(file.name)
 			util.Must(ezbin.Write(subtableWriter, byte(len(fname)), fname))
-
-			// Increment file ID counter
-			fileId++
 		}
 
-		// Write folders
-		for i := range folder.folders {
-			childFolder := &folder.folders[i]
-
-			// Write to subtable
+		// Write folders to subtable
+		for _, childFolder := range folder.folders {
 			fname := []byte(childFolder.name)
 			util.Must(ezbin.Write(subtableWriter, byte(len(fname)|0x80), fname, folderId))
-
-			// Queue up this folder
-			todoFolders = append(todoFolders, listElem{
-				folder: childFolder,
-				parent: myId,
-				mine:   folderId,
-			})
 			folderId++
 		}
 
@@ -257,6 +251,45 @@ func Build(w util.WriteAtSeeker, fsys fs.FS, mmap *mapping.Mapping) (info *Info,
 		util.Must1(subtableWriter.Write([]byte{0}))
 	}
 
+	// Write overlay tables
+	for i, ov := range arm9Overlays {
+		fileId := plan.ovt9[i]
+		util.Must(overlayWrite(ovt9Writer, ov, plan.entries[fileId].data, uint32(i), fileId))
+	}
+	for i, ov := range arm7Overlays {
+		fileId := plan.ovt7[i]
+		util.Must(overlayWrite(ovt7Writer, ov, plan.entries[fileId].data, uint32(i), fileId))
+	}
+
+	// Write files, ordered by ID
+	util.Must1(ezbin.Seek(w, writeHead, io.SeekStart))
+	for id, entry := range plan.entries {
+		switch {
+		case entry.overlay:
+			writeFile(bytes.NewReader(entry.data), w, fatWriter)
+		case entry.path != "":
+			file := util.Must1(fsys.Open(entry.path))
+			writeFile(file, w, fatWriter)
+			file.Close()
+		case entry.unnamed:
+			// Empty unnamed files keep their original FAT entry
+			file := util.Must1(fsys.(IDFS).OpenID(uint16(id)))
+			if stat, err := file.Stat(); err == nil && stat.Size() == 0 {
+				start, end := uint32(0), uint32(0)
+				if fe, ok := file.(fatEntryFile); ok {
+					start, end = fe.fatEntry()
+				}
+				util.Must(ezbin.Write(fatWriter, start, end))
+			} else {
+				writeFile(file, w, fatWriter)
+			}
+			file.Close()
+		default:
+			// Unused ID
+			util.Must(ezbin.Write(fatWriter, uint32(0), uint32(0)))
+		}
+	}
+
 	// Ok, looks like that went well
 	return
 }
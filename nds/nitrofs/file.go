@@ -6,70 +6,31 @@ import (
 	"time"
 )
 
-type streamElement struct {
+// A file or folder in the NitroFS index.
+// Entries never change once the index is built.
+type streamEntry struct {
 	fs       *streamFS
-	r        *io.SectionReader
 	name     string
-	head     int
-	id       uint16
 	isFolder bool
-}
 
-// -------------------
-//
-// 	Implement fs.File
-//
-// -------------------
+	// File ID, or folder ID without the type flag (0x0000..0x0FFF)
+	id uint16
 
-func (e *streamElement) Stat() (fs.FileInfo, error) {
-	return e, nil
-}
-func (e *streamElement) Read(buf []byte) (int, error) {
-	if e.r == nil {
-		return 0, fs.ErrClosed
-	}
+	// Position of file data, only for files
+	start uint32
+	end   uint32
 
-	return e.r.Read(buf)
-}
-func (e *streamElement) Close() error {
-	if e.r == nil {
-		return fs.ErrClosed
-	}
-	e.r = nil
-	return nil
+	// First file ID and children sorted by name, only for folders
+	firstFile uint16
+	children  []*streamEntry
 }
 
-// --------------------------
-//
-// 	Implement fs.ReadDirFile
-//
-// --------------------------
-
-func (e *streamElement) ReadDir(n int) ([]fs.DirEntry, error) {
-	if e.head == -1 {
-		return nil, fs.ErrClosed
-	}
-
-	// Convert children to DirEntry array
-	children, offset := e.fs.getFolderChildren(e.id, uint32(e.head), n)
-	dirEntries := make([]fs.DirEntry, len(children))
-	for i := range children {
-		dirEntries[i] = children[i]
-	}
-
-	// Not enough elements received
-	e.head = int(offset)
-	if len(children) != n {
-		e.head = -1
-		if e.fs.err != nil {
-			return dirEntries, e.fs.err
-		} else if n > 0 {
-			return dirEntries, io.EOF
-		}
-	}
-
-	// All good
-	return dirEntries, nil
+// An opened file or folder.
+type streamElement struct {
+	*streamEntry
+	r      *io.SectionReader
+	head   int
+	closed bool
 }
 
 // -----------------------
@@ -78,14 +39,14 @@ func (e *streamElement) ReadDir(n int) ([]fs.DirEntry, error) {
 //
 // -----------------------
 
-func (e *streamElement) Type() fs.FileMode {
+func (e *streamEntry) Type() fs.FileMode {
 	if e.isFolder {
 		return fs.ModeDir
 	} else {
 		return 0
 	}
 }
-func (e *streamElement) Info() (fs.FileInfo, error) {
+func (e *streamEntry) Info() (fs.FileInfo, error) {
 	return e, nil
 }
 
@@ -95,75 +56,127 @@ func (e *streamElement) Info() (fs.FileInfo, error) {
 //
 // -----------------------
 
-func (e *streamElement) Name() string {
+func (e *streamEntry) Name() string {
 	return e.name
 }
-func (e *streamElement) Size() int64 {
-	start, end := e.fs.readFilePosition(e.id)
-	return int64(end - start)
+func (e *streamEntry) Size() int64 {
+	return int64(e.end) - int64(e.start)
 }
-func (e *streamElement) Mode() fs.FileMode {
+func (e *streamEntry) Mode() fs.FileMode {
 	mode := fs.FileMode(0555)
 	if e.isFolder {
 		mode |= fs.ModeDir
 	}
 	return mode
 }
-func (e *streamElement) ModTime() time.Time {
+func (e *streamEntry) ModTime() time.Time {
 	return time.Time{}
 }
-func (e *streamElement) IsDir() bool {
+func (e *streamEntry) IsDir() bool {
 	return e.isFolder
 }
-func (e *streamElement) Sys() any {
+func (e *streamEntry) Sys() any {
 	return e.fs
 }
 
-// ---------------------
+// Get the FAT entry of a file.
+func (e *streamEntry) fatEntry() (start uint32, end uint32) {
+	return e.start, e.end
+}
+
+// Open entry for reading.
+func (e *streamEntry) open() *streamElement {
+	element := &streamElement{
+		streamEntry: e,
+	}
+	if !e.isFolder {
+		element.r = io.NewSectionReader(e.fs.r, int64(e.start), e.Size())
+	}
+	return element
+}
+
+// -------------------
 //
-//  Implement io.Seeker, io.ReaderAt
+// 	Implement fs.File
 //
-// ---------------------
+// -------------------
 
-func (e *streamElement) Seek(offset int64, whence int) (int64, error) {
-	if e.r == nil {
-		return 0, fs.ErrClosed
+func (e *streamElement) Stat() (fs.FileInfo, error) {
+	if e.closed {
+		return nil, fs.ErrClosed
 	}
-	return e.r.Seek(offset, whence)
+	return e.streamEntry, nil
 }
-func (e *streamElement) ReadAt(p []byte, off int64) (int, error) {
-	if e.r == nil {
+func (e *streamElement) Read(buf []byte) (int, error) {
+	if e.closed {
 		return 0, fs.ErrClosed
 	}
-	return e.r.ReadAt(p, off)
+	if e.isFolder {
+		return 0, &fs.PathError{Op: "read", Path: e.name, Err: fs.ErrInvalid}
+	}
+	return e.r.Read(buf)
+}
+func (e *streamElement) Close() error {
+	if e.closed {
+		return fs.ErrClosed
+	}
+	e.closed = true
+	return nil
 }
 
-// -------------------
+// --------------------------
 //
-// 	Other methods
+// 	Implement fs.ReadDirFile
 //
-// -------------------
+// --------------------------
 
-// Only valid for folders
-func (e *streamElement) Children() []*streamElement {
+func (e *streamElement) ReadDir(n int) ([]fs.DirEntry, error) {
+	if e.closed {
+		return nil, fs.ErrClosed
+	}
 	if !e.isFolder {
-		return nil
+		return nil, &fs.PathError{Op: "readdir", Path: e.name, Err: fs.ErrInvalid}
 	}
-	children, _ := e.fs.getFolderChildren(e.id, 0, 0)
-	return children
+
+	// Convert children to DirEntry array
+	remaining := e.children[e.head:]
+	if n > 0 && len(remaining) > n {
+		remaining = remaining[:n]
+	}
+	dirEntries := make([]fs.DirEntry, len(remaining))
+	for i := range remaining {
+		dirEntries[i] = remaining[i]
+	}
+	e.head += len(remaining)
+
+	// No elements left
+	if n > 0 && len(dirEntries) == 0 {
+		return dirEntries, io.EOF
+	}
+	return dirEntries, nil
 }
 
-// Only valid for non-folders
-func (e *streamElement) Data() []byte {
+// ---------------------
+//
+//  Implement io.Seeker, io.ReaderAt
+//
+// ---------------------
+
+func (e *streamElement) Seek(offset int64, whence int) (int64, error) {
+	if e.closed {
+		return 0, fs.ErrClosed
+	}
 	if e.isFolder {
-		return nil
+		return 0, &fs.PathError{Op: "seek", Path: e.name, Err: fs.ErrInvalid}
 	}
-	return e.fs.readContent(e.id)
+	return e.r.Seek(offset, whence)
 }
-
-// Only valid for non-folders.
-// Initializes reader.
-func (e *streamElement) open() {
-	start, end := e.fs.readFilePosition(e.id)
-	e.r = io.NewSectionReader(e.fs.r, int64(start), int64(end)-int64(start))
+func (e *streamElement) ReadAt(p []byte, off int64) (int, error) {
+	if e.closed {
+		return 0, fs.ErrClosed
+	}
+	if e.isFolder {
+		return 0, &fs.PathError{Op: "read", Path: e.name, Err: fs.ErrInvalid}
+	}
+	return e.r.ReadAt(p, off)
 }
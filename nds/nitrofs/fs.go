@@ -1,16 +1,21 @@
 package nitrofs
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
+	"path"
+	"slices"
 	"strings"
+	"sync"
 
-	"github.com/sukus21/nintil/util"
 	"github.com/sukus21/nintil/util/ezbin"
 	"github.com/sukus21/nintil/util/mapping"
 )
 
+var ErrFolderLoop = errors.New("folder contains itself")
+
 type Info struct {
 	FntOffset  uint32
 	FntSize    uint32
@@ -22,11 +27,25 @@ type Info struct {
 	Ovt7Size   uint32
 }
 
-// This implements fs.FS
+// This implements fs.FS, fs.ReadDirFS, fs.ReadFileFS, fs.StatFS, fs.GlobFS and fs.SubFS.
+// Only ReadAt is used on the underlying reader, and the index is never changed once built,
+// so this is safe for concurrent use if the underlying reader is.
 type streamFS struct {
 	info *Info
-	r    util.ReadAtSeeker
-	err  error
+	r    io.ReaderAt
+
+	// Index of the whole filesystem, built on first use
+	index     *streamIndex
+	indexErr  error
+	indexOnce sync.Once
+}
+
+type streamIndex struct {
+	// Entries by path, the root folder is "."
+	entries map[string]*streamEntry
+
+	// File paths by ID, including overlay files
+	paths map[uint16]string
 }
 
 // ----------------------
@@ -38,6 +57,79 @@ type streamFS struct {
 func (blob *streamFS) GetInfo() *Info {
 	return blob.info
 }
+
+// Get the file ID of a file, or the first file ID of a directory.
+func (blob *streamFS) FileID(name string) (uint16, bool) {
+	entry, err := blob.lookup("open", name)
+	if err != nil {
+		return 0, false
+	}
+	if entry.isFolder {
+		return entry.firstFile, true
+	}
+	return entry.id, true
+}
+
+// Open a file by file ID.
+func (blob *streamFS) OpenID(id uint16) (fs.File, error) {
+	if uint32(id) >= blob.info.FatSize/8 {
+		return nil, &fs.PathError{
+			Op:   "open",
+			Path: fmt.Sprintf("#%d", id),
+			Err:  fs.ErrNotExist,
+		}
+	}
+
+	// Named files are already indexed
+	name := fmt.Sprintf("%d", id)
+	if p, err := blob.PathOf(id); err == nil {
+		if idx, _ := blob.getIndex(); idx != nil && idx.entries[p] != nil {
+			return idx.entries[p].open(), nil
+		}
+		name = path.Base(p)
+	}
+
+	entry, err := blob.entryByID(id, name)
+	if err != nil {
+		return nil, &fs.PathError{
+			Op:   "open",
+			Path: fmt.Sprintf("#%d", id),
+			Err:  err,
+		}
+	}
+	return entry.open(), nil
+}
+
+// Get the path of a file ID.
+func (blob *streamFS) PathOf(id uint16) (string, error) {
+	if uint32(id) >= blob.info.FatSize/8 {
+		return "", fmt.Errorf("file ID %d: %w", id, fs.ErrNotExist)
+	}
+	idx, err := blob.getIndex()
+	if err != nil {
+		return "", fmt.Errorf("file ID %d: %w", id, err)
+	}
+	if p, ok := idx.paths[id]; ok {
+		return p, nil
+	}
+	return "", fmt.Errorf("file ID %d: %w", id, ErrUnnamed)
+}
+
+// Get IDs of FAT entries with no name, that are not overlays either.
+func (blob *streamFS) UnnamedIDs() ([]uint16, error) {
+	idx, err := blob.getIndex()
+	if err != nil {
+		return nil, fmt.Errorf("unnamed file IDs: %w", err)
+	}
+	var ids []uint16
+	for id := range blob.info.FatSize / 8 {
+		if _, ok := idx.paths[uint16(id)]; !ok {
+			ids = append(ids, uint16(id))
+		}
+	}
+	return ids, nil
+}
+
 func (blob *streamFS) GetArm9Overlays() []Overlay {
 	return blob.readOverlays(blob.info.Ovt9Offset, blob.info.Ovt9Size)
 }
@@ -45,23 +137,22 @@ func (blob *streamFS) GetArm7Overlays() []Overlay {
 	return blob.readOverlays(blob.info.Ovt7Offset, blob.info.Ovt7Size)
 }
 
+// Read overlay table.
+// If an overlay cannot be read, only the overlays before it are returned.
 func (blob *streamFS) readOverlays(offset, size uint32) []Overlay {
 	out := make([]Overlay, size/32)
 
 	for i := range out {
 		fileId, overlay, err := overlayRead(blob.r, offset+uint32(i)*32)
 		if err != nil {
-			blob.err = err
-			return nil
+			return out[:i]
 		}
 
-		element := &streamElement{
-			fs:       blob,
-			id:       fileId,
-			isFolder: false,
+		entry, err := blob.entryByID(fileId, fmt.Sprintf("%d", i))
+		if err != nil {
+			return out[:i]
 		}
-		element.open()
-		overlay.element = element
+		overlay.element = entry.open()
 		out[i] = overlay
 	}
 
@@ -75,58 +166,140 @@ func (blob *streamFS) readOverlays(offset, size uint32) []Overlay {
 // ---------------------------
 
 func (blob *streamFS) Open(name string) (fs.File, error) {
-	if !fs.ValidPath(name) {
-		return nil, &fs.PathError{
-			Op:   "open",
-			Path: name,
-			Err:  fs.ErrInvalid,
-		}
+	entry, err := blob.lookup("open", name)
+	if err != nil {
+		return nil, err
 	}
+	return entry.open(), nil
+}
 
-	root := &streamElement{
-		fs:       blob,
-		name:     "",
-		isFolder: true,
+// ---------------------------
+//
+//  Implement fs.ReadDirFS, fs.ReadFileFS, fs.StatFS
+//
+// ---------------------------
+
+func (blob *streamFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entry, err := blob.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !entry.isFolder {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
 	}
 
-	if name == "." {
-		return root, nil
+	dirEntries := make([]fs.DirEntry, len(entry.children))
+	for i, child := range entry.children {
+		dirEntries[i] = child
 	}
+	return dirEntries, nil
+}
 
-	names := strings.Split(name, "/")
-	elem := findByPath(root, names)
-	if elem == nil {
-		return nil, &fs.PathError{
-			Op:   "open",
-			Path: name,
-			Err:  fs.ErrNotExist,
-		}
+func (blob *streamFS) ReadFile(name string) ([]byte, error) {
+	entry, err := blob.lookup("readfile", name)
+	if err != nil {
+		return nil, err
+	}
+	if entry.isFolder {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: fs.ErrInvalid}
 	}
 
-	return elem, nil
+	content := make([]byte, entry.Size())
+	if n, err := blob.r.ReadAt(content, int64(entry.start)); n != len(content) {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: err}
+	}
+	return content, nil
 }
 
-func findByPath(elem *streamElement, path []string) fs.File {
-	if !elem.IsDir() {
-		return nil
+func (blob *streamFS) Stat(name string) (fs.FileInfo, error) {
+	entry, err := blob.lookup("stat", name)
+	if err != nil {
+		return nil, err
 	}
+	return entry, nil
+}
 
-	// Go through all children
-	for _, v := range elem.Children() {
-		if v.Name() == path[0] {
-			if len(path) == 1 {
-				if !v.isFolder {
-					v.open()
-				}
-				return v
-			} else {
-				return findByPath(v, path[1:])
-			}
+// ---------------------------
+//
+//  Implement fs.GlobFS, fs.SubFS
+//
+// ---------------------------
+
+// Same as fs.Glob, but using the index directly.
+func (blob *streamFS) Glob(pattern string) ([]string, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	return blob.glob(pattern)
+}
+
+func (blob *streamFS) glob(pattern string) ([]string, error) {
+	if !hasMeta(pattern) {
+		if _, err := blob.lookup("glob", pattern); err != nil {
+			return nil, nil
 		}
+		return []string{pattern}, nil
 	}
 
-	// No match found
-	return nil
+	dir, file := path.Split(pattern)
+	dir = strings.TrimSuffix(dir, "/")
+	if dir == "" {
+		dir = "."
+	}
+	if !hasMeta(dir) {
+		return blob.globIn(dir, file, nil)
+	}
+	if dir == pattern {
+		return nil, path.ErrBadPattern
+	}
+
+	dirs, err := blob.glob(dir)
+	if err != nil {
+		return nil, err
+	}
+	var matches []string
+	for _, d := range dirs {
+		if matches, err = blob.globIn(d, file, matches); err != nil {
+			return nil, err
+		}
+	}
+	return matches, nil
+}
+
+// Append names in dir matching pattern to matches.
+func (blob *streamFS) globIn(dir, pattern string, matches []string) ([]string, error) {
+	entry, err := blob.lookup("glob", dir)
+	if err != nil || !entry.isFolder {
+		return matches, nil
+	}
+	for _, child := range entry.children {
+		matched, err := path.Match(pattern, child.name)
+		if err != nil {
+			return matches, err
+		}
+		if matched {
+			matches = append(matches, path.Join(dir, child.name))
+		}
+	}
+	return matches, nil
+}
+
+func hasMeta(pattern string) bool {
+	return strings.ContainsAny(pattern, `*?[\`)
+}
+
+func (blob *streamFS) Sub(dir string) (fs.FS, error) {
+	entry, err := blob.lookup("sub", dir)
+	if err != nil {
+		return nil, err
+	}
+	if !entry.isFolder {
+		return nil, &fs.PathError{Op: "sub", Path: dir, Err: fs.ErrInvalid}
+	}
+	if dir == "." {
+		return blob, nil
+	}
+	return &subFS{fsys: blob, dir: dir}, nil
 }
 
 // ----------------
@@ -135,26 +308,115 @@ func findByPath(elem *streamElement, path []string) fs.File {
 //
 // ----------------
 
-func (blob *streamFS) readFilePosition(id uint16) (start uint32, end uint32) {
-	if err := ezbin.ReadAt(blob.r, blob.info.FatOffset+uint32(id)*8, &start, &end); err != nil {
-		blob.err = err
+// Get the index, building it if needed.
+func (blob *streamFS) getIndex() (*streamIndex, error) {
+	blob.indexOnce.Do(blob.buildIndex)
+	return blob.index, blob.indexErr
+}
+
+// Find an indexed entry by path.
+// Errors are returned as *fs.PathError.
+func (blob *streamFS) lookup(op string, name string) (*streamEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
 	}
-	return
+	idx, err := blob.getIndex()
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	entry := idx.entries[name]
+	if entry == nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return entry, nil
+}
+
+func (blob *streamFS) buildIndex() {
+	idx := &streamIndex{
+		entries: map[string]*streamEntry{},
+		paths:   map[uint16]string{},
+	}
+	root := &streamEntry{
+		fs:       blob,
+		name:     ".",
+		isFolder: true,
+	}
+	if err := blob.indexFolder(idx, root, ".", map[uint16]bool{}); err != nil {
+		blob.indexErr = err
+		return
+	}
+
+	// Overlay files get paths too
+	for i, ov := range blob.GetArm9Overlays() {
+		if id, ok := ov.(*OverlaySimple).FileID(); ok {
+			idx.paths[id] = fmt.Sprintf(overlayPath9, i)
+		}
+	}
+	for i, ov := range blob.GetArm7Overlays() {
+		if id, ok := ov.(*OverlaySimple).FileID(); ok {
+			idx.paths[id] = fmt.Sprintf(overlayPath7, i)
+		}
+	}
+	blob.index = idx
 }
 
-func (blob *streamFS) readContent(id uint16) []byte {
-	// Get start and end of file
-	fileStart, fileEnd := blob.readFilePosition(id)
+// Add folder and everything in it to the index.
+func (blob *streamFS) indexFolder(idx *streamIndex, folder *streamEntry, folderPath string, visited map[uint16]bool) error {
+	if visited[folder.id] {
+		return fmt.Errorf("folder %#04x: %w", folder.id|0xF000, ErrFolderLoop)
+	}
+	visited[folder.id] = true
+	idx.entries[folderPath] = folder
 
-	// Read file data
-	content := make([]byte, fileEnd-fileStart)
-	if _, err := blob.r.ReadAt(content, int64(fileStart)); err != nil {
-		blob.err = err
-		return nil
+	children, firstFile, err := blob.readFolderChildren(folder.id)
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		childPath := path.Join(folderPath, child.name)
+		if child.isFolder {
+			if err := blob.indexFolder(idx, child, childPath, visited); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if child.start, child.end, err = blob.readFilePosition(child.id); err != nil {
+			return err
+		}
+		idx.entries[childPath] = child
+		idx.paths[child.id] = childPath
 	}
 
-	// Return read content
-	return content
+	slices.SortFunc(children, func(a, b *streamEntry) int {
+		return strings.Compare(a.name, b.name)
+	})
+	folder.firstFile = firstFile
+	folder.children = children
+	return nil
+}
+
+// Make an entry for a file ID, straight from the FAT.
+// The entry is not part of the index.
+func (blob *streamFS) entryByID(id uint16, name string) (*streamEntry, error) {
+	start, end, err := blob.readFilePosition(id)
+	if err != nil {
+		return nil, err
+	}
+	return &streamEntry{
+		fs:    blob,
+		name:  name,
+		id:    id,
+		start: start,
+		end:   end,
+	}, nil
+}
+
+// End is never before start.
+func (blob *streamFS) readFilePosition(id uint16) (start uint32, end uint32, err error) {
+	err = ezbin.ReadAt(blob.r, blob.info.FatOffset+uint32(id)*8, &start, &end)
+	end = max(start, end)
+	return
 }
 
 type dirTableEntry struct {
@@ -169,36 +431,35 @@ type dirTableEntry struct {
 }
 
 // Folder ID must be without the type flag (0x0000..0x0FFF)
-func (blob *streamFS) readFolder(id uint16) dirTableEntry {
+func (blob *streamFS) readFolder(id uint16) (dirTableEntry, error) {
 	var entry dirTableEntry
-	ezbin.ReadAt(blob.r, blob.info.FntOffset+uint32(id)*8,
+	err := ezbin.ReadAt(blob.r, blob.info.FntOffset+uint32(id)*8,
 		&entry.subtableOffset,
 		&entry.firstFile,
 		&entry.num,
 	)
-	return entry
+	return entry, err
 }
 
-// Get all children for this folder
-func (blob *streamFS) getFolderChildren(folderId uint16, from uint32, n int) ([]*streamElement, uint32) {
-	folder := blob.readFolder(folderId)
-	subtableBase := blob.info.FntOffset + folder.subtableOffset
-	blob.r.Seek(int64(subtableBase+from), io.SeekStart)
-
-	all := n <= 0
-	var elements []*streamElement
-	if all {
-		elements = make([]*streamElement, 0, 16)
-	} else {
-		elements = make([]*streamElement, 0, n)
+// Get all children of a folder, in file name table order.
+// File positions are not read.
+// Also returns the first file ID of the folder.
+func (blob *streamFS) readFolderChildren(folderId uint16) ([]*streamEntry, uint16, error) {
+	folder, err := blob.readFolder(folderId)
+	if err != nil {
+		return nil, 0, err
 	}
+	r := io.NewSectionReader(blob.r, int64(blob.info.FntOffset+folder.subtableOffset), int64(blob.info.FntSize))
 
+	entries := make([]*streamEntry, 0, 16)
 	fid := folder.firstFile
 	for {
-		tlen := ezbin.ReadSingle[byte](blob.r)
+		var tlen byte
+		if err := ezbin.Read(r, &tlen); err != nil {
+			return entries, folder.firstFile, err
+		}
 		if tlen == 0 || tlen == 0x80 {
-			at, _ := ezbin.At[uint32](blob.r)
-			return elements, at - subtableBase
+			return entries, folder.firstFile, nil
 		}
 
 		isFolder := tlen&0x80 != 0
@@ -206,37 +467,26 @@ func (blob *streamFS) getFolderChildren(folderId uint16, from uint32, n int) ([]
 
 		// Read name
 		fname := make([]byte, tlen)
-		if _, err := io.ReadFull(blob.r, fname); err != nil {
-			blob.err = err
-			at, _ := ezbin.At[uint32](blob.r)
-			return elements, at - subtableBase
+		if _, err := io.ReadFull(r, fname); err != nil {
+			return entries, folder.firstFile, err
 		}
 
+		entry := &streamEntry{
+			fs:       blob,
+			name:     string(fname),
+			isFolder: isFolder,
+		}
 		if isFolder {
-			elements = append(elements, &streamElement{
-				fs:       blob,
-				name:     string(fname),
-				id:       ezbin.ReadSingle[uint16](blob.r) & 0x0FFF,
-				isFolder: true,
-			})
+			var childId uint16
+			if err := ezbin.Read(r, &childId); err != nil {
+				return entries, folder.firstFile, err
+			}
+			entry.id = childId & 0x0FFF
 		} else {
-			elements = append(elements, &streamElement{
-				fs:       blob,
-				name:     string(fname),
-				id:       fid,
-				isFolder: false,
-			})
+			entry.id = fid
 			fid++
 		}
-
-		// In case of limited elements, count down
-		if !all {
-			n--
-			if n == 0 {
-				at, _ := ezbin.At[uint32](blob.r)
-				return elements, at - subtableBase
-			}
-		}
+		entries = append(entries, entry)
 	}
 }
 
@@ -248,9 +498,8 @@ func (blob *streamFS) updateMapping(mmap *mapping.Mapping) {
 		}
 
 		// Add file to mapping
-		streamElement := d.(*streamElement)
-		start, end := streamElement.fs.readFilePosition(streamElement.id)
-		mmap.AddAt(fmt.Sprintf(mappingFileNamed, streamElement.Name()), start, end-start)
+		entry := d.(*streamEntry)
+		mmap.AddAt(fmt.Sprintf(mappingFileNamed, entry.Name()), entry.start, entry.end-entry.start)
 		return nil
 	})
 
@@ -263,7 +512,6 @@ func (blob *streamFS) updateMapping(mmap *mapping.Mapping) {
 	// Do remaining orphan overlay files
 	for _, overlay := range append(blob.GetArm9Overlays(), blob.GetArm7Overlays()...) {
 		file := overlay.(*OverlaySimple).element.(*streamElement)
-		start, end := blob.readFilePosition(file.id)
-		mmap.AddAt(fmt.Sprintf(mappingFileUnnamed, file.id), start, end-start)
+		mmap.AddAt(fmt.Sprintf(mappingFileUnnamed, file.id), file.start, file.end-file.start)
 	}
 }
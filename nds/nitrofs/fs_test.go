@@ -0,0 +1,143 @@
+package nitrofs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"sync"
+	"testing"
+	"testing/fstest"
+
+	"github.com/sukus21/nintil/util"
+	"github.com/sukus21/nintil/util/mapping"
+)
+
+// Files in the filesystem built by buildTestFS.
+var testFiles = fstest.MapFS{
+	"a.bin":           {Data: []byte("hello")},
+	"empty.bin":       {Data: []byte{}},
+	"dir/b.bin":       {Data: bytes.Repeat([]byte{1}, 1000)},
+	"dir/c.txt":       {Data: []byte("c")},
+	"dir/sub/d.txt":   {Data: []byte("deep")},
+	"other/e.dat":     {Data: []byte("e")},
+	"other/empty/.gz": {Data: []byte("dotfile")},
+}
+
+// Build a small NitroFS with nested directories, an empty file and overlays.
+func buildTestFS(t *testing.T) NitroFS {
+	t.Helper()
+	arm9 := NewOverlaySet(NewOverlay(0x02100000, []byte("overlay 9"), 0x20))
+	arm7 := NewOverlaySet(NewOverlay(0x03800000, []byte("overlay 7"), 0))
+
+	w := util.NewGrowingWriteSeeker(nil)
+	mmap := mapping.NewMapping(0x1000000)
+	info, err := Build(util.NewWriteAtSeeker(w), WithOverlays(testFiles, arm9, arm7), mmap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return FromROM(bytes.NewReader(w.Buf), info, mapping.NewMapping(0x1000000))
+}
+
+func TestFS(t *testing.T) {
+	fsys := buildTestFS(t)
+	var expected []string
+	for name, file := range testFiles {
+		expected = append(expected, name)
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, file.Data) {
+			t.Errorf("%s: got %q, expected %q", name, data, file.Data)
+		}
+	}
+	if err := fstest.TestFS(fsys, expected...); err != nil {
+		t.Fatal(err)
+	}
+
+	sub, err := fs.Sub(fsys, "dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(sub, "b.bin", "c.txt", "sub/d.txt"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDirectoryHandle(t *testing.T) {
+	fsys := buildTestFS(t)
+	f, err := fsys.Open("dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.(io.Seeker).Seek(0, io.SeekStart); !errors.Is(err, fs.ErrInvalid) {
+		t.Errorf("seek: got %v, expected %v", err, fs.ErrInvalid)
+	}
+	if _, err := f.(io.ReaderAt).ReadAt(make([]byte, 1), 0); !errors.Is(err, fs.ErrInvalid) {
+		t.Errorf("read at: got %v, expected %v", err, fs.ErrInvalid)
+	}
+
+	// Closed handles report being closed first
+	f.Close()
+	if _, err := f.(io.Seeker).Seek(0, io.SeekStart); !errors.Is(err, fs.ErrClosed) {
+		t.Errorf("seek: got %v, expected %v", err, fs.ErrClosed)
+	}
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	fsys := buildTestFS(t)
+	var wg sync.WaitGroup
+	for i := range 16 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name, file := range testFiles {
+				if data, err := fs.ReadFile(fsys, name); err != nil || !bytes.Equal(data, file.Data) {
+					t.Errorf("goroutine %d: read %s: %q, %v", i, name, data, err)
+				}
+				if stat, err := fs.Stat(fsys, name); err != nil || stat.Size() != int64(len(file.Data)) {
+					t.Errorf("goroutine %d: stat %s: %v", i, name, err)
+				}
+				f, err := fsys.Open(name)
+				if err != nil {
+					t.Errorf("goroutine %d: open %s: %v", i, name, err)
+					continue
+				}
+				data, err := io.ReadAll(f)
+				f.Close()
+				if err != nil || !bytes.Equal(data, file.Data) {
+					t.Errorf("goroutine %d: read opened %s: %q, %v", i, name, data, err)
+				}
+			}
+			for _, dir := range []string{".", "dir", "dir/sub", "other"} {
+				if _, err := fs.ReadDir(fsys, dir); err != nil {
+					t.Errorf("goroutine %d: read directory %s: %v", i, dir, err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestUnnamedIDs(t *testing.T) {
+	// Empty root folder, followed by a FAT of 65536 empty files
+	fnt := []byte{8, 0, 0, 0, 0, 0, 1, 0, 0}
+	fatOffset := uint32(0x200)
+	buf := make([]byte, fatOffset+0x10000*8)
+	copy(buf, fnt)
+	info := &Info{FntSize: uint32(len(fnt)), FatOffset: fatOffset, FatSize: 0x10000 * 8}
+	ids, err := FromROM(bytes.NewReader(buf), info, nil).(IDFS).UnnamedIDs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 0x10000 || ids[0xFFFF] != 0xFFFF {
+		t.Errorf("got %d unnamed IDs, expected %d", len(ids), 0x10000)
+	}
+
+	// An unreadable FNT is an error, not a lack of unnamed files
+	info.FntOffset = uint32(len(buf))
+	if _, err := FromROM(bytes.NewReader(buf), info, nil).(IDFS).UnnamedIDs(); err == nil {
+		t.Errorf("expected an error")
+	}
+}
@@ -0,0 +1,488 @@
+package nitrofs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+var ErrDirNotEmpty = errors.New("directory not empty")
+
+// A writable layer on top of another filesystem.
+// Changes are kept in memory, unchanged files are streamed from the source filesystem.
+// Overlays are taken from the source filesystem, if it has any.
+type MutableFS struct {
+	source fs.FS
+	root   *mutableNode
+
+	// Files by their original file ID
+	ids map[uint16]*mutableNode
+}
+
+type mutableNode struct {
+	name     string
+	isDir    bool
+	parent   *mutableNode
+	children map[string]*mutableNode
+
+	// Path in source filesystem, for unchanged files
+	source string
+
+	// Contents of written files
+	data []byte
+	size int64
+
+	// Original file ID (first file ID for directories), -1 if unknown
+	id int
+}
+
+// Create a writable layer on top of source.
+// The directory structure of source is read right away, file contents are not.
+func NewMutableFS(source fs.FS) (*MutableFS, error) {
+	m := &MutableFS{
+		source: source,
+		root:   newMutableDir("."),
+		ids:    map[uint16]*mutableNode{},
+	}
+	mapper, _ := source.(IDMapper)
+	getId := func(name string) int {
+		if mapper == nil {
+			return -1
+		}
+		if id, ok := mapper.FileID(name); ok {
+			return int(id)
+		}
+		return -1
+	}
+	m.root.id = getId(".")
+
+	err := fs.WalkDir(source, ".", func(currentPath string, d fs.DirEntry, err error) error {
+		if err != nil || currentPath == "." {
+			return err
+		}
+
+		parent := m.lookup(path.Dir(currentPath))
+		if d.IsDir() {
+			dir := newMutableDir(d.Name())
+			dir.id = getId(currentPath)
+			m.link(parent, dir)
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		m.link(parent, &mutableNode{
+			name:   d.Name(),
+			source: currentPath,
+			size:   info.Size(),
+			id:     getId(currentPath),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func newMutableDir(name string) *mutableNode {
+	return &mutableNode{
+		name:     name,
+		isDir:    true,
+		children: map[string]*mutableNode{},
+		id:       -1,
+	}
+}
+
+// Add a node to a directory, and index its file ID.
+func (m *MutableFS) link(parent *mutableNode, node *mutableNode) {
+	node.parent = parent
+	parent.children[node.name] = node
+	if !node.isDir && node.id != -1 {
+		m.ids[uint16(node.id)] = node
+	}
+}
+
+// Remove a node from its directory, and from the file ID index.
+func (m *MutableFS) unlink(node *mutableNode) {
+	delete(node.parent.children, node.name)
+	if !node.isDir && node.id != -1 && m.ids[uint16(node.id)] == node {
+		delete(m.ids, uint16(node.id))
+	}
+}
+
+// Get the current path of a node.
+func (n *mutableNode) path() string {
+	if n.parent == nil {
+		return "."
+	}
+	var parts []string
+	for ; n.parent != nil; n = n.parent {
+		parts = append(parts, n.name)
+	}
+	slices.Reverse(parts)
+	return strings.Join(parts, "/")
+}
+
+// Get node at path, or nil if it does not exist.
+func (m *MutableFS) lookup(name string) *mutableNode {
+	node := m.root
+	if name == "." {
+		return node
+	}
+	for _, part := range strings.Split(name, "/") {
+		if !node.isDir {
+			return nil
+		}
+		if node = node.children[part]; node == nil {
+			return nil
+		}
+	}
+	return node
+}
+
+// Get parent directory of path, for creating a new entry.
+func (m *MutableFS) lookupParent(op string, name string) (*mutableNode, error) {
+	if !fs.ValidPath(name) || name == "." {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	parent := m.lookup(path.Dir(name))
+	if parent == nil || !parent.isDir {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return parent, nil
+}
+
+// Get the filesystem this layer was created on top of.
+func (m *MutableFS) Source() fs.FS {
+	return m.source
+}
+
+// Create or replace a file.
+// The parent directory must already exist.
+func (m *MutableFS) WriteFile(name string, data []byte) error {
+	parent, err := m.lookupParent("write", name)
+	if err != nil {
+		return err
+	}
+	base := path.Base(name)
+	existing := parent.children[base]
+	if existing != nil && existing.isDir {
+		return &fs.PathError{Op: "write", Path: name, Err: fs.ErrExist}
+	}
+
+	// Overwritten files keep their ID
+	id := -1
+	if existing != nil {
+		id = existing.id
+		m.unlink(existing)
+	}
+	m.link(parent, &mutableNode{
+		name: base,
+		data: append([]byte{}, data...),
+		size: int64(len(data)),
+		id:   id,
+	})
+	return nil
+}
+
+// Remove a file or an empty directory.
+func (m *MutableFS) Remove(name string) error {
+	parent, err := m.lookupParent("remove", name)
+	if err != nil {
+		return err
+	}
+	base := path.Base(name)
+	node := parent.children[base]
+	if node == nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	if node.isDir && len(node.children) != 0 {
+		return &fs.PathError{Op: "remove", Path: name, Err: ErrDirNotEmpty}
+	}
+
+	m.unlink(node)
+	return nil
+}
+
+// Create a new directory.
+// The parent directory must already exist.
+func (m *MutableFS) Mkdir(name string) error {
+	parent, err := m.lookupParent("mkdir", name)
+	if err != nil {
+		return err
+	}
+	base := path.Base(name)
+	if parent.children[base] != nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+	}
+
+	m.link(parent, newMutableDir(base))
+	return nil
+}
+
+// Move a file or directory.
+// Nothing may exist at newname, and its parent directory must already exist.
+func (m *MutableFS) Rename(oldname string, newname string) error {
+	oldParent, err := m.lookupParent("rename", oldname)
+	if err != nil {
+		return err
+	}
+	newParent, err := m.lookupParent("rename", newname)
+	if err != nil {
+		return err
+	}
+	oldBase := path.Base(oldname)
+	newBase := path.Base(newname)
+	node := oldParent.children[oldBase]
+	if node == nil {
+		return &fs.PathError{Op: "rename", Path: oldname, Err: fs.ErrNotExist}
+	}
+	if newParent.children[newBase] != nil {
+		return &fs.PathError{Op: "rename", Path: newname, Err: fs.ErrExist}
+	}
+	if node.isDir && strings.HasPrefix(newname+"/", oldname+"/") {
+		return &fs.PathError{Op: "rename", Path: newname, Err: fs.ErrInvalid}
+	}
+
+	m.unlink(node)
+	node.name = newBase
+	m.link(newParent, node)
+	return nil
+}
+
+// Returns the path a file had in the source filesystem.
+// Returns false if the file does not exist, or was written to.
+func (m *MutableFS) SourcePath(name string) (string, bool) {
+	if !fs.ValidPath(name) {
+		return "", false
+	}
+	node := m.lookup(name)
+	if node == nil || node.isDir || node.data != nil {
+		return "", false
+	}
+	return node.source, true
+}
+
+// Get the original file ID of a file, or the first file ID of a directory.
+// Files keep their ID when written to or renamed, new files have no ID.
+func (m *MutableFS) FileID(name string) (uint16, bool) {
+	if !fs.ValidPath(name) {
+		return 0, false
+	}
+	node := m.lookup(name)
+	if node == nil || node.id == -1 {
+		return 0, false
+	}
+	return uint16(node.id), true
+}
+
+// Open a file by its original file ID.
+// Overlay files and unnamed files are opened from the source filesystem.
+func (m *MutableFS) OpenID(id uint16) (fs.File, error) {
+	if p, ok := m.treePathOf(id); ok {
+		return m.Open(p)
+	}
+	if idfs, ok := m.source.(IDFS); ok {
+		if _, err := m.PathOf(id); err == nil || errors.Is(err, ErrUnnamed) {
+			return idfs.OpenID(id)
+		}
+	}
+	return nil, &fs.PathError{Op: "open", Path: fmt.Sprintf("#%d", id), Err: fs.ErrNotExist}
+}
+
+// Get the current path of a file by its original file ID.
+// Overlay files resolve to the same paths as in the source filesystem.
+func (m *MutableFS) PathOf(id uint16) (string, error) {
+	if p, ok := m.treePathOf(id); ok {
+		return p, nil
+	}
+	if idfs, ok := m.source.(IDFS); ok {
+		p, err := idfs.PathOf(id)
+		if err != nil {
+			return "", err
+		}
+		if isOverlayPath(p) {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("file ID %d: %w", id, fs.ErrNotExist)
+}
+
+// Find a file in the directory tree by its original file ID.
+func (m *MutableFS) treePathOf(id uint16) (string, bool) {
+	node := m.ids[id]
+	if node == nil {
+		return "", false
+	}
+	return node.path(), true
+}
+
+// Get IDs of unnamed files in the source filesystem.
+// These are kept when building.
+func (m *MutableFS) UnnamedIDs() ([]uint16, error) {
+	if idfs, ok := m.source.(IDFS); ok {
+		return idfs.UnnamedIDs()
+	}
+	return nil, nil
+}
+
+// ---------------------------
+//
+//  Implement fs.FS, NitroFS
+//
+// ---------------------------
+
+func (m *MutableFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	node := m.lookup(name)
+	if node == nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	f := &mutableFile{node: node}
+	if node.isDir {
+		f.entries = node.sortedChildren()
+	} else if node.data != nil {
+		f.r = bytes.NewReader(node.data)
+	} else {
+		src, err := m.source.Open(node.source)
+		if err != nil {
+			return nil, err
+		}
+		f.r = src
+		f.src = src
+	}
+	return f, nil
+}
+
+func (m *MutableFS) GetArm9Overlays() []Overlay {
+	if nfs, ok := m.source.(NitroFS); ok {
+		return nfs.GetArm9Overlays()
+	}
+	return nil
+}
+func (m *MutableFS) GetArm7Overlays() []Overlay {
+	if nfs, ok := m.source.(NitroFS); ok {
+		return nfs.GetArm7Overlays()
+	}
+	return nil
+}
+
+// ---------------------------
+//
+//  Implement fs.FileInfo, fs.DirEntry
+//
+// ---------------------------
+
+func (n *mutableNode) sortedChildren() []*mutableNode {
+	children := make([]*mutableNode, 0, len(n.children))
+	for _, child := range n.children {
+		children = append(children, child)
+	}
+	slices.SortFunc(children, func(a, b *mutableNode) int {
+		return strings.Compare(a.name, b.name)
+	})
+	return children
+}
+
+func (n *mutableNode) Name() string {
+	return n.name
+}
+func (n *mutableNode) Size() int64 {
+	return n.size
+}
+func (n *mutableNode) Mode() fs.FileMode {
+	if n.isDir {
+		return fs.ModeDir | 0777
+	}
+	return 0666
+}
+func (n *mutableNode) ModTime() time.Time {
+	return time.Time{}
+}
+func (n *mutableNode) IsDir() bool {
+	return n.isDir
+}
+func (n *mutableNode) Sys() any {
+	return nil
+}
+func (n *mutableNode) Type() fs.FileMode {
+	return n.Mode().Type()
+}
+func (n *mutableNode) Info() (fs.FileInfo, error) {
+	return n, nil
+}
+
+// ---------------------------
+//
+//  Implement fs.File, fs.ReadDirFile
+//
+// ---------------------------
+
+type mutableFile struct {
+	node    *mutableNode
+	r       io.Reader
+	src     fs.File
+	entries []*mutableNode
+	closed  bool
+}
+
+func (f *mutableFile) Stat() (fs.FileInfo, error) {
+	if f.closed {
+		return nil, fs.ErrClosed
+	}
+	return f.node, nil
+}
+func (f *mutableFile) Read(buf []byte) (int, error) {
+	if f.closed {
+		return 0, fs.ErrClosed
+	}
+	if f.node.isDir {
+		return 0, &fs.PathError{Op: "read", Path: f.node.name, Err: fs.ErrInvalid}
+	}
+	return f.r.Read(buf)
+}
+func (f *mutableFile) Close() error {
+	if f.closed {
+		return fs.ErrClosed
+	}
+	f.closed = true
+	if f.src != nil {
+		return f.src.Close()
+	}
+	return nil
+}
+func (f *mutableFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if f.closed {
+		return nil, fs.ErrClosed
+	}
+	if !f.node.isDir {
+		return nil, &fs.PathError{Op: "readdir", Path: f.node.name, Err: fs.ErrInvalid}
+	}
+
+	count := len(f.entries)
+	if n > 0 {
+		count = min(n, count)
+	}
+	entries := make([]fs.DirEntry, count)
+	for i := range entries {
+		entries[i] = f.entries[i]
+	}
+	f.entries = f.entries[count:]
+
+	if n > 0 && count == 0 {
+		return nil, io.EOF
+	}
+	return entries, nil
+}
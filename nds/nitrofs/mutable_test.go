@@ -0,0 +1,250 @@
+package nitrofs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"slices"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// Check the files in a mutable filesystem, and their contents.
+func checkMutableFS(t *testing.T, m *MutableFS, files map[string]string) {
+	t.Helper()
+	var expected []string
+	for name, contents := range files {
+		expected = append(expected, name)
+		data, err := fs.ReadFile(m, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != contents {
+			t.Errorf("%s: got %q, expected %q", name, data, contents)
+		}
+	}
+	if err := fstest.TestFS(m, expected...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Files of the test filesystem, as strings.
+func mutableTestFiles() map[string]string {
+	files := map[string]string{}
+	for name, file := range testFiles {
+		files[name] = string(file.Data)
+	}
+	return files
+}
+
+func TestMutableFS(t *testing.T) {
+	m, err := NewMutableFS(buildTestFS(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := mutableTestFiles()
+	checkMutableFS(t, m, files)
+
+	// Written files
+	if err := m.WriteFile("new.txt", []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.WriteFile("dir/c.txt", []byte("overwritten")); err != nil {
+		t.Fatal(err)
+	}
+	files["new.txt"] = "new"
+	files["dir/c.txt"] = "overwritten"
+	checkMutableFS(t, m, files)
+	if _, ok := m.SourcePath("dir/c.txt"); ok {
+		t.Errorf("overwritten file still has a source path")
+	}
+	if _, ok := m.FileID("new.txt"); ok {
+		t.Errorf("new file has a file ID")
+	}
+
+	// Directories
+	if err := m.Mkdir("created"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.WriteFile("created/f.txt", []byte("f")); err != nil {
+		t.Fatal(err)
+	}
+	files["created/f.txt"] = "f"
+	checkMutableFS(t, m, files)
+
+	// Renamed files and directories
+	if err := m.Rename("a.bin", "created/a.bin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Rename("dir", "created/moved"); err != nil {
+		t.Fatal(err)
+	}
+	renamed := map[string]string{}
+	for name, contents := range files {
+		if name == "a.bin" {
+			name = "created/a.bin"
+		} else if rest, ok := strings.CutPrefix(name, "dir/"); ok {
+			name = "created/moved/" + rest
+		}
+		renamed[name] = contents
+	}
+	files = renamed
+	checkMutableFS(t, m, files)
+
+	// Removed files and directories
+	if err := m.Remove("other"); !errors.Is(err, ErrDirNotEmpty) {
+		t.Errorf("got %v, expected %v", err, ErrDirNotEmpty)
+	}
+	if err := m.Remove("other/empty/.gz"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Remove("other/empty"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Remove("other/empty"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("got %v, expected %v", err, fs.ErrNotExist)
+	}
+	delete(files, "other/empty/.gz")
+	checkMutableFS(t, m, files)
+}
+
+func TestMutableFSErrors(t *testing.T) {
+	m, err := NewMutableFS(buildTestFS(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		err      error
+		expected error
+	}{
+		{"write to directory", m.WriteFile("dir", nil), fs.ErrExist},
+		{"write without parent", m.WriteFile("missing/a.bin", nil), fs.ErrNotExist},
+		{"mkdir existing", m.Mkdir("other"), fs.ErrExist},
+		{"rename missing", m.Rename("missing", "a"), fs.ErrNotExist},
+		{"rename onto file", m.Rename("a.bin", "empty.bin"), fs.ErrExist},
+		{"rename into itself", m.Rename("dir", "dir/sub/dir"), fs.ErrInvalid},
+	}
+	for _, tt := range tests {
+		if !errors.Is(tt.err, tt.expected) {
+			t.Errorf("%s: got %v, expected %v", tt.name, tt.err, tt.expected)
+		}
+	}
+	checkMutableFS(t, m, mutableTestFiles())
+}
+
+func TestMutableFSIDs(t *testing.T) {
+	source := buildTestFS(t)
+	m, err := NewMutableFS(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idfs := source.(IDFS)
+	ids := map[string]uint16{}
+	for name := range testFiles {
+		id, ok := m.FileID(name)
+		if !ok {
+			t.Fatalf("%s: no file ID", name)
+		}
+		if p, err := idfs.PathOf(id); err != nil || p != name {
+			t.Errorf("%s: file ID %d is %q in the source, %v", name, id, p, err)
+		}
+		ids[name] = id
+	}
+
+	// IDs follow files through changes
+	if err := m.WriteFile("a.bin", []byte("changed")); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Rename("a.bin", "dir/sub/a.bin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Rename("dir", "renamed"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Remove("other/e.dat"); err != nil {
+		t.Fatal(err)
+	}
+	moved := map[string]string{
+		"a.bin":         "renamed/sub/a.bin",
+		"dir/b.bin":     "renamed/b.bin",
+		"dir/sub/d.txt": "renamed/sub/d.txt",
+		"empty.bin":     "empty.bin",
+	}
+	for name, current := range moved {
+		if p, err := m.PathOf(ids[name]); err != nil || p != current {
+			t.Errorf("%s: got %q, %v, expected %q", name, p, err, current)
+		}
+	}
+	f, err := m.OpenID(ids["a.bin"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(f)
+	f.Close()
+	if err != nil || string(data) != "changed" {
+		t.Errorf("got %q, %v, expected %q", data, err, "changed")
+	}
+	if _, err := m.OpenID(ids["other/e.dat"]); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("removed file: got %v, expected %v", err, fs.ErrNotExist)
+	}
+	if _, err := m.PathOf(ids["other/e.dat"]); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("removed file: got %v, expected %v", err, fs.ErrNotExist)
+	}
+
+	// A new file at the path of a removed file does not take its ID
+	if err := m.WriteFile("other/e.dat", []byte("e")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.FileID("other/e.dat"); ok {
+		t.Errorf("new file took the ID of a removed file")
+	}
+
+	// Overlays are still found in the source
+	for _, ov := range m.GetArm9Overlays() {
+		id, ok := ov.(*OverlaySimple).FileID()
+		if !ok {
+			t.Fatalf("overlay has no file ID")
+		}
+		if _, err := m.PathOf(id); err != nil {
+			t.Errorf("overlay %d: %v", id, err)
+		}
+	}
+	unnamed, err := m.UnnamedIDs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := idfs.UnnamedIDs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(unnamed, expected) {
+		t.Errorf("got unnamed IDs %v, expected %v", unnamed, expected)
+	}
+}
+
+func TestMutableFileClosed(t *testing.T) {
+	m, err := NewMutableFS(buildTestFS(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.WriteFile("new.txt", []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"new.txt", "dir"} {
+		f, err := m.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Stat(); !errors.Is(err, fs.ErrClosed) {
+			t.Errorf("%s: got %v, expected %v", name, err, fs.ErrClosed)
+		}
+		if _, err := f.Read(make([]byte, 1)); !errors.Is(err, fs.ErrClosed) {
+			t.Errorf("%s: got %v, expected %v", name, err, fs.ErrClosed)
+		}
+	}
+}
@@ -1,10 +1,11 @@
 package nitrofs
 
 import (
+	"errors"
+	"fmt"
 	"io"
 	"io/fs"
 
-	"github.com/sukus21/nintil/util"
 	"github.com/sukus21/nintil/util/mapping"
 )
 
@@ -18,10 +19,28 @@ const (
 	mappingOVT7        = "ARM7 overlay table"
 )
 
-func FromROM(r io.ReadSeeker, info *Info, mmap *mapping.Mapping) NitroFS {
+var ErrUnnamed = errors.New("file has no name")
+
+// Paths given to overlay files, which have no name in the file name table
+const (
+	overlayPath9 = "overlay9/%d"
+	overlayPath7 = "overlay7/%d"
+)
+
+// Is this the path of an overlay file?
+func isOverlayPath(p string) bool {
+	var n int
+	_, err9 := fmt.Sscanf(p, overlayPath9, &n)
+	_, err7 := fmt.Sscanf(p, overlayPath7, &n)
+	return err9 == nil || err7 == nil
+}
+
+// Read a NitroFS from a ROM.
+// Only ReadAt is used on r, so the returned filesystem is safe for concurrent use if r is.
+func FromROM(r io.ReaderAt, info *Info, mmap *mapping.Mapping) NitroFS {
 	nfs := &streamFS{
 		info: info,
-		r:    util.NewReadAtSeeker(r),
+		r:    r,
 	}
 
 	if mmap != nil {
@@ -36,3 +55,26 @@ type NitroFS interface {
 	GetArm9Overlays() []Overlay
 	GetArm7Overlays() []Overlay
 }
+
+// Implemented by filesystems that know the file IDs of their contents.
+type IDMapper interface {
+	// Get the file ID of a file.
+	// For directories, get the ID of the first file in it.
+	FileID(name string) (uint16, bool)
+}
+
+// Implemented by filesystems that can access files by file ID.
+type IDFS interface {
+	IDMapper
+
+	// Open a file by file ID, including overlay files and unnamed files.
+	OpenID(id uint16) (fs.File, error)
+
+	// Get the path of a file ID.
+	// Overlay files resolve to "overlay9/<n>" or "overlay7/<n>".
+	// Returns ErrUnnamed if the file has no name.
+	PathOf(id uint16) (string, error)
+
+	// Get IDs of files that have no name in the file name table, and are not overlays.
+	UnnamedIDs() ([]uint16, error)
+}
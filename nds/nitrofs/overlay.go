@@ -1,12 +1,36 @@
 package nitrofs
 
 import (
+	"errors"
+	"fmt"
 	"io"
 	"io/fs"
+	"slices"
+	"sync"
 
+	"github.com/sukus21/nintil/compression/blz"
 	"github.com/sukus21/nintil/util/ezbin"
 )
 
+// Flags stored in the upper byte of the last overlay table word.
+// The lower 24 bits hold the compressed size, which is derived from the overlay data.
+type OverlayFlags uint8
+
+const (
+	// Overlay data is BLZ compressed
+	OverlayFlagCompressed = OverlayFlags(1 << 0)
+
+	// Overlay data is covered by a signature
+	OverlayFlagAuthenticated = OverlayFlags(1 << 1)
+)
+
+func (f OverlayFlags) IsCompressed() bool {
+	return f&OverlayFlagCompressed != 0
+}
+func (f OverlayFlags) IsAuthenticated() bool {
+	return f&OverlayFlagAuthenticated != 0
+}
+
 // I am not sure how overlays work.
 // Regardless, now there's an interface to implement if you need them regardless.
 type Overlay interface {
@@ -29,6 +53,9 @@ type Overlay interface {
 
 	// Returns the size of the BSS section for this overlay
 	DynamicSize() uint32
+
+	// Returns the overlay table flags
+	Flags() OverlayFlags
 }
 
 type OverlaySimple struct {
@@ -49,14 +76,40 @@ type OverlaySimple struct {
 	stintAddressStart uint32
 	stintAddressEnd   uint32
 
+	// Overlay table flags
+	flags OverlayFlags
+
+	// Original file ID, -1 for new overlays
+	fileId int
+
 	// Overlay file data
 	element fs.File
+
+	// Cached file data and decompressed code.
+	// Data and Code fill these in lazily, so they are guarded by mu.
+	mu   sync.Mutex
+	data []byte
+	code []byte
+}
+
+// Create a new overlay from uncompressed code.
+// The code is loaded at address, followed by bssSize bytes of zeroed memory.
+func NewOverlay(address uint32, code []byte, bssSize uint32) *OverlaySimple {
+	return &OverlaySimple{
+		loadAddress: address,
+		loadSize:    uint32(len(code)),
+		bssSize:     bssSize,
+		fileId:      -1,
+		data:        slices.Clone(code),
+		code:        slices.Clone(code),
+	}
 }
 
 // Reads an overlay directly from the overlay table
 func overlayRead(r io.ReaderAt, pos uint32) (uint16, *OverlaySimple, error) {
 	o := &OverlaySimple{}
 	fileId := uint32(0)
+	reserved := uint32(0)
 	err := ezbin.ReadAt(r, pos,
 		&o.id,
 		&o.loadAddress,
@@ -65,14 +118,22 @@ func overlayRead(r io.ReaderAt, pos uint32) (uint16, *OverlaySimple, error) {
 		&o.stintAddressStart,
 		&o.stintAddressEnd,
 		&fileId,
-		make([]byte, 4), // reserved, filler
+		&reserved,
 	)
+	o.flags = OverlayFlags(reserved >> 24)
+	o.fileId = int(uint16(fileId))
 	return uint16(fileId), o, err
 }
 
-// Write overlay data directly to overlay table
-func overlayWrite(w io.Writer, overlay Overlay, overlayId uint32, fileId uint16) error {
+// Write overlay data directly to overlay table.
+// data should be the overlay file contents.
+func overlayWrite(w io.Writer, overlay Overlay, data []byte, overlayId uint32, fileId uint16) error {
 	startAddr, endAddr := overlay.StaticData()
+	flags := overlay.Flags()
+	reserved := uint32(flags) << 24
+	if flags.IsCompressed() {
+		reserved |= uint32(len(data)) & 0x00FFFFFF
+	}
 	return ezbin.Write(w,
 		overlayId,
 		overlay.Address(),
@@ -81,7 +142,7 @@ func overlayWrite(w io.Writer, overlay Overlay, overlayId uint32, fileId uint16)
 		startAddr,
 		endAddr,
 		uint32(fileId),
-		uint32(0), // reserved, filler
+		reserved,
 	)
 }
 
@@ -91,14 +152,57 @@ func (o *OverlaySimple) Address() uint32 {
 func (o *OverlaySimple) Size() uint32 {
 	return o.loadSize
 }
+
+// Get the overlay file contents.
+// Returns nil if the overlay file cannot be read, use ReadOverlayData to get the error.
 func (o *OverlaySimple) Data() []byte {
+	data, _ := o.readData()
+	return data
+}
+
+// Get the overlay file contents, or the error reading them.
+func (o *OverlaySimple) readData() ([]byte, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	data, err := o.loadData()
+	if err != nil {
+		return nil, fmt.Errorf("overlay %d data: %w", o.id, err)
+	}
+	return data, nil
+}
+
+// Get the file contents of any overlay.
+// Unlike Overlay.Data, errors reading the overlay file are returned.
+func ReadOverlayData(ov Overlay) ([]byte, error) {
+	if r, ok := ov.(interface{ readData() ([]byte, error) }); ok {
+		return r.readData()
+	}
+	return ov.Data(), nil
+}
+
+// Read the overlay file, if it isn't cached already.
+// Nothing is cached on errors, so the next call tries again.
+// Must be called with mu held.
+func (o *OverlaySimple) loadData() ([]byte, error) {
+	if o.data != nil || o.element == nil {
+		return o.data, nil
+	}
 	stat, err := o.element.Stat()
 	if err != nil {
-		return nil
+		return nil, err
+	}
+
+	// Read from the start, even if a previous attempt failed halfway
+	r := io.Reader(o.element)
+	if ra, ok := o.element.(io.ReaderAt); ok {
+		r = io.NewSectionReader(ra, 0, stat.Size())
 	}
 	buf := make([]byte, stat.Size())
-	io.ReadFull(o.element, buf)
-	return buf
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	o.data = buf
+	return buf, nil
 }
 func (o *OverlaySimple) StaticData() (uint32, uint32) {
 	return o.stintAddressStart, o.stintAddressEnd
@@ -106,3 +210,131 @@ func (o *OverlaySimple) StaticData() (uint32, uint32) {
 func (o *OverlaySimple) DynamicSize() uint32 {
 	return o.bssSize
 }
+func (o *OverlaySimple) Flags() OverlayFlags {
+	return o.flags
+}
+
+// Get the file ID this overlay was read from.
+// Returns false for new overlays.
+func (o *OverlaySimple) FileID() (uint16, bool) {
+	return uint16(o.fileId), o.fileId != -1
+}
+
+// Set the address to load the overlay at.
+func (o *OverlaySimple) SetAddress(address uint32) {
+	o.loadAddress = address
+}
+
+// Set the size in bytes of this overlay.
+// This is updated automatically by SetCode.
+func (o *OverlaySimple) SetSize(size uint32) {
+	o.loadSize = size
+}
+
+// Set the size of the BSS section for this overlay.
+func (o *OverlaySimple) SetDynamicSize(size uint32) {
+	o.bssSize = size
+}
+
+// Set start and end of statically initialized data.
+func (o *OverlaySimple) SetStaticData(start uint32, end uint32) {
+	o.stintAddressStart = start
+	o.stintAddressEnd = end
+}
+
+// Set the overlay table flags.
+// Setting OverlayFlagCompressed does not compress the data, use SetCode for that.
+func (o *OverlaySimple) SetFlags(flags OverlayFlags) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.flags = flags
+	o.code = nil
+}
+
+// Replace the overlay file contents as-is.
+// The data should match the overlay flags (BLZ compressed or not).
+func (o *OverlaySimple) SetData(data []byte) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.data = slices.Clone(data)
+	o.code = nil
+}
+
+// Get the overlay code as it looks once loaded into RAM.
+// If the overlay file is BLZ compressed, it is decompressed first.
+// The returned slice is a copy, changes to it are not reflected in the overlay.
+func (o *OverlaySimple) Code() ([]byte, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.code == nil {
+		data, err := o.loadData()
+		if err != nil {
+			return nil, fmt.Errorf("overlay %d code: %w", o.id, err)
+		}
+		if !o.flags.IsCompressed() {
+			return slices.Clone(data), nil
+		}
+		code, err := blz.Decompress(data)
+		if err != nil {
+			return nil, fmt.Errorf("overlay %d code: %w", o.id, err)
+		}
+		o.code = code
+	}
+	return slices.Clone(o.code), nil
+}
+
+// Replace the overlay file with (uncompressed) code.
+// If the overlay file is BLZ compressed, the new code is compressed as well.
+// If compression does not help, the compressed flag is cleared.
+// Load size is updated to match the new code.
+func (o *OverlaySimple) SetCode(code []byte) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	data := slices.Clone(code)
+	if o.flags.IsCompressed() {
+		compressed, err := blz.Compress(code)
+		if errors.Is(err, blz.ErrIncompressible) {
+			o.flags &^= OverlayFlagCompressed
+		} else if err != nil {
+			return fmt.Errorf("overlay %d code: %w", o.id, err)
+		} else {
+			data = compressed
+		}
+	}
+
+	o.data = data
+	o.code = slices.Clone(code)
+	o.loadSize = uint32(len(code))
+	return nil
+}
+
+// Read an overlay table, like the ones in a ROM or the y9.bin/y7.bin files made by ndstool.
+// The overlays have no data, use SetData or SetCode to fill it in.
+func ReadOverlayTable(r io.ReaderAt, offset uint32, size uint32) ([]*OverlaySimple, error) {
+	out := make([]*OverlaySimple, size/32)
+	for i := range out {
+		_, overlay, err := overlayRead(r, offset+uint32(i)*32)
+		if err != nil {
+			return nil, fmt.Errorf("read overlay table: overlay %d: %w", i, err)
+		}
+		out[i] = overlay
+	}
+	return out, nil
+}
+
+// Write an overlay table, giving each overlay the file ID at the same index in fileIds.
+func WriteOverlayTable(w io.Writer, overlays []Overlay, fileIds []uint16) error {
+	if len(overlays) != len(fileIds) {
+		return fmt.Errorf("write overlay table: got %d file IDs for %d overlays", len(fileIds), len(overlays))
+	}
+	for i, ov := range overlays {
+		data, err := ReadOverlayData(ov)
+		if err != nil {
+			return fmt.Errorf("write overlay table: %w", err)
+		}
+		if err := overlayWrite(w, ov, data, uint32(i), fileIds[i]); err != nil {
+			return fmt.Errorf("write overlay table: overlay %d: %w", i, err)
+		}
+	}
+	return nil
+}
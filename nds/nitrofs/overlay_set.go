@@ -0,0 +1,143 @@
+package nitrofs
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"slices"
+)
+
+var ErrNoSuchOverlay = errors.New("overlay does not exist")
+
+// An editable list of overlays for one CPU.
+// An overlay's ID is its position in the list.
+// File IDs are assigned when building, so they always stay consistent.
+//
+// The set takes ownership of the overlays added to it, they are not copied.
+// The ID of an *OverlaySimple is updated whenever its position changes,
+// so an overlay should only be in one set at a time.
+type OverlaySet struct {
+	overlays []Overlay
+}
+
+// Create a new overlay set with the given overlays, in order.
+func NewOverlaySet(overlays ...Overlay) *OverlaySet {
+	s := &OverlaySet{
+		overlays: slices.Clone(overlays),
+	}
+	s.renumber(0)
+	return s
+}
+
+// Number of overlays in set.
+func (s *OverlaySet) Len() int {
+	if s == nil {
+		return 0
+	}
+	return len(s.overlays)
+}
+
+// Get overlay with the given ID.
+func (s *OverlaySet) Get(id uint32) (Overlay, error) {
+	if int(id) >= s.Len() {
+		return nil, fmt.Errorf("get overlay %d: %w", id, ErrNoSuchOverlay)
+	}
+	return s.overlays[id], nil
+}
+
+// Get all overlays, ordered by ID.
+func (s *OverlaySet) All() []Overlay {
+	if s == nil {
+		return nil
+	}
+	return slices.Clone(s.overlays)
+}
+
+// Add an overlay to the end of the set.
+// Returns the ID of the new overlay.
+// Unlike the other methods, this needs a non-nil set, use NewOverlaySet to create one.
+func (s *OverlaySet) Append(ov Overlay) uint32 {
+	s.overlays = append(s.overlays, ov)
+	s.renumber(len(s.overlays) - 1)
+	return uint32(len(s.overlays) - 1)
+}
+
+// Replace the overlay with the given ID.
+func (s *OverlaySet) Replace(id uint32, ov Overlay) error {
+	if int(id) >= s.Len() {
+		return fmt.Errorf("replace overlay %d: %w", id, ErrNoSuchOverlay)
+	}
+	s.overlays[id] = ov
+	s.renumber(int(id))
+	return nil
+}
+
+// Remove the overlay with the given ID.
+// Overlays after it move down one ID.
+func (s *OverlaySet) Remove(id uint32) error {
+	if int(id) >= s.Len() {
+		return fmt.Errorf("remove overlay %d: %w", id, ErrNoSuchOverlay)
+	}
+	s.overlays = slices.Delete(s.overlays, int(id), int(id)+1)
+	s.renumber(int(id))
+	return nil
+}
+
+// Update IDs of overlays from the given position and on.
+// This changes the overlays themselves, see OverlaySet.
+func (s *OverlaySet) renumber(from int) {
+	for i := from; i < len(s.overlays); i++ {
+		if o, ok := s.overlays[i].(*OverlaySimple); ok {
+			o.mu.Lock()
+			o.id = uint32(i)
+			o.mu.Unlock()
+		}
+	}
+}
+
+// Use a filesystem with a different set of overlays.
+// A nil set means no overlays.
+func WithOverlays(fsys fs.FS, arm9 *OverlaySet, arm7 *OverlaySet) NitroFS {
+	return &overlayFS{
+		FS:   fsys,
+		arm9: arm9,
+		arm7: arm7,
+	}
+}
+
+type overlayFS struct {
+	fs.FS
+	arm9 *OverlaySet
+	arm7 *OverlaySet
+}
+
+func (o *overlayFS) GetArm9Overlays() []Overlay {
+	return o.arm9.All()
+}
+func (o *overlayFS) GetArm7Overlays() []Overlay {
+	return o.arm7.All()
+}
+func (o *overlayFS) FileID(name string) (uint16, bool) {
+	if mapper, ok := o.FS.(IDMapper); ok {
+		return mapper.FileID(name)
+	}
+	return 0, false
+}
+func (o *overlayFS) OpenID(id uint16) (fs.File, error) {
+	if idfs, ok := o.FS.(IDFS); ok {
+		return idfs.OpenID(id)
+	}
+	return nil, &fs.PathError{Op: "open", Path: fmt.Sprintf("#%d", id), Err: fs.ErrNotExist}
+}
+func (o *overlayFS) PathOf(id uint16) (string, error) {
+	if idfs, ok := o.FS.(IDFS); ok {
+		return idfs.PathOf(id)
+	}
+	return "", fmt.Errorf("file ID %d: %w", id, fs.ErrNotExist)
+}
+func (o *overlayFS) UnnamedIDs() ([]uint16, error) {
+	if idfs, ok := o.FS.(IDFS); ok {
+		return idfs.UnnamedIDs()
+	}
+	return nil, nil
+}
@@ -0,0 +1,144 @@
+package nitrofs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"sync"
+	"testing"
+	"testing/fstest"
+
+	"github.com/sukus21/nintil/util"
+	"github.com/sukus21/nintil/util/mapping"
+)
+
+var errTestRead = errors.New("read failed")
+
+// Overlay file that fails halfway through the first read.
+type flakyFile struct {
+	fs.File
+	data   []byte
+	failed bool
+}
+
+func (f *flakyFile) ReadAt(p []byte, off int64) (int, error) {
+	if !f.failed {
+		f.failed = true
+		return copy(p[:len(p)/2], f.data[off:]), errTestRead
+	}
+	n := copy(p, f.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func TestOverlayDataError(t *testing.T) {
+	fsys := fstest.MapFS{"overlay.bin": {Data: []byte("overlay code")}}
+	file, err := fsys.Open("overlay.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := &OverlaySimple{element: &flakyFile{File: file, data: fsys["overlay.bin"].Data}}
+
+	// Failed reads are not cached
+	if _, err := o.Code(); !errors.Is(err, errTestRead) {
+		t.Errorf("got %v, expected %v", err, errTestRead)
+	}
+	if data := o.Data(); !bytes.Equal(data, []byte("overlay code")) {
+		t.Errorf("got %q, expected %q", data, "overlay code")
+	}
+	if code, err := o.Code(); err != nil || !bytes.Equal(code, []byte("overlay code")) {
+		t.Errorf("got %q, %v", code, err)
+	}
+}
+
+// Overlay file that always fails to read.
+type failingFile struct {
+	fs.File
+}
+
+func (f failingFile) Read([]byte) (int, error) {
+	return 0, errTestRead
+}
+
+func TestBuildOverlayDataError(t *testing.T) {
+	fsys := fstest.MapFS{"overlay.bin": {Data: []byte("overlay code")}}
+	file, err := fsys.Open("overlay.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	overlays := NewOverlaySet(&OverlaySimple{element: failingFile{file}})
+
+	w := util.NewGrowingWriteSeeker(nil)
+	mmap := mapping.NewMapping(0x1000000)
+	for _, opts := range [][]BuildOption{nil, {WithStableIDs()}} {
+		_, err := Build(util.NewWriteAtSeeker(w), WithOverlays(testFiles, overlays, nil), mmap, opts...)
+		if !errors.Is(err, errTestRead) {
+			t.Errorf("got %v, expected %v", err, errTestRead)
+		}
+	}
+	if err := WriteOverlayTable(io.Discard, overlays.All(), []uint16{0}); !errors.Is(err, errTestRead) {
+		t.Errorf("got %v, expected %v", err, errTestRead)
+	}
+}
+
+func TestOverlayConcurrentAccess(t *testing.T) {
+	fsys := buildTestFS(t)
+	overlays := fsys.GetArm9Overlays()
+	if len(overlays) != 1 {
+		t.Fatalf("got %d overlays, expected 1", len(overlays))
+	}
+	o := overlays[0].(*OverlaySimple)
+
+	var wg sync.WaitGroup
+	for i := range 16 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if data := o.Data(); !bytes.Equal(data, []byte("overlay 9")) {
+				t.Errorf("goroutine %d: got data %q", i, data)
+			}
+			if code, err := o.Code(); err != nil || !bytes.Equal(code, []byte("overlay 9")) {
+				t.Errorf("goroutine %d: got code %q, %v", i, code, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestOverlaySetIDs(t *testing.T) {
+	overlays := []*OverlaySimple{
+		NewOverlay(0x02100000, []byte{0}, 0),
+		NewOverlay(0x02100000, []byte{1}, 0),
+		NewOverlay(0x02100000, []byte{2}, 0),
+	}
+	checkIDs := func(name string, expected ...uint32) {
+		t.Helper()
+		for i, o := range overlays {
+			if o.id != expected[i] {
+				t.Errorf("%s: overlay %d: got ID %d, expected %d", name, i, o.id, expected[i])
+			}
+		}
+	}
+
+	// The set changes the IDs of the overlays given to it
+	s := NewOverlaySet(overlays[2], overlays[0])
+	checkIDs("new", 1, 0, 0)
+	if id := s.Append(overlays[1]); id != 2 {
+		t.Errorf("got ID %d, expected 2", id)
+	}
+	checkIDs("appended", 1, 2, 0)
+	if err := s.Remove(0); err != nil {
+		t.Fatal(err)
+	}
+	checkIDs("removed", 0, 1, 0)
+	if err := s.Replace(1, overlays[2]); err != nil {
+		t.Fatal(err)
+	}
+	checkIDs("replaced", 0, 1, 1)
+	if err := s.Remove(2); !errors.Is(err, ErrNoSuchOverlay) {
+		t.Errorf("got %v, expected %v", err, ErrNoSuchOverlay)
+	}
+}
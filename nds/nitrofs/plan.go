@@ -0,0 +1,313 @@
+package nitrofs
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+var ErrUnstableIDs = errors.New("cannot keep original file IDs")
+
+// Largest number of files a NitroFS can hold
+const maxFiles = 0xF000
+
+// What to write for each file ID
+type buildPlanEntry struct {
+	// Path of file in filesystem
+	path string
+
+	// Overlay data
+	overlay bool
+	data    []byte
+
+	// Unnamed file, opened by ID
+	unnamed bool
+}
+
+func (e *buildPlanEntry) used() bool {
+	return e.path != "" || e.overlay || e.unnamed
+}
+
+// File ID assignments for Build.
+// File IDs of regular files are stored in the fsCache.
+type buildPlan struct {
+	// Indexed by file ID
+	entries []buildPlanEntry
+
+	// File IDs of overlays
+	ovt9 []uint16
+	ovt7 []uint16
+}
+
+func (plan *buildPlan) set(id int, entry buildPlanEntry) {
+	if id >= len(plan.entries) {
+		plan.entries = append(plan.entries, make([]buildPlanEntry, id+1-len(plan.entries))...)
+	}
+	plan.entries[id] = entry
+}
+
+func (plan *buildPlan) isUsed(id int) bool {
+	return id < len(plan.entries) && plan.entries[id].used()
+}
+
+// Get IDs of unnamed files that should be kept
+func unnamedIDs(fsys any) ([]uint16, error) {
+	if idfs, ok := fsys.(IDFS); ok {
+		return idfs.UnnamedIDs()
+	}
+	return nil, nil
+}
+
+// Get all folders in breadth-first order, which is the order of folder IDs.
+// Also returns the index of each folder's parent.
+func (fsc *fsCache) breadthFirst() ([]*fsCacheFolder, []int) {
+	folders := []*fsCacheFolder{&fsc.root}
+	parents := []int{-1}
+	for i := 0; i < len(folders); i++ {
+		for j := range folders[i].folders {
+			folders = append(folders, &folders[i].folders[j])
+			parents = append(parents, i)
+		}
+	}
+	return folders, parents
+}
+
+// Give out file IDs in order: ARM9 overlays, ARM7 overlays, then files breadth-first.
+// Unnamed files keep their IDs, and are skipped over.
+func planSequential(fsys any, fsc *fsCache, arm9Overlays []Overlay, arm7Overlays []Overlay) (*buildPlan, error) {
+	plan := &buildPlan{}
+	unnamed, err := unnamedIDs(fsys)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range unnamed {
+		plan.set(int(id), buildPlanEntry{unnamed: true})
+	}
+
+	// Find next run of free IDs
+	next := 0
+	alloc := func(n int) int {
+		for i := 0; i < n; i++ {
+			if plan.isUsed(next + i) {
+				next += i + 1
+				i = -1
+			}
+		}
+		start := next
+		next += n
+		return start
+	}
+
+	addOverlays := func(overlays []Overlay) ([]uint16, error) {
+		ids := make([]uint16, len(overlays))
+		for i, ov := range overlays {
+			data, err := ReadOverlayData(ov)
+			if err != nil {
+				return nil, err
+			}
+			id := alloc(1)
+			ids[i] = uint16(id)
+			plan.set(id, buildPlanEntry{
+				overlay: true,
+				data:    data,
+			})
+		}
+		return ids, nil
+	}
+	if plan.ovt9, err = addOverlays(arm9Overlays); err != nil {
+		return nil, err
+	}
+	if plan.ovt7, err = addOverlays(arm7Overlays); err != nil {
+		return nil, err
+	}
+
+	folders, _ := fsc.breadthFirst()
+	for _, folder := range folders {
+		first := alloc(len(folder.files))
+		folder.firstFile = uint16(first)
+		for i := range folder.files {
+			folder.files[i].id = uint16(first + i)
+			plan.set(first+i, buildPlanEntry{
+				path: folder.files[i].path,
+			})
+		}
+	}
+	return plan, nil
+}
+
+// Keep original file IDs where known, and give new files IDs after those.
+func planStable(fsys any, fsc *fsCache, arm9Overlays []Overlay, arm7Overlays []Overlay) (*buildPlan, error) {
+	mapper, _ := fsys.(IDMapper)
+	getId := func(name string) (uint16, bool) {
+		if mapper == nil {
+			return 0, false
+		}
+		return mapper.FileID(name)
+	}
+
+	// Collect known IDs first, unnamed files included
+	plan := &buildPlan{}
+	used := map[uint16]string{}
+	next := 0
+	claim := func(id uint16, name string) error {
+		if other, ok := used[id]; ok {
+			return fmt.Errorf("%w: %s and %s both have file ID %d", ErrUnstableIDs, other, name, id)
+		}
+		used[id] = name
+		next = max(next, int(id)+1)
+		return nil
+	}
+	overlayIds := func(overlays []Overlay, cpu int) ([]int, error) {
+		ids := make([]int, len(overlays))
+		for i, ov := range overlays {
+			ids[i] = -1
+			if ovs, ok := ov.(*OverlaySimple); ok {
+				if id, ok := ovs.FileID(); ok {
+					if err := claim(id, fmt.Sprintf("ARM%d overlay %d", cpu, i)); err != nil {
+						return nil, err
+					}
+					ids[i] = int(id)
+				}
+			}
+		}
+		return ids, nil
+	}
+	unnamed, err := unnamedIDs(fsys)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range unnamed {
+		if err := claim(id, fmt.Sprintf("unnamed file %d", id)); err != nil {
+			return nil, err
+		}
+	}
+	ovt9, err := overlayIds(arm9Overlays, 9)
+	if err != nil {
+		return nil, err
+	}
+	ovt7, err := overlayIds(arm7Overlays, 7)
+	if err != nil {
+		return nil, err
+	}
+
+	folders, _ := fsc.breadthFirst()
+	known := make(map[string]bool)
+	for _, folder := range folders {
+		for i := range folder.files {
+			file := &folder.files[i]
+			if id, ok := getId(file.path); ok {
+				if err := claim(id, file.path); err != nil {
+					return nil, err
+				}
+				file.id = id
+				known[file.path] = true
+			}
+		}
+	}
+
+	// Fit new files around known ones.
+	// Files in a folder must have consecutive IDs.
+	for _, folder := range folders {
+		var oldFiles, newFiles []fsCacheFile
+		for _, file := range folder.files {
+			if known[file.path] {
+				oldFiles = append(oldFiles, file)
+			} else {
+				newFiles = append(newFiles, file)
+			}
+		}
+		slices.SortFunc(oldFiles, func(a, b fsCacheFile) int {
+			return int(a.id) - int(b.id)
+		})
+
+		// Folders without existing files start at the next free ID.
+		// Empty folders keep their original first ID.
+		cur := next
+		if len(oldFiles) != 0 {
+			cur = int(oldFiles[0].id)
+		} else if id, ok := getId(folder.path); ok && len(newFiles) == 0 {
+			cur = int(id)
+		}
+		folder.firstFile = uint16(cur)
+
+		files := make([]fsCacheFile, 0, len(folder.files))
+		takeNew := func() error {
+			if _, ok := used[uint16(cur)]; ok || cur >= maxFiles {
+				return fmt.Errorf("%w: no room for %s in directory %s", ErrUnstableIDs, newFiles[0].path, folder.path)
+			}
+			file := newFiles[0]
+			newFiles = newFiles[1:]
+			file.id = uint16(cur)
+			used[file.id] = file.path
+			files = append(files, file)
+			cur++
+			next = max(next, cur)
+			return nil
+		}
+		for _, file := range oldFiles {
+			for cur < int(file.id) {
+				if len(newFiles) == 0 {
+					return nil, fmt.Errorf("%w: gap before %s (file ID %d) in directory %s", ErrUnstableIDs, file.path, file.id, folder.path)
+				}
+				if err := takeNew(); err != nil {
+					return nil, err
+				}
+			}
+			files = append(files, file)
+			cur++
+		}
+		for len(newFiles) != 0 {
+			if err := takeNew(); err != nil {
+				return nil, err
+			}
+		}
+		folder.files = files
+	}
+
+	// New overlays go last
+	resolveOverlays := func(overlays []Overlay, ids []int) []uint16 {
+		out := make([]uint16, len(overlays))
+		for i := range overlays {
+			if ids[i] == -1 {
+				ids[i] = next
+				next++
+			}
+			out[i] = uint16(ids[i])
+		}
+		return out
+	}
+	plan.ovt9 = resolveOverlays(arm9Overlays, ovt9)
+	plan.ovt7 = resolveOverlays(arm7Overlays, ovt7)
+	if next > maxFiles {
+		return nil, fmt.Errorf("%w: file ID %d exceeds limit", ErrUnstableIDs, next-1)
+	}
+
+	// Fill in entries
+	plan.entries = make([]buildPlanEntry, next)
+	for _, folder := range folders {
+		for _, file := range folder.files {
+			plan.entries[file.id] = buildPlanEntry{
+				path: file.path,
+			}
+		}
+	}
+	for _, table := range []struct {
+		overlays []Overlay
+		ids      []uint16
+	}{
+		{arm9Overlays, plan.ovt9},
+		{arm7Overlays, plan.ovt7},
+	} {
+		for i, ov := range table.overlays {
+			data, err := ReadOverlayData(ov)
+			if err != nil {
+				return nil, err
+			}
+			plan.entries[table.ids[i]] = buildPlanEntry{overlay: true, data: data}
+		}
+	}
+	for _, id := range unnamed {
+		plan.entries[id] = buildPlanEntry{unnamed: true}
+	}
+	return plan, nil
+}
@@ -0,0 +1,187 @@
+package nitrofs
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"testing"
+	"testing/fstest"
+)
+
+// Filesystem with known file IDs and unnamed files.
+type plannedFS struct {
+	fstest.MapFS
+	ids     map[string]uint16
+	unnamed []uint16
+}
+
+func (p plannedFS) FileID(name string) (uint16, bool) {
+	id, ok := p.ids[name]
+	return id, ok
+}
+func (p plannedFS) OpenID(id uint16) (fs.File, error) {
+	return nil, fs.ErrNotExist
+}
+func (p plannedFS) PathOf(id uint16) (string, error) {
+	return "", ErrUnnamed
+}
+func (p plannedFS) UnnamedIDs() ([]uint16, error) {
+	return p.unnamed, nil
+}
+
+// Create a filesystem with empty files at the given paths.
+func newPlannedFS(ids map[string]uint16, files ...string) plannedFS {
+	p := plannedFS{MapFS: fstest.MapFS{}, ids: ids}
+	for name := range ids {
+		p.MapFS[name] = &fstest.MapFile{}
+	}
+	for _, name := range files {
+		p.MapFS[name] = &fstest.MapFile{}
+	}
+	return p
+}
+
+// Overlay with a file ID, or none if id is -1.
+func plannedOverlay(id int) *OverlaySimple {
+	ov := NewOverlay(0x02100000, nil, 0)
+	ov.fileId = id
+	return ov
+}
+
+// Get the planned file ID of each file, and of each overlay as "overlay9/<n>" and "overlay7/<n>".
+func plannedIDs(fsc *fsCache, plan *buildPlan) map[string]uint16 {
+	ids := map[string]uint16{}
+	folders, _ := fsc.breadthFirst()
+	for _, folder := range folders {
+		for _, file := range folder.files {
+			ids[file.path] = file.id
+		}
+	}
+	for i, id := range plan.ovt9 {
+		ids[fmt.Sprintf("overlay9/%d", i)] = id
+	}
+	for i, id := range plan.ovt7 {
+		ids[fmt.Sprintf("overlay7/%d", i)] = id
+	}
+	return ids
+}
+
+func TestPlanStable(t *testing.T) {
+	tests := []struct {
+		name     string
+		fsys     plannedFS
+		arm9     []Overlay
+		arm7     []Overlay
+		expected map[string]uint16
+		err      error
+	}{
+		{
+			name: "all known",
+			fsys: newPlannedFS(map[string]uint16{"a": 3, "b": 4, "dir/c": 1, "dir/d": 2}),
+			arm9: []Overlay{plannedOverlay(0)},
+			expected: map[string]uint16{
+				"a": 3, "b": 4, "dir/c": 1, "dir/d": 2, "overlay9/0": 0,
+			},
+		},
+		{
+			name: "new file fills gap",
+			fsys: newPlannedFS(map[string]uint16{"dir/a": 5, "dir/c": 7}, "dir/b"),
+			expected: map[string]uint16{
+				"dir/a": 5, "dir/b": 6, "dir/c": 7,
+			},
+		},
+		{
+			name: "new files go last",
+			fsys: newPlannedFS(map[string]uint16{"a": 0, "dir/b": 1}, "dir/new", "other/x", "other/y"),
+			arm9: []Overlay{plannedOverlay(-1)},
+			arm7: []Overlay{plannedOverlay(3)},
+			expected: map[string]uint16{
+				"a": 0, "dir/b": 1, "dir/new": 2, "overlay7/0": 3, "other/x": 4, "other/y": 5, "overlay9/0": 6,
+			},
+		},
+		{
+			name: "unnamed file blocks new file",
+			fsys: func() plannedFS {
+				p := newPlannedFS(map[string]uint16{"a": 0}, "b", "c")
+				p.unnamed = []uint16{1}
+				return p
+			}(),
+			err: ErrUnstableIDs,
+		},
+		{
+			name: "same ID twice",
+			fsys: newPlannedFS(map[string]uint16{"a": 1, "dir/b": 1}),
+			err:  ErrUnstableIDs,
+		},
+		{
+			name: "overlay and file share ID",
+			fsys: newPlannedFS(map[string]uint16{"a": 0}),
+			arm9: []Overlay{plannedOverlay(0)},
+			err:  ErrUnstableIDs,
+		},
+		{
+			name: "unnamed file and file share ID",
+			fsys: func() plannedFS {
+				p := newPlannedFS(map[string]uint16{"a": 0})
+				p.unnamed = []uint16{0}
+				return p
+			}(),
+			err: ErrUnstableIDs,
+		},
+		{
+			name: "gap without new files",
+			fsys: newPlannedFS(map[string]uint16{"dir/a": 0, "dir/c": 2, "b": 1}),
+			err:  ErrUnstableIDs,
+		},
+		{
+			name: "no room for new file",
+			fsys: newPlannedFS(map[string]uint16{"dir/a": 0, "b": 1}, "dir/new"),
+			err:  ErrUnstableIDs,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fsc, err := validate(tt.fsys)
+			if err != nil {
+				t.Fatal(err)
+			}
+			plan, err := planStable(tt.fsys, fsc, tt.arm9, tt.arm7)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got error %v, expected %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			if ids := plannedIDs(fsc, plan); !maps.Equal(ids, tt.expected) {
+				t.Errorf("got IDs %v, expected %v", ids, tt.expected)
+			}
+		})
+	}
+}
+
+func TestPlanSequential(t *testing.T) {
+	fsys := newPlannedFS(nil, "a", "b", "dir/c", "dir/sub/d", "e/f")
+	fsys.unnamed = []uint16{1, 4}
+	fsc, err := validate(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := planSequential(fsys, fsc, []Overlay{plannedOverlay(-1)}, []Overlay{plannedOverlay(-1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Files of a directory stay together, around unnamed files
+	expected := map[string]uint16{
+		"overlay9/0": 0, "overlay7/0": 2, "a": 5, "b": 6, "dir/c": 7, "e/f": 8, "dir/sub/d": 9,
+	}
+	if ids := plannedIDs(fsc, plan); !maps.Equal(ids, expected) {
+		t.Errorf("got IDs %v, expected %v", ids, expected)
+	}
+	for _, id := range fsys.unnamed {
+		if !plan.entries[id].unnamed {
+			t.Errorf("file ID %d is not kept for unnamed file", id)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package nitrofs
+
+import (
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// A directory of a streamFS, returned by streamFS.Sub.
+// Paths are relative to dir, and errors report them the same way.
+type subFS struct {
+	fsys *streamFS
+	dir  string
+}
+
+// Get the path in the parent filesystem.
+func (s *subFS) fullName(op string, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return path.Join(s.dir, name), nil
+}
+
+// Get the path relative to dir.
+func (s *subFS) shorten(name string) (string, bool) {
+	if name == s.dir {
+		return ".", true
+	}
+	if rel, ok := strings.CutPrefix(name, s.dir+"/"); ok {
+		return rel, true
+	}
+	return "", false
+}
+
+// Rewrite paths in errors to be relative to dir.
+func (s *subFS) fixErr(err error) error {
+	if e, ok := err.(*fs.PathError); ok {
+		if short, ok := s.shorten(e.Path); ok {
+			e.Path = short
+		}
+	}
+	return err
+}
+
+func (s *subFS) Open(name string) (fs.File, error) {
+	full, err := s.fullName("open", name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := s.fsys.Open(full)
+	return f, s.fixErr(err)
+}
+
+func (s *subFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	full, err := s.fullName("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := s.fsys.ReadDir(full)
+	return entries, s.fixErr(err)
+}
+
+func (s *subFS) ReadFile(name string) ([]byte, error) {
+	full, err := s.fullName("readfile", name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := s.fsys.ReadFile(full)
+	return data, s.fixErr(err)
+}
+
+func (s *subFS) Stat(name string) (fs.FileInfo, error) {
+	full, err := s.fullName("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := s.fsys.Stat(full)
+	return info, s.fixErr(err)
+}
+
+func (s *subFS) Glob(pattern string) ([]string, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	if pattern == "." {
+		return []string{"."}, nil
+	}
+
+	list, err := s.fsys.Glob(path.Join(s.dir, pattern))
+	if err != nil {
+		return nil, err
+	}
+	out := make([]string, 0, len(list))
+	for _, name := range list {
+		if short, ok := s.shorten(name); ok {
+			out = append(out, short)
+		}
+	}
+	return out, nil
+}
+
+func (s *subFS) Sub(dir string) (fs.FS, error) {
+	if dir == "." {
+		return s, nil
+	}
+	full, err := s.fullName("sub", dir)
+	if err != nil {
+		return nil, err
+	}
+	sub, err := s.fsys.Sub(full)
+	return sub, s.fixErr(err)
+}
@@ -0,0 +1,69 @@
+package patch
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/sukus21/nintil/nds/disasm"
+)
+
+var ErrOutOfRange = errors.New("branch target out of range")
+var ErrMisaligned = errors.New("address is misaligned")
+var ErrModeSwitch = errors.New("only a branch with link can switch instruction set")
+
+// Encode a branch with an immediate offset, as it is stored in memory.
+// The branch is located at from in the mode instruction set, and jumps to to in the target instruction set.
+// ARM branches are 4 bytes, Thumb B is 2 bytes, and Thumb BL and BLX are 4 bytes.
+// Switching instruction set needs link, and is encoded as BLX, which does not exist in ARMv4T.
+func EncodeBranch(from uint32, mode disasm.Mode, to uint32, target disasm.Mode, link bool) ([]byte, error) {
+	fail := func(err error) ([]byte, error) {
+		return nil, fmt.Errorf("branch from 0x%08X to 0x%08X: %w", from, to, err)
+	}
+	switch {
+	case mode != target && !link:
+		return fail(ErrModeSwitch)
+	case mode == disasm.ModeARM && from%4 != 0, mode == disasm.ModeThumb && from%2 != 0:
+		return fail(ErrMisaligned)
+	case target == disasm.ModeARM && to%4 != 0, target == disasm.ModeThumb && to%2 != 0:
+		return fail(ErrMisaligned)
+	}
+
+	inRange := func(offset int32, bits int) bool {
+		return offset >= -(1<<(bits-1)) && offset < 1<<(bits-1)
+	}
+	if mode == disasm.ModeARM {
+		offset := int32(to - from - 8)
+		if !inRange(offset, 26) {
+			return fail(ErrOutOfRange)
+		}
+		w := 0xEA000000 | uint32(offset>>2)&0xFFFFFF
+		if target == disasm.ModeThumb {
+			w = 0xFA000000 | uint32(offset&2)<<23 | uint32(offset>>2)&0xFFFFFF
+		} else if link {
+			w |= 1 << 24
+		}
+		return binary.LittleEndian.AppendUint32(nil, w), nil
+	}
+
+	// Thumb B
+	offset := int32(to - from - 4)
+	if !link {
+		if !inRange(offset, 12) {
+			return fail(ErrOutOfRange)
+		}
+		return binary.LittleEndian.AppendUint16(nil, 0xE000|uint16(offset>>1)&0x7FF), nil
+	}
+
+	// Thumb BL and BLX, BLX targets are relative to the word aligned PC
+	second := uint16(0xF800)
+	if target == disasm.ModeARM {
+		offset = int32(to - (from+4)&^3)
+		second = 0xE800
+	}
+	if !inRange(offset, 23) {
+		return fail(ErrOutOfRange)
+	}
+	out := binary.LittleEndian.AppendUint16(nil, 0xF000|uint16(offset>>12)&0x7FF)
+	return binary.LittleEndian.AppendUint16(out, second|uint16(offset>>1)&0x7FF), nil
+}
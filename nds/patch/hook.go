@@ -0,0 +1,181 @@
+package patch
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/sukus21/nintil/nds/disasm"
+)
+
+var ErrRelocation = errors.New("instruction cannot be moved")
+
+// ARM instructions saving and restoring the registers a called function may change
+const (
+	armPushScratch = 0xE92D500F // push {r0-r3, r12, lr}
+	armPopScratch  = 0xE8BD500F // pop {r0-r3, r12, lr}
+)
+
+// Size of a hook trampoline in bytes
+const trampolineSize = 5 * 4
+
+// Call a function before the ARM instruction at address.
+// The instruction is replaced with a branch to a trampoline placed in free space,
+// which calls the function at target in the mode instruction set, runs the replaced instruction, then branches back.
+// Registers are kept across the call, except for the condition flags.
+// Thumb function addresses may have bit 0 set.
+// Returns the address of the trampoline.
+//
+// Instructions that read the PC can not be moved to the trampoline, except for branches.
+func (p *Patcher) Hook(address uint32, target uint32, mode disasm.Mode) (uint32, error) {
+	fail := func(err error) (uint32, error) {
+		return 0, fmt.Errorf("hook at 0x%08X: %w", address, err)
+	}
+	if address%4 != 0 {
+		return fail(ErrMisaligned)
+	}
+	if mode == disasm.ModeThumb {
+		if p.arm7 {
+			return fail(ErrNoExchange)
+		}
+		target &^= 1
+	}
+	loc, err := p.resolve(address)
+	if err != nil {
+		return fail(err)
+	}
+	code := make([]byte, 4)
+	if err := p.space.Get(loc, code); err != nil {
+		return fail(err)
+	}
+	ins, err := disasm.Decode(code, address, disasm.ModeARM, disasm.WithArch(p.arch()))
+	if err != nil {
+		return fail(err)
+	}
+
+	trampoline, err := p.alloc(trampolineSize, 4)
+	if err != nil {
+		return fail(err)
+	}
+	data, err := p.trampoline(trampoline, address, ins, target, mode)
+	if err == nil {
+		var branch []byte
+		if branch, err = EncodeBranch(address, disasm.ModeARM, trampoline, disasm.ModeARM, false); err == nil {
+			patch := Patch{Kind: KindHook, Address: address, Space: trampoline, Size: trampolineSize}
+			err = p.apply(patch, change{trampoline, data}, change{address, branch})
+		}
+	}
+	if err != nil {
+		p.release(trampoline, trampolineSize)
+		return fail(err)
+	}
+	return trampoline, nil
+}
+
+// Build a hook trampoline located at address.
+// hook is the address of the replaced instruction ins.
+func (p *Patcher) trampoline(address uint32, hook uint32, ins disasm.Instruction, target uint32, mode disasm.Mode) ([]byte, error) {
+	call, err := EncodeBranch(address+4, disasm.ModeARM, target, mode, true)
+	if err != nil {
+		return nil, err
+	}
+	moved, err := relocate(ins, address+12)
+	if err != nil {
+		return nil, err
+	}
+	back, err := EncodeBranch(address+16, disasm.ModeARM, hook+4, disasm.ModeARM, false)
+	if err != nil {
+		return nil, err
+	}
+
+	out := binary.LittleEndian.AppendUint32(nil, armPushScratch)
+	out = append(out, call...)
+	out = binary.LittleEndian.AppendUint32(out, armPopScratch)
+	out = binary.LittleEndian.AppendUint32(out, moved)
+	return append(out, back...), nil
+}
+
+// Encode an ARM instruction so it does the same when located at address.
+func relocate(ins disasm.Instruction, address uint32) (uint32, error) {
+	switch {
+	case ins.Undefined:
+		return 0, fmt.Errorf("%s: %w", ins, ErrRelocation)
+	case ins.Branch != nil:
+		data, err := EncodeBranch(address, disasm.ModeARM, ins.Branch.Target, ins.Branch.Mode, ins.Branch.Link)
+		if err != nil {
+			return 0, err
+		}
+
+		// Keep the condition, BLX has none
+		w := binary.LittleEndian.Uint32(data)
+		if ins.Branch.Mode == disasm.ModeARM {
+			w = w&0x0FFFFFFF | ins.Raw&0xF0000000
+		}
+		return w, nil
+	case armReadsPC(ins.Raw):
+		return 0, fmt.Errorf("%s: %w", ins, ErrRelocation)
+	}
+	return ins.Raw, nil
+}
+
+// Does a defined ARM instruction read the PC, other than as a branch with an immediate offset?
+// Only the register fields read by the instruction are checked.
+// Writing the PC, like pop {r4, pc} or mov pc, lr, does the same wherever the instruction is.
+func armReadsPC(w uint32) bool {
+	const pc = 15
+	rn, rd, rs, rm := (w>>16)&0xF, (w>>12)&0xF, (w>>8)&0xF, w&0xF
+	bit := func(n int) bool {
+		return w&(1<<n) != 0
+	}
+	store := !bit(20)
+
+	if w>>28 == 0xF {
+		switch {
+		case w&0x0D70F000 == 0x0550F000: // PLD
+			return rn == pc || bit(25) && rm == pc
+		case w&0x0F100010 == 0x0E000010: // MCR2
+			return rd == pc
+		case w&0x0E000000 == 0x0C000000: // LDC2 and STC2
+			return rn == pc
+		}
+		return false
+	}
+
+	switch (w >> 25) & 7 {
+	case 0:
+		switch {
+		case w&0x90 == 0x90 && w&0x60 == 0: // Multiplies and swaps
+			return rn == pc || rd == pc || rs == pc || rm == pc
+		case w&0x90 == 0x90: // Halfword, signed byte and doubleword loads and stores
+			return rn == pc || !bit(22) && rm == pc || store && (w>>5)&3 != 2 && rd == pc
+		case w&0x0FB0FFF0 == 0x0120F000, w&0x0FFFFFD0 == 0x012FFF10, w&0x0FFF0FF0 == 0x016F0F10: // MSR, BX, BLX and CLZ
+			return rm == pc
+		case w&0x0F900FF0 == 0x01000050: // Saturating arithmetic
+			return rm == pc || rn == pc
+		case w&0x0F900090 == 0x01000080: // Signed halfword multiplies
+			return rm == pc || rs == pc || rd == pc || (w>>21)&3 == 2 && rn == pc
+		case w&0x01900000 == 0x01000000: // MRS and BKPT
+			return false
+		}
+	case 1:
+		if w&0x01900000 == 0x01000000 { // MSR
+			return false
+		}
+		return rn == pc
+	case 2:
+		return rn == pc || store && rd == pc
+	case 3:
+		return rn == pc || rm == pc || store && rd == pc
+	case 4:
+		return rn == pc || store && bit(15)
+	case 6:
+		return rn == pc || w&0x0FF00000 == 0x0C400000 && rd == pc // MCRR
+	case 7:
+		return !bit(24) && bit(4) && store && rd == pc // MCR
+	default:
+		return false
+	}
+
+	// Data processing with a register operand
+	return rn == pc || rm == pc || bit(4) && rs == pc
+}
@@ -0,0 +1,298 @@
+// Patch code and data of a ROM by RAM address.
+// Every applied patch is logged, so it can be reverted or exported.
+package patch
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/sukus21/nintil/nds"
+	"github.com/sukus21/nintil/nds/disasm"
+)
+
+var ErrNoFreeSpace = errors.New("not enough free space")
+var ErrOtherCPU = errors.New("address is loaded by the other CPU")
+var ErrNoExchange = errors.New("ARMv4T has no BLX to switch instruction set")
+var ErrNothingToRevert = errors.New("no patches to revert")
+
+// Kind of patch.
+type Kind int
+
+const (
+	// Bytes written with Write
+	KindWrite Kind = iota
+
+	// Word written with WriteWord
+	KindWord
+
+	// Branch written with Branch
+	KindBranch
+
+	// Code or data placed in free space with Insert
+	KindInsert
+
+	// Hook written with Hook, and its trampoline
+	KindHook
+
+	// Overlay added with AppendOverlay
+	KindOverlay
+
+	// ARM9 section extended with ExtendSection, Address is the start of the section
+	KindExtend
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindWrite:
+		return "write"
+	case KindWord:
+		return "word"
+	case KindBranch:
+		return "branch"
+	case KindInsert:
+		return "insert"
+	case KindHook:
+		return "hook"
+	case KindOverlay:
+		return "overlay"
+	case KindExtend:
+		return "extend"
+	default:
+		return "unknown"
+	}
+}
+
+func (k Kind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+// Bytes written by a patch.
+type Write struct {
+	Address  uint32
+	Location nds.Location
+	Old      []byte
+	New      []byte
+}
+
+// A change made by the patcher.
+type Patch struct {
+	Kind Kind
+
+	// RAM address the patch was applied at
+	Address uint32
+
+	// Bytes written, in order
+	Writes []Write
+
+	// Free space taken by the patch, or added by KindOverlay and KindExtend.
+	// Size is 0 if there is none.
+	Space uint32
+	Size  uint32
+
+	// ID of the overlay added by KindOverlay
+	Overlay uint32
+}
+
+// Free space, from start up to end.
+type span struct {
+	start uint32
+	end   uint32
+}
+
+// Applies patches to an address space, and keeps a log of them.
+// Changes are made to the address space, use Flush to apply them to the ROM.
+type Patcher struct {
+	space    *nds.AddressSpace
+	arm7     bool
+	overlays []uint32
+	free     []span
+	log      []Patch
+}
+
+// Options for New.
+type Option func(*Patcher)
+
+// Patch the ARM7 binary and its overlays, instead of the ARM9 binary and its overlays.
+func WithArm7() Option {
+	return func(p *Patcher) {
+		p.arm7 = true
+	}
+}
+
+// Prefer these ARM9 overlays when resolving addresses that more than one overlay is loaded at.
+// Overlays added with AppendOverlay are always preferred.
+func WithOverlays(ids ...uint32) Option {
+	return func(p *Patcher) {
+		p.overlays = append(p.overlays, ids...)
+	}
+}
+
+// Create a patcher for an address space.
+func New(a *nds.AddressSpace, opts ...Option) *Patcher {
+	p := &Patcher{
+		space: a,
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// Get the address space being patched.
+func (p *Patcher) AddressSpace() *nds.AddressSpace {
+	return p.space
+}
+
+// Apply changes to the binaries of the ROM.
+func (p *Patcher) Flush() error {
+	return p.space.Flush()
+}
+
+// Get the applied patches, oldest first.
+func (p *Patcher) Log() []Patch {
+	return slices.Clone(p.log)
+}
+
+// Write the patch log as JSON.
+func (p *Patcher) Export(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(p.Log())
+}
+
+func (p *Patcher) arch() disasm.Arch {
+	if p.arm7 {
+		return disasm.ARMv4T
+	}
+	return disasm.ARMv5TE
+}
+
+// Find the location of an address, which must be loaded by the patched CPU.
+func (p *Patcher) resolve(address uint32) (nds.Location, error) {
+	loc, err := p.space.Resolve(address, p.overlays...)
+	if err != nil {
+		return loc, err
+	}
+	if loc.Binary.IsArm7() != p.arm7 {
+		return loc, fmt.Errorf("resolve 0x%08X: %w", address, ErrOtherCPU)
+	}
+	return loc, nil
+}
+
+// Bytes to write at an address.
+type change struct {
+	address uint32
+	data    []byte
+}
+
+// Make the changes of a patch, and log it.
+// If a change fails, the changes before it are undone.
+func (p *Patcher) apply(patch Patch, changes ...change) error {
+	for _, c := range changes {
+		loc, err := p.resolve(c.address)
+		if err != nil {
+			return p.rollback(patch.Writes, err)
+		}
+		w := Write{Address: c.address, Location: loc, Old: make([]byte, len(c.data)), New: slices.Clone(c.data)}
+		if err := p.space.Get(loc, w.Old); err != nil {
+			return p.rollback(patch.Writes, err)
+		}
+		if err := p.space.Put(loc, w.New); err != nil {
+			return p.rollback(patch.Writes, err)
+		}
+		patch.Writes = append(patch.Writes, w)
+	}
+	p.log = append(p.log, patch)
+	return nil
+}
+
+// Undo the writes of a patch that failed with err.
+// If undoing fails as well, both errors are returned, and the code may be left half-patched.
+func (p *Patcher) rollback(writes []Write, err error) error {
+	if undoErr := p.undo(writes); undoErr != nil {
+		return errors.Join(err, fmt.Errorf("undo: %w", undoErr))
+	}
+	return err
+}
+
+// Restore the old bytes of writes, last write first.
+func (p *Patcher) undo(writes []Write) error {
+	for i := len(writes) - 1; i >= 0; i-- {
+		if err := p.space.Put(writes[i].Location, writes[i].Old); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write bytes at a RAM address.
+func (p *Patcher) Write(address uint32, data []byte) error {
+	return p.apply(Patch{Kind: KindWrite, Address: address}, change{address, data})
+}
+
+// Write a word at a RAM address, such as a literal pool value.
+func (p *Patcher) WriteWord(address uint32, value uint32) error {
+	if address%4 != 0 {
+		return fmt.Errorf("write word at 0x%08X: %w", address, ErrMisaligned)
+	}
+	data := binary.LittleEndian.AppendUint32(nil, value)
+	return p.apply(Patch{Kind: KindWord, Address: address}, change{address, data})
+}
+
+// Write a branch at from, in the mode instruction set, to to in the target instruction set.
+// See EncodeBranch for the branches that can be encoded.
+func (p *Patcher) Branch(from uint32, mode disasm.Mode, to uint32, target disasm.Mode, link bool) error {
+	if mode != target && p.arm7 {
+		return fmt.Errorf("branch from 0x%08X to 0x%08X: %w", from, to, ErrNoExchange)
+	}
+	data, err := EncodeBranch(from, mode, to, target, link)
+	if err != nil {
+		return err
+	}
+	return p.apply(Patch{Kind: KindBranch, Address: from}, change{from, data})
+}
+
+// Revert the last applied patch.
+func (p *Patcher) Revert() error {
+	if len(p.log) == 0 {
+		return ErrNothingToRevert
+	}
+	patch := p.log[len(p.log)-1]
+	if err := p.undo(patch.Writes); err != nil {
+		return fmt.Errorf("revert %s at 0x%08X: %w", patch.Kind, patch.Address, err)
+	}
+
+	switch patch.Kind {
+	case KindInsert, KindHook:
+		p.release(patch.Space, patch.Size)
+	case KindOverlay:
+		p.forget(patch.Space, patch.Size)
+		if err := p.space.RemoveOverlay(patch.Overlay); err != nil {
+			return fmt.Errorf("revert %s at 0x%08X: %w", patch.Kind, patch.Address, err)
+		}
+		p.overlays = slices.DeleteFunc(p.overlays, func(id uint32) bool {
+			return id == patch.Overlay
+		})
+	case KindExtend:
+		p.forget(patch.Space, patch.Size)
+		if _, err := p.space.ResizeArm9Section(patch.Address, patch.Space-patch.Address); err != nil {
+			return fmt.Errorf("revert %s at 0x%08X: %w", patch.Kind, patch.Address, err)
+		}
+	}
+	p.log = p.log[:len(p.log)-1]
+	return nil
+}
+
+// Revert every applied patch, last patch first.
+func (p *Patcher) RevertAll() error {
+	for len(p.log) != 0 {
+		if err := p.Revert(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,357 @@
+package patch
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"slices"
+	"testing"
+	"testing/fstest"
+
+	"github.com/sukus21/nintil/nds"
+	"github.com/sukus21/nintil/nds/disasm"
+	"github.com/sukus21/nintil/nds/ndstest"
+	"github.com/sukus21/nintil/nds/nitrofs"
+)
+
+// RAM addresses of the test ROM
+const (
+	testArm9    = 0x02000000
+	testArm7    = 0x02380000
+	testItcm    = 0x01FF8000
+	testOverlay = 0x02100000
+	testFree    = 0x02000300
+)
+
+// Instructions at the start of the test ARM9 binary
+var testCode = []uint32{
+	0xE3A00001, // mov r0, #1
+	0xE59F0004, // ldr r0, [pc, #4]
+	0x0A000001, // beq 0x02000014
+	0xE8BD8010, // pop {r4, pc}
+	0xE28F0004, // add r0, pc, #4
+	0xE1A0F00E, // mov pc, lr
+	0xE92D8000, // push {pc}
+	0xE12FFF1E, // bx lr
+}
+
+// Build a ROM with a static ARM9 section, an ITCM autoload section, an ARM7 binary and one ARM9 overlay.
+// The ARM9 module params follow the autoload list, so they move when the ITCM section grows.
+func testRom(t *testing.T) *nds.Rom {
+	t.Helper()
+	arm9 := make([]byte, 0x400)
+	for i := range len(arm9) / 4 {
+		binary.LittleEndian.PutUint32(arm9[i*4:], 0xE1A00000) // nop
+	}
+	for i, w := range testCode {
+		binary.LittleEndian.PutUint32(arm9[i*4:], w)
+	}
+	arm9 = append(arm9, bytes.Repeat([]byte{0xAA}, 0x40)...)
+	arm9 = binary.LittleEndian.AppendUint32(arm9, testItcm)
+	arm9 = binary.LittleEndian.AppendUint32(arm9, 0x40)
+	arm9 = binary.LittleEndian.AppendUint32(arm9, 0x20)
+	for _, v := range []uint32{
+		testArm9 + 0x440, // Autoload list start
+		testArm9 + 0x44C, // Autoload list end
+		testArm9 + 0x400, // Autoload start
+		0x02000500,       // BSS start
+		0x02000600,       // BSS end
+		0,                // Compressed end
+		0x04000000,       // SDK version
+		0xDEC00621,
+		0x2106C0DE,
+	} {
+		arm9 = binary.LittleEndian.AppendUint32(arm9, v)
+	}
+
+	rom := ndstest.Rom(t, ndstest.Header(), fstest.MapFS{
+		"arm9.bin": {Data: arm9},
+		"arm7.bin": {Data: bytes.Repeat([]byte{0x77}, 0x100)},
+	})
+	rom.Arm9Overlays.Append(nitrofs.NewOverlay(testOverlay, bytes.Repeat([]byte{0x99}, 0x100), 0x20))
+	return rom
+}
+
+// Create a patcher for a test ROM, with free space after the module params.
+func testPatcher(t *testing.T) (*nds.Rom, *Patcher) {
+	t.Helper()
+	rom := testRom(t)
+	space, err := rom.AddressSpace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := New(space)
+	if err := p.AddFreeSpace(testFree, 0x100); err != nil {
+		t.Fatal(err)
+	}
+	return rom, p
+}
+
+// Read a word from the address space being patched.
+func readWord(t *testing.T, p *Patcher, address uint32) uint32 {
+	t.Helper()
+	var w uint32
+	if err := p.AddressSpace().Read(address, &w); err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+func TestRevertAll(t *testing.T) {
+	rom, p := testPatcher(t)
+	arm9 := slices.Clone(rom.Arm9Binary)
+	arm7 := slices.Clone(rom.Arm7Binary)
+	ov, err := rom.Arm9Overlays.Get(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	overlay := slices.Clone(ov.Data())
+
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	must(p.Write(0x02000020, []byte{1, 2, 3, 4}))
+	must(p.WriteWord(0x02000024, 0xDEADBEEF))
+	must(p.Branch(0x02000028, disasm.ModeARM, 0x02000100, disasm.ModeARM, true))
+	must(p.Write(testOverlay+0x10, []byte{5, 6}))
+	must(p.Write(testItcm+4, []byte{7, 8}))
+	_, err = p.Insert([]byte{9, 10, 11}, 4)
+	must(err)
+	_, err = p.Hook(0x02000000, 0x02000100, disasm.ModeARM)
+	must(err)
+	_, err = p.Hook(0x0200000C, 0x02000101, disasm.ModeThumb)
+	must(err)
+	_, err = p.AppendOverlay(0x02200000, 0x40)
+	must(err)
+	extended, err := p.ExtendSection(testItcm, 0x20)
+	must(err)
+	must(p.Write(extended, []byte{12, 13, 14, 15}))
+	_, err = p.Insert(make([]byte, 0x30), 4)
+	must(err)
+
+	// Something changed
+	must(p.Flush())
+	if bytes.Equal(rom.Arm9Binary, arm9) || rom.Arm9Overlays.Len() != 2 {
+		t.Fatalf("patches were not applied")
+	}
+
+	must(p.RevertAll())
+	must(p.Flush())
+	if !bytes.Equal(rom.Arm9Binary, arm9) {
+		t.Errorf("ARM9 binary differs after reverting")
+	}
+	if !bytes.Equal(rom.Arm7Binary, arm7) {
+		t.Errorf("ARM7 binary differs after reverting")
+	}
+	if ov, _ := rom.Arm9Overlays.Get(0); rom.Arm9Overlays.Len() != 1 || !bytes.Equal(ov.Data(), overlay) {
+		t.Errorf("overlays differ after reverting")
+	}
+	if len(p.Log()) != 0 {
+		t.Errorf("log is not empty: %v", p.Log())
+	}
+	if err := p.Revert(); !errors.Is(err, ErrNothingToRevert) {
+		t.Errorf("got %v, expected %v", err, ErrNothingToRevert)
+	}
+
+	// All free space is available again
+	if _, err := p.Insert(make([]byte, 0x100), 4); err != nil {
+		t.Errorf("free space was not released: %v", err)
+	}
+}
+
+func TestHookTrampoline(t *testing.T) {
+	_, p := testPatcher(t)
+	trampoline, err := p.Hook(0x02000000, 0x02000100, disasm.ModeARM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trampoline != testFree {
+		t.Fatalf("got trampoline at 0x%08X, expected 0x%08X", trampoline, testFree)
+	}
+
+	expected := []uint32{
+		0xE92D500F, // push {r0-r3, r12, lr}
+		0xEBFFFF7D, // bl 0x02000100
+		0xE8BD500F, // pop {r0-r3, r12, lr}
+		0xE3A00001, // mov r0, #1
+		0xEAFFFF3B, // b 0x02000004
+	}
+	for i, w := range expected {
+		if got := readWord(t, p, trampoline+uint32(i)*4); got != w {
+			t.Errorf("trampoline word %d: got %08X, expected %08X", i, got, w)
+		}
+	}
+	if got := readWord(t, p, 0x02000000); got != 0xEA0000BE {
+		t.Errorf("hook: got %08X, expected b 0x%08X", got, trampoline)
+	}
+
+	// Thumb functions are called with BLX
+	trampoline, err = p.Hook(0x0200001C, 0x02000101, disasm.ModeThumb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ins, err := disasm.Decode(binary.LittleEndian.AppendUint32(nil, readWord(t, p, trampoline+4)), trampoline+4, disasm.ModeARM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ins.String() != "blx 0x02000100" {
+		t.Errorf("got %q, expected blx 0x02000100", ins)
+	}
+
+	// The ARM7 has no BLX
+	space, err := testRom(t).AddressSpace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(space, WithArm7()).Hook(testArm7, 0x02000101, disasm.ModeThumb); !errors.Is(err, ErrNoExchange) {
+		t.Errorf("got %v, expected %v", err, ErrNoExchange)
+	}
+	if _, err := p.Hook(0x02000002, 0x02000100, disasm.ModeARM); !errors.Is(err, ErrMisaligned) {
+		t.Errorf("got %v, expected %v", err, ErrMisaligned)
+	}
+}
+
+func TestRelocate(t *testing.T) {
+	const trampoline = 0x02000300
+	tests := []struct {
+		raw      uint32
+		expected string
+	}{
+		{0xE3A00001, "mov r0, #1"},
+		{0x0A000001, "beq 0x0200000C"},
+		{0xEB000000, "bl 0x02000008"},
+		{0xFA000000, "blx 0x02000008"},
+		{0xE8BD8010, "pop {r4, pc}"},
+		{0xE1A0F00E, "mov pc, lr"},
+		{0xE12FFF1E, "bx lr"},
+		{0xE5910004, "ldr r0, [r1, #4]"},
+		{0xE59F0004, ""}, // ldr r0, [pc, #4]
+		{0xE28F0004, ""}, // add r0, pc, #4
+		{0xE1A0000F, ""}, // mov r0, pc
+		{0xE92D8000, ""}, // push {pc}
+		{0xE58DF000, ""}, // str pc, [sp]
+		{0xE12FFF1F, ""}, // bx pc
+		{0xE79F0001, ""}, // ldr r0, [pc, r1]
+		{0xE1CF00B0, ""}, // strh r0, [pc]
+		{0xE7F000F0, ""}, // undefined
+		{0xE129F00F, ""}, // msr cpsr_fc, pc
+		{0xE329F01F, "msr cpsr_fc, #0x1F"},
+		{0xE8BD800F, "pop {r0-r3, pc}"},
+	}
+	for _, tt := range tests {
+		ins, err := disasm.Decode(binary.LittleEndian.AppendUint32(nil, tt.raw), testArm9, disasm.ModeARM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, err := relocate(ins, trampoline)
+		if tt.expected == "" {
+			if !errors.Is(err, ErrRelocation) {
+				t.Errorf("%s: got %v, expected %v", ins, err, ErrRelocation)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", ins, err)
+			continue
+		}
+		moved, _ := disasm.Decode(binary.LittleEndian.AppendUint32(nil, w), trampoline, disasm.ModeARM)
+		if moved.String() != tt.expected {
+			t.Errorf("%s: got %q, expected %q", ins, moved, tt.expected)
+		}
+	}
+}
+
+func TestEncodeBranch(t *testing.T) {
+	const arm, thumb = disasm.ModeARM, disasm.ModeThumb
+	tests := []struct {
+		from     uint32
+		mode     disasm.Mode
+		to       uint32
+		target   disasm.Mode
+		link     bool
+		expected []byte
+		err      error
+	}{
+		{0x02000000, arm, 0x02000008, arm, false, []byte{0x00, 0x00, 0x00, 0xEA}, nil},
+		{0x02000100, arm, 0x02000100, arm, true, []byte{0xFE, 0xFF, 0xFF, 0xEB}, nil},
+		{0x02000000, arm, 0x0200000A, thumb, true, []byte{0x00, 0x00, 0x00, 0xFB}, nil},
+		{0x02000000, arm, 0x04000004, arm, false, []byte{0xFF, 0xFF, 0x7F, 0xEA}, nil},
+		{0x02000000, arm, 0x04000008, arm, false, nil, ErrOutOfRange},
+		{0x02000000, arm, 0x00000000, arm, true, nil, ErrOutOfRange},
+		{0x02000000, thumb, 0x02000000, thumb, false, []byte{0xFE, 0xE7}, nil},
+		{0x02000000, thumb, 0x02000802, thumb, false, []byte{0xFF, 0xE3}, nil},
+		{0x02000000, thumb, 0x02000804, thumb, false, nil, ErrOutOfRange},
+		{0x02000000, thumb, 0x02000008, thumb, true, []byte{0x00, 0xF0, 0x02, 0xF8}, nil},
+		{0x02000002, thumb, 0x02000008, arm, true, []byte{0x00, 0xF0, 0x02, 0xE8}, nil},
+		{0x02000000, thumb, 0x02400004, thumb, true, nil, ErrOutOfRange},
+		{0x02000000, thumb, 0x01C00000, arm, true, nil, ErrOutOfRange},
+		{0x02000002, arm, 0x02000008, arm, false, nil, ErrMisaligned},
+		{0x02000000, arm, 0x02000002, arm, true, nil, ErrMisaligned},
+		{0x02000001, thumb, 0x02000008, thumb, false, nil, ErrMisaligned},
+		{0x02000000, arm, 0x02000008, thumb, false, nil, ErrModeSwitch},
+	}
+	for _, tt := range tests {
+		data, err := EncodeBranch(tt.from, tt.mode, tt.to, tt.target, tt.link)
+		if !errors.Is(err, tt.err) || !bytes.Equal(data, tt.expected) {
+			t.Errorf("%s 0x%08X to %s 0x%08X: got % X, %v, expected % X, %v", tt.mode, tt.from, tt.target, tt.to, data, err, tt.expected, tt.err)
+		}
+	}
+}
+
+func TestExport(t *testing.T) {
+	_, p := testPatcher(t)
+	if err := p.WriteWord(0x02000024, 0xDEADBEEF); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Hook(0x02000000, 0x02000100, disasm.ModeARM); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := p.Export(buf); err != nil {
+		t.Fatal(err)
+	}
+	var log []struct {
+		Kind    string
+		Address uint32
+		Writes  []struct{ Old, New []byte }
+	}
+	if err := json.Unmarshal(buf.Bytes(), &log); err != nil {
+		t.Fatal(err)
+	}
+	if len(log) != 2 || log[0].Kind != "word" || log[1].Kind != "hook" || log[1].Address != 0x02000000 {
+		t.Fatalf("got %+v", log)
+	}
+	if w := log[0].Writes[0]; !bytes.Equal(w.Old, []byte{0, 0, 0xA0, 0xE1}) || !bytes.Equal(w.New, []byte{0xEF, 0xBE, 0xAD, 0xDE}) {
+		t.Errorf("got write %+v", w)
+	}
+}
+
+func TestFailedPatch(t *testing.T) {
+	_, p := testPatcher(t)
+	before := readWord(t, p, 0x02000020)
+
+	// The second change is outside the ARM9 binary, so the first is undone
+	err := p.apply(Patch{Kind: KindWrite, Address: 0x02000020}, change{0x02000020, []byte{1, 2, 3, 4}}, change{0x03000000, []byte{1}})
+	if !errors.Is(err, nds.ErrUnmappedAddress) {
+		t.Errorf("got %v, expected %v", err, nds.ErrUnmappedAddress)
+	}
+	if got := readWord(t, p, 0x02000020); got != before {
+		t.Errorf("got %08X, expected %08X", got, before)
+	}
+	if len(p.Log()) != 0 {
+		t.Errorf("failed patch was logged")
+	}
+
+	// Free space must be loaded by the patched CPU
+	if err := p.AddFreeSpace(testArm7, 0x10); !errors.Is(err, ErrOtherCPU) {
+		t.Errorf("got %v, expected %v", err, ErrOtherCPU)
+	}
+	if _, err := p.Insert(make([]byte, 0x101), 4); !errors.Is(err, ErrNoFreeSpace) {
+		t.Errorf("got %v, expected %v", err, ErrNoFreeSpace)
+	}
+}
@@ -0,0 +1,132 @@
+package patch
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+
+	"github.com/sukus21/nintil/nds"
+)
+
+// Mark RAM as free, so Insert and Hook can place code there.
+// The memory must be loaded by the patched CPU, and not be used by the game.
+func (p *Patcher) AddFreeSpace(address uint32, size uint32) error {
+	if size == 0 {
+		return nil
+	}
+	for _, at := range []uint32{address, address + size - 1} {
+		if _, err := p.resolve(at); err != nil {
+			return fmt.Errorf("add free space: %w", err)
+		}
+	}
+	p.release(address, size)
+	return nil
+}
+
+// Take size bytes of free space, aligned to align bytes.
+// Returns the address of the space.
+func (p *Patcher) alloc(size uint32, align uint32) (uint32, error) {
+	align = max(align, 1)
+	for i, s := range p.free {
+		start := (s.start + align - 1) / align * align
+		if start < s.start || start > s.end || s.end-start < size {
+			continue
+		}
+
+		// Keep what is left on either side
+		var rest []span
+		if start != s.start {
+			rest = append(rest, span{s.start, start})
+		}
+		if start+size != s.end {
+			rest = append(rest, span{start + size, s.end})
+		}
+		p.free = slices.Replace(p.free, i, i+1, rest...)
+		return start, nil
+	}
+	return 0, fmt.Errorf("allocate %d bytes: %w", size, ErrNoFreeSpace)
+}
+
+// Give space back, so it can be taken again.
+// Adjacent free space is merged.
+func (p *Patcher) release(address uint32, size uint32) {
+	if size == 0 {
+		return
+	}
+	free := append(p.free, span{address, address + size})
+	slices.SortFunc(free, func(a, b span) int {
+		return cmp.Compare(a.start, b.start)
+	})
+	p.free = free[:1]
+	for _, s := range free[1:] {
+		last := &p.free[len(p.free)-1]
+		if s.start <= last.end {
+			last.end = max(last.end, s.end)
+		} else {
+			p.free = append(p.free, s)
+		}
+	}
+}
+
+// Remove space from the free space, whether it is taken or not.
+func (p *Patcher) forget(address uint32, size uint32) {
+	var free []span
+	for _, s := range p.free {
+		if s.start < address {
+			free = append(free, span{s.start, min(s.end, address)})
+		}
+		if s.end > address+size {
+			free = append(free, span{max(s.start, address+size), s.end})
+		}
+	}
+	p.free = free
+}
+
+// Place code or data in free space, aligned to align bytes.
+// Returns the RAM address it was placed at.
+func (p *Patcher) Insert(data []byte, align uint32) (uint32, error) {
+	address, err := p.alloc(uint32(len(data)), align)
+	if err != nil {
+		return 0, err
+	}
+	patch := Patch{Kind: KindInsert, Address: address, Space: address, Size: uint32(len(data))}
+	if err := p.apply(patch, change{address, data}); err != nil {
+		p.release(address, uint32(len(data)))
+		return 0, err
+	}
+	return address, nil
+}
+
+// Add a new ARM9 overlay of size zeroed bytes loaded at address, and mark it as free space.
+// Returns the ID of the new overlay.
+// The game does not know about the overlay, so it has to be loaded by code patched into the game.
+func (p *Patcher) AppendOverlay(address uint32, size uint32) (uint32, error) {
+	if p.arm7 {
+		return 0, fmt.Errorf("append overlay: %w", ErrOtherCPU)
+	}
+	id := p.space.AppendOverlay(address, make([]byte, size), 0)
+	p.overlays = append(p.overlays, id)
+	p.release(address, size)
+	p.log = append(p.log, Patch{Kind: KindOverlay, Address: address, Space: address, Size: size, Overlay: id})
+	return id, nil
+}
+
+// Add size zeroed bytes to the end of the ARM9 autoload section containing address, and mark them as free space.
+// Returns the RAM address of the added bytes.
+// The BSS of the section moves up by size, so the RAM following it must be unused.
+func (p *Patcher) ExtendSection(address uint32, size uint32) (uint32, error) {
+	if p.arm7 {
+		return 0, fmt.Errorf("extend section: %w", ErrOtherCPU)
+	}
+	section := p.space.Arm9Memory().Section(address)
+	if section == nil {
+		return 0, fmt.Errorf("extend section at 0x%08X: %w", address, nds.ErrUnmappedAddress)
+	}
+	start, err := p.space.ResizeArm9Section(address, uint32(len(section.Data))+size)
+	if err != nil {
+		return 0, err
+	}
+	p.release(start, size)
+	p.log = append(p.log, Patch{Kind: KindExtend, Address: section.Address, Space: start, Size: size})
+	return start, nil
+}
@@ -4,13 +4,14 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"image"
 	"image/draw"
 	"io"
-	"slices"
 
 	"github.com/sukus21/nintil/compression/rlz"
 	"github.com/sukus21/nintil/nds"
+	"github.com/sukus21/nintil/nds/signature"
 	"github.com/sukus21/nintil/util"
 	"github.com/sukus21/nintil/util/ezbin"
 )
@@ -93,7 +94,10 @@ func NewFMapReader(fmapInfoBlock []byte, fmapFile io.ReadSeeker, treasureFile io
 // It SHOULD work with ROMs from all regions and all revisions though?
 // Only tested with the PAL version.
 func NewFMapReaderFromRom(rom *nds.Rom) (*FMapReader, error) {
-	fmapInfo := findFmapInfo(rom)
+	fmapInfo, err := findFmapInfo(rom)
+	if err != nil {
+		return nil, err
+	}
 	fmapFile, err := rom.Filesystem.Open("FMap/FMapData.dat")
 	if err != nil {
 		return nil, err
@@ -111,15 +115,41 @@ func NewFMapReaderFromRom(rom *nds.Rom) (*FMapReader, error) {
 	)
 }
 
-func findFmapInfo(rom *nds.Rom) []byte {
-	size := 638 * 20
-	for i := range rom.Arm9Binary[:len(rom.Arm9Binary)-size] {
-		if slices.Equal([]byte{0, 0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0, 3, 0, 0, 0}, rom.Arm9Binary[i:i+16]) {
-			return rom.Arm9Binary[i : i+size]
-		}
+// The FMap info block starts with the tileset IDs of the first map
+var fmapInfoSignature = signature.MustParse("00 00 00 00 01 00 00 00 02 00 00 00 03 00 00 00")
+
+// Number of maps in the FMap info block
+const fmapInfoCount = 638
+
+// Find the FMap info block in the ARM9 binary.
+func findFmapInfo(rom *nds.Rom) ([]byte, error) {
+	space, err := rom.AddressSpace()
+	if err != nil {
+		return nil, fmt.Errorf("FMap: %w", err)
+	}
+	matches, err := signature.Scan(space, fmapInfoSignature,
+		signature.WithAlignment(4),
+		signature.WithBinaries(nds.BinaryArm9),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("FMap: info block: %w", err)
 	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("FMap: info block: %w", signature.ErrNotFound)
+	}
+
+	// The signature is short enough to show up elsewhere, the info block comes first
+	match := matches[0]
 
-	panic("could not find the thing :(")
+	code, err := space.Code(match.Location)
+	if err != nil {
+		return nil, fmt.Errorf("FMap: %w", err)
+	}
+	size := fmapInfoCount * 20
+	if len(code)-int(match.Location.Offset) < size {
+		return nil, ErrInvalidFMapInfo
+	}
+	return code[match.Location.Offset : int(match.Location.Offset)+size], nil
 }
 
 // Number of total maps
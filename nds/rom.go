@@ -1,12 +1,18 @@
 package nds
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"image"
+	"image/gif"
 	"io"
 	"unicode/utf16"
 
+	"github.com/sukus21/nintil/nds/key1"
 	"github.com/sukus21/nintil/nds/nitrofs"
+	"github.com/sukus21/nintil/patch"
 	"github.com/sukus21/nintil/util"
 	"github.com/sukus21/nintil/util/ezbin"
 	"github.com/sukus21/nintil/util/mapping"
@@ -15,30 +21,109 @@ import (
 // Nintendo DS ROM structure.
 // Contains most of the things you probably want to get from a ROM file.
 type Rom struct {
-	reader     io.ReadSeeker
+	reader     util.ReadAtSeeker
 	mapping    *mapping.Mapping
-	header     *header
+	header     *Header
 	banner     *banner
-	Filesystem nitrofs.NitroFS
 	Arm9Binary []byte
 	Arm7Binary []byte
+
+	// Files written by SaveROM.
+	// Its overlays are ignored when saving, Arm9Overlays and Arm7Overlays are written instead.
+	// Assigning a new filesystem keeps the current overlay sets, use SetFilesystem to read them from it.
+	Filesystem nitrofs.NitroFS
+
+	// Footer following the ARM9 binary, nil if there is none
+	arm9Footer []byte
+
+	// Overlays written by SaveROM.
+	// Initially read from Filesystem, these always take precedence over the overlays of Filesystem.
+	// A nil set means no overlays.
+	Arm9Overlays *nitrofs.OverlaySet
+	Arm7Overlays *nitrofs.OverlaySet
+
+	// DSi binaries, only used if the header has a DSi extension
+	Arm9iBinary []byte
+	Arm7iBinary []byte
+
+	// Data between the start of the DSi region and the ARM9i binary
+	twlPreamble []byte
+
+	// Checksums that did not match when opening the ROM
+	checksumMismatches []Diagnostic
+
+	// KEY1 key table given to OpenROM, used to check the secure area checksum
+	key1 *key1.KeyTable
 }
 
 func (o *Rom) String() string {
 	return o.mapping.String()
 }
 
+// Options for OpenROM.
+type OpenOption func(*openOptions)
+
+type openOptions struct {
+	validate bool
+	key1     *key1.KeyTable
+	patch    []byte
+}
+
+// Validate the ROM while opening it.
+// If any problems are found, OpenROM returns a *ValidationError.
+func WithValidation() OpenOption {
+	return func(o *openOptions) {
+		o.validate = true
+	}
+}
+
+// Decrypt the secure area of the ARM9 binary if it is encrypted, using the given KEY1 key table.
+// Without this, Arm9Binary is left as it is in the ROM.
+func WithSecureAreaDecryption(table *key1.KeyTable) OpenOption {
+	return func(o *openOptions) {
+		o.key1 = table
+	}
+}
+
+// Apply an IPS or BPS patch to the ROM file before opening it.
+// The patched ROM is kept in memory.
+func WithPatch(data []byte) OpenOption {
+	return func(o *openOptions) {
+		o.patch = data
+	}
+}
+
 // Open a new ROM.
-// TODO: ROM validation.
-func OpenROM(r util.ReadAtSeeker) (*Rom, error) {
+func OpenROM(r util.ReadAtSeeker, opts ...OpenOption) (*Rom, error) {
+	options := openOptions{}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if options.patch != nil {
+		size, err := r.Seek(0, io.SeekEnd)
+		if err != nil {
+			return nil, err
+		}
+		data, err := patch.Apply(r, size, options.patch)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(data)
+	}
+
 	rom := &Rom{
 		reader: r,
-		// TODO: allow different mapping sizes
-		mapping: mapping.NewMapping(0x4000000),
+		key1:   options.key1,
 	}
 	if err := rom.openHeader(); err != nil {
 		return nil, err
 	}
+	rom.checksumMismatches = validateChecksums(rom.header, r, options.key1)
+	if options.validate {
+		if diagnostics := Validate(rom); len(diagnostics) != 0 {
+			return nil, &ValidationError{Diagnostics: diagnostics}
+		}
+	}
 	if err := rom.openNitroFS(); err != nil {
 		return nil, err
 	}
@@ -46,38 +131,118 @@ func OpenROM(r util.ReadAtSeeker) (*Rom, error) {
 		return nil, err
 	}
 
-	rom.Arm9Binary = make([]byte, rom.header.Arm9Size)
-	rom.reader.Seek(int64(rom.header.Arm9RomOffset), io.SeekStart)
-	if _, err := rom.reader.Read(rom.Arm9Binary); err != nil {
+	var err error
+	h := rom.header
+	if rom.Arm9Binary, err = rom.openBinary(mappingNameArm9Binary, h.Arm9RomOffset, h.Arm9Size); err != nil {
 		return nil, err
 	}
-	rom.mapping.AddAt(mappingNameArm9Binary, rom.header.Arm9RomOffset, rom.header.Arm9Size)
-
-	rom.Arm7Binary = make([]byte, rom.header.Arm7Size)
-	rom.reader.Seek(int64(rom.header.Arm7RomOffset), io.SeekStart)
-	if _, err := rom.reader.Read(rom.Arm7Binary); err != nil {
+	rom.openArm9Footer()
+	if options.key1 != nil {
+		if err := rom.decryptSecureArea(options.key1); err != nil {
+			return nil, err
+		}
+	}
+	if rom.Arm7Binary, err = rom.openBinary(mappingNameArm7Binary, h.Arm7RomOffset, h.Arm7Size); err != nil {
 		return nil, err
 	}
-	rom.mapping.AddAt(mappingNameArm7Binary, rom.header.Arm7RomOffset, rom.header.Arm7Size)
+	if h.Twl != nil {
+		if err := rom.openTwlBinaries(); err != nil {
+			return nil, err
+		}
+	}
 
 	return rom, nil
 }
 
+// Options for SaveROM and SaveROMTo.
+type SaveOption func(*saveOptions)
+
+type saveOptions struct {
+	build        []nitrofs.BuildOption
+	fixChecksums bool
+	key1         *key1.KeyTable
+}
+
+// Recompute the secure area checksum and the Nintendo logo checksum.
+// The secure area checksum is only recomputed if it can be, see SecureAreaCRC.
+// Saving fails with ErrSecureAreaKeyTable if the secure area is decrypted,
+// as it is then saved decrypted unless WithSecureAreaEncryption is used.
+// The header checksum is always recomputed.
+func WithFixedChecksums() SaveOption {
+	return func(o *saveOptions) {
+		o.fixChecksums = true
+	}
+}
+
+// Encrypt the secure area of the ARM9 binary if it is decrypted, using the given KEY1 key table.
+// Arm9Binary itself is not changed.
+func WithSecureAreaEncryption(table *key1.KeyTable) SaveOption {
+	return func(o *saveOptions) {
+		o.key1 = table
+	}
+}
+
+// Keep the original file IDs of all NitroFS files and overlays.
+// See nitrofs.WithStableIDs.
+func WithStableFileIDs() SaveOption {
+	return func(o *saveOptions) {
+		o.build = append(o.build, nitrofs.WithStableIDs())
+	}
+}
+
 // Serialize ROM.
-// TODO: ROM validation.
-func SaveROM(o *Rom, out io.Writer) error {
-
-	// TODO: currently only worried about Partners in Time PAL, which is always 64MB.
-	romSize := 0x4000000
-	wRaw := util.NewWriteSeeker(make([]byte, romSize))
-	w := util.NewWriteAtSeeker(wRaw)
-	m := mapping.NewMapping(uint32(romSize))
+// The whole ROM is built in memory before being written to out.
+// To avoid this, use SaveROMTo.
+func SaveROM(o *Rom, out io.Writer, opts ...SaveOption) error {
+	w := util.NewGrowingWriteSeeker(nil)
+	if err := SaveROMTo(o, util.NewWriteAtSeeker(w), opts...); err != nil {
+		return err
+	}
+
+	// Copy all of this to the output writer
+	_, err := out.Write(w.Buf)
+	return err
+}
+
+// Serialize ROM directly to w, streaming file contents as they are written.
+// w should be empty (like a newly created file), as skipped over regions are not cleared.
+// The cartridge capacity from the header is kept if everything fits,
+// otherwise the next capacity large enough to hold the ROM is used.
+//
+// For DSi ROMs, the digest hashtables, the HMACs and the RSA signature in the header are not recomputed,
+// so a DSi ROM with changed contents will not pass signature checks.
+// Hashtables are moved along with the DSi region, Validate reports those that no longer match the layout.
+func SaveROMTo(o *Rom, w util.WriteAtSeeker, opts ...SaveOption) error {
+	options := saveOptions{}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	var secureArea *regionCapture
+	if options.fixChecksums {
+		secureArea = newRegionCapture(w, secureAreaStart, secureAreaSize)
+		w = secureArea
+	}
+
+	capacityMax, _ := DeviceCapacity(DeviceSizeMax)
+	m := mapping.NewMapping(capacityMax)
 	h := *o.header
 	nh := &h
+	if h.Twl != nil {
+		twl := *h.Twl
+		nh.Twl = &twl
+	}
 
 	// Write ARM9 binary
-	pos, _ := w.Seek(0x4000, io.SeekStart)
-	if err := ezbin.WritePadded(w, 0x0200, 0xFF, o.Arm9Binary); err != nil {
+	arm9 := o.Arm9Binary
+	if options.key1 != nil {
+		var err error
+		if arm9, err = o.encryptedArm9(options.key1); err != nil {
+			return err
+		}
+	}
+	pos, _ := w.Seek(secureAreaStart, io.SeekStart)
+	if err := ezbin.WritePadded(w, 0x0200, 0xFF, arm9, o.arm9Footer); err != nil {
 		return err
 	}
 	nh.Arm9RomOffset = uint32(pos)
@@ -101,25 +266,129 @@ func SaveROM(o *Rom, out io.Writer) error {
 	nh.BannerOffset = uint32(pos)
 
 	// Serialize NitroFS
-	ezbin.Align(w, 0x0200)
-	nfsInfo, err := nitrofs.Build(w, o.Filesystem, m)
+	if _, err := ezbin.Align(w, 0x0200); err != nil {
+		return err
+	}
+	fsys := nitrofs.WithOverlays(o.Filesystem, o.Arm9Overlays, o.Arm7Overlays)
+	nfsInfo, err := nitrofs.Build(w, fsys, m, options.build...)
+	if err != nil {
+		return err
+	}
+	end, err := ezbin.At[int64](w)
 	if err != nil {
 		return err
 	}
+	nh.RomSize = uint32(end)
+
+	// Write DSi region
+	if nh.Twl != nil {
+		if end, err = o.saveTwlBinaries(w, nh, uint32(end)); err != nil {
+			return err
+		}
+	}
+
+	// Grow cartridge if needed
+	deviceSize := nh.DeviceSize
+	if capacity, err := DeviceCapacity(deviceSize); err != nil || int64(capacity) < end {
+		if end > int64(capacityMax) {
+			return fmt.Errorf("save ROM: contents exceed largest cartridge capacity")
+		}
+		deviceSize, _ = DeviceSizeFor(uint32(end))
+	}
+	capacity, _ := DeviceCapacity(deviceSize)
+
+	// Pad the rest of the cartridge
+	padding := make([]byte, 0x10000)
+	for pos := end; pos < int64(capacity); pos += int64(len(padding)) {
+		n := min(int64(len(padding)), int64(capacity)-pos)
+		if _, err := w.WriteAt(padding[:n], pos); err != nil {
+			return err
+		}
+	}
 
 	// Update header
 	nh.ApplyNitroFSInfo(nfsInfo)
-	nh.UpdateChecksum()
+	nh.DeviceSize = deviceSize
+	if secureArea != nil {
+		// Keep the checksum if it cannot be computed, but not if a key table is missing
+		crc, err := secureAreaCRC(nh, secureArea.buf, options.key1)
+		if err == nil {
+			nh.secureAreaChecksum = crc
+		} else if errors.Is(err, ErrSecureAreaKeyTable) {
+			return fmt.Errorf("save ROM: %w", err)
+		}
+		nh.UpdateLogoChecksum()
+	}
+	if err := nh.UpdateChecksum(); err != nil {
+		return err
+	}
 
 	// Finally, serialize header
 	w.Seek(0, io.SeekStart)
-	if err := SaveHeader(w, nh); err != nil {
-		return err
+	return SaveHeader(w, nh)
+}
+
+// Write the DSi region after the end of the regular ROM, and update the header to match.
+// Digest hashtables and modcrypt areas move along with the region, their contents are kept as-is.
+// Returns the end of the DSi region.
+func (o *Rom) saveTwlBinaries(w util.WriteAtSeeker, nh *Header, ntrEnd uint32) (int64, error) {
+	twl := nh.Twl
+	oldTwl := o.header.Twl
+	oldTwlStart := uint32(o.header.TwlRegionStart) * twlRegionAlignment
+	twlStart := ezbin.PadTo(ntrEnd, twlRegionAlignment)
+	nh.NtrRegionEnd = uint16(twlStart / twlRegionAlignment)
+	nh.TwlRegionStart = uint16(twlStart / twlRegionAlignment)
+
+	// Write preamble
+	if _, err := w.Seek(int64(twlStart), io.SeekStart); err != nil {
+		return 0, err
+	}
+	if err := ezbin.Write(w, o.twlPreamble); err != nil {
+		return 0, err
 	}
 
-	// Copy all of this to the output writer
-	_, err = out.Write(wRaw.Buf)
-	return err
+	// Write ARM9i binary
+	pos, _ := ezbin.Align(w, uint32(0x0200))
+	if err := ezbin.WritePadded(w, 0x0200, 0xFF, o.Arm9iBinary); err != nil {
+		return 0, err
+	}
+	twl.Arm9iRomOffset = pos
+	twl.Arm9iSize = uint32(len(o.Arm9iBinary))
+
+	// Write ARM7i binary
+	pos, _ = ezbin.At[uint32](w)
+	if err := ezbin.WritePadded(w, 0x0200, 0xFF, o.Arm7iBinary); err != nil {
+		return 0, err
+	}
+	twl.Arm7iRomOffset = pos
+	twl.Arm7iSize = uint32(len(o.Arm7iBinary))
+
+	// Move offsets pointing into the DSi region.
+	// Modcrypt areas start within the ARM9i and ARM7i binaries, and move along with them.
+	move := func(offset *uint32) {
+		switch old := *offset; {
+		case old == 0 || oldTwlStart == 0 || old < oldTwlStart:
+		case old >= oldTwl.Arm9iRomOffset && old < oldTwl.Arm9iRomOffset+oldTwl.Arm9iSize:
+			*offset = old - oldTwl.Arm9iRomOffset + twl.Arm9iRomOffset
+		case old >= oldTwl.Arm7iRomOffset && old < oldTwl.Arm7iRomOffset+oldTwl.Arm7iSize:
+			*offset = old - oldTwl.Arm7iRomOffset + twl.Arm7iRomOffset
+		default:
+			*offset = old - oldTwlStart + twlStart
+		}
+	}
+	move(&twl.DigestSectorHashtableOffset)
+	move(&twl.DigestBlockHashtableOffset)
+	move(&twl.Modcrypt1Offset)
+	move(&twl.Modcrypt2Offset)
+
+	// Update region info
+	end, _ := ezbin.At[uint32](w)
+	twl.DigestNtrOffset = 0x4000
+	twl.DigestNtrSize = twlStart - 0x4000
+	twl.DigestTwlOffset = twlStart
+	twl.DigestTwlSize = end - twlStart
+	twl.TotalRomSize = end
+	return int64(end), nil
 }
 
 // Read new header.
@@ -131,21 +400,82 @@ func (o *Rom) openHeader() error {
 		return err
 	}
 
+	// Mapping covers the whole cartridge.
+	// An invalid device size gets the largest cartridge instead.
+	capacity, err := DeviceCapacity(h.DeviceSize)
+	if err != nil {
+		capacity, _ = DeviceCapacity(DeviceSizeMax)
+	}
+
 	// Yay :)
 	o.header = h
+	o.mapping = mapping.NewMapping(capacity)
 	o.mapping.AddAt(mappingNameHeader, 0x00, 0x4000)
-	return err
+	return nil
+}
+
+// Read a binary blob from the ROM, and add it to the mapping.
+func (o *Rom) openBinary(name string, offset uint32, size uint32) ([]byte, error) {
+	buf := make([]byte, size)
+	if _, err := o.reader.ReadAt(buf, int64(offset)); err != nil {
+		return nil, fmt.Errorf("open ROM: read %s: %w", name, err)
+	}
+	o.mapping.AddAt(name, offset, size)
+	return buf, nil
+}
+
+// Read the footer following the ARM9 binary, if there is one.
+func (o *Rom) openArm9Footer() {
+	offset := o.header.Arm9RomOffset + o.header.Arm9Size
+	footer := make([]byte, arm9FooterSize)
+	if _, err := o.reader.ReadAt(footer, int64(offset)); err != nil {
+		return
+	}
+	if binary.LittleEndian.Uint32(footer) != moduleParamsMagic1 {
+		return
+	}
+	o.arm9Footer = footer
+	o.mapping.AddAt(mappingNameArm9Footer, offset, arm9FooterSize)
+}
+
+// Read ARM9i and ARM7i binaries.
+func (o *Rom) openTwlBinaries() error {
+	var err error
+	twl := o.header.Twl
+	if o.Arm9iBinary, err = o.openBinary(mappingNameArm9iBinary, twl.Arm9iRomOffset, twl.Arm9iSize); err != nil {
+		return err
+	}
+	if o.Arm7iBinary, err = o.openBinary(mappingNameArm7iBinary, twl.Arm7iRomOffset, twl.Arm7iSize); err != nil {
+		return err
+	}
+
+	// Keep whatever comes before the ARM9i binary
+	twlStart := uint32(o.header.TwlRegionStart) * twlRegionAlignment
+	if twlStart != 0 && twlStart <= twl.Arm9iRomOffset {
+		o.twlPreamble = make([]byte, twl.Arm9iRomOffset-twlStart)
+		if _, err := o.reader.ReadAt(o.twlPreamble, int64(twlStart)); err != nil {
+			return fmt.Errorf("open ROM: read DSi region: %w", err)
+		}
+	}
+	return nil
 }
 
 // Read the in-ROM filesystem.
 func (o *Rom) openNitroFS() error {
-	fs := nitrofs.FromROM(o.reader, o.header.GetNitroFSInfo(), o.mapping)
-	o.Filesystem = fs
+	o.SetFilesystem(nitrofs.FromROM(o.reader, o.header.GetNitroFSInfo(), o.mapping))
 	return nil
 }
 
-// Read the ROM's banner (titles + icon).
-// TODO: does not work with DSi animated icons.
+// Replace the ROM's filesystem, and read the overlay sets from it.
+// Changes made to the previous overlay sets are lost.
+// The new sets share their overlays with fsys, see nitrofs.OverlaySet.
+func (o *Rom) SetFilesystem(fsys nitrofs.NitroFS) {
+	o.Filesystem = fsys
+	o.Arm9Overlays = nitrofs.NewOverlaySet(fsys.GetArm9Overlays()...)
+	o.Arm7Overlays = nitrofs.NewOverlaySet(fsys.GetArm7Overlays()...)
+}
+
+// Read the ROM's banner (titles + icon, and the animated icon of DSi banners).
 func (o *Rom) openBanner() error {
 	o.reader.Seek(int64(o.header.BannerOffset), io.SeekStart)
 	b, err := OpenBanner(o.reader)
@@ -161,7 +491,7 @@ func (o *Rom) openBanner() error {
 }
 
 // Expose header to outside world.
-func (o *Rom) GetHeader() *header {
+func (o *Rom) GetHeader() *Header {
 	return o.header
 }
 
@@ -182,6 +512,41 @@ func (o *Rom) SetIcon(src image.Image) error {
 	return nil
 }
 
+// Get frames of the animated DSi icon.
+// Only available with banner version BannerVersionDSi.
+func (o *Rom) GetAnimatedIcon() ([]AnimatedIconFrame, error) {
+	if o.banner.version != BannerVersionDSi || o.banner.animation == nil {
+		return nil, fmt.Errorf("animated icon: banner version %04X does not support animated icons", o.banner.version)
+	}
+	return o.banner.animation.frames(), nil
+}
+
+// Get the animated DSi icon as a looping GIF.
+// Only available with banner version BannerVersionDSi.
+func (o *Rom) GetAnimatedIconGIF() (*gif.GIF, error) {
+	if o.banner.version != BannerVersionDSi || o.banner.animation == nil {
+		return nil, fmt.Errorf("animated icon: banner version %04X does not support animated icons", o.banner.version)
+	}
+	return o.banner.animation.toGIF(), nil
+}
+
+// Set the animated DSi icon from a 32x32 GIF.
+// Requires banner version BannerVersionDSi.
+// At most 8 unique frames and 8 palettes of 15 colors + transparency can be used.
+func (o *Rom) SetAnimatedIconGIF(g *gif.GIF) error {
+	if o.banner.version != BannerVersionDSi {
+		return fmt.Errorf("animated icon: banner version %04X does not support animated icons", o.banner.version)
+	}
+	animation, err := animationFromGIF(g)
+	if err != nil {
+		return err
+	}
+
+	// Inject into ROM
+	o.banner.animation = animation
+	return nil
+}
+
 // Get title in specified language.
 func (o *Rom) GetTitle(language TitleLanguage) (string, error) {
 	if err := o.banner.checkValidLanguage(language); err != nil {
@@ -212,6 +577,11 @@ func (o *Rom) SetBannerVersion(version uint16) {
 	o.banner.version = version
 }
 
+// Get the mapping of what lies where in the ROM.
+func (o *Rom) GetMapping() *mapping.Mapping {
+	return o.mapping
+}
+
 func (o *Rom) WhatsHere(at uint32) *mapping.MappingEntry {
 	return o.mapping.Find(at)
 }
@@ -0,0 +1,300 @@
+package nds
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/sukus21/nintil/nds/nitrofs"
+)
+
+// Generate random bytes.
+func testData(seed int64, size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+// Header of the test ROM, before SaveROM fills in the rest.
+func testHeader(twl bool) *Header {
+	h := &Header{
+		GameTitle:       "NINTIL",
+		GameCode:        "NTIL",
+		MakerCode:       "01",
+		Arm9Destination: 0x02000000,
+		Arm7Destination: 0x02380000,
+		HeaderSize:      0x4000,
+	}
+	h.SetSecureAreaDelay(0x051E)
+	h.UpdateLogoChecksum()
+	if twl {
+		h.UnitCode = UnitCodeDSi
+		h.Twl = &TwlHeader{
+			Arm9iDestination: 0x02400000,
+			Arm7iDestination: 0x02E80000,
+			TitleId:          0x00030004_4E54494C,
+		}
+	}
+	return h
+}
+
+// A 32x32 icon with a few colors.
+func testIcon() *image.Paletted {
+	palette := color.Palette{color.RGBA{}}
+	for i := range 15 {
+		palette = append(palette, color.RGBA{byte(i * 16), 0x80, byte(255 - i*16), 0xFF})
+	}
+	icon := image.NewPaletted(image.Rect(0, 0, 32, 32), palette)
+	for i := range icon.Pix {
+		icon.Pix[i] = byte(i/7) % 16
+	}
+	return icon
+}
+
+// NitroFS without overlays.
+type testFS struct {
+	fs.FS
+}
+
+func (testFS) GetArm9Overlays() []nitrofs.Overlay {
+	return nil
+}
+func (testFS) GetArm7Overlays() []nitrofs.Overlay {
+	return nil
+}
+
+// Files of the test ROM.
+func testFiles() fstest.MapFS {
+	return fstest.MapFS{
+		"a.txt":         {Data: []byte("hello")},
+		"dir/b.bin":     {Data: testData(4, 0x3000)},
+		"dir/sub/c.bin": {Data: []byte{}},
+	}
+}
+
+// Create a small ROM with files and an overlay.
+// DSi ROMs get a DSi header, DSi binaries and a DSi banner.
+func newTestROM(twl bool) *Rom {
+	b := &banner{version: BannerVersionKorean, icon: testIcon()}
+	if twl {
+		b.version = BannerVersionDSi
+	}
+	for i := range b.titles {
+		b.titles[i] = "Nintil\nTest ROM\n" + TitleLanguage(i).String()
+	}
+	rom := &Rom{
+		header:     testHeader(twl),
+		banner:     b,
+		Filesystem: testFS{testFiles()},
+		Arm9Binary: testData(1, 0x1000),
+		Arm7Binary: testData(2, 0x800),
+
+		Arm9Overlays: nitrofs.NewOverlaySet(nitrofs.NewOverlay(0x02100000, testData(3, 0x400), 0x20)),
+	}
+	if twl {
+		rom.Arm9iBinary = testData(5, 0x900)
+		rom.Arm7iBinary = testData(6, 0x300)
+	}
+	return rom
+}
+
+// Save a ROM and open the result.
+func saveAndOpenROM(t *testing.T, rom *Rom, opts ...SaveOption) (*Rom, []byte) {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	if err := SaveROM(rom, buf, opts...); err != nil {
+		t.Fatal(err)
+	}
+	opened, err := OpenROM(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return opened, buf.Bytes()
+}
+
+// Build the test ROM and open it.
+func testROM(t *testing.T, twl bool) (*Rom, []byte) {
+	t.Helper()
+	return saveAndOpenROM(t, newTestROM(twl))
+}
+
+// Counts bytes written to it, without keeping them.
+type discardWriter struct {
+	pos  int64
+	size int64
+}
+
+func (w *discardWriter) Write(p []byte) (int, error) {
+	n, err := w.WriteAt(p, w.pos)
+	w.pos += int64(n)
+	return n, err
+}
+
+func (w *discardWriter) WriteAt(p []byte, off int64) (int, error) {
+	w.size = max(w.size, off+int64(len(p)))
+	return len(p), nil
+}
+
+func (w *discardWriter) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += w.pos
+	case io.SeekEnd:
+		offset += w.size
+	}
+	w.pos = offset
+	return offset, nil
+}
+
+// Filesystem where one file is a run of zeroes, which is not kept in memory.
+type zeroFileFS struct {
+	files fstest.MapFS
+	name  string
+	size  int64
+}
+
+func (z zeroFileFS) Open(name string) (fs.File, error) {
+	f, err := z.files.Open(name)
+	if err != nil || name != z.name {
+		return f, err
+	}
+	return zeroFile{f, io.LimitReader(zeroReader{}, z.size)}, nil
+}
+
+type zeroFile struct {
+	fs.File
+	r io.Reader
+}
+
+func (f zeroFile) Read(p []byte) (int, error) {
+	return f.r.Read(p)
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+func TestSaveROMCapacity(t *testing.T) {
+	tests := []struct {
+		name       string
+		twl        bool
+		deviceSize byte
+		extra      int
+		expected   byte
+	}{
+		{"kept", false, 5, 0, 5},
+		{"grown", false, 0, 0x40000, 2},
+		{"invalid", false, DeviceSizeMax + 1, 0, 0},
+		{"DSi region", true, 0, 0, 3},
+	}
+	for _, tt := range tests {
+		rom := newTestROM(tt.twl)
+		if tt.extra != 0 {
+			files := testFiles()
+			files["extra.bin"] = &fstest.MapFile{Data: testData(7, tt.extra)}
+			rom.Filesystem = testFS{files}
+		}
+		rom.header.DeviceSize = tt.deviceSize
+
+		saved, data := saveAndOpenROM(t, rom)
+		capacity, _ := DeviceCapacity(tt.expected)
+		if saved.header.DeviceSize != tt.expected || len(data) != int(capacity) {
+			t.Errorf("%s: got device size %d and %d bytes, expected %d and %d bytes", tt.name, saved.header.DeviceSize, len(data), tt.expected, capacity)
+		}
+		if data[len(data)-1] != 0 {
+			t.Errorf("%s: cartridge is not padded", tt.name)
+		}
+	}
+}
+
+func TestOpenROMInvalidDeviceSize(t *testing.T) {
+	_, data := testROM(t, false)
+	data[0x14] = DeviceSizeMax + 1
+	rom, err := OpenROM(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rom.Arm9Binary, testData(1, 0x1000)) {
+		t.Errorf("ARM9 binary differs")
+	}
+}
+
+func TestSaveROMTooLarge(t *testing.T) {
+	capacityMax, _ := DeviceCapacity(DeviceSizeMax)
+	tests := []struct {
+		name string
+		twl  bool
+		size int64
+		fits bool
+	}{
+		{"fits", false, int64(capacityMax) - 0x40000, true},
+		{"too large", false, int64(capacityMax), false},
+		{"no room for DSi region", true, int64(capacityMax) - 0x40000, false},
+	}
+	for _, tt := range tests {
+		fsys := zeroFileFS{testFiles(), "large.bin", tt.size}
+		fsys.files[fsys.name] = &fstest.MapFile{}
+		rom := newTestROM(tt.twl)
+		rom.Filesystem = testFS{fsys}
+
+		w := &discardWriter{}
+		err := SaveROMTo(rom, w)
+		switch {
+		case tt.fits && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case tt.fits && w.size != int64(capacityMax):
+			t.Errorf("%s: wrote 0x%X bytes, expected 0x%X", tt.name, w.size, capacityMax)
+		case !tt.fits && (err == nil || !strings.Contains(err.Error(), "exceed largest cartridge capacity")):
+			t.Errorf("%s: got %v, expected capacity error", tt.name, err)
+		}
+	}
+}
+
+func TestSaveROMTo(t *testing.T) {
+	for _, twl := range []bool{false, true} {
+		rom, data := testROM(t, twl)
+
+		// Saving an opened ROM gives the same ROM
+		buf := &bytes.Buffer{}
+		if err := SaveROM(rom, buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), data) {
+			t.Errorf("DSi %t: saved ROM differs from opened ROM", twl)
+		}
+
+		// Streamed to a file, SaveROM builds in memory
+		for i, opts := range [][]SaveOption{nil, {WithFixedChecksums(), WithStableFileIDs()}} {
+			buf := &bytes.Buffer{}
+			if err := SaveROM(rom, buf, opts...); err != nil {
+				t.Fatal(err)
+			}
+			f, err := os.Create(filepath.Join(t.TempDir(), "rom.nds"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			if err := SaveROMTo(rom, f, opts...); err != nil {
+				t.Fatal(err)
+			}
+			streamed, err := os.ReadFile(f.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(streamed, buf.Bytes()) {
+				t.Errorf("DSi %t, options %d: SaveROMTo output differs from SaveROM output", twl, i)
+			}
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package nds
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/sukus21/nintil/nds/key1"
+)
+
+// Get the encryption state of the secure area at the start of the ARM9 binary.
+// table may be nil, but then encrypted secure areas cannot be detected.
+// SaveROM always places the ARM9 binary at the secure area, so any ARM9 binary can have one.
+func (o *Rom) SecureAreaState(table *key1.KeyTable) key1.State {
+	state, _ := key1.SecureAreaState(table, o.header.GameCode, o.Arm9Binary)
+	return state
+}
+
+// Decrypt the secure area of the ARM9 binary, if it is encrypted.
+func (o *Rom) decryptSecureArea(table *key1.KeyTable) error {
+	if o.SecureAreaState(table) != key1.StateEncrypted {
+		return nil
+	}
+	if err := key1.DecryptSecureArea(table, o.header.GameCode, o.Arm9Binary); err != nil {
+		return fmt.Errorf("open ROM: %w", err)
+	}
+	return nil
+}
+
+// Get the ARM9 binary with its secure area encrypted.
+// The binary is returned as-is if the secure area is not decrypted.
+func (o *Rom) encryptedArm9(table *key1.KeyTable) ([]byte, error) {
+	if o.SecureAreaState(table) != key1.StateDecrypted {
+		return o.Arm9Binary, nil
+	}
+	bin := slices.Clone(o.Arm9Binary)
+	if err := key1.EncryptSecureArea(table, o.header.GameCode, bin); err != nil {
+		return nil, fmt.Errorf("save ROM: %w", err)
+	}
+	return bin, nil
+}
@@ -0,0 +1,131 @@
+// Search for byte signatures in the code of a ROM.
+package signature
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidPattern = errors.New("invalid signature pattern")
+var ErrNotFound = errors.New("signature not found")
+var ErrAmbiguous = errors.New("signature found more than once")
+
+// Byte pattern where each byte has a mask of the bits that must match.
+type Pattern struct {
+	data []byte
+	mask []byte
+}
+
+// Create a pattern from data and a mask of the bits that must match.
+// A nil mask means all bits must match.
+func New(data []byte, mask []byte) (*Pattern, error) {
+	if mask == nil {
+		mask = make([]byte, len(data))
+		for i := range mask {
+			mask[i] = 0xFF
+		}
+	}
+	if len(data) != len(mask) || len(data) == 0 {
+		return nil, fmt.Errorf("%w: data and mask must be the same non-zero length", ErrInvalidPattern)
+	}
+
+	p := &Pattern{
+		data: make([]byte, len(data)),
+		mask: make([]byte, len(mask)),
+	}
+	for i := range data {
+		p.data[i] = data[i] & mask[i]
+		p.mask[i] = mask[i]
+	}
+	return p, nil
+}
+
+// Parse a pattern of space-separated hex bytes.
+// "??" (or "?") matches any byte, and a single "?" nibble matches any nibble, like "1?" or "?F".
+//
+// Example: "00 00 00 00 01 ?? ?? ?? 02".
+func Parse(s string) (*Pattern, error) {
+	fields := strings.Fields(s)
+	data := make([]byte, len(fields))
+	mask := make([]byte, len(fields))
+	for i, field := range fields {
+		if field == "?" {
+			field = "??"
+		}
+		if len(field) != 2 {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidPattern, field)
+		}
+		for j, nibble := range []byte(field) {
+			shift := 4 - j*4
+			if nibble == '?' {
+				continue
+			}
+			v, err := strconv.ParseUint(string(nibble), 16, 8)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %q", ErrInvalidPattern, field)
+			}
+			data[i] |= byte(v) << shift
+			mask[i] |= 0x0F << shift
+		}
+	}
+	return New(data, mask)
+}
+
+// Must parse a pattern, panics on error.
+// Meant for patterns known at compile time.
+func MustParse(s string) *Pattern {
+	p, err := Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// Get the length of the pattern in bytes.
+func (p *Pattern) Len() int {
+	return len(p.data)
+}
+
+// Does data start with the pattern?
+func (p *Pattern) Match(data []byte) bool {
+	if len(data) < len(p.data) {
+		return false
+	}
+	for i := range p.data {
+		if data[i]&p.mask[i] != p.data[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Find every offset in data where the pattern matches.
+// Only offsets that are a multiple of align are checked, an align of 0 or 1 checks every offset.
+func (p *Pattern) FindAll(data []byte, align int) []int {
+	align = max(align, 1)
+	var found []int
+	for i := 0; i+len(p.data) <= len(data); i += align {
+		if p.Match(data[i:]) {
+			found = append(found, i)
+		}
+	}
+	return found
+}
+
+func (p *Pattern) String() string {
+	const hex = "0123456789ABCDEF"
+	fields := make([]string, len(p.data))
+	for i := range p.data {
+		field := []byte{'?', '?'}
+		for j := range field {
+			shift := 4 - j*4
+			if p.mask[i]>>shift&0x0F == 0x0F {
+				field[j] = hex[p.data[i]>>shift&0x0F]
+			}
+		}
+		fields[i] = string(field)
+	}
+	return strings.Join(fields, " ")
+}
@@ -0,0 +1,105 @@
+package signature
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		expected string
+	}{
+		{"00 01 ff", "00 01 FF"},
+		{"  12\t?? ?  ", "12 ?? ??"},
+		{"1? ?F", "1? ?F"},
+	}
+	for _, tt := range tests {
+		p, err := Parse(tt.pattern)
+		if err != nil {
+			t.Errorf("%q: %v", tt.pattern, err)
+			continue
+		}
+		if s := p.String(); s != tt.expected {
+			t.Errorf("%q: got %q, expected %q", tt.pattern, s, tt.expected)
+		}
+	}
+
+	for _, pattern := range []string{"", "   ", "123", "0", "GG", "0? 1G", "???"} {
+		if _, err := Parse(pattern); !errors.Is(err, ErrInvalidPattern) {
+			t.Errorf("%q: got %v, expected %v", pattern, err, ErrInvalidPattern)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New([]byte{1, 2}, []byte{0xFF}); !errors.Is(err, ErrInvalidPattern) {
+		t.Errorf("got %v, expected %v", err, ErrInvalidPattern)
+	}
+
+	// Bits outside the mask are ignored
+	p, err := New([]byte{0x12, 0x34}, []byte{0xF0, 0xFF})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := p.String(); s != "1? 34" {
+		t.Errorf("got %q, expected %q", s, "1? 34")
+	}
+	if !p.Match([]byte{0x1F, 0x34}) {
+		t.Errorf("expected a match")
+	}
+}
+
+func TestMatch(t *testing.T) {
+	p := MustParse("12 ?? 3? ?4")
+	tests := []struct {
+		data     []byte
+		expected bool
+	}{
+		{[]byte{0x12, 0x00, 0x30, 0x04}, true},
+		{[]byte{0x12, 0xFF, 0x3F, 0xF4, 0x99}, true},
+		{[]byte{0x13, 0x00, 0x30, 0x04}, false},
+		{[]byte{0x12, 0x00, 0x40, 0x04}, false},
+		{[]byte{0x12, 0x00, 0x30, 0x05}, false},
+		{[]byte{0x12, 0x00, 0x30}, false},
+	}
+	for _, tt := range tests {
+		if got := p.Match(tt.data); got != tt.expected {
+			t.Errorf("% X: got %t, expected %t", tt.data, got, tt.expected)
+		}
+	}
+}
+
+func TestFindAll(t *testing.T) {
+	p := MustParse("AB ??")
+	data := []byte{0xAB, 0xAB, 0x00, 0xAB, 0x01, 0x02, 0xAB, 0x03, 0xAB}
+	tests := []struct {
+		align    int
+		expected []int
+	}{
+		{0, []int{0, 1, 3, 6}},
+		{1, []int{0, 1, 3, 6}},
+		{2, []int{0, 6}},
+		{3, []int{0, 3, 6}},
+		{4, []int{0}},
+	}
+	for _, tt := range tests {
+		if found := p.FindAll(data, tt.align); !slices.Equal(found, tt.expected) {
+			t.Errorf("align %d: got %v, expected %v", tt.align, found, tt.expected)
+		}
+	}
+
+	if found := p.FindAll(data[:1], 1); found != nil {
+		t.Errorf("got %v, expected nothing", found)
+	}
+}
+
+func TestMustParse(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected a panic")
+		}
+	}()
+	MustParse("XY")
+}
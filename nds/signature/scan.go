@@ -0,0 +1,95 @@
+package signature
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/sukus21/nintil/nds"
+)
+
+// Place a signature was found.
+type Match struct {
+	Location nds.Location
+
+	// RAM address of the match, 0 if that part of the binary is not loaded
+	Address uint32
+}
+
+// Options for Scan.
+type Option func(*options)
+
+type options struct {
+	align    uint32
+	binaries []nds.Binary
+}
+
+// Only match at RAM addresses that are a multiple of align.
+// Matches that are not loaded use their offset in the binary instead.
+func WithAlignment(align uint32) Option {
+	return func(o *options) {
+		o.align = align
+	}
+}
+
+// Only search the given kinds of binaries.
+// By default, the ARM9 binary, the ARM7 binary and every overlay are searched.
+func WithBinaries(binaries ...nds.Binary) Option {
+	return func(o *options) {
+		o.binaries = binaries
+	}
+}
+
+// Search the uncompressed code of every binary in the address space for a pattern.
+// Matches are returned in binary order, then offset order.
+func Scan(a *nds.AddressSpace, p *Pattern, opts ...Option) ([]Match, error) {
+	options := options{align: 1}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	options.align = max(options.align, 1)
+
+	var matches []Match
+	for _, bin := range a.Binaries() {
+		if options.binaries != nil && !slices.Contains(options.binaries, bin.Binary) {
+			continue
+		}
+		code, err := a.Code(bin)
+		if err != nil {
+			return nil, fmt.Errorf("signature scan: %w", err)
+		}
+
+		for _, offset := range p.FindAll(code, 1) {
+			loc := bin
+			loc.Offset = uint32(offset)
+			address, err := a.Address(loc)
+			aligned := address
+			if errors.Is(err, nds.ErrUnmappedAddress) {
+				address, aligned = 0, loc.Offset
+			} else if err != nil {
+				return nil, fmt.Errorf("signature scan: %w", err)
+			}
+			if aligned%options.align == 0 {
+				matches = append(matches, Match{Location: loc, Address: address})
+			}
+		}
+	}
+	return matches, nil
+}
+
+// Search for a pattern that should only be found once.
+// Returns ErrNotFound if there are no matches, and ErrAmbiguous if there are several.
+func ScanOne(a *nds.AddressSpace, p *Pattern, opts ...Option) (Match, error) {
+	matches, err := Scan(a, p, opts...)
+	if err != nil {
+		return Match{}, err
+	}
+	switch len(matches) {
+	case 0:
+		return Match{}, fmt.Errorf("signature scan: %w: %s", ErrNotFound, p)
+	case 1:
+		return matches[0], nil
+	default:
+		return Match{}, fmt.Errorf("signature scan: %w: %s (%d matches)", ErrAmbiguous, p, len(matches))
+	}
+}
@@ -0,0 +1,107 @@
+package signature
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"testing/fstest"
+
+	"github.com/sukus21/nintil/nds"
+	"github.com/sukus21/nintil/nds/ndstest"
+	"github.com/sukus21/nintil/nds/nitrofs"
+)
+
+// Get the address space of a small ROM with the test signature in every binary, including an ARM7 overlay.
+// The ARM9 binary has it at an aligned and an unaligned offset.
+func testAddressSpace(t *testing.T) *nds.AddressSpace {
+	t.Helper()
+	signature := []byte{0xDE, 0xAD, 0xBE, 0xEF}
+	arm9 := make([]byte, 0x100)
+	copy(arm9[0x10:], signature)
+	copy(arm9[0x22:], signature)
+	arm7 := make([]byte, 0x80)
+	copy(arm7[0x40:], signature)
+	code := make([]byte, 0x40)
+	copy(code[0x08:], signature)
+	code7 := make([]byte, 0x20)
+	copy(code7[0x0C:], signature)
+
+	rom := ndstest.Rom(t, ndstest.Header(), fstest.MapFS{
+		"arm9.bin":                 {Data: arm9},
+		"arm7.bin":                 {Data: arm7},
+		"y9.bin":                   {Data: ndstest.OverlayTable(t, []nitrofs.Overlay{nitrofs.NewOverlay(0x02100000, code, 0)}, []uint16{0})},
+		"y7.bin":                   {Data: ndstest.OverlayTable(t, []nitrofs.Overlay{nitrofs.NewOverlay(0x037F8000, code7, 0)}, []uint16{1})},
+		"overlay/overlay_0000.bin": {Data: code},
+		"overlay/overlay_0001.bin": {Data: code7},
+	})
+	space, err := rom.AddressSpace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return space
+}
+
+func TestScan(t *testing.T) {
+	space := testAddressSpace(t)
+	p := MustParse("DE AD ?? EF")
+	tests := []struct {
+		name     string
+		opts     []Option
+		expected []uint32
+	}{
+		{"all", nil, []uint32{0x02000010, 0x02000022, 0x02380040, 0x02100008, 0x037F800C}},
+		{"aligned", []Option{WithAlignment(4)}, []uint32{0x02000010, 0x02380040, 0x02100008, 0x037F800C}},
+		{"ARM9", []Option{WithBinaries(nds.BinaryArm9)}, []uint32{0x02000010, 0x02000022}},
+		{"overlays", []Option{WithBinaries(nds.BinaryArm9Overlay, nds.BinaryArm7)}, []uint32{0x02380040, 0x02100008}},
+		{"ARM7 overlays", []Option{WithBinaries(nds.BinaryArm7Overlay)}, []uint32{0x037F800C}},
+	}
+	for _, tt := range tests {
+		matches, err := Scan(space, p, tt.opts...)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		addresses := make([]uint32, len(matches))
+		for i, m := range matches {
+			addresses[i] = m.Address
+		}
+		if !slices.Equal(addresses, tt.expected) {
+			t.Errorf("%s: got %08X, expected %08X", tt.name, addresses, tt.expected)
+		}
+	}
+
+	matches, err := Scan(space, p, WithBinaries(nds.BinaryArm9Overlay))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Match{{Location: nds.Location{Binary: nds.BinaryArm9Overlay, Overlay: 0, Offset: 0x08}, Address: 0x02100008}}
+	if !slices.Equal(matches, expected) {
+		t.Errorf("got %v, expected %v", matches, expected)
+	}
+
+	matches, err = Scan(space, p, WithBinaries(nds.BinaryArm7Overlay))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []Match{{Location: nds.Location{Binary: nds.BinaryArm7Overlay, Overlay: 0, Offset: 0x0C}, Address: 0x037F800C}}
+	if !slices.Equal(matches, expected) {
+		t.Errorf("got %v, expected %v", matches, expected)
+	}
+}
+
+func TestScanOne(t *testing.T) {
+	space := testAddressSpace(t)
+	p := MustParse("DE AD BE EF")
+
+	match, err := ScanOne(space, p, WithBinaries(nds.BinaryArm7))
+	expected := Match{Location: nds.Location{Binary: nds.BinaryArm7, Offset: 0x40}, Address: 0x02380040}
+	if err != nil || match != expected {
+		t.Errorf("got %v, %v, expected %v", match, err, expected)
+	}
+
+	if _, err := ScanOne(space, p, WithBinaries(nds.BinaryArm9)); !errors.Is(err, ErrAmbiguous) {
+		t.Errorf("got %v, expected %v", err, ErrAmbiguous)
+	}
+	if _, err := ScanOne(space, MustParse("DE AD BE EE")); !errors.Is(err, ErrNotFound) {
+		t.Errorf("got %v, expected %v", err, ErrNotFound)
+	}
+}
@@ -0,0 +1,122 @@
+package nds
+
+import (
+	"github.com/sukus21/nintil/util/ezbin"
+)
+
+// Unit codes found in the ROM header
+const (
+	UnitCodeNDS         = 0x00
+	UnitCodeDSiEnhanced = 0x02
+	UnitCodeDSi         = 0x03
+
+	// Set for all ROMs with an extended DSi header
+	UnitCodeTwlFlag = 0x02
+)
+
+// Region 0x180-0x1000 of the ROM header.
+const (
+	twlHeaderStart = 0x0180
+	twlHeaderSize  = 0x1000 - twlHeaderStart
+)
+
+// NTR and TWL region boundaries in the header are in units of this.
+const twlRegionAlignment = 0x80000
+
+// Extended DSi (TWL) header.
+// Fields not listed here are kept as-is.
+type TwlHeader struct {
+	RegionFlags     uint32
+	AccessControl   uint32
+	Arm7ScfgExtMask uint32
+
+	// ARM9i and ARM7i binaries
+	Arm9iRomOffset   uint32
+	Arm9iDestination uint32
+	Arm9iSize        uint32
+	Arm7iRomOffset   uint32
+	Arm7iDestination uint32
+	Arm7iSize        uint32
+
+	// Digest table layout
+	DigestNtrOffset             uint32
+	DigestNtrSize               uint32
+	DigestTwlOffset             uint32
+	DigestTwlSize               uint32
+	DigestSectorHashtableOffset uint32
+	DigestSectorHashtableSize   uint32
+	DigestBlockHashtableOffset  uint32
+	DigestBlockHashtableSize    uint32
+	DigestSectorSize            uint32
+	DigestBlockSectorCount      uint32
+
+	// Size of the DSi banner
+	BannerSize uint32
+
+	// Used ROM size, including the DSi area
+	TotalRomSize uint32
+
+	// Modcrypt areas
+	Modcrypt1Offset uint32
+	Modcrypt1Size   uint32
+	Modcrypt2Offset uint32
+	Modcrypt2Size   uint32
+
+	TitleId uint64
+
+	// The whole area, including unparsed fields
+	raw [twlHeaderSize]byte
+}
+
+type twlField struct {
+	at  int
+	ptr any
+}
+
+// Location of each field in the header
+func (t *TwlHeader) fields() []twlField {
+	return []twlField{
+		{0x1B0, &t.RegionFlags},
+		{0x1B4, &t.AccessControl},
+		{0x1B8, &t.Arm7ScfgExtMask},
+		{0x1C0, &t.Arm9iRomOffset},
+		{0x1C8, &t.Arm9iDestination},
+		{0x1CC, &t.Arm9iSize},
+		{0x1D0, &t.Arm7iRomOffset},
+		{0x1D8, &t.Arm7iDestination},
+		{0x1DC, &t.Arm7iSize},
+		{0x1E0, &t.DigestNtrOffset},
+		{0x1E4, &t.DigestNtrSize},
+		{0x1E8, &t.DigestTwlOffset},
+		{0x1EC, &t.DigestTwlSize},
+		{0x1F0, &t.DigestSectorHashtableOffset},
+		{0x1F4, &t.DigestSectorHashtableSize},
+		{0x1F8, &t.DigestBlockHashtableOffset},
+		{0x1FC, &t.DigestBlockHashtableSize},
+		{0x200, &t.DigestSectorSize},
+		{0x204, &t.DigestBlockSectorCount},
+		{0x208, &t.BannerSize},
+		{0x210, &t.TotalRomSize},
+		{0x220, &t.Modcrypt1Offset},
+		{0x224, &t.Modcrypt1Size},
+		{0x228, &t.Modcrypt2Offset},
+		{0x22C, &t.Modcrypt2Size},
+		{0x230, &t.TitleId},
+	}
+}
+
+// Parse fields from raw header data
+func (t *TwlHeader) decode() {
+	for _, f := range t.fields() {
+		ezbin.Get(t.raw[:], f.at-twlHeaderStart, f.ptr)
+	}
+}
+
+// Get raw header data with fields applied
+func (t *TwlHeader) encode() []byte {
+	buf := t.raw
+	for _, f := range t.fields() {
+		ezbin.Put(buf[:], f.at-twlHeaderStart, f.ptr)
+	}
+	return buf[:]
+}
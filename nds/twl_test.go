@@ -0,0 +1,60 @@
+package nds
+
+import (
+	"bytes"
+	"testing"
+	"testing/fstest"
+)
+
+func TestTwlRoundTrip(t *testing.T) {
+	rom, _ := testROM(t, true)
+	h := rom.GetHeader()
+	expected := testHeader(true)
+	if !h.IsTwl() || h.Twl == nil {
+		t.Fatalf("DSi header was not kept")
+	}
+	if h.Twl.Arm9iDestination != expected.Twl.Arm9iDestination || h.Twl.Arm7iDestination != expected.Twl.Arm7iDestination || h.Twl.TitleId != expected.Twl.TitleId {
+		t.Errorf("got %+v", h.Twl)
+	}
+	if !bytes.Equal(rom.Arm9iBinary, testData(5, 0x900)) || !bytes.Equal(rom.Arm7iBinary, testData(6, 0x300)) {
+		t.Errorf("DSi binaries differ")
+	}
+
+	// DSi region follows the regular ROM
+	twlStart := uint32(h.TwlRegionStart) * twlRegionAlignment
+	if twlStart < h.RomSize || h.Twl.Arm9iRomOffset < twlStart || h.Twl.Arm7iRomOffset < h.Twl.Arm9iRomOffset+h.Twl.Arm9iSize {
+		t.Errorf("DSi region at 0x%X, ARM9i at 0x%X, ARM7i at 0x%X, ROM ends at 0x%X", twlStart, h.Twl.Arm9iRomOffset, h.Twl.Arm7iRomOffset, h.RomSize)
+	}
+	if h.Twl.DigestTwlOffset != twlStart || h.Twl.TotalRomSize != h.Twl.DigestTwlOffset+h.Twl.DigestTwlSize {
+		t.Errorf("digest region 0x%X+0x%X, ROM size 0x%X", h.Twl.DigestTwlOffset, h.Twl.DigestTwlSize, h.Twl.TotalRomSize)
+	}
+
+	// Offsets into the DSi region move along with it, unparsed fields are kept
+	h.Twl.Modcrypt1Offset = h.Twl.Arm9iRomOffset + 0x100
+	h.Twl.Modcrypt1Size = 0x200
+	h.Twl.Modcrypt2Offset = h.Twl.Arm7iRomOffset
+	h.Twl.Modcrypt2Size = 0x100
+	h.Twl.DigestBlockHashtableOffset = twlStart + 0x10
+	h.Twl.raw[0xF80-twlHeaderStart] = 0xAB
+	files := fstest.MapFS{"large.bin": {Data: testData(7, twlRegionAlignment)}}
+	rom.Filesystem = testFS{files}
+
+	saved, _ := saveAndOpenROM(t, rom)
+	twl := saved.GetHeader().Twl
+	newTwlStart := uint32(saved.GetHeader().TwlRegionStart) * twlRegionAlignment
+	if newTwlStart <= twlStart {
+		t.Fatalf("DSi region did not move")
+	}
+	if twl.Modcrypt1Offset != twl.Arm9iRomOffset+0x100 || twl.Modcrypt2Offset != twl.Arm7iRomOffset {
+		t.Errorf("modcrypt areas at 0x%X and 0x%X, ARM9i at 0x%X, ARM7i at 0x%X", twl.Modcrypt1Offset, twl.Modcrypt2Offset, twl.Arm9iRomOffset, twl.Arm7iRomOffset)
+	}
+	if twl.DigestBlockHashtableOffset != newTwlStart+0x10 {
+		t.Errorf("block hashtable at 0x%X, expected 0x%X", twl.DigestBlockHashtableOffset, newTwlStart+0x10)
+	}
+	if twl.raw[0xF80-twlHeaderStart] != 0xAB {
+		t.Errorf("unparsed header data was not kept")
+	}
+	if !bytes.Equal(saved.Arm9iBinary, rom.Arm9iBinary) || !bytes.Equal(saved.Arm7iBinary, rom.Arm7iBinary) {
+		t.Errorf("DSi binaries differ")
+	}
+}
@@ -0,0 +1,409 @@
+package nds
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/sukus21/nintil/nds/key1"
+	"github.com/sukus21/nintil/util"
+	"github.com/sukus21/nintil/util/ezbin"
+	"github.com/sukus21/nintil/util/mapping"
+)
+
+// The kind of problem a Diagnostic describes.
+type DiagnosticKind int
+
+const (
+	// Header checksum does not match header contents
+	DiagnosticHeaderChecksum = DiagnosticKind(iota)
+
+	// Nintendo logo checksum does not match logo
+	DiagnosticLogoChecksum
+
+	// A region lies (partially) outside the ROM
+	DiagnosticRegionBounds
+
+	// Two regions overlap
+	DiagnosticRegionOverlap
+
+	// Malformed file allocation table entry
+	DiagnosticFAT
+
+	// Malformed file name table entry
+	DiagnosticFNT
+
+	// Malformed overlay table entry
+	DiagnosticOverlay
+
+	// Secure area checksum does not match secure area
+	DiagnosticSecureAreaChecksum
+
+	// DSi digest hashtables or modcrypt areas do not match the ROM layout
+	DiagnosticTwlDigest
+
+	// The ROM has no image to check
+	DiagnosticNoImage
+)
+
+var diagnosticKindNames = []string{
+	"header checksum",
+	"logo checksum",
+	"region bounds",
+	"region overlap",
+	"file allocation table",
+	"file name table",
+	"overlay table",
+	"secure area checksum",
+	"DSi digest",
+	"ROM image",
+}
+
+func (k DiagnosticKind) String() string {
+	if k < 0 || int(k) >= len(diagnosticKindNames) {
+		return "invalid diagnostic kind"
+	}
+	return diagnosticKindNames[k]
+}
+
+// A single problem found while validating a ROM.
+type Diagnostic struct {
+	Kind DiagnosticKind
+
+	// ROM offset the problem was found at
+	Offset uint32
+
+	// Human readable description
+	Message string
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%s at 0x%08X: %s", d.Kind, d.Offset, d.Message)
+}
+
+// Returned by OpenROM when validation is enabled and the ROM has problems.
+type ValidationError struct {
+	Diagnostics []Diagnostic
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Diagnostics))
+	for i, d := range e.Diagnostics {
+		msgs[i] = d.String()
+	}
+	return "validate ROM: " + strings.Join(msgs, "; ")
+}
+
+// Check the ROM for corrupt or inconsistent data.
+// Returns an empty list if no problems are found.
+// Only ROMs opened with OpenROM are checked.
+// Others have no ROM image, and get a DiagnosticNoImage, save and reopen them to check them.
+func Validate(o *Rom) []Diagnostic {
+	if o.reader == nil {
+		return []Diagnostic{{Kind: DiagnosticNoImage, Message: "ROM was not opened from an image"}}
+	}
+	return validate(o.header, o.reader, o.key1)
+}
+
+type validator struct {
+	h           *Header
+	r           io.ReaderAt
+	key1        *key1.KeyTable
+	limit       uint32
+	regions     *mapping.Mapping
+	diagnostics []Diagnostic
+}
+
+func (v *validator) add(kind DiagnosticKind, offset uint32, format string, args ...any) {
+	v.diagnostics = append(v.diagnostics, Diagnostic{
+		Kind:    kind,
+		Offset:  offset,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+func validate(h *Header, r util.ReadAtSeeker, table *key1.KeyTable) []Diagnostic {
+	v := &validator{
+		h:    h,
+		r:    r,
+		key1: table,
+	}
+
+	// Get bounds of ROM
+	capacity, err := DeviceCapacity(h.DeviceSize)
+	if err != nil {
+		v.add(DiagnosticRegionBounds, 0x14, "%s (%d)", err, h.DeviceSize)
+		capacity, _ = DeviceCapacity(DeviceSizeMax)
+	}
+	v.limit = capacity
+	if returnTo, err := r.Seek(0, io.SeekCurrent); err == nil {
+		if size, err := r.Seek(0, io.SeekEnd); err == nil && size < int64(v.limit) {
+			v.limit = uint32(size)
+		}
+		r.Seek(returnTo, io.SeekStart)
+	}
+
+	v.checkChecksums()
+	v.checkRegions()
+	fatCount := v.checkFAT()
+	v.checkFNT(fatCount)
+	v.checkOverlays(h.Arm9OverlayOffset, h.Arm9OverlaySize, fatCount)
+	v.checkOverlays(h.Arm7OverlayOffset, h.Arm7OverlaySize, fatCount)
+	v.checkTwl()
+	return v.diagnostics
+}
+
+func (v *validator) checkChecksums() {
+	raw := make([]byte, 0x15E)
+	if _, err := v.r.ReadAt(raw, 0); err != nil {
+		v.add(DiagnosticRegionBounds, 0, "cannot read header: %s", err)
+		return
+	}
+
+	if crc := CRC16(raw); crc != v.h.HeaderChecksum {
+		v.add(DiagnosticHeaderChecksum, 0x15E, "expected %04X, got %04X", crc, v.h.HeaderChecksum)
+	}
+	if crc := LogoCRC(v.h.nintendoLogo); crc != v.h.nintendoLogoCrc {
+		v.add(DiagnosticLogoChecksum, 0x15C, "expected %04X, got %04X", crc, v.h.nintendoLogoCrc)
+	}
+	if crc, err := SecureAreaCRC(v.h, v.r, v.key1); err == nil && crc != v.h.secureAreaChecksum {
+		v.add(DiagnosticSecureAreaChecksum, 0x6C, "expected %04X, got %04X", crc, v.h.secureAreaChecksum)
+	}
+}
+
+// Check only the checksums.
+func validateChecksums(h *Header, r io.ReaderAt, table *key1.KeyTable) []Diagnostic {
+	v := &validator{
+		h:    h,
+		r:    r,
+		key1: table,
+	}
+	v.checkChecksums()
+	return v.diagnostics
+}
+
+// Check the binaries and tables against the ROM size and each other.
+// The regions are kept, so files can be checked against them.
+func (v *validator) checkRegions() {
+	m := mapping.NewMapping(v.limit)
+	v.regions = m
+	check := func(name string, offset, size uint32) {
+		if size == 0 {
+			return
+		}
+		if uint64(offset)+uint64(size) > uint64(v.limit) {
+			v.add(DiagnosticRegionBounds, offset, "%s (0x%X bytes) exceeds ROM size 0x%X", name, size, v.limit)
+			return
+		}
+		if _, err := m.AddAt(name, offset, size); err != nil {
+			v.add(DiagnosticRegionOverlap, offset, "%s: %s", name, err)
+		}
+	}
+
+	// Get banner size from version
+	bannerSize := uint32(0)
+	if v.h.BannerOffset != 0 {
+		b := banner{}
+		if err := ezbin.ReadAt(v.r, v.h.BannerOffset, &b.version); err != nil {
+			v.add(DiagnosticRegionBounds, v.h.BannerOffset, "cannot read banner version: %s", err)
+		} else if size := b.getSize(); size < 0 {
+			v.add(DiagnosticRegionBounds, v.h.BannerOffset, "unknown banner version %04X", b.version)
+		} else {
+			bannerSize = uint32(size)
+		}
+	}
+
+	check(mappingNameHeader, 0, 0x4000)
+	check(mappingNameArm9Binary, v.h.Arm9RomOffset, v.h.Arm9Size)
+	check(mappingNameArm7Binary, v.h.Arm7RomOffset, v.h.Arm7Size)
+	check("file name table", v.h.FilenameOffset, v.h.FilenameSize)
+	check("file allocation table", v.h.FatOffset, v.h.FatSize)
+	check("ARM9 overlay table", v.h.Arm9OverlayOffset, v.h.Arm9OverlaySize)
+	check("ARM7 overlay table", v.h.Arm7OverlayOffset, v.h.Arm7OverlaySize)
+	check(mappingBanner, v.h.BannerOffset, bannerSize)
+	if twl := v.h.Twl; twl != nil {
+		check(mappingNameArm9iBinary, twl.Arm9iRomOffset, twl.Arm9iSize)
+		check(mappingNameArm7iBinary, twl.Arm7iRomOffset, twl.Arm7iSize)
+	}
+}
+
+// Returns the number of FAT entries
+func (v *validator) checkFAT() uint32 {
+	if v.h.FatSize%8 != 0 {
+		v.add(DiagnosticFAT, v.h.FatOffset, "table size 0x%X is not a multiple of 8", v.h.FatSize)
+	}
+	count := v.h.FatSize / 8
+	if uint64(v.h.FatOffset)+uint64(count)*8 > uint64(v.limit) {
+		return 0
+	}
+
+	for i := range count {
+		offset := v.h.FatOffset + i*8
+		var start, end uint32
+		if err := ezbin.ReadAt(v.r, offset, &start, &end); err != nil {
+			v.add(DiagnosticFAT, offset, "cannot read file %d: %s", i, err)
+			return i
+		}
+		if end < start {
+			v.add(DiagnosticFAT, offset, "file %d ends (0x%X) before it starts (0x%X)", i, end, start)
+		} else if end > v.limit {
+			v.add(DiagnosticFAT, offset, "file %d ends (0x%X) outside ROM", i, end)
+		} else {
+			v.checkFileRegion(i, start, end)
+		}
+	}
+	return count
+}
+
+// Files may share data with each other, but not with the binaries and tables.
+func (v *validator) checkFileRegion(id uint32, start, end uint32) {
+	if v.regions == nil {
+		return
+	}
+	for _, region := range v.regions.Entries() {
+		if start < region.To() && region.From() < end {
+			v.add(DiagnosticRegionOverlap, start, "file %d (0x%X-0x%X) overlaps %s", id, start, end, region.Name())
+		}
+	}
+}
+
+func (v *validator) checkFNT(fatCount uint32) {
+	base := v.h.FilenameOffset
+	size := v.h.FilenameSize
+	if size < 8 || uint64(base)+uint64(size) > uint64(v.limit) {
+		return
+	}
+
+	// Read whole table
+	fnt := make([]byte, size)
+	if _, err := v.r.ReadAt(fnt, int64(base)); err != nil {
+		v.add(DiagnosticFNT, base, "cannot read table: %s", err)
+		return
+	}
+
+	// Root entry holds the number of directories
+	var rootOffset uint32
+	var rootFirst, numDirs uint16
+	ezbin.Get(fnt, 0, &rootOffset, &rootFirst, &numDirs)
+	if numDirs == 0 || uint32(numDirs) > 0x1000 || uint32(numDirs)*8 > size {
+		v.add(DiagnosticFNT, base, "invalid directory count %d", numDirs)
+		return
+	}
+
+	for dir := range uint32(numDirs) {
+		var subtableOffset uint32
+		var firstFile, parent uint16
+		ezbin.Get(fnt, int(dir*8), &subtableOffset, &firstFile, &parent)
+		if dir != 0 && (parent < 0xF000 || uint32(parent&0x0FFF) >= uint32(numDirs)) {
+			v.add(DiagnosticFNT, base+dir*8, "directory %d has invalid parent %04X", dir, parent)
+		}
+		if subtableOffset < uint32(numDirs)*8 || subtableOffset >= size {
+			v.add(DiagnosticFNT, base+dir*8, "directory %d subtable offset 0x%X outside table", dir, subtableOffset)
+			continue
+		}
+
+		// Walk subtable
+		numFiles := uint32(0)
+		pos := subtableOffset
+		for {
+			if pos >= size {
+				v.add(DiagnosticFNT, base+subtableOffset, "directory %d subtable runs past end of table", dir)
+				break
+			}
+			tlen := fnt[pos]
+			pos++
+			if tlen == 0 || tlen == 0x80 {
+				break
+			}
+
+			isFolder := tlen&0x80 != 0
+			pos += uint32(tlen & 0x7F)
+			if !isFolder {
+				numFiles++
+				continue
+			}
+
+			if pos+2 > size {
+				v.add(DiagnosticFNT, base+subtableOffset, "directory %d subtable runs past end of table", dir)
+				break
+			}
+			var childId uint16
+			ezbin.Get(fnt, int(pos), &childId)
+			pos += 2
+			if childId < 0xF000 || uint32(childId&0x0FFF) >= uint32(numDirs) {
+				v.add(DiagnosticFNT, base+pos-2, "directory %d references invalid directory %04X", dir, childId)
+			}
+		}
+
+		// A FAT that could not be read has already been reported
+		if fatCount != 0 && uint32(firstFile)+numFiles > fatCount {
+			v.add(DiagnosticFNT, base+dir*8, "directory %d files %d..%d exceed FAT", dir, firstFile, uint32(firstFile)+numFiles)
+		}
+	}
+}
+
+func (v *validator) checkOverlays(offset uint32, size uint32, fatCount uint32) {
+	if size%32 != 0 {
+		v.add(DiagnosticOverlay, offset, "table size 0x%X is not a multiple of 32", size)
+	}
+	if uint64(offset)+uint64(size) > uint64(v.limit) {
+		return
+	}
+
+	for i := range size / 32 {
+		var fileId uint32
+		if err := ezbin.ReadAt(v.r, offset+i*32+0x18, &fileId); err != nil {
+			v.add(DiagnosticOverlay, offset+i*32, "cannot read overlay %d: %s", i, err)
+			return
+		}
+		if fatCount != 0 && fileId >= fatCount {
+			v.add(DiagnosticOverlay, offset+i*32, "overlay %d references invalid file %d", i, fileId)
+		}
+	}
+}
+
+// Check that the DSi digest hashtables and modcrypt areas fit the ROM.
+// Their contents are signed, so only their layout is checked.
+// Hashtables that no longer cover the digest regions are left over from before the ROM was rebuilt.
+func (v *validator) checkTwl() {
+	twl := v.h.Twl
+	if twl == nil {
+		return
+	}
+
+	for _, area := range []struct {
+		name   string
+		at     uint32
+		offset uint32
+		size   uint32
+	}{
+		{"NTR digest region", 0x1E0, twl.DigestNtrOffset, twl.DigestNtrSize},
+		{"TWL digest region", 0x1E8, twl.DigestTwlOffset, twl.DigestTwlSize},
+		{"sector hashtable", 0x1F0, twl.DigestSectorHashtableOffset, twl.DigestSectorHashtableSize},
+		{"block hashtable", 0x1F8, twl.DigestBlockHashtableOffset, twl.DigestBlockHashtableSize},
+		{"modcrypt area 1", 0x220, twl.Modcrypt1Offset, twl.Modcrypt1Size},
+		{"modcrypt area 2", 0x228, twl.Modcrypt2Offset, twl.Modcrypt2Size},
+	} {
+		if area.size != 0 && uint64(area.offset)+uint64(area.size) > uint64(v.limit) {
+			v.add(DiagnosticTwlDigest, area.at, "%s (0x%X bytes at 0x%X) exceeds ROM size 0x%X", area.name, area.size, area.offset, v.limit)
+		}
+	}
+
+	// One SHA1 hash per sector, and one per block of sectors
+	const hashSize = 20
+	if twl.DigestSectorSize == 0 {
+		return
+	}
+	sectors := (twl.DigestNtrSize+twl.DigestSectorSize-1)/twl.DigestSectorSize +
+		(twl.DigestTwlSize+twl.DigestSectorSize-1)/twl.DigestSectorSize
+	if twl.DigestSectorHashtableSize != sectors*hashSize {
+		v.add(DiagnosticTwlDigest, 0x1F4, "sector hashtable holds %d hashes, digest regions have %d sectors", twl.DigestSectorHashtableSize/hashSize, sectors)
+	}
+	if twl.DigestBlockSectorCount == 0 {
+		return
+	}
+	blocks := (sectors + twl.DigestBlockSectorCount - 1) / twl.DigestBlockSectorCount
+	if twl.DigestBlockHashtableSize != blocks*hashSize {
+		v.add(DiagnosticTwlDigest, 0x1FC, "block hashtable holds %d hashes, digest regions have %d blocks", twl.DigestBlockHashtableSize/hashSize, blocks)
+	}
+}
@@ -0,0 +1,213 @@
+package nds
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"slices"
+	"testing"
+	"testing/fstest"
+
+	"github.com/sukus21/nintil/nds/nitrofs"
+	"github.com/sukus21/nintil/util"
+)
+
+// Change the header of a ROM image, keeping its header checksum valid.
+func changeHeader(t *testing.T, data []byte, change func(h *Header)) []byte {
+	t.Helper()
+	data = slices.Clone(data)
+	h, err := OpenHeader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	change(h)
+	if err := h.UpdateChecksum(); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveHeader(util.NewWriteSeeker(data[:0x1000]), h); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// Change bytes of a ROM image.
+func changeData(data []byte, change func(data []byte)) []byte {
+	data = slices.Clone(data)
+	change(data)
+	return data
+}
+
+func TestValidate(t *testing.T) {
+	for _, twl := range []bool{false, true} {
+		rom, data := testROM(t, twl)
+		if diagnostics := Validate(rom); len(diagnostics) != 0 {
+			t.Errorf("DSi %t: got %v", twl, diagnostics)
+		}
+		if diagnostics := rom.ChecksumMismatches(); len(diagnostics) != 0 {
+			t.Errorf("DSi %t: got checksum mismatches %v", twl, diagnostics)
+		}
+		if _, err := OpenROM(bytes.NewReader(data), WithValidation()); err != nil {
+			t.Errorf("DSi %t: %v", twl, err)
+		}
+	}
+
+	// Nothing to check without a ROM image
+	if diagnostics := Validate(newTestROM(false)); len(diagnostics) != 1 || diagnostics[0].Kind != DiagnosticNoImage {
+		t.Errorf("got %v, expected %s", diagnostics, DiagnosticNoImage)
+	}
+}
+
+func TestValidateDiagnostics(t *testing.T) {
+	rom, data := testROM(t, false)
+	h := rom.GetHeader()
+	tests := []struct {
+		name   string
+		data   []byte
+		kind   DiagnosticKind
+		offset uint32
+	}{
+		{
+			"header checksum",
+			changeData(data, func(data []byte) { data[0x15E] ^= 1 }),
+			DiagnosticHeaderChecksum, 0x15E,
+		},
+		{
+			"logo checksum",
+			changeHeader(t, data, func(h *Header) { h.nintendoLogoCrc ^= 1 }),
+			DiagnosticLogoChecksum, 0x15C,
+		},
+		{
+			"invalid device size",
+			changeHeader(t, data, func(h *Header) { h.DeviceSize = DeviceSizeMax + 1 }),
+			DiagnosticRegionBounds, 0x14,
+		},
+		{
+			"region outside ROM",
+			changeHeader(t, data, func(h *Header) { h.Arm7Size = 0x10000000 }),
+			DiagnosticRegionBounds, h.Arm7RomOffset,
+		},
+		{
+			"overlapping regions",
+			changeHeader(t, data, func(h *Header) { h.Arm7RomOffset = h.Arm9RomOffset + 0x10 }),
+			DiagnosticRegionOverlap, h.Arm9RomOffset + 0x10,
+		},
+		{
+			"FAT entry ends before it starts",
+			changeData(data, func(data []byte) { binary.LittleEndian.PutUint32(data[h.FatOffset+4:], 0) }),
+			DiagnosticFAT, h.FatOffset,
+		},
+		{
+			"FAT entry outside ROM",
+			changeData(data, func(data []byte) { binary.LittleEndian.PutUint32(data[h.FatOffset+4:], 0xFFFFFFFF) }),
+			DiagnosticFAT, h.FatOffset,
+		},
+		{
+			"FAT entry overlaps ARM9 binary",
+			changeData(data, func(data []byte) {
+				binary.LittleEndian.PutUint32(data[h.FatOffset:], h.Arm9RomOffset+0x10)
+				binary.LittleEndian.PutUint32(data[h.FatOffset+4:], h.Arm9RomOffset+0x20)
+			}),
+			DiagnosticRegionOverlap, h.Arm9RomOffset + 0x10,
+		},
+		{
+			"FAT size",
+			changeHeader(t, data, func(h *Header) { h.FatSize -= 4 }),
+			DiagnosticFAT, h.FatOffset,
+		},
+		{
+			"FNT directory count",
+			changeData(data, func(data []byte) { binary.LittleEndian.PutUint16(data[h.FilenameOffset+6:], 0) }),
+			DiagnosticFNT, h.FilenameOffset,
+		},
+		{
+			"FNT parent directory",
+			changeData(data, func(data []byte) { binary.LittleEndian.PutUint16(data[h.FilenameOffset+8+6:], 0x1234) }),
+			DiagnosticFNT, h.FilenameOffset + 8,
+		},
+		{
+			"overlay file ID",
+			changeData(data, func(data []byte) { binary.LittleEndian.PutUint32(data[h.Arm9OverlayOffset+0x18:], 0xFFFF) }),
+			DiagnosticOverlay, h.Arm9OverlayOffset,
+		},
+		{
+			"overlay table size",
+			changeHeader(t, data, func(h *Header) { h.Arm9OverlaySize = 0x10 }),
+			DiagnosticOverlay, h.Arm9OverlayOffset,
+		},
+	}
+	for _, tt := range tests {
+		_, err := OpenROM(bytes.NewReader(tt.data), WithValidation())
+		var verr *ValidationError
+		if !errors.As(err, &verr) {
+			t.Errorf("%s: got %v, expected a validation error", tt.name, err)
+			continue
+		}
+		expected := slices.ContainsFunc(verr.Diagnostics, func(d Diagnostic) bool {
+			return d.Kind == tt.kind && d.Offset == tt.offset
+		})
+		if !expected {
+			t.Errorf("%s: got %v, expected %s at 0x%08X", tt.name, verr.Diagnostics, tt.kind, tt.offset)
+		}
+	}
+}
+
+func TestDiagnosticString(t *testing.T) {
+	d := Diagnostic{Kind: DiagnosticFAT, Offset: 0x1234, Message: "broken"}
+	if s := d.String(); s != "file allocation table at 0x00001234: broken" {
+		t.Errorf("got %q", s)
+	}
+	if s := DiagnosticKind(-1).String(); s != "invalid diagnostic kind" {
+		t.Errorf("got %q", s)
+	}
+	err := &ValidationError{Diagnostics: []Diagnostic{d, {Kind: DiagnosticLogoChecksum, Offset: 0x15C, Message: "a"}}}
+	if s := err.Error(); s != "validate ROM: "+d.String()+"; logo checksum at 0x0000015C: a" {
+		t.Errorf("got %q", s)
+	}
+}
+
+func TestValidateTwlDigest(t *testing.T) {
+	_, data := testROM(t, true)
+
+	// Hashtables covering the digest regions
+	data = changeHeader(t, data, func(h *Header) {
+		twl := h.Twl
+		twl.DigestSectorSize = 0x400
+		twl.DigestBlockSectorCount = 0x20
+		sectors := (twl.DigestNtrSize+0x3FF)/0x400 + (twl.DigestTwlSize+0x3FF)/0x400
+		twl.DigestSectorHashtableOffset = twl.Arm9iRomOffset
+		twl.DigestSectorHashtableSize = sectors * 20
+		twl.DigestBlockHashtableOffset = twl.Arm9iRomOffset
+		twl.DigestBlockHashtableSize = (sectors + 0x1F) / 0x20 * 20
+	})
+	rom, err := OpenROM(bytes.NewReader(data), WithValidation())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rebuilt with a larger NTR region, the hashtables are left as they were
+	files := fstest.MapFS{"large.bin": {Data: testData(7, twlRegionAlignment)}}
+	rom.Filesystem = nitrofs.WithOverlays(files, rom.Arm9Overlays, rom.Arm7Overlays)
+	saved, _ := saveAndOpenROM(t, rom)
+	diagnostics := Validate(saved)
+	offsets := make([]uint32, len(diagnostics))
+	for i, d := range diagnostics {
+		if d.Kind != DiagnosticTwlDigest {
+			t.Errorf("got %v", d)
+		}
+		offsets[i] = d.Offset
+	}
+	if !slices.Equal(offsets, []uint32{0x1F4, 0x1FC}) {
+		t.Errorf("got %v, expected stale sector and block hashtables", diagnostics)
+	}
+
+	// Areas outside the ROM
+	data = changeHeader(t, data, func(h *Header) {
+		h.Twl.Modcrypt2Offset = 0xFFFFFF00
+		h.Twl.Modcrypt2Size = 0x200
+	})
+	_, err = OpenROM(bytes.NewReader(data), WithValidation())
+	var verr *ValidationError
+	if !errors.As(err, &verr) || len(verr.Diagnostics) != 1 || verr.Diagnostics[0].Kind != DiagnosticTwlDigest || verr.Diagnostics[0].Offset != 0x228 {
+		t.Errorf("got %v, expected modcrypt area outside ROM", err)
+	}
+}
@@ -0,0 +1,269 @@
+package patch
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+var ErrSourceSize = errors.New("source size does not match patch")
+var ErrSourceChecksum = errors.New("source checksum does not match patch")
+var ErrTargetChecksum = errors.New("target checksum does not match patch")
+var ErrPatchChecksum = errors.New("patch checksum does not match")
+
+const bpsMagic = "BPS1"
+
+// Source, target and patch CRC32 at the end of a BPS patch
+const bpsFooterSize = 12
+
+// BPS actions, stored in the lower 2 bits of a command
+const (
+	bpsSourceRead = iota
+	bpsTargetRead
+	bpsSourceCopy
+	bpsTargetCopy
+)
+
+// Matches shorter than this are written as target bytes
+const bpsMinMatch = 8
+
+// Largest number of source positions indexed when looking for moved data
+const bpsMaxIndex = 1 << 22
+
+// Reads numbers from a BPS patch.
+type bpsReader struct {
+	data []byte
+	pos  int
+	err  bool
+}
+
+// Read a variable length number.
+func (r *bpsReader) number() uint64 {
+	n, shift := uint64(0), uint64(1)
+	for {
+		if r.pos >= len(r.data) || shift > 1<<56 {
+			r.err = true
+			return 0
+		}
+		x := r.data[r.pos]
+		r.pos++
+		n += uint64(x&0x7F) * shift
+		if x&0x80 != 0 {
+			return n
+		}
+		shift <<= 7
+		n += shift
+	}
+}
+
+// Read a signed relative offset.
+func (r *bpsReader) offset() int {
+	n := r.number()
+	if n&1 != 0 {
+		return -int(n >> 1)
+	}
+	return int(n >> 1)
+}
+
+// Append a variable length number.
+func bpsNumber(out []byte, n uint64) []byte {
+	for {
+		x := byte(n & 0x7F)
+		n >>= 7
+		if n == 0 {
+			return append(out, 0x80|x)
+		}
+		out = append(out, x)
+		n--
+	}
+}
+
+// Append a signed relative offset.
+func bpsOffset(out []byte, offset int) []byte {
+	if offset < 0 {
+		return bpsNumber(out, uint64(-offset)<<1|1)
+	}
+	return bpsNumber(out, uint64(offset)<<1)
+}
+
+// Apply a BPS patch to size bytes of source.
+// The source size and checksum are checked before patching, and the target checksum after.
+// Returns the patched data.
+func ApplyBPS(source io.ReaderAt, size int64, patch []byte) ([]byte, error) {
+	fail := func(err error) ([]byte, error) {
+		return nil, fmt.Errorf("apply BPS: %w", err)
+	}
+	if !bytes.HasPrefix(patch, []byte(bpsMagic)) || len(patch) < len(bpsMagic)+bpsFooterSize {
+		return fail(fmt.Errorf("%w: missing header", ErrInvalidPatch))
+	}
+	footer := patch[len(patch)-bpsFooterSize:]
+	if crc32.ChecksumIEEE(patch[:len(patch)-4]) != binary.LittleEndian.Uint32(footer[8:]) {
+		return fail(ErrPatchChecksum)
+	}
+
+	r := &bpsReader{data: patch[:len(patch)-bpsFooterSize], pos: len(bpsMagic)}
+	sourceSize := r.number()
+	targetSize := r.number()
+	r.pos += int(min(r.number(), uint64(len(r.data))))
+	if r.err || r.pos > len(r.data) || targetSize > 1<<32 {
+		return fail(fmt.Errorf("%w: bad header", ErrInvalidPatch))
+	}
+	if sourceSize != uint64(size) {
+		return fail(fmt.Errorf("%w: expected 0x%X bytes, got 0x%X", ErrSourceSize, sourceSize, size))
+	}
+	src, err := readAll(source, size)
+	if err != nil {
+		return fail(fmt.Errorf("source: %w", err))
+	}
+	if crc32.ChecksumIEEE(src) != binary.LittleEndian.Uint32(footer) {
+		return fail(ErrSourceChecksum)
+	}
+
+	// The target size is not checked until the end, so the target grows as it is written
+	var tgt []byte
+	sourceRel, targetRel := 0, 0
+	for r.pos < len(r.data) {
+		command := r.number()
+		if command>>2 >= targetSize-uint64(len(tgt)) {
+			return fail(fmt.Errorf("%w: action at 0x%X too long", ErrInvalidPatch, r.pos))
+		}
+		length := int(command>>2) + 1
+		switch command & 3 {
+		case bpsSourceRead:
+			if len(tgt)+length > len(src) {
+				return fail(fmt.Errorf("%w: source read at 0x%X outside source", ErrInvalidPatch, r.pos))
+			}
+			tgt = append(tgt, src[len(tgt):len(tgt)+length]...)
+		case bpsTargetRead:
+			if r.pos+length > len(r.data) {
+				return fail(fmt.Errorf("%w: target read at 0x%X cut short", ErrInvalidPatch, r.pos))
+			}
+			tgt = append(tgt, r.data[r.pos:r.pos+length]...)
+			r.pos += length
+		case bpsSourceCopy:
+			sourceRel += r.offset()
+			if sourceRel < 0 || sourceRel+length > len(src) {
+				return fail(fmt.Errorf("%w: source copy at 0x%X outside source", ErrInvalidPatch, r.pos))
+			}
+			tgt = append(tgt, src[sourceRel:sourceRel+length]...)
+			sourceRel += length
+		case bpsTargetCopy:
+			targetRel += r.offset()
+			if targetRel < 0 || targetRel >= len(tgt) {
+				return fail(fmt.Errorf("%w: target copy at 0x%X outside target", ErrInvalidPatch, r.pos))
+			}
+
+			// Copies may overlap what they write
+			for range length {
+				tgt = append(tgt, tgt[targetRel])
+				targetRel++
+			}
+		}
+		if r.err {
+			return fail(fmt.Errorf("%w: action at 0x%X", ErrInvalidPatch, r.pos))
+		}
+	}
+	if uint64(len(tgt)) != targetSize {
+		return fail(fmt.Errorf("%w: target is 0x%X bytes, expected 0x%X", ErrInvalidPatch, len(tgt), targetSize))
+	}
+	if crc32.ChecksumIEEE(tgt) != binary.LittleEndian.Uint32(footer[4:]) {
+		return fail(ErrTargetChecksum)
+	}
+	return tgt, nil
+}
+
+// Create a BPS patch, turning source into target.
+// Data moved within the file is found as well, such as NitroFS files moved by a rebuild.
+func CreateBPS(source io.ReaderAt, sourceSize int64, target io.ReaderAt, targetSize int64) ([]byte, error) {
+	src, err := readAll(source, sourceSize)
+	if err != nil {
+		return nil, fmt.Errorf("create BPS: source: %w", err)
+	}
+	tgt, err := readAll(target, targetSize)
+	if err != nil {
+		return nil, fmt.Errorf("create BPS: target: %w", err)
+	}
+
+	out := []byte(bpsMagic)
+	out = bpsNumber(out, uint64(len(src)))
+	out = bpsNumber(out, uint64(len(tgt)))
+	out = bpsNumber(out, 0)
+
+	// Index source positions by the bytes found there
+	stride := max(bpsMinMatch, len(src)/bpsMaxIndex)
+	index := make(map[uint64]int, len(src)/stride+1)
+	for pos := 0; pos+8 <= len(src); pos += stride {
+		key := binary.LittleEndian.Uint64(src[pos:])
+		if _, ok := index[key]; !ok {
+			index[key] = pos
+		}
+	}
+
+	// Target bytes not yet written start at literal
+	literal := 0
+	command := func(pos int, action int, length int) {
+		if pos > literal {
+			out = bpsNumber(out, uint64(pos-literal-1)<<2|bpsTargetRead)
+			out = append(out, tgt[literal:pos]...)
+		}
+		out = bpsNumber(out, uint64(length-1)<<2|uint64(action))
+		literal = pos + length
+	}
+
+	sourceRel, targetRel := 0, 0
+	for pos := 0; pos < len(tgt); {
+		// Unchanged bytes
+		if n := matchLength(src, pos, tgt, pos); n >= bpsMinMatch {
+			command(pos, bpsSourceRead, n)
+			pos += n
+			continue
+		}
+
+		// Repeats of the previous byte
+		if pos > 0 {
+			if n := matchLength(tgt, pos-1, tgt, pos); n >= bpsMinMatch {
+				command(pos, bpsTargetCopy, n)
+				out = bpsOffset(out, pos-1-targetRel)
+				targetRel = pos - 1 + n
+				pos += n
+				continue
+			}
+		}
+
+		// Moved bytes, which may have started before pos
+		if pos+8 <= len(tgt) {
+			if from, ok := index[binary.LittleEndian.Uint64(tgt[pos:])]; ok {
+				n := matchLength(src, from, tgt, pos)
+				for pos > literal && from > 0 && src[from-1] == tgt[pos-1] {
+					from, pos, n = from-1, pos-1, n+1
+				}
+				command(pos, bpsSourceCopy, n)
+				out = bpsOffset(out, from-sourceRel)
+				sourceRel = from + n
+				pos += n
+				continue
+			}
+		}
+		pos++
+	}
+	if len(tgt) > literal {
+		out = bpsNumber(out, uint64(len(tgt)-literal-1)<<2|bpsTargetRead)
+		out = append(out, tgt[literal:]...)
+	}
+
+	out = binary.LittleEndian.AppendUint32(out, crc32.ChecksumIEEE(src))
+	out = binary.LittleEndian.AppendUint32(out, crc32.ChecksumIEEE(tgt))
+	return binary.LittleEndian.AppendUint32(out, crc32.ChecksumIEEE(out)), nil
+}
+
+// Count the bytes that are the same in a from i and b from j.
+func matchLength(a []byte, i int, b []byte, j int) int {
+	n := 0
+	for i+n < len(a) && j+n < len(b) && a[i+n] == b[j+n] {
+		n++
+	}
+	return n
+}
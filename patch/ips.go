@@ -0,0 +1,187 @@
+package patch
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var ErrIPSLimit = errors.New("IPS offsets are limited to 24 bits")
+
+const (
+	ipsMagic = "PATCH"
+	ipsEnd   = "EOF"
+)
+
+// Limits of the IPS format
+const (
+	ipsMaxOffset = 0xFFFFFF
+	ipsMaxRecord = 0xFFFF
+)
+
+// Offset that reads as the end marker, so no record can start there
+const ipsEndOffset = 0x454F46
+
+// Size of a record header, unchanged gaps shorter than this are included in records
+const ipsRecordHeader = 5
+
+// Runs of the same byte at least this long are written as RLE records
+const ipsMinRun = 16
+
+// Apply an IPS patch to size bytes of source.
+// Returns the patched data.
+func ApplyIPS(source io.ReaderAt, size int64, patch []byte) ([]byte, error) {
+	if !bytes.HasPrefix(patch, []byte(ipsMagic)) {
+		return nil, fmt.Errorf("apply IPS: %w: missing header", ErrInvalidPatch)
+	}
+	data, err := readAll(source, size)
+	if err != nil {
+		return nil, fmt.Errorf("apply IPS: source: %w", err)
+	}
+	get := func(pos int, n int) (uint32, bool) {
+		if pos+n > len(patch) {
+			return 0, false
+		}
+		v := uint32(0)
+		for _, b := range patch[pos : pos+n] {
+			v = v<<8 | uint32(b)
+		}
+		return v, true
+	}
+
+	pos := len(ipsMagic)
+	for {
+		if bytes.HasPrefix(patch[pos:], []byte(ipsEnd)) {
+			pos += len(ipsEnd)
+
+			// Optional truncation
+			if length, ok := get(pos, 3); ok && int(length) < len(data) {
+				data = data[:length]
+			}
+			return data, nil
+		}
+
+		offset, ok1 := get(pos, 3)
+		length, ok2 := get(pos+3, 2)
+		if !ok1 || !ok2 {
+			return nil, fmt.Errorf("apply IPS: %w: record at 0x%X cut short", ErrInvalidPatch, pos)
+		}
+		pos += ipsRecordHeader
+
+		var chunk []byte
+		if length != 0 {
+			if pos+int(length) > len(patch) {
+				return nil, fmt.Errorf("apply IPS: %w: record at 0x%X cut short", ErrInvalidPatch, pos)
+			}
+			chunk = patch[pos : pos+int(length)]
+			pos += int(length)
+		} else {
+			run, ok := get(pos, 2)
+			value, ok2 := get(pos+2, 1)
+			if !ok || !ok2 {
+				return nil, fmt.Errorf("apply IPS: %w: record at 0x%X cut short", ErrInvalidPatch, pos)
+			}
+			chunk = bytes.Repeat([]byte{byte(value)}, int(run))
+			pos += 3
+		}
+
+		if end := int(offset) + len(chunk); end > len(data) {
+			data = append(data, make([]byte, end-len(data))...)
+		}
+		copy(data[offset:], chunk)
+	}
+}
+
+// Create an IPS patch, turning source into target.
+// Returns ErrIPSLimit if a change or the target size does not fit in 24 bits.
+func CreateIPS(source io.ReaderAt, sourceSize int64, target io.ReaderAt, targetSize int64) ([]byte, error) {
+	src, err := readAll(source, sourceSize)
+	if err != nil {
+		return nil, fmt.Errorf("create IPS: source: %w", err)
+	}
+	tgt, err := readAll(target, targetSize)
+	if err != nil {
+		return nil, fmt.Errorf("create IPS: target: %w", err)
+	}
+	differs := func(i int) bool {
+		return i >= len(src) || src[i] != tgt[i]
+	}
+
+	out := []byte(ipsMagic)
+	for i := 0; i < len(tgt); {
+		if !differs(i) {
+			i++
+			continue
+		}
+
+		// Changed bytes, with short unchanged gaps
+		last := i
+		for j := i + 1; j < len(tgt) && j-last <= ipsRecordHeader; j++ {
+			if differs(j) {
+				last = j
+			}
+		}
+		if out, err = ipsRecords(out, tgt, i, last+1); err != nil {
+			return nil, fmt.Errorf("create IPS: %w", err)
+		}
+		i = last + 1
+	}
+
+	out = append(out, ipsEnd...)
+	if len(tgt) < len(src) {
+		if len(tgt) > ipsMaxOffset {
+			return nil, fmt.Errorf("create IPS: truncate to 0x%X: %w", len(tgt), ErrIPSLimit)
+		}
+		out = append(out, byte(len(tgt)>>16), byte(len(tgt)>>8), byte(len(tgt)))
+	}
+	return out, nil
+}
+
+// Append records writing tgt[start:end] to an IPS patch.
+func ipsRecords(out []byte, tgt []byte, start int, end int) ([]byte, error) {
+	longRun := func(pos int) bool {
+		if pos+ipsMinRun > end {
+			return false
+		}
+		for k := 1; k < ipsMinRun; k++ {
+			if tgt[pos+k] != tgt[pos] {
+				return false
+			}
+		}
+		return true
+	}
+
+	for pos := start; pos < end; {
+		// Start one byte early instead, the record must then be longer than that byte
+		minLength := 1
+		if pos == ipsEndOffset {
+			pos--
+			minLength = 2
+		}
+		if pos > ipsMaxOffset {
+			return nil, fmt.Errorf("record at 0x%X: %w", pos, ErrIPSLimit)
+		}
+		out = append(out, byte(pos>>16), byte(pos>>8), byte(pos))
+
+		run := 1
+		for pos+run < end && run < ipsMaxRecord && tgt[pos+run] == tgt[pos] {
+			run++
+		}
+		if run >= ipsMinRun {
+			out = append(out, 0, 0, byte(run>>8), byte(run), tgt[pos])
+			pos += run
+			continue
+		}
+
+		// Literal bytes, up to the next long run
+		length := 0
+		for pos+length < end && length < ipsMaxRecord && (length < minLength || !longRun(pos+length)) {
+			length++
+		}
+		out = append(out, byte(length>>8), byte(length))
+		out = append(out, tgt[pos:pos+length]...)
+		pos += length
+	}
+	return out, nil
+}
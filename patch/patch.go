@@ -0,0 +1,80 @@
+// Create and apply IPS and BPS patches.
+// Source and target files are read through io.ReaderAt, patches are kept in memory.
+package patch
+
+import (
+	"bytes"
+	"errors"
+	"io"
+
+	"github.com/sukus21/nintil/util"
+)
+
+var ErrUnknownFormat = errors.New("unknown patch format")
+var ErrInvalidPatch = errors.New("invalid patch")
+
+// Patch format.
+type Format int
+
+const (
+	FormatIPS Format = iota
+	FormatBPS
+)
+
+func (f Format) String() string {
+	switch f {
+	case FormatIPS:
+		return "IPS"
+	case FormatBPS:
+		return "BPS"
+	default:
+		return "unknown"
+	}
+}
+
+// Detect the format of a patch from its magic number.
+// Returns ErrUnknownFormat if it is neither IPS nor BPS.
+func Detect(patch []byte) (Format, error) {
+	switch {
+	case bytes.HasPrefix(patch, []byte(ipsMagic)):
+		return FormatIPS, nil
+	case bytes.HasPrefix(patch, []byte(bpsMagic)):
+		return FormatBPS, nil
+	default:
+		return 0, ErrUnknownFormat
+	}
+}
+
+// Apply an IPS or BPS patch to size bytes of source.
+// Returns the patched data.
+func Apply(source io.ReaderAt, size int64, patch []byte) ([]byte, error) {
+	format, err := Detect(patch)
+	if err != nil {
+		return nil, err
+	}
+	if format == FormatBPS {
+		return ApplyBPS(source, size, patch)
+	}
+	return ApplyIPS(source, size, patch)
+}
+
+// Create a patch in the given format, turning source into target.
+func Create(format Format, source io.ReaderAt, sourceSize int64, target io.ReaderAt, targetSize int64) ([]byte, error) {
+	switch format {
+	case FormatIPS:
+		return CreateIPS(source, sourceSize, target, targetSize)
+	case FormatBPS:
+		return CreateBPS(source, sourceSize, target, targetSize)
+	default:
+		return nil, ErrUnknownFormat
+	}
+}
+
+// Read size bytes from the start of r.
+func readAll(r io.ReaderAt, size int64) ([]byte, error) {
+	buf := make([]byte, size)
+	if n, err := r.ReadAt(buf, 0); n != len(buf) {
+		return nil, util.TranslateEOF(err)
+	}
+	return buf, nil
+}
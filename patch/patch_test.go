@@ -0,0 +1,259 @@
+package patch
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"math/rand"
+	"slices"
+	"testing"
+)
+
+// Generate random bytes.
+func testData(seed int64, size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+// Create a patch from source to target, apply it, and check that the result is target.
+func roundTrip(t *testing.T, format Format, source []byte, target []byte) []byte {
+	t.Helper()
+	patch, err := Create(format, bytes.NewReader(source), int64(len(source)), bytes.NewReader(target), int64(len(target)))
+	if err != nil {
+		t.Fatalf("create %s: %v", format, err)
+	}
+	if detected, err := Detect(patch); err != nil || detected != format {
+		t.Fatalf("detected %s, %v, expected %s", detected, err, format)
+	}
+	got, err := Apply(bytes.NewReader(source), int64(len(source)), patch)
+	if err != nil {
+		t.Fatalf("apply %s: %v", format, err)
+	}
+	if !bytes.Equal(got, target) {
+		t.Fatalf("%s: patched data differs from target", format)
+	}
+	return patch
+}
+
+// Targets made from a source, for round trips.
+func testTargets(source []byte) map[string][]byte {
+	changed := slices.Clone(source)
+	copy(changed[0x100:], "changed")
+	changed[0x1000] ^= 0xFF
+	copy(changed[0x2000:], bytes.Repeat([]byte{0x55}, 0x40))
+
+	// Blocks swapped around, like files moved by a rebuild
+	moved := slices.Concat(source[0x2000:0x3000], source[0x1000:0x2000], source[:0x1000], source[0x3000:])
+
+	return map[string][]byte{
+		"same":      slices.Clone(source),
+		"changed":   changed,
+		"moved":     moved,
+		"grown":     slices.Concat(source, bytes.Repeat([]byte{0xFF}, 0x1234), []byte("tail")),
+		"truncated": slices.Clone(source[:0x1800]),
+		"empty":     {},
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	source := testData(1, 0x4000)
+	for _, format := range []Format{FormatIPS, FormatBPS} {
+		for name, target := range testTargets(source) {
+			t.Run(format.String()+"/"+name, func(t *testing.T) {
+				roundTrip(t, format, source, target)
+			})
+		}
+	}
+}
+
+func TestIPSEndOffset(t *testing.T) {
+	// A record starting at 0x454F46 would read as the end marker
+	source := make([]byte, ipsEndOffset+0x10)
+	for _, at := range []int{ipsEndOffset, ipsEndOffset + 1} {
+		target := slices.Clone(source)
+		target[at] = 1
+		patch := roundTrip(t, FormatIPS, source, target)
+		if bytes.Contains(patch, []byte{0x45, 0x4F, 0x46, 0x00}) {
+			t.Errorf("change at 0x%X: patch has a record at 0x%X", at, ipsEndOffset)
+		}
+	}
+
+	// Runs are moved back as well
+	target := slices.Clone(source)
+	copy(target[ipsEndOffset:], bytes.Repeat([]byte{2}, 0x10))
+	roundTrip(t, FormatIPS, source, target)
+}
+
+func TestIPSTruncation(t *testing.T) {
+	source := testData(2, 0x1000)
+	patch := roundTrip(t, FormatIPS, source, source[:0x800])
+	if !bytes.HasSuffix(patch, []byte("EOF\x00\x08\x00")) {
+		t.Errorf("patch does not end with a truncation: % X", patch[len(patch)-6:])
+	}
+
+	// Truncation is ignored if it would grow the data
+	patch = []byte("PATCHEOF\x00\x20\x00")
+	got, err := ApplyIPS(bytes.NewReader(source), int64(len(source)), patch)
+	if err != nil || !bytes.Equal(got, source) {
+		t.Errorf("got %d bytes, %v, expected source", len(got), err)
+	}
+}
+
+func TestIPSLimit(t *testing.T) {
+	source := make([]byte, ipsMaxOffset+0x10)
+
+	// Changes past 24 bits
+	target := slices.Clone(source)
+	target[ipsMaxOffset+1] = 1
+	if _, err := CreateIPS(bytes.NewReader(source), int64(len(source)), bytes.NewReader(target), int64(len(target))); !errors.Is(err, ErrIPSLimit) {
+		t.Errorf("got %v, expected %v", err, ErrIPSLimit)
+	}
+
+	// Truncating to a size past 24 bits
+	target = source[:ipsMaxOffset+1]
+	if _, err := CreateIPS(bytes.NewReader(source), int64(len(source)), bytes.NewReader(target), int64(len(target))); !errors.Is(err, ErrIPSLimit) {
+		t.Errorf("got %v, expected %v", err, ErrIPSLimit)
+	}
+
+	// A change at the last offset still fits
+	target = slices.Clone(source)
+	target[ipsMaxOffset] = 1
+	roundTrip(t, FormatIPS, source, target)
+}
+
+func TestIPSMalformed(t *testing.T) {
+	source := testData(3, 0x100)
+	target := slices.Clone(source)
+	copy(target[0x10:], "record")
+	copy(target[0x80:], bytes.Repeat([]byte{0}, 0x20))
+	patch := roundTrip(t, FormatIPS, source, target)
+
+	// Every patch cut off before the end marker is invalid
+	for n := 0; n < len(patch)-len(ipsEnd); n++ {
+		if _, err := ApplyIPS(bytes.NewReader(source), int64(len(source)), patch[:n]); !errors.Is(err, ErrInvalidPatch) {
+			t.Errorf("patch cut to %d bytes: got %v, expected %v", n, err, ErrInvalidPatch)
+		}
+	}
+
+	// Records past the end grow the data
+	got, err := ApplyIPS(bytes.NewReader(source), int64(len(source)), []byte("PATCH\x00\x01\x10\x00\x02abEOF"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, slices.Concat(source, make([]byte, 0x10), []byte("ab"))) {
+		t.Errorf("record past the end was not applied")
+	}
+}
+
+// Build a BPS patch from its actions, with a valid patch checksum.
+func bpsPatch(source []byte, targetSize uint64, actions []byte, targetCRC uint32) []byte {
+	out := []byte(bpsMagic)
+	out = bpsNumber(out, uint64(len(source)))
+	out = bpsNumber(out, targetSize)
+	out = bpsNumber(out, 0)
+	out = append(out, actions...)
+	out = binary.LittleEndian.AppendUint32(out, crc32.ChecksumIEEE(source))
+	out = binary.LittleEndian.AppendUint32(out, targetCRC)
+	return binary.LittleEndian.AppendUint32(out, crc32.ChecksumIEEE(out))
+}
+
+func TestBPSNumber(t *testing.T) {
+	for _, n := range []uint64{0, 1, 0x7F, 0x80, 0x407F, 0x4080, 1 << 32, 1<<63 - 1} {
+		r := &bpsReader{data: bpsNumber(nil, n)}
+		if got := r.number(); got != n || r.err || r.pos != len(r.data) {
+			t.Errorf("got %d, expected %d", got, n)
+		}
+	}
+	for _, offset := range []int{0, 1, -1, 0x1000, -0x1000} {
+		r := &bpsReader{data: bpsOffset(nil, offset)}
+		if got := r.offset(); got != offset {
+			t.Errorf("got %d, expected %d", got, offset)
+		}
+	}
+
+	// Numbers cut short, or too long to fit
+	for _, data := range [][]byte{{}, {0x00}, bytes.Repeat([]byte{0x7F}, 10)} {
+		r := &bpsReader{data: data}
+		if r.number(); !r.err {
+			t.Errorf("% X: expected an error", data)
+		}
+	}
+}
+
+func TestBPSChecksums(t *testing.T) {
+	source := testData(4, 0x4000)
+	target := testTargets(source)["changed"]
+	patch := roundTrip(t, FormatBPS, source, target)
+
+	// Patch data changed
+	broken := slices.Clone(patch)
+	broken[len(bpsMagic)+8] ^= 1
+	if _, err := ApplyBPS(bytes.NewReader(source), int64(len(source)), broken); !errors.Is(err, ErrPatchChecksum) {
+		t.Errorf("got %v, expected %v", err, ErrPatchChecksum)
+	}
+
+	// Source with the right size, but different contents
+	other := slices.Clone(source)
+	other[0] ^= 1
+	if _, err := ApplyBPS(bytes.NewReader(other), int64(len(other)), patch); !errors.Is(err, ErrSourceChecksum) {
+		t.Errorf("got %v, expected %v", err, ErrSourceChecksum)
+	}
+	if _, err := ApplyBPS(bytes.NewReader(source[:0x800]), 0x800, patch); !errors.Is(err, ErrSourceSize) {
+		t.Errorf("got %v, expected %v", err, ErrSourceSize)
+	}
+
+	// Target checksum in the footer does not match
+	actions := bpsNumber(nil, uint64(len(source)-1)<<2|bpsSourceRead)
+	broken = bpsPatch(source, uint64(len(source)), actions, crc32.ChecksumIEEE(source)^1)
+	if _, err := ApplyBPS(bytes.NewReader(source), int64(len(source)), broken); !errors.Is(err, ErrTargetChecksum) {
+		t.Errorf("got %v, expected %v", err, ErrTargetChecksum)
+	}
+}
+
+func TestBPSMalformed(t *testing.T) {
+	source := testData(5, 0x100)
+	action := func(action int, length int, data ...byte) []byte {
+		return append(bpsNumber(nil, uint64(length-1)<<2|uint64(action)), data...)
+	}
+	tests := []struct {
+		name       string
+		targetSize uint64
+		actions    []byte
+	}{
+		{"source read outside source", 0x200, action(bpsSourceRead, 0x101)},
+		{"target read cut short", 0x10, action(bpsTargetRead, 0x10, 1, 2, 3)},
+		{"source copy before source", 0x10, slices.Concat(action(bpsSourceCopy, 4), bpsOffset(nil, -1))},
+		{"source copy after source", 0x10, slices.Concat(action(bpsSourceCopy, 4), bpsOffset(nil, 0xFE))},
+		{"target copy of empty target", 0x10, slices.Concat(action(bpsTargetCopy, 4), bpsOffset(nil, 0))},
+		{"target copy ahead of target", 0x10, slices.Concat(action(bpsTargetRead, 1, 1), action(bpsTargetCopy, 4), bpsOffset(nil, 1))},
+		{"action past target size", 0x10, action(bpsSourceRead, 0x11)},
+		{"actions past target size", 0x10, slices.Concat(action(bpsSourceRead, 0x8), action(bpsSourceRead, 0x9))},
+		{"target smaller than its size", 0x20, action(bpsSourceRead, 0x10)},
+		{"action cut short", 0x10, []byte{0x00}},
+
+		// Must fail without allocating the claimed target size
+		{"huge target size", 1 << 32, action(bpsTargetRead, 2, 1, 2)},
+	}
+	for _, tt := range tests {
+		patch := bpsPatch(source, tt.targetSize, tt.actions, 0)
+		if _, err := ApplyBPS(bytes.NewReader(source), int64(len(source)), patch); !errors.Is(err, ErrInvalidPatch) {
+			t.Errorf("%s: got %v, expected %v", tt.name, err, ErrInvalidPatch)
+		}
+	}
+
+	// Headers
+	for _, patch := range [][]byte{
+		[]byte("BPS1"),
+		[]byte("BPS"),
+		bpsPatch(source, 1<<33, nil, 0),
+	} {
+		if _, err := ApplyBPS(bytes.NewReader(source), int64(len(source)), patch); !errors.Is(err, ErrInvalidPatch) {
+			t.Errorf("% X: got %v, expected %v", patch, err, ErrInvalidPatch)
+		}
+	}
+	if _, err := Apply(bytes.NewReader(source), int64(len(source)), []byte("UPS1")); !errors.Is(err, ErrUnknownFormat) {
+		t.Errorf("got %v, expected %v", err, ErrUnknownFormat)
+	}
+}
@@ -2,6 +2,7 @@ package mapping
 
 import (
 	"fmt"
+	"slices"
 )
 
 func NewMapping(maxLength uint32) *Mapping {
@@ -67,7 +68,7 @@ func (m *Mapping) insertAt(entry *MappingEntry, at uint32) error {
 		if v.To() <= at {
 			continue
 		}
-		if v.from >= at && v.To() < at {
+		if v.from <= at {
 			return fmt.Errorf("space already occupied at %08X by %s", at, v.name)
 		}
 		if v.from-at < entry.length {
@@ -101,6 +102,11 @@ func (m *Mapping) placeInto(entry *MappingEntry, pos uint32) {
 	m.mappings[pos] = entry
 }
 
+// Get all entries, ordered by position.
+func (m *Mapping) Entries() []*MappingEntry {
+	return slices.Clone(m.mappings)
+}
+
 func (m *Mapping) Find(pos uint32) *MappingEntry {
 	for _, v := range m.mappings {
 		if v.from <= pos && v.To() > pos {
@@ -0,0 +1,41 @@
+package mapping
+
+import "testing"
+
+func TestAddAt(t *testing.T) {
+	m := NewMapping(0x1000)
+	if _, err := m.AddAt("a", 0x100, 0x100); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.AddAt("b", 0x400, 0x100); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		at     uint32
+		length uint32
+		ok     bool
+	}{
+		{"before", 0x000, 0x100, true},
+		{"between", 0x200, 0x200, true},
+		{"after", 0x500, 0xB00, true},
+		{"at start of entry", 0x100, 0x10, false},
+		{"inside entry", 0x180, 0x10, false},
+		{"at last byte of entry", 0x1FF, 0x01, false},
+		{"overlapping next entry", 0x300, 0x101, false},
+		{"past the end", 0x500, 0xB01, false},
+	}
+	for _, tt := range tests {
+		// Copy the mapping, so entries do not affect each other
+		c := &Mapping{mappings: append([]*MappingEntry{}, m.mappings...), maxLength: m.maxLength}
+		entry, err := c.AddAt(tt.name, tt.at, tt.length)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got %v, expected ok %t", tt.name, err, tt.ok)
+			continue
+		}
+		if err == nil && (entry.From() != tt.at || c.Find(tt.at) != entry) {
+			t.Errorf("%s: entry placed at %08X", tt.name, entry.From())
+		}
+	}
+}
@@ -7,8 +7,9 @@ import (
 
 // GO has no ready-made in-memory implementation io.WriteSeeker, so here's my version.
 type WriteSeeker struct {
-	Buf []byte
-	Pos int64
+	Buf  []byte
+	Pos  int64
+	grow bool
 }
 
 func NewWriteSeeker(buf []byte) *WriteSeeker {
@@ -18,7 +19,20 @@ func NewWriteSeeker(buf []byte) *WriteSeeker {
 	}
 }
 
+// Same as NewWriteSeeker, except writing or seeking past the end grows the buffer.
+// Bytes skipped over by seeking are 0.
+func NewGrowingWriteSeeker(buf []byte) *WriteSeeker {
+	return &WriteSeeker{
+		Buf:  buf,
+		Pos:  0,
+		grow: true,
+	}
+}
+
 func (w *WriteSeeker) Write(data []byte) (int, error) {
+	if w.grow && w.Pos+int64(len(data)) > int64(len(w.Buf)) {
+		w.Buf = append(w.Buf, make([]byte, w.Pos+int64(len(data))-int64(len(w.Buf)))...)
+	}
 	n := copy(w.Buf[w.Pos:], data)
 	if n != len(data) {
 		return n, fmt.Errorf("trying to write outside buffer")
@@ -38,6 +52,9 @@ func (w *WriteSeeker) Seek(offset int64, whence int) (int64, error) {
 		npos = int64(len(w.Buf)) + offset
 	}
 
+	if w.grow && npos > int64(len(w.Buf)) {
+		w.Buf = append(w.Buf, make([]byte, npos-int64(len(w.Buf)))...)
+	}
 	if npos > int64(len(w.Buf)) || npos < 0 {
 		return w.Pos, fmt.Errorf("trying to seek outside buffer")
 	}